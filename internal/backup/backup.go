@@ -2,21 +2,44 @@ package backup
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/hra42/pg_backup/internal/compression"
 	"github.com/hra42/pg_backup/internal/config"
+	"github.com/hra42/pg_backup/internal/dumpformat"
+	"github.com/hra42/pg_backup/internal/events"
+	"github.com/hra42/pg_backup/internal/exporter"
+	"github.com/hra42/pg_backup/internal/lock"
 	"github.com/hra42/pg_backup/internal/notification"
+	"github.com/hra42/pg_backup/internal/pgoutput"
+	"github.com/hra42/pg_backup/internal/report"
+	"github.com/hra42/pg_backup/internal/retention"
+	"github.com/hra42/pg_backup/internal/retry"
 	"github.com/hra42/pg_backup/internal/rsync"
+	"github.com/hra42/pg_backup/internal/runlog"
+	"github.com/hra42/pg_backup/internal/shell"
 	"github.com/hra42/pg_backup/internal/ssh"
+	"github.com/hra42/pg_backup/internal/standby"
 	"github.com/hra42/pg_backup/internal/storage"
+	"github.com/hra42/pg_backup/internal/verify"
 )
 
+// errLockLost aborts a backup whose S3 lock was taken over or couldn't be renewed
+var errLockLost = errors.New("run lock lost")
+
 type BackupManager struct {
 	config             *config.Config
 	sshClient          *ssh.SSHClient
@@ -24,13 +47,63 @@ type BackupManager struct {
 	notificationClient *notification.NotificationClient
 	logger             *slog.Logger
 	cancelFunc         context.CancelFunc
-	backupSize         int64
+	listener           events.Listener
+	runID              string
+	recorder           *runlog.Recorder
+	label              string
+	reason             string
+	databases          []string // Subset of the configured databases backed up by the following runs
+	resume             bool
+	jobs               []*databaseJob // Jobs of the last run, for Keys
+	pod                string         // Pod the client tools run in (kubernetes mode)
+	tunnelClient       *ssh.SSHClient // SSH connection carrying the tunnel (direct mode with tunnel)
+	tunnel             *ssh.Tunnel
+}
+
+// databaseJob holds the state of one database's backup within a run
+type databaseJob struct {
+	database   string
+	settings   config.DatabaseSettings // Backup settings with the database's override applied
+	fileName   string
+	logger     *slog.Logger
+	events     events.Emitter
+	backupSize int64
+	warnings   []string
+	trendWarnings []string // Deviations found by checkTrend, also sent as a backup_warning
+	snapshot   string
+	server     *storage.ServerMetadata
+	key        string
+	checksum   string
+	dumpFormat string // Archive format version from the dump header, e.g. 1.16
+	verified   bool
+	retries    int       // Extra attempts needed by retried stages, including the shared SSH connection
+	resumed    *runState // State of the interrupted run this job continues (-resume)
+	duration   time.Duration
+	err        error
 }
 
 func NewBackupManager(cfg *config.Config, logger *slog.Logger) (*BackupManager, error) {
-	sshClient, err := ssh.NewSSHClient(&cfg.SSH, logger)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create SSH client: %w", err)
+	// Capture everything logged during a run so it can be uploaded if the run fails
+	recorder := runlog.NewRecorder()
+	logger = slog.New(recorder.Handler(logger.Handler()))
+
+	// In kubernetes and direct mode commands run on this machine and reach the database through
+	// kubectl or the network
+	sshClient := ssh.NewLocalClient(logger)
+	if cfg.Backup.Mode != "kubernetes" && cfg.Backup.Mode != "direct" {
+		var err error
+		sshClient, err = ssh.NewSSHClient(&cfg.SSH, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create SSH client: %w", err)
+		}
+	}
+	var tunnelClient *ssh.SSHClient
+	if cfg.Backup.Tunneled() {
+		var err error
+		tunnelClient, err = ssh.NewSSHClient(&cfg.SSH, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create SSH client: %w", err)
+		}
 	}
 
 	s3Client, err := storage.NewS3Client(&cfg.S3, logger)
@@ -39,6 +112,8 @@ func NewBackupManager(cfg *config.Config, logger *slog.Logger) (*BackupManager,
 	}
 
 	notificationClient := notification.NewNotificationClient(&cfg.Notification, logger)
+	notificationClient.SetEnv(cfg.Backup.Env)
+	notificationClient.SetQueue(notification.NewQueue(cfg, logger))
 
 	return &BackupManager{
 		config:             cfg,
@@ -46,92 +121,723 @@ func NewBackupManager(cfg *config.Config, logger *slog.Logger) (*BackupManager,
 		s3Client:           s3Client,
 		notificationClient: notificationClient,
 		logger:             logger,
+		listener:           events.NopListener{},
+		recorder:           recorder,
+		tunnelClient:       tunnelClient,
 	}, nil
 }
 
+// SetListener registers a listener for stage, progress and completion events
+func (bm *BackupManager) SetListener(listener events.Listener) {
+	bm.listener = listener
+}
+
 func (bm *BackupManager) SetCancelFunc(cancel context.CancelFunc) {
 	bm.cancelFunc = cancel
 }
 
-func (bm *BackupManager) Run(ctx context.Context, dryRun bool) error {
+// SetSnapshot makes pg_dump use an externally exported snapshot, overriding backup.snapshot
+func (bm *BackupManager) SetSnapshot(snapshot string) {
+	bm.config.Backup.Snapshot = snapshot
+}
+
+// SetLabel tags the backups of the following runs, e.g. "pre-deploy"; the label is stored in
+// the backup metadata and the run report
+func (bm *BackupManager) SetLabel(label string) {
+	bm.label = label
+}
+
+// SetReason records why the backups of the following runs are taken, e.g. "before migrating
+// to PostgreSQL 17"; like the label it is stored in the backup metadata and the run report
+func (bm *BackupManager) SetReason(reason string) {
+	bm.reason = reason
+}
+
+// SetDatabases restricts the following runs to a subset of the configured databases, e.g. the
+// databases sharing a schedule
+func (bm *BackupManager) SetDatabases(databases []string) {
+	bm.databases = databases
+}
+
+// SetNotification sends the notifications of the following runs according to cfg instead of
+// the notification section, e.g. to the target of the schedule running them
+func (bm *BackupManager) SetNotification(cfg *config.NotificationConfig) {
+	bm.notificationClient = notification.NewNotificationClient(cfg, bm.logger)
+	bm.notificationClient.SetEnv(bm.config.Backup.Env)
+	bm.notificationClient.SetQueue(notification.NewQueue(bm.config, bm.logger))
+}
+
+// runDatabases returns the databases the following runs back up
+func (bm *BackupManager) runDatabases() []string {
+	if len(bm.databases) > 0 {
+		return bm.databases
+	}
+	return bm.config.BackupDatabases()
+}
+
+// SetResume makes the following runs continue interrupted backups from their last completed
+// stage instead of starting over
+func (bm *BackupManager) SetResume(resume bool) {
+	bm.resume = resume
+}
+
+// RunID returns the ID of the last run
+func (bm *BackupManager) RunID() string {
+	return bm.runID
+}
+
+// Keys returns the S3 keys uploaded by the last run, by database
+func (bm *BackupManager) Keys() map[string]string {
+	keys := make(map[string]string)
+	for _, job := range bm.jobs {
+		if job.key != "" {
+			keys[job.database] = job.key
+		}
+	}
+	return keys
+}
+
+func (bm *BackupManager) Run(ctx context.Context, dryRun bool) (err error) {
 	defer bm.cleanup()
-	startTime := time.Now()
+
+	bm.recorder.Reset()
+	bm.runID = uuid.New().String()
+	bm.notificationClient.SetRun(bm.runID, bm.recorder)
+	bm.jobs = nil
+	databases := bm.runDatabases()
+	bm.logger.Info("Backup run started",
+		slog.String("run_id", bm.runID),
+		slog.String("label", bm.label),
+		slog.String("reason", bm.reason),
+		slog.String("databases", strings.Join(databases, ", ")),
+		slog.Int("parallelism", bm.config.Backup.Parallelism))
+
+	if bm.config.Backup.Snapshot != "" && len(databases) > 1 {
+		return fmt.Errorf("a snapshot can only be used when backing up a single database")
+	}
 
 	if dryRun {
 		bm.logger.Info("DRY RUN MODE - No actual backup will be performed")
 		return bm.validateConfiguration()
 	}
 
+	// Uploads older than the upload timeout can't still be running; whatever crashed runs left
+	// behind would otherwise be billed forever
+	if bm.config.Timeouts.S3Upload > 0 {
+		if aborted, err := bm.s3Client.AbortIncompleteUploads(ctx, bm.config.Timeouts.S3Upload); err != nil {
+			bm.logger.Warn("Failed to clean up incomplete uploads", slog.String("error", err.Error()))
+		} else if aborted > 0 {
+			bm.logger.Info("Cleaned up incomplete uploads of earlier runs", slog.Int("aborted", aborted))
+		}
+	}
+
+	if bm.config.Timeouts.Total > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, bm.config.Timeouts.Total)
+		defer cancel()
+	}
+
 	timestamp := time.Now().UTC().Format("20060102_150405")
-	backupFileName := fmt.Sprintf("backup_%s.dump", timestamp)
-	remoteBackupPath := filepath.Join(bm.config.Backup.TempDir, backupFileName)
-	localBackupPath := filepath.Join(os.TempDir(), backupFileName)
+	startTime := time.Now()
+
+	// Stages shared by all databases are reported without a database name
+	collector := report.NewCollector()
+	exporters, stopExporters := exporter.StartAll(bm.config.Exporters, bm.logger)
+	defer stopExporters()
+	runEvents := events.Emitter{Listener: events.Multi{bm.listener, collector, exporters}, RunID: bm.runID, Job: events.JobBackup}
+
+	jobs := make([]*databaseJob, len(databases))
+	for i, database := range databases {
+		jobEvents := runEvents
+		jobEvents.Database = database
+		jobs[i] = &databaseJob{
+			database: database,
+			settings: bm.config.DatabaseSettings(database),
+			fileName: bm.backupFileName(database, timestamp),
+			logger:   bm.logger.With(slog.String("database", database)),
+			events:   jobEvents,
+		}
+	}
+	bm.jobs = jobs
+	defer func() {
+		bm.writeReport(collector, jobs, startTime, err)
+	}()
 
-	if err := bm.connectSSH(); err != nil {
-		bm.notificationClient.SendBackupFailure(bm.config.Postgres.Database, err, notification.GetBackupStage(err))
+	var connectAttempts int
+	err = runEvents.Stage(events.StageConnect, func() error {
+		var err error
+		connectAttempts, err = retry.Do(ctx, bm.config.Backup.Retry.SSHConnection, bm.logger, "SSH connection", bm.connectSSH)
+		return err
+	})
+	for _, job := range jobs {
+		job.retries = connectAttempts - 1
+	}
+	if err != nil {
+		for _, job := range jobs {
+			job.err = err
+			bm.notifyFailure(job.database, err)
+		}
 		return err
 	}
 
-	if err := bm.createRemoteBackup(remoteBackupPath); err != nil {
-		bm.notificationClient.SendBackupFailure(bm.config.Postgres.Database, err, notification.GetBackupStage(err))
+	bm.runJobs(ctx, jobs)
+
+	// Retention runs once after all databases so a slow dump never races the cleanup
+	if bm.succeeded(jobs) > 0 {
+		bm.logger.Info("Stage 5: Applying retention policy")
+		err := runEvents.Stage(events.StageRetention, func() error {
+			return retention.Cleanup(ctx, bm.config, bm.s3Client, bm.notificationClient, bm.logger)
+		})
+		if err != nil {
+			bm.logger.Warn("Cleanup encountered errors", slog.String("error", fmt.Sprintf("retention cleanup failed: %v", err)))
+		}
+	}
+
+	return bm.report(jobs)
+}
+
+// runJobs backs up the databases through a worker pool bounded by backup.parallelism. The SSH
+// connection is shared; each job opens its own sessions on it.
+func (bm *BackupManager) runJobs(ctx context.Context, jobs []*databaseJob) {
+	sem := make(chan struct{}, bm.config.Backup.Parallelism)
+	var wg sync.WaitGroup
+
+	for _, job := range jobs {
+		wg.Add(1)
+		go func(job *databaseJob) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			if err := ctx.Err(); err != nil {
+				job.err = fmt.Errorf("backup cancelled before start: %w", err)
+				return
+			}
+
+			startTime := time.Now()
+			job.err = job.events.Stage(events.StageRun, func() error {
+				return bm.backupDatabase(ctx, job)
+			})
+			job.duration = time.Since(startTime)
+
+			if job.err != nil {
+				bm.notifyFailure(job.database, job.err)
+				return
+			}
+			bm.checkTrend(job)
+
+			job.logger.Info("Backup completed successfully",
+				slog.String("file", job.fileName),
+				slog.Int("warnings", len(job.warnings)),
+				slog.Int("retries", job.retries))
+
+			// Send success notification
+			if bm.notificationClient != nil {
+				if err := bm.notificationClient.SendBackupSuccess(job.database, job.duration, job.backupSize, job.warnings, job.retries); err != nil {
+					job.logger.Warn("Failed to send success notification", slog.String("error", err.Error()))
+				}
+				if len(job.trendWarnings) > 0 {
+					if err := bm.notificationClient.SendBackupWarning(job.database, job.duration, job.backupSize, job.trendWarnings); err != nil {
+						job.logger.Warn("Failed to send warning notification", slog.String("error", err.Error()))
+					}
+				}
+			}
+		}(job)
+	}
+
+	wg.Wait()
+}
+
+// backupDatabase runs the dump, transfer and upload stages for a single database
+func (bm *BackupManager) backupDatabase(ctx context.Context, job *databaseJob) (err error) {
+	ctx, abort := context.WithCancelCause(ctx)
+	defer abort(nil)
+	defer func() {
+		// Report why the stages were canceled rather than just the canceled command
+		if cause := context.Cause(ctx); err != nil && errors.Is(cause, errLockLost) {
+			err = fmt.Errorf("%w (%w)", cause, err)
+		}
+	}()
+
+	var release func()
+	err = job.events.Stage(events.StagePreflight, func() error {
+		var err error
+		if release, err = bm.acquireLock(ctx, job, abort); err != nil {
+			return err
+		}
+		bm.prepareResume(job)
+		if err := bm.verifyIdentity(ctx, job); err != nil {
+			return err
+		}
+		if job.resumed.reached(stateDumped) {
+			return nil
+		}
+		if err := bm.checkDiskSpace(ctx, job); err != nil {
+			return err
+		}
+		return bm.waitForLoad(ctx, job)
+	})
+	if release != nil {
+		defer release()
+	}
+	if err != nil {
 		return err
 	}
 
-	if err := bm.transferBackup(remoteBackupPath, localBackupPath); err != nil {
-		bm.notificationClient.SendBackupFailure(bm.config.Postgres.Database, err, notification.GetBackupStage(err))
+	// Resumed jobs reuse the file name of the interrupted run
+	remoteBackupPath := filepath.Join(bm.config.Backup.TempDir, job.fileName)
+	localBackupPath := filepath.Join(os.TempDir(), job.fileName)
+	if job.resumed != nil {
+		remoteBackupPath = job.resumed.RemotePath
+		localBackupPath = job.resumed.LocalPath
+	}
+
+	// Track the dump's files before they exist, so a run killed mid-dump leaves nothing behind
+	if !job.resumed.reached(stateDumped) {
+		bm.saveState(job, stateStarted, remoteBackupPath, localBackupPath, "")
+	}
+
+	err = bm.stage(ctx, job, events.StageDump, "dump", bm.config.Timeouts.Dump, func(ctx context.Context) error {
+		if job.resumed.reached(stateTransferred) || (job.resumed.reached(stateDumped) && bm.remoteFileExists(remoteBackupPath)) {
+			job.logger.Info("Stage 2: Reusing dump of the interrupted run", slog.String("path", remoteBackupPath))
+			return nil
+		}
+		bm.collectServerInfo(ctx, job)
+		releaseSnapshot, err := bm.prepareSnapshot(job)
+		if err != nil {
+			return err
+		}
+		defer releaseSnapshot()
+		return bm.retry(ctx, job, "Dump", bm.config.Backup.Retry.Dump, func() error {
+			if err := bm.createRemoteBackup(ctx, job, remoteBackupPath); err != nil {
+				return err
+			}
+			if bm.config.Backup.IntegrityCheck == "remote" {
+				return bm.checkIntegrity(ctx, job, remoteBackupPath, true)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		// The partial dump was removed, so a canceled run leaves nothing to resume
+		if ctx.Err() != nil && !job.resumed.reached(stateDumped) {
+			bm.removeState(job)
+		}
 		return err
 	}
+	if !job.resumed.reached(stateDumped) {
+		bm.saveState(job, stateDumped, remoteBackupPath, localBackupPath, "")
+	}
+
+	err = bm.stage(ctx, job, events.StageTransfer, "transfer", bm.config.Timeouts.Transfer, func(ctx context.Context) error {
+		if job.resumed.reached(stateTransferred) {
+			if _, err := os.Stat(localBackupPath); err == nil {
+				job.logger.Info("Stage 3: Reusing transferred file of the interrupted run", slog.String("path", localBackupPath))
+				return nil
+			}
+			if !job.resumed.reached(stateUploaded) {
+				return fmt.Errorf("transferred file %s of the interrupted run is gone, run without -resume to start over (exit code 4)", localBackupPath)
+			}
+			return nil
+		}
+		err := bm.retry(ctx, job, "Transfer", bm.config.Backup.Retry.Transfer, func() error {
+			return bm.transferBackup(ctx, job, remoteBackupPath, localBackupPath)
+		})
+		if err != nil {
+			return err
+		}
+		if bm.config.Backup.IntegrityCheck == "local" {
+			if err := bm.checkIntegrity(ctx, job, localBackupPath, false); err != nil {
+				os.Remove(localBackupPath)
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !job.resumed.reached(stateTransferred) {
+		bm.saveState(job, stateTransferred, remoteBackupPath, localBackupPath, "")
+	}
 
 	// Get backup size for notification
 	if stat, err := os.Stat(localBackupPath); err == nil {
-		bm.backupSize = stat.Size()
+		job.backupSize = stat.Size()
+	}
+	if checksum, err := fileSHA256(localBackupPath); err == nil {
+		job.checksum = checksum
+	} else {
+		job.logger.Warn("Failed to checksum backup file", slog.String("error", err.Error()))
+	}
+	if format, err := dumpformat.ReadFile(localBackupPath); err == nil {
+		job.dumpFormat = format.String()
+		job.logger.Info("Dump format detected", slog.String("dump_format", job.dumpFormat))
+	} else {
+		job.logger.Warn("Failed to read dump format", slog.String("error", err.Error()))
 	}
 
-	if err := bm.uploadToS3(ctx, localBackupPath); err != nil {
-		bm.notificationClient.SendBackupFailure(bm.config.Postgres.Database, err, notification.GetBackupStage(err))
+	var backupKey string
+	err = bm.stage(ctx, job, events.StageUpload, "s3_upload", bm.config.Timeouts.S3Upload, func(ctx context.Context) error {
+		if job.resumed.reached(stateUploaded) && job.resumed.Key != "" {
+			job.logger.Info("Stage 4: Backup was already uploaded by the interrupted run", slog.String("key", job.resumed.Key))
+			backupKey = job.resumed.Key
+			return nil
+		}
+		return bm.retry(ctx, job, "Upload", bm.config.Backup.Retry.Upload, func() error {
+			var err error
+			backupKey, err = bm.uploadToS3(ctx, job, localBackupPath)
+			return err
+		})
+	})
+	if err != nil {
+		// The transferred file is kept for -resume; a run without it removes the file
 		return err
 	}
+	if !job.resumed.reached(stateUploaded) {
+		bm.saveState(job, stateUploaded, remoteBackupPath, localBackupPath, backupKey)
+	}
 
-	if err := bm.performCleanup(ctx, localBackupPath); err != nil {
-		bm.logger.Warn("Cleanup encountered errors", slog.String("error", err.Error()))
+	metadata := &storage.BackupMetadata{
+		Database:    job.database,
+		RunID:       bm.runID,
+		Label:       bm.label,
+		Labels:      bm.config.Backup.Labels,
+		Reason:      bm.reason,
+		CreatedAt:   time.Now().UTC(),
+		Size:        job.backupSize,
+		SHA256:      job.checksum,
+		Compression: job.settings.Compression,
+		DumpFormat:  job.dumpFormat,
+		Server:      job.server,
 	}
+	job.key = backupKey
 
-	bm.logger.Info("Backup completed successfully", slog.String("file", backupFileName))
-	
-	// Send success notification
-	if bm.notificationClient != nil {
-		duration := time.Since(startTime)
-		if err := bm.notificationClient.SendBackupSuccess(bm.config.Postgres.Database, duration, bm.backupSize); err != nil {
-			bm.logger.Warn("Failed to send success notification", slog.String("error", err.Error()))
+	var verifyErr error
+	if bm.config.Backup.Verify != nil && bm.config.Backup.Verify.Enabled {
+		if _, err := os.Stat(localBackupPath); err != nil {
+			// Only possible when resuming after the upload
+			job.logger.Warn("Skipping verification, the local file of the interrupted run is gone")
+		} else {
+			verifyErr = bm.stage(ctx, job, events.StageVerify, "verify", bm.config.Timeouts.Verify, func(ctx context.Context) error {
+				return bm.verifyBackup(ctx, job, localBackupPath, metadata)
+			})
 		}
 	}
-	
+
+	// The backup is only marked verified after the scratch restore succeeded
+	job.verified = metadata.Verified
+
+	// A dump that failed verification is never seeded. The backup itself is already safe, so a
+	// failed refresh is reported as a warning.
+	if bm.config.Backup.Standby != nil && bm.config.Backup.Standby.Enabled && verifyErr == nil {
+		if _, err := os.Stat(localBackupPath); err != nil {
+			job.logger.Warn("Skipping standby refresh, the local file of the interrupted run is gone")
+		} else {
+			err := job.events.Stage(events.StageStandby, func() error {
+				return standby.NewSeeder(bm.config, job.logger).Seed(ctx, localBackupPath, job.database)
+			})
+			if err != nil {
+				job.logger.Warn("Failed to refresh standby database", slog.String("error", err.Error()))
+				job.warnings = append(job.warnings, "standby refresh failed: "+err.Error())
+			}
+		}
+	}
+	if bm.config.Backup.Globals {
+		metadata.Globals = bm.storeGlobals(ctx, job, backupKey)
+	}
+	if err := bm.s3Client.PutMetadata(ctx, backupKey, metadata); err != nil {
+		job.logger.Warn("Failed to store backup metadata", slog.String("error", err.Error()))
+	}
+	pointer := &storage.LatestPointer{
+		Database:  job.database,
+		Key:       backupKey,
+		SHA256:    job.checksum,
+		Size:      job.backupSize,
+		CreatedAt: metadata.CreatedAt,
+	}
+	if err := bm.s3Client.PutLatestPointer(ctx, pointer); err != nil {
+		job.logger.Warn("Failed to update latest pointer", slog.String("error", err.Error()))
+	}
+	bm.removeState(job)
+
+	if err := os.Remove(localBackupPath); err != nil {
+		job.logger.Warn("Failed to remove local backup file", slog.String("error", err.Error()))
+	} else {
+		job.logger.Info("Local backup file removed", slog.String("path", localBackupPath))
+	}
+
+	if verifyErr != nil {
+		return fmt.Errorf("backup verification failed (exit code 8): %w", verifyErr)
+	}
 	return nil
 }
 
+// verifyBackup restores the dump into a scratch database and records the outcome in metadata
+func (bm *BackupManager) verifyBackup(ctx context.Context, job *databaseJob, localBackupPath string, metadata *storage.BackupMetadata) error {
+	verifier := verify.NewVerifier(bm.config, job.logger)
+	verification := &storage.VerificationMetadata{
+		VerifiedAt: time.Now().UTC(),
+		Host:       verifier.Host(),
+	}
+	metadata.Verification = verification
+
+	result, err := verifier.Verify(ctx, localBackupPath, job.database)
+	if err != nil {
+		verification.Error = err.Error()
+		return err
+	}
+
+	verification.Tables = result.Tables
+	verification.Rows = result.Rows
+	verification.Checks = result.Checks
+	verification.Duration = result.Duration.String()
+	metadata.Verified = true
+	return nil
+}
+
+// stage runs fn as one of job's stages, limited by the stage's own timeout. An expired timeout,
+// or the run's total budget, is named in the returned error, so a stage that ran out of time
+// is told apart from one that failed.
+func (bm *BackupManager) stage(ctx context.Context, job *databaseJob, stage events.Stage, setting string, limit time.Duration, fn func(ctx context.Context) error) error {
+	return job.events.Stage(stage, func() error {
+		stageCtx, cancel := ctx, context.CancelFunc(func() {})
+		if limit > 0 {
+			stageCtx, cancel = context.WithTimeout(ctx, limit)
+		}
+		defer cancel()
+
+		err := fn(stageCtx)
+		switch {
+		case err == nil:
+			return nil
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			return &events.TimeoutError{Stage: stage, Setting: "total", Limit: bm.config.Timeouts.Total, Err: err}
+		case errors.Is(stageCtx.Err(), context.DeadlineExceeded):
+			return &events.TimeoutError{Stage: stage, Setting: setting, Limit: limit, Err: err}
+		}
+		return err
+	})
+}
+
+// retry runs fn under a stage's retry policy and counts the extra attempts on the job
+func (bm *BackupManager) retry(ctx context.Context, job *databaseJob, name string, policy config.RetryPolicy, fn func() error) error {
+	attempts, err := retry.Do(ctx, policy, job.logger, name, fn)
+	job.retries += attempts - 1
+	return err
+}
+
+// backupFileName keeps the historical backup_<ts> name for single database configs and
+// embeds the database name when postgres.databases is used, so retention can group by it
+func (bm *BackupManager) backupFileName(database, timestamp string) string {
+	ext := compression.DumpExtension + compression.Extension(bm.config.DatabaseSettings(database).Compression)
+	if len(bm.config.Postgres.Databases) == 0 {
+		return fmt.Sprintf("backup_%s%s", timestamp, ext)
+	}
+	return fmt.Sprintf("backup_%s_%s%s", storage.KeyDatabase(database), timestamp, ext)
+}
+
+func (bm *BackupManager) succeeded(jobs []*databaseJob) int {
+	count := 0
+	for _, job := range jobs {
+		if job.err == nil {
+			count++
+		}
+	}
+	return count
+}
+
+// report logs the per-database outcome of the run and returns an error if any database failed
+func (bm *BackupManager) report(jobs []*databaseJob) error {
+	var failures []string
+	for _, job := range jobs {
+		if job.err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", job.database, job.err))
+			bm.logger.Error("Database backup failed",
+				slog.String("database", job.database),
+				slog.Duration("duration", job.duration),
+				slog.String("error", job.err.Error()))
+			continue
+		}
+		bm.logger.Info("Database backup succeeded",
+			slog.String("database", job.database),
+			slog.String("file", job.fileName),
+			slog.Int64("size", job.backupSize),
+			slog.Int("warnings", len(job.warnings)),
+			slog.Duration("duration", job.duration))
+	}
+
+	bm.logger.Info("Backup run summary",
+		slog.String("run_id", bm.runID),
+		slog.Int("databases", len(jobs)),
+		slog.Int("succeeded", len(jobs)-len(failures)),
+		slog.Int("failed", len(failures)))
+
+	if len(failures) == 0 {
+		return nil
+	}
+	if len(jobs) == 1 {
+		return jobs[0].err
+	}
+	return fmt.Errorf("backup failed for %d of %d databases: %s", len(failures), len(jobs), strings.Join(failures, "; "))
+}
+
+// writeReport writes the machine-readable run report configured under backup.report
+func (bm *BackupManager) writeReport(collector *report.Collector, jobs []*databaseJob, startTime time.Time, runErr error) {
+	cfg := bm.config.Backup.Report
+	if cfg.Path == "" && !cfg.Stdout {
+		return
+	}
+
+	finishedAt := time.Now()
+	runReport := &report.Report{
+		RunID:      bm.runID,
+		Job:        events.JobBackup,
+		Label:      bm.label,
+		Reason:     bm.reason,
+		StartedAt:  startTime.UTC(),
+		FinishedAt: finishedAt.UTC(),
+		Duration:   finishedAt.Sub(startTime).Seconds(),
+		Success:    runErr == nil,
+		Stages:     collector.Stages(""),
+		Databases:  make([]report.Database, 0, len(jobs)),
+	}
+	if runErr != nil {
+		runReport.Error = runErr.Error()
+	}
+
+	for _, job := range jobs {
+		entry := report.Database{
+			Database: job.database,
+			Success:  job.err == nil,
+			Key:      job.key,
+			Size:     job.backupSize,
+			SHA256:   job.checksum,
+			Verified: job.verified,
+			Retries:  job.retries,
+			Duration: job.duration.Seconds(),
+			Warnings: job.warnings,
+			Stages:   collector.Stages(job.database),
+		}
+		if job.err != nil {
+			entry.Error = job.err.Error()
+		}
+		if entry.Warnings == nil {
+			entry.Warnings = []string{}
+		}
+		runReport.Databases = append(runReport.Databases, entry)
+	}
+
+	var stdout io.Writer
+	if cfg.Stdout {
+		stdout = os.Stdout
+	}
+	if err := report.Write(runReport, cfg.Path, stdout); err != nil {
+		bm.logger.Warn("Failed to write run report", slog.String("error", err.Error()))
+		return
+	}
+	if cfg.Path != "" {
+		bm.logger.Info("Run report written", slog.String("path", cfg.Path))
+	}
+}
+
+// fileSHA256 returns the hex encoded SHA-256 of a file
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// notifyFailure uploads the run's evidence (if enabled) and sends the failure notification
+func (bm *BackupManager) notifyFailure(database string, err error) {
+	incidentKey := ""
+	if bm.config.Incident.UploadLogs {
+		// Use a fresh context so evidence is preserved even when the run was cancelled
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+		defer cancel()
+
+		key, uploadErr := bm.s3Client.UploadIncident(ctx, bm.config.Incident.Prefix, bm.runID, bm.recorder.Files())
+		if uploadErr != nil {
+			bm.logger.Warn("Failed to upload incident logs", slog.String("error", uploadErr.Error()))
+		} else {
+			incidentKey = key
+		}
+	}
+
+	bm.notificationClient.SendBackupFailure(database, err, notification.GetBackupStage(err), incidentKey)
+}
+
+// Validate checks what the following runs need, like a run with -dry-run, without logging a run
+func (bm *BackupManager) Validate() error {
+	defer bm.cleanup()
+	return bm.validateConfiguration()
+}
+
 func (bm *BackupManager) validateConfiguration() error {
 	bm.logger.Info("Validating configuration...")
 
 	if err := bm.sshClient.Connect(bm.config.Timeouts.SSHConnection); err != nil {
 		return fmt.Errorf("SSH validation failed: %w", err)
 	}
+	switch {
+	case bm.config.Backup.Mode == "kubernetes":
+		if err := bm.resolvePod(); err != nil {
+			return err
+		}
+	case bm.config.Backup.Tunneled():
+		if err := bm.openTunnel(); err != nil {
+			return fmt.Errorf("SSH validation failed: %w", err)
+		}
+	}
 
-	output, err := bm.sshClient.ExecuteCommand("which pg_dump", 10*time.Second)
+	output, err := bm.sshClient.ExecuteCommand(bm.clientTool("which", false)+" pg_dump", 10*time.Second)
 	if err != nil || strings.TrimSpace(output) == "" {
+		switch bm.config.Backup.Mode {
+		case "docker":
+			return fmt.Errorf("pg_dump not found in container %s: %v", bm.config.Backup.Docker.Container, err)
+		case "kubernetes":
+			return fmt.Errorf("pg_dump not found in pod %s: %v", bm.pod, err)
+		case "direct":
+			return fmt.Errorf("pg_dump not found on local machine")
+		}
 		return fmt.Errorf("pg_dump not found on remote server")
 	}
 	bm.logger.Info("Found pg_dump", slog.String("path", strings.TrimSpace(output)))
 
+	checked := make(map[string]bool)
+	for _, database := range bm.runDatabases() {
+		tool := compression.Tool(bm.config.DatabaseSettings(database).Compression)
+		if tool == "" || checked[tool] {
+			continue
+		}
+		checked[tool] = true
+		output, err = bm.sshClient.ExecuteCommand(fmt.Sprintf("which %s", tool), 10*time.Second)
+		if err != nil || strings.TrimSpace(output) == "" {
+			return fmt.Errorf("%s not found on remote server (required by the compression of %s)", tool, database)
+		}
+		bm.logger.Info("Found compressor", slog.String("path", strings.TrimSpace(output)))
+	}
+
 	output, err = bm.sshClient.ExecuteCommand(fmt.Sprintf("test -w %s && echo writable", bm.config.Backup.TempDir), 10*time.Second)
 	if err != nil || !strings.Contains(output, "writable") {
 		return fmt.Errorf("temp directory %s is not writable", bm.config.Backup.TempDir)
 	}
 
-	// Check for rsync on local machine
-	if _, err := exec.LookPath("rsync"); err != nil {
-		return fmt.Errorf("rsync not found on local machine")
+	// Check for rsync on local machine; in kubernetes and direct mode the dump is already local
+	if !bm.dumpsLocally() {
+		if _, err := exec.LookPath("rsync"); err != nil {
+			return fmt.Errorf("rsync not found on local machine")
+		}
+		bm.logger.Info("Found rsync on local machine")
 	}
-	bm.logger.Info("Found rsync on local machine")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
@@ -145,6 +851,25 @@ func (bm *BackupManager) validateConfiguration() error {
 }
 
 func (bm *BackupManager) connectSSH() error {
+	switch bm.config.Backup.Mode {
+	case "kubernetes":
+		bm.logger.Info("Stage 1: Locating PostgreSQL pod")
+		if err := bm.resolvePod(); err != nil {
+			return fmt.Errorf("kubernetes pod lookup failed (exit code 2): %w", err)
+		}
+		return nil
+	case "direct":
+		if !bm.config.Backup.Tunneled() {
+			bm.logger.Info("Stage 1: Connecting to PostgreSQL directly, no SSH needed")
+			return nil
+		}
+		bm.logger.Info("Stage 1: Opening SSH tunnel")
+		if err := bm.openTunnel(); err != nil {
+			return fmt.Errorf("SSH tunnel failed (exit code 2): %w", err)
+		}
+		return nil
+	}
+
 	bm.logger.Info("Stage 1: Establishing SSH connection")
 	if err := bm.sshClient.Connect(bm.config.Timeouts.SSHConnection); err != nil {
 		return fmt.Errorf("SSH connection failed (exit code 2): %w", err)
@@ -153,44 +878,469 @@ func (bm *BackupManager) connectSSH() error {
 	return nil
 }
 
-func (bm *BackupManager) createRemoteBackup(remoteBackupPath string) error {
-	bm.logger.Info("Stage 2: Creating remote backup", slog.String("path", remoteBackupPath))
+// acquireLock takes the local lock file and, if enabled, the S3 lock object for the database so
+// manual, scheduled and cron runs never dump the same database at the same time. The S3 lock is
+// renewed until released; abort cancels the run if it is lost.
+func (bm *BackupManager) acquireLock(ctx context.Context, job *databaseJob, abort context.CancelCauseFunc) (func(), error) {
+	name := lock.Name(bm.config.Postgres.Host, bm.config.Postgres.Port, job.database)
+	owner := lock.Owner(bm.runID)
+
+	fileLock, err := lock.AcquireFile(filepath.Join(bm.config.Backup.Lock.Dir, "pg_backup_"+name+".lock"), owner)
+	if errors.Is(err, lock.ErrLocked) {
+		return nil, fmt.Errorf("backup of %s is already running (exit code 7): %w", job.database, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire run lock: %w", err)
+	}
+
+	stopRenewal := func() {}
+	if bm.config.Backup.Lock.S3 {
+		if err := bm.s3Client.AcquireLock(ctx, name, owner, bm.config.Backup.Lock.StaleAfter); err != nil {
+			fileLock.Release()
+			if errors.Is(err, lock.ErrLocked) {
+				return nil, fmt.Errorf("backup of %s is already running (exit code 7): %w", job.database, err)
+			}
+			return nil, fmt.Errorf("failed to acquire run lock: %w", err)
+		}
+
+		renewCtx, cancel := context.WithCancel(ctx)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bm.renewLock(renewCtx, job, name, owner, abort)
+		}()
+		stopRenewal = func() {
+			cancel()
+			wg.Wait()
+		}
+	}
+
+	job.logger.Debug("Run lock acquired", slog.String("lock", name))
+
+	return func() {
+		stopRenewal()
+		if bm.config.Backup.Lock.S3 {
+			// Release even if the run was cancelled, otherwise the lock blocks runs until it goes stale
+			releaseCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if err := bm.s3Client.ReleaseLock(releaseCtx, name, owner); err != nil {
+				job.logger.Warn("Failed to release S3 lock", slog.String("error", err.Error()))
+			}
+		}
+		if err := fileLock.Release(); err != nil {
+			job.logger.Warn("Failed to release lock file", slog.String("error", err.Error()))
+		}
+	}, nil
+}
+
+// renewLock rewrites the S3 lock every third of stale_after so other hosts never take over the
+// lock of a long running backup. The run is aborted once the lock was taken over or couldn't be
+// renewed for stale_after, as another run may hold it by then.
+func (bm *BackupManager) renewLock(ctx context.Context, job *databaseJob, name string, owner []byte, abort context.CancelCauseFunc) {
+	staleAfter := bm.config.Backup.Lock.StaleAfter
+	ticker := time.NewTicker(staleAfter / 3)
+	defer ticker.Stop()
+	renewed := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := bm.s3Client.RenewLock(ctx, name, owner)
+		switch {
+		case err == nil:
+			renewed = time.Now()
+		case errors.Is(err, lock.ErrLocked) || time.Since(renewed) >= staleAfter:
+			job.logger.Error("Lost the S3 lock, aborting the backup", slog.String("error", err.Error()))
+			abort(fmt.Errorf("%w: %w", errLockLost, err))
+			return
+		case ctx.Err() == nil:
+			job.logger.Warn("Failed to renew S3 lock", slog.String("error", err.Error()))
+		}
+	}
+}
+
+// verifyIdentity checks the configured identity assertions so a config that suddenly points
+// at another cluster fails instead of silently backing up the wrong data
+func (bm *BackupManager) verifyIdentity(ctx context.Context, job *databaseJob) error {
+	identity := bm.config.Postgres.Identity
+	if identity == nil {
+		return nil
+	}
+
+	job.logger.Info("Verifying database identity")
+
+	if identity.SystemIdentifier != "" {
+		actual, err := bm.queryScalar(ctx, job.database, "SELECT system_identifier FROM pg_control_system();")
+		if err != nil {
+			return fmt.Errorf("identity assertion failed (exit code 3): could not read system_identifier: %w", err)
+		}
+		if actual != identity.SystemIdentifier {
+			return fmt.Errorf("identity assertion failed (exit code 3): system_identifier is %s, expected %s", actual, identity.SystemIdentifier)
+		}
+	}
+
+	if expected, ok := identity.DatabaseOIDs[job.database]; ok {
+		actual, err := bm.queryScalar(ctx, job.database, "SELECT oid FROM pg_database WHERE datname = current_database();")
+		if err != nil {
+			return fmt.Errorf("identity assertion failed (exit code 3): could not read database OID: %w", err)
+		}
+		if actual != strconv.FormatUint(uint64(expected), 10) {
+			return fmt.Errorf("identity assertion failed (exit code 3): database OID is %s, expected %d", actual, expected)
+		}
+	}
+
+	if identity.MarkerTable != "" {
+		actual, err := bm.queryScalar(ctx, job.database, fmt.Sprintf("SELECT to_regclass(%s) IS NOT NULL;", quoteLiteral(identity.MarkerTable)))
+		if err != nil {
+			return fmt.Errorf("identity assertion failed (exit code 3): could not look up marker table: %w", err)
+		}
+		if actual != "t" {
+			return fmt.Errorf("identity assertion failed (exit code 3): marker table %s does not exist", identity.MarkerTable)
+		}
+	}
+
+	job.logger.Info("Database identity verified")
+	return nil
+}
+
+// psqlCommand builds a psql invocation against the source database on the remote server
+func (bm *BackupManager) psqlCommand(database, args string) string {
+	host, port := bm.pgAddress()
+	return fmt.Sprintf(
+		"%s%s -h %s -p %d -U %s -d \"%s\" %s",
+		bm.pgEnvPrefix(),
+		bm.pgTool("psql"),
+		host,
+		port,
+		bm.config.Postgres.Username,
+		database,
+		args,
+	)
+}
+
+// pgEnvPrefix exports the job environment and the source server's TLS options for libpq tools
+func (bm *BackupManager) pgEnvPrefix() string {
+	prefix := shell.EnvPrefix(bm.config.Backup.Env) + shell.EnvPrefix(bm.config.Postgres.SSLEnv())
+	if bm.tunnel != nil {
+		prefix += shell.EnvPrefix(map[string]string{"PGHOSTADDR": "127.0.0.1"})
+	}
+	return prefix
+}
+
+// executePg runs a command that connects to the source database on the remote server. The
+// password is sent over stdin instead of being part of the command line.
+func (bm *BackupManager) executePg(ctx context.Context, cmd string, timeout time.Duration) (string, error) {
+	prelude, input := bm.pgPassword()
+	return bm.sshClient.ExecuteCommandContext(ctx, prelude+cmd, input, timeout)
+}
+
+// remoteFileExists reports whether a non-empty file exists on the remote server
+func (bm *BackupManager) remoteFileExists(path string) bool {
+	_, err := bm.sshClient.ExecuteCommand(fmt.Sprintf("test -s %s", path), 10*time.Second)
+	return err == nil
+}
+
+// queryScalar runs a single-value query against the source database with psql on the remote server
+func (bm *BackupManager) queryScalar(ctx context.Context, database, query string) (string, error) {
+	cmd := bm.psqlCommand(database, "-t -A -c "+shell.Quote(query))
+	output, err := bm.executePg(ctx, cmd, 30*time.Second)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(output), nil
+}
+
+// quoteLiteral quotes an SQL string literal
+func quoteLiteral(value string) string {
+	return `'` + strings.ReplaceAll(value, `'`, `''`) + `'`
+}
+
+// collectServerInfo records the source server version and installed extensions so restores can
+// check compatibility up front. Failures only cost that check and don't fail the backup.
+func (bm *BackupManager) collectServerInfo(ctx context.Context, job *databaseJob) {
+	server := &storage.ServerMetadata{Extensions: make(map[string]string)}
+
+	version, err := bm.queryScalar(ctx, job.database, "SELECT version();")
+	if err != nil {
+		job.logger.Warn("Failed to query server version", slog.String("error", err.Error()))
+		return
+	}
+	server.Version = version
+
+	versionNum, err := bm.queryScalar(ctx, job.database, "SHOW server_version_num;")
+	if err == nil {
+		server.VersionNum, err = strconv.Atoi(versionNum)
+	}
+	if err != nil {
+		job.logger.Warn("Failed to query server version number", slog.String("error", err.Error()))
+		return
+	}
+
+	extensions, err := bm.queryScalar(ctx, job.database, "SELECT string_agg(extname || '=' || extversion, ',' ORDER BY extname) FROM pg_extension;")
+	if err != nil {
+		job.logger.Warn("Failed to query installed extensions", slog.String("error", err.Error()))
+		return
+	}
+	for _, entry := range strings.Split(extensions, ",") {
+		if name, extVersion, ok := strings.Cut(entry, "="); ok {
+			server.Extensions[name] = extVersion
+		}
+	}
+
+	job.logger.Debug("Source server info collected",
+		slog.Int("version_num", server.VersionNum),
+		slog.Int("extensions", len(server.Extensions)))
+	job.server = server
+}
+
+// prepareSnapshot sets the snapshot pg_dump should use. With export_snapshot a psql session
+// exports one and keeps its transaction open until the returned release func is called, so
+// other tools can import the same snapshot while the dump runs.
+func (bm *BackupManager) prepareSnapshot(job *databaseJob) (func(), error) {
+	if bm.config.Backup.Snapshot != "" {
+		job.snapshot = bm.config.Backup.Snapshot
+		job.logger.Info("Using external snapshot", slog.String("snapshot", job.snapshot))
+		return func() {}, nil
+	}
+	if !bm.config.Backup.ExportSnapshot {
+		return func() {}, nil
+	}
+
+	prelude, input := bm.pgPassword()
+	session, err := bm.sshClient.StartSession(prelude + bm.psqlCommand(job.database, "-X -q -t -A -v ON_ERROR_STOP=1"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to export snapshot (exit code 3): %w", err)
+	}
+
+	if err := session.Write(input + "BEGIN ISOLATION LEVEL REPEATABLE READ READ ONLY;\nSELECT pg_export_snapshot();\n"); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("failed to export snapshot (exit code 3): %w", err)
+	}
+	snapshot, err := session.ReadLine(30 * time.Second)
+	if err != nil || snapshot == "" {
+		session.Close()
+		return nil, fmt.Errorf("failed to export snapshot (exit code 3): %v", err)
+	}
+
+	job.snapshot = snapshot
+	job.logger.Info("Exported snapshot", slog.String("snapshot", snapshot))
+
+	if bm.config.Backup.SnapshotFile != "" {
+		if err := os.WriteFile(bm.config.Backup.SnapshotFile, []byte(snapshot+"\n"), 0644); err != nil {
+			job.logger.Warn("Failed to write snapshot file", slog.String("error", err.Error()))
+		}
+	}
+
+	return func() {
+		session.Write("COMMIT;\n")
+		if err := session.Close(); err != nil {
+			job.logger.Warn("Snapshot session did not exit cleanly", slog.String("error", err.Error()))
+		}
+		if bm.config.Backup.SnapshotFile != "" {
+			os.Remove(bm.config.Backup.SnapshotFile)
+		}
+		job.logger.Debug("Released exported snapshot", slog.String("snapshot", snapshot))
+	}, nil
+}
+
+// checkDiskSpace estimates the dump size from pg_database_size and verifies that both the
+// remote temp_dir and the local temp dir can hold it, so we fail before pg_dump starts
+func (bm *BackupManager) checkDiskSpace(ctx context.Context, job *databaseJob) error {
+	if bm.config.Backup.SkipDiskCheck {
+		return nil
+	}
+
+	job.logger.Info("Checking free disk space before dump")
+
+	output, err := bm.queryScalar(ctx, job.database, "SELECT pg_database_size(current_database());")
+	if err != nil {
+		// psql may not be installed next to pg_dump; the check is best effort in that case
+		job.logger.Warn("Could not determine database size, skipping disk space check", slog.String("error", err.Error()))
+		return nil
+	}
+
+	dbSize, err := strconv.ParseInt(output, 10, 64)
+	if err != nil {
+		job.logger.Warn("Unexpected database size output, skipping disk space check", slog.String("output", output))
+		return nil
+	}
+	required := int64(float64(dbSize) * bm.config.Backup.DiskSpaceRatio)
+
+	remoteFree, err := bm.remoteFreeBytes(bm.config.Backup.TempDir)
+	if err != nil {
+		job.logger.Warn("Could not determine remote free space", slog.String("error", err.Error()))
+	} else if remoteFree < required {
+		return fmt.Errorf("insufficient disk space in remote %s (exit code 3): %d bytes free, estimated dump size %d bytes (database size %d bytes)",
+			bm.config.Backup.TempDir, remoteFree, required, dbSize)
+	}
+
+	localFree, err := localFreeBytes(os.TempDir())
+	if err != nil {
+		job.logger.Warn("Could not determine local free space", slog.String("error", err.Error()))
+	} else if localFree < required {
+		return fmt.Errorf("insufficient disk space in local %s (exit code 3): %d bytes free, estimated dump size %d bytes (database size %d bytes)",
+			os.TempDir(), localFree, required, dbSize)
+	}
+
+	job.logger.Info("Disk space check passed",
+		slog.Int64("database_size", dbSize),
+		slog.Int64("estimated_dump_size", required),
+		slog.Int64("remote_free", remoteFree),
+		slog.Int64("local_free", localFree))
+	return nil
+}
+
+func (bm *BackupManager) remoteFreeBytes(dir string) (int64, error) {
+	output, err := bm.sshClient.ExecuteCommand(fmt.Sprintf("df -Pk %s | tail -1", dir), 10*time.Second)
+	if err != nil {
+		return 0, err
+	}
+	return parseDfAvailable(output)
+}
+
+func localFreeBytes(dir string) (int64, error) {
+	output, err := exec.Command("df", "-Pk", dir).Output()
+	if err != nil {
+		return 0, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	return parseDfAvailable(lines[len(lines)-1])
+}
+
+// parseDfAvailable extracts the "Available" column (in KiB) from a `df -Pk` line
+func parseDfAvailable(line string) (int64, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 {
+		return 0, fmt.Errorf("unexpected df output: %q", line)
+	}
+	kb, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected df output: %q", line)
+	}
+	return kb * 1024, nil
+}
+
+// storeGlobals stores the server's roles and tablespaces next to the backup, so a restore onto a
+// rebuilt server can recreate them first. Passwords are left out of the bucket. The backup
+// itself is complete without them, so a failure is only a warning.
+func (bm *BackupManager) storeGlobals(ctx context.Context, job *databaseJob, backupKey string) bool {
+	host, port := bm.pgAddress()
+	dumpallCmd := fmt.Sprintf(
+		"%s%s -h %s -p %d -U %s -l \"%s\" --globals-only --no-role-passwords --no-password",
+		bm.pgEnvPrefix(),
+		bm.pgTool("pg_dumpall"),
+		host,
+		port,
+		bm.config.Postgres.Username,
+		job.database,
+	)
+	output, err := bm.executePg(ctx, dumpallCmd, 5*time.Minute)
+	if err == nil {
+		err = bm.s3Client.PutGlobals(ctx, backupKey, []byte(output))
+	}
+	if err != nil {
+		job.logger.Warn("Failed to store globals", slog.String("error", err.Error()))
+		job.warnings = append(job.warnings, "globals not stored: "+err.Error())
+		return false
+	}
+	job.logger.Info("Globals stored", slog.String("key", backupKey+storage.GlobalsSuffix))
+	return true
+}
+
+func (bm *BackupManager) createRemoteBackup(ctx context.Context, job *databaseJob, remoteBackupPath string) error {
+	job.logger.Info("Stage 2: Creating remote backup",
+		slog.String("path", remoteBackupPath),
+		slog.String("compression", job.settings.Compression),
+		slog.Int("compression_level", job.settings.CompressionLvl))
+
+	// pg_dump only compresses itself in builtin mode; external algorithms compress the stream
+	pgDumpCompress := 0
+	if job.settings.Compression == compression.Builtin {
+		pgDumpCompress = job.settings.CompressionLvl
+	}
 
 	// Use pg_dump for better compatibility (doesn't require replication privileges)
-	pgPassword := fmt.Sprintf("PGPASSWORD='%s'", bm.config.Postgres.Password)
-	
 	// Create pg_dump command with custom format and compression
 	// Custom format allows for parallel restore and selective restoration
 	// Quote database name to handle special characters
+	host, port := bm.pgAddress()
 	pgDumpCmd := fmt.Sprintf(
-		"%s pg_dump -h %s -p %d -U %s -d \"%s\" --verbose --no-password --no-owner --no-privileges --no-tablespaces --no-security-labels --format=custom --compress=%d --file=%s 2>&1",
-		pgPassword,
-		bm.config.Postgres.Host,
-		bm.config.Postgres.Port,
+		"%s%s -h %s -p %d -U %s -d \"%s\" --verbose --no-password --no-owner --no-tablespaces --no-security-labels --format=custom --compress=%d",
+		bm.pgEnvPrefix(),
+		bm.pgTool("pg_dump"),
+		host,
+		port,
 		bm.config.Postgres.Username,
-		bm.config.Postgres.Database,
-		bm.config.Backup.CompressionLvl,
-		remoteBackupPath,
+		job.database,
+		pgDumpCompress,
 	)
+	// --no-owner and --no-tablespaces only affect text output; archives keep both and leave the
+	// choice to pg_restore. Grants are only in the archive when dumped.
+	if !bm.config.Backup.Privileges {
+		pgDumpCmd += " --no-privileges"
+	}
+	if job.snapshot != "" {
+		pgDumpCmd += fmt.Sprintf(" --snapshot=%s", shell.Quote(job.snapshot))
+	}
+	for _, table := range bm.config.Backup.SchemaOnlyTables {
+		pgDumpCmd += fmt.Sprintf(" --exclude-table-data=%s", shell.Quote(table))
+	}
+
+	if compression.IsExternal(job.settings.Compression) {
+		// Pipe the dump through the compressor; pg_dump's exit code and messages are kept in
+		// side files because POSIX sh has no pipefail
+		rcFile := remoteBackupPath + ".rc"
+		logFile := remoteBackupPath + ".log"
+		pgDumpCmd = fmt.Sprintf(
+			"(%s 2>%s; echo $? > %s) | %s > %s || { cat %s; rm -f %s %s; exit 1; }; rc=$(cat %s); cat %s; rm -f %s %s; exit $rc",
+			pgDumpCmd,
+			logFile,
+			rcFile,
+			compression.CompressCommand(job.settings.Compression, job.settings.CompressionLvl),
+			remoteBackupPath,
+			logFile, rcFile, logFile,
+			rcFile,
+			logFile, rcFile, logFile,
+		)
+	} else if bm.config.Backup.Mode != "ssh" {
+		// --file would write inside the container; the dump is written to the host from stdout
+		pgDumpCmd += fmt.Sprintf(" 2>&1 > %s", remoteBackupPath)
+	} else {
+		pgDumpCmd += fmt.Sprintf(" --file=%s 2>&1", remoteBackupPath)
+	}
 
 	// Try to run the command and capture all output
-	output, err := bm.sshClient.ExecuteCommand(pgDumpCmd, bm.config.Timeouts.BackupOp)
+	output, err := bm.executePg(ctx, pgDumpCmd, bm.config.Timeouts.Dump)
+	bm.recorder.RecordOutput("pg_dump_"+job.database, output)
+
+	// Separate warnings from errors so warnings are reported without failing the run
+	result := pgoutput.Classify(output)
+	job.warnings = result.Warnings
 	
 	if err != nil {
-		// Try to get the error output from the file
-		errorOutput, _ := bm.sshClient.ExecuteCommand(fmt.Sprintf("head -100 %s 2>/dev/null", remoteBackupPath), 5*time.Second)
-		bm.sshClient.ExecuteCommand(fmt.Sprintf("rm -f %s", remoteBackupPath), 10*time.Second)
+		bm.recorder.RecordOutput("pg_dump_error_"+job.database, err.Error())
+		// A killed pipeline leaves its side files behind as well
+		bm.sshClient.ExecuteCommand(fmt.Sprintf("rm -f %s %s.rc %s.log", remoteBackupPath, remoteBackupPath, remoteBackupPath), 10*time.Second)
 		
 		errMsg := fmt.Sprintf("backup creation failed (exit code 3): %v", err)
-		if errorOutput != "" {
-			errMsg = fmt.Sprintf("%s\npg_dump output: %s", errMsg, errorOutput)
-		}
-		if output != "" {
+		if result.HasErrors() {
+			errMsg = fmt.Sprintf("%s\npg_dump errors:\n%s", errMsg, pgoutput.Summary(result.Errors, 20))
+		} else if output != "" {
 			errMsg = fmt.Sprintf("%s\nCommand output: %s", errMsg, output)
 		}
 		return fmt.Errorf("%s", errMsg)
 	}
 
+	if len(result.Warnings) > 0 {
+		job.logger.Warn("pg_dump reported warnings",
+			slog.Int("count", len(result.Warnings)),
+			slog.String("warnings", pgoutput.Summary(result.Warnings, 10)))
+	}
+
 	statOutput, err := bm.sshClient.ExecuteCommand(fmt.Sprintf("stat -c %%s %s 2>/dev/null || stat -f %%z %s 2>/dev/null", remoteBackupPath, remoteBackupPath), 10*time.Second)
 	if err != nil {
 		return fmt.Errorf("failed to verify backup file (exit code 3): %w", err)
@@ -202,24 +1352,83 @@ func (bm *BackupManager) createRemoteBackup(remoteBackupPath string) error {
 		return fmt.Errorf("backup file is empty (exit code 3)")
 	}
 
-	bm.logger.Info("Remote backup created successfully", slog.String("size", fileSize))
+	job.logger.Info("Remote backup created successfully", slog.String("size", fileSize))
 	return nil
 }
 
-func (bm *BackupManager) transferBackup(remoteBackupPath, localBackupPath string) error {
-	bm.logger.Info("Stage 3: Transferring backup to local machine",
+// checkIntegrity reads the dump's table of contents with pg_restore --list, on the database
+// server (remote) or on this host after the transfer. Externally compressed dumps are fully
+// decompressed first, which also catches truncated files; for builtin compression only the
+// TOC at the start of the file is read.
+func (bm *BackupManager) checkIntegrity(ctx context.Context, job *databaseJob, path string, remote bool) error {
+	job.logger.Info("Checking dump integrity", slog.String("path", path), slog.Bool("remote", remote))
+
+	// On the database server pg_restore may only exist inside the container, which can't
+	// read the host's files, so the dump is fed through stdin there
+	pgRestore := "pg_restore"
+	if remote {
+		pgRestore = bm.clientTool("pg_restore", false)
+	}
+	listCmd := fmt.Sprintf("%s --list < %s 2>&1", pgRestore, path)
+	if algorithm := compression.Detect(path); algorithm != "" {
+		listCmd = fmt.Sprintf("%s 2>&1 && %s < %s | %s --list 2>&1",
+			compression.TestCommand(algorithm, path),
+			compression.DecompressCommand(algorithm),
+			path,
+			pgRestore)
+	}
+
+	var output string
+	var err error
+	if remote {
+		output, err = bm.sshClient.ExecuteCommandContext(ctx, shell.EnvPrefix(bm.config.Backup.Env)+listCmd, "", bm.config.Timeouts.Dump)
+	} else {
+		cmd := shell.Command(ctx, listCmd)
+		cmd.Env = append(os.Environ(), shell.EnvList(bm.config.Backup.Env)...)
+		var out []byte
+		out, err = cmd.CombinedOutput()
+		output = string(out)
+	}
+
+	entries := 0
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, ";") {
+			entries++
+		}
+	}
+
+	if err != nil {
+		bm.recorder.RecordOutput("pg_restore_list_"+job.database, output)
+		return fmt.Errorf("dump integrity check failed (exit code 3): %w (output: %s)", err, pgoutput.Summary(strings.Split(strings.TrimSpace(output), "\n"), 10))
+	}
+	if entries == 0 {
+		return fmt.Errorf("dump integrity check failed (exit code 3): pg_restore --list found no TOC entries")
+	}
+
+	job.logger.Info("Dump integrity check passed", slog.Int("toc_entries", entries))
+	return nil
+}
+
+func (bm *BackupManager) transferBackup(ctx context.Context, job *databaseJob, remoteBackupPath, localBackupPath string) error {
+	job.logger.Info("Stage 3: Transferring backup to local machine",
 		slog.String("remote", remoteBackupPath),
 		slog.String("local", localBackupPath))
 
+	if bm.dumpsLocally() {
+		return bm.moveLocalBackup(remoteBackupPath, localBackupPath)
+	}
+
 	// Use rsync for file transfer
-	rsyncClient := rsync.NewRsyncClient(&bm.config.SSH, bm.logger)
+	rsyncClient := rsync.NewRsyncClient(&bm.config.SSH, job.logger)
 	
 	lastProgress := time.Now()
-	err := rsyncClient.DownloadFile(remoteBackupPath, localBackupPath, bm.config.Timeouts.Transfer, 
+	err := rsyncClient.DownloadFile(ctx, remoteBackupPath, localBackupPath, bm.config.Timeouts.Transfer, 
 		func(transferred, total int64) {
+			job.events.Progress(events.StageTransfer, transferred, total)
 			if time.Since(lastProgress) > 5*time.Second {
 				percentage := float64(transferred) / float64(total) * 100
-				bm.logger.Info("Transfer progress",
+				job.logger.Info("Transfer progress",
 					slog.Float64("percentage", percentage),
 					slog.Int64("transferred", transferred),
 					slog.Int64("total", total))
@@ -234,47 +1443,62 @@ func (bm *BackupManager) transferBackup(remoteBackupPath, localBackupPath string
 
 	// Remove remote file after successful transfer
 	if err := bm.sshClient.RemoveRemoteFile(remoteBackupPath); err != nil {
-		bm.logger.Warn("Failed to remove remote backup file", slog.String("error", err.Error()))
+		job.logger.Warn("Failed to remove remote backup file", slog.String("error", err.Error()))
 	}
 
 	return nil
 }
 
-func (bm *BackupManager) uploadToS3(ctx context.Context, localBackupPath string) error {
-	bm.logger.Info("Stage 4: Uploading backup to S3", slog.String("file", localBackupPath))
-
-	lastProgress := time.Now()
-	err := bm.s3Client.UploadFile(ctx, localBackupPath, func(uploaded int64) {
-		if time.Since(lastProgress) > 5*time.Second {
-			bm.logger.Info("S3 upload progress", slog.Int64("uploaded", uploaded))
-			lastProgress = time.Now()
-		}
-	})
+// moveLocalBackup moves a dump streamed to this machine's temp_dir into place, copying it when
+// the two directories are on different file systems
+func (bm *BackupManager) moveLocalBackup(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
 
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("transfer failed (exit code 4): %w", err)
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
 	if err != nil {
-		return fmt.Errorf("S3 upload failed (exit code 5): %w", err)
+		return fmt.Errorf("transfer failed (exit code 4): %w", err)
 	}
-
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return fmt.Errorf("transfer failed (exit code 4): %w", err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return fmt.Errorf("transfer failed (exit code 4): %w", err)
+	}
+	os.Remove(src)
 	return nil
 }
 
-func (bm *BackupManager) performCleanup(ctx context.Context, localBackupPath string) error {
-	bm.logger.Info("Stage 5: Performing cleanup")
+func (bm *BackupManager) uploadToS3(ctx context.Context, job *databaseJob, localBackupPath string) (string, error) {
+	job.logger.Info("Stage 4: Uploading backup to S3", slog.String("file", localBackupPath))
 
-	if err := os.Remove(localBackupPath); err != nil {
-		bm.logger.Warn("Failed to remove local backup file", slog.String("error", err.Error()))
-	} else {
-		bm.logger.Info("Local backup file removed", slog.String("path", localBackupPath))
-	}
+	lastProgress := time.Now()
+	key, err := bm.s3Client.UploadFile(ctx, localBackupPath, job.settings.Prefix, func(uploaded, total int64) {
+		job.events.Progress(events.StageUpload, uploaded, total)
+		if time.Since(lastProgress) > 5*time.Second {
+			job.logger.Info("S3 upload progress", slog.Int64("uploaded", uploaded), slog.Int64("total", total))
+			lastProgress = time.Now()
+		}
+	})
 
-	if err := bm.s3Client.CleanupOldBackups(ctx, bm.config.Backup.RetentionCount); err != nil {
-		return fmt.Errorf("retention cleanup failed: %w", err)
+	if err != nil {
+		return "", fmt.Errorf("S3 upload failed (exit code 5): %w", err)
 	}
 
-	return nil
+	return key, nil
 }
 
 func (bm *BackupManager) cleanup() {
+	bm.closeTunnel()
 	if bm.sshClient != nil {
 		bm.sshClient.Close()
 	}
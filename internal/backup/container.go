@@ -0,0 +1,181 @@
+package backup
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hra42/pg_backup/internal/shell"
+)
+
+// readPasswordScript runs inside the pod: it exports the first stdin line as PGPASSWORD and
+// replaces itself with the tool, which keeps reading the rest of stdin
+const readPasswordScript = `IFS= read -r PGPASSWORD; export PGPASSWORD; exec "$0" "$@"`
+
+// pgTool returns the command that runs a PostgreSQL client tool connecting to the source
+// database. In ssh mode it runs on the SSH host, in docker mode inside the container there and
+// in kubernetes mode inside the pod. The password never appears in the command line.
+func (bm *BackupManager) pgTool(name string) string {
+	return bm.clientTool(name, true)
+}
+
+// clientTool returns the command that runs a tool where pg_dump runs. Tools that don't connect
+// to the database (withPassword false) get their stdin untouched.
+func (bm *BackupManager) clientTool(name string, withPassword bool) string {
+	switch bm.config.Backup.Mode {
+	case "docker":
+		docker := bm.config.Backup.Docker
+		args := []string{docker.Command, "exec", "-i"}
+		if docker.User != "" {
+			args = append(args, "-u", shell.Quote(docker.User))
+		}
+		for _, env := range bm.forwardedEnv() {
+			args = append(args, "-e", env)
+		}
+		args = append(args, shell.Quote(docker.Container), name)
+		return strings.Join(args, " ")
+
+	case "kubernetes":
+		// kubectl exec can't forward environment variables, so the non-secret ones are set with
+		// env and the password is read from stdin inside the pod
+		args := append(bm.kubectl(), "exec", "-i", shell.Quote(bm.pod))
+		if container := bm.config.Backup.Kubernetes.Container; container != "" {
+			args = append(args, "-c", shell.Quote(container))
+		}
+		args = append(args, "--")
+		env := bm.config.Postgres.SSLEnv()
+		for key, value := range bm.config.Backup.Env {
+			env[key] = value
+		}
+		if len(env) > 0 {
+			args = append(args, "env")
+			for _, pair := range shell.EnvList(env) {
+				args = append(args, shell.Quote(pair))
+			}
+		}
+		if withPassword {
+			args = append(args, "sh", "-c", shell.Quote(readPasswordScript))
+		}
+		return strings.Join(append(args, name), " ")
+
+	default:
+		return name
+	}
+}
+
+// forwardedEnv lists the variables exported on the SSH host that the tools in the container need
+func (bm *BackupManager) forwardedEnv() []string {
+	names := []string{"PGPASSWORD"}
+	for name := range bm.config.Postgres.SSLEnv() {
+		names = append(names, name)
+	}
+	for name := range bm.config.Backup.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names[1:])
+	return names
+}
+
+// pgPassword returns the shell prelude and the stdin input that hand the source password to
+// commands built with pgTool
+func (bm *BackupManager) pgPassword() (prelude, input string) {
+	switch bm.config.Backup.Mode {
+	case "docker":
+		// The container can't read a password file on the host
+		return shell.PasswordEnvPrelude, bm.config.Postgres.Password + "\n"
+	case "kubernetes":
+		// Read inside the pod by readPasswordScript
+		return "", bm.config.Postgres.Password + "\n"
+	default:
+		return shell.PgPassPrelude, shell.PgPassInput(bm.config.Postgres.Password)
+	}
+}
+
+// kubectl returns the kubectl command with the configured kubeconfig, context and namespace
+func (bm *BackupManager) kubectl() []string {
+	k8s := bm.config.Backup.Kubernetes
+	args := []string{k8s.Command}
+	if k8s.Kubeconfig != "" {
+		args = append(args, "--kubeconfig", shell.Quote(k8s.Kubeconfig))
+	}
+	if k8s.Context != "" {
+		args = append(args, "--context", shell.Quote(k8s.Context))
+	}
+	return append(args, "-n", shell.Quote(k8s.Namespace))
+}
+
+// resolvePod picks the pod the tools run in, once per run, so every command of the run talks to
+// the same pod even if the selector matches several
+func (bm *BackupManager) resolvePod() error {
+	k8s := bm.config.Backup.Kubernetes
+	// Every command of the mode goes through kubectl, it doesn't talk to the API itself
+	if _, err := exec.LookPath(k8s.Command); err != nil {
+		return fmt.Errorf("kubernetes mode needs %s installed on this machine: %w", k8s.Command, err)
+	}
+	if k8s.Pod != "" {
+		bm.pod = k8s.Pod
+		return nil
+	}
+
+	cmd := strings.Join(append(bm.kubectl(), "get", "pods",
+		"-l", shell.Quote(k8s.Selector),
+		"--field-selector=status.phase=Running",
+		"-o", shell.Quote("jsonpath={.items[0].metadata.name}")), " ")
+	output, err := bm.sshClient.ExecuteCommand(cmd, 30*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to find pod for selector %s: %w", k8s.Selector, err)
+	}
+	bm.pod = strings.TrimSpace(output)
+	if bm.pod == "" {
+		return fmt.Errorf("no running pod matches selector %s in namespace %s", k8s.Selector, k8s.Namespace)
+	}
+	bm.logger.Info("Selected pod", slog.String("pod", bm.pod), slog.String("namespace", k8s.Namespace))
+	return nil
+}
+
+// dumpsLocally reports whether pg_dump writes the dump on this machine (kubernetes and direct
+// mode), so there is nothing to transfer
+func (bm *BackupManager) dumpsLocally() bool {
+	return bm.config.Backup.Mode == "kubernetes" || bm.config.Backup.Mode == "direct"
+}
+
+// pgAddress returns the host and port the client tools connect to. While a tunnel is open the
+// port is its local end; pgEnvPrefix then points libpq at 127.0.0.1 with PGHOSTADDR, so the
+// host name is still the one sslmode verify-full checks the certificate against.
+func (bm *BackupManager) pgAddress() (string, int) {
+	if bm.tunnel != nil {
+		return bm.config.Postgres.Host, bm.tunnel.Port()
+	}
+	return bm.config.Postgres.Host, bm.config.Postgres.Port
+}
+
+// openTunnel connects to the SSH host and forwards a local port to postgres.host:port as seen
+// from there. A tunnel left by an earlier attempt is replaced.
+func (bm *BackupManager) openTunnel() error {
+	bm.closeTunnel()
+	if err := bm.tunnelClient.Connect(bm.config.Timeouts.SSHConnection); err != nil {
+		return err
+	}
+	remote := net.JoinHostPort(bm.config.Postgres.Host, strconv.Itoa(bm.config.Postgres.Port))
+	tunnel, err := bm.tunnelClient.Forward(remote, bm.config.Backup.Direct.LocalPort)
+	if err != nil {
+		bm.tunnelClient.Close()
+		return err
+	}
+	bm.tunnel = tunnel
+	return nil
+}
+
+func (bm *BackupManager) closeTunnel() {
+	if bm.tunnel == nil {
+		return
+	}
+	bm.tunnel.Close()
+	bm.tunnel = nil
+	bm.tunnelClient.Close()
+}
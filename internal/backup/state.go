@@ -0,0 +1,133 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hra42/pg_backup/internal/lock"
+)
+
+// Stages recorded in the run state, in order. A started state only tracks the files of a dump
+// in progress, so they are removed if the run dies before finishing it.
+const (
+	stateStarted     = "started"
+	stateDumped      = "dumped"
+	stateTransferred = "transferred"
+	stateUploaded    = "uploaded"
+)
+
+var stateOrder = map[string]int{
+	stateStarted:     0,
+	stateDumped:      1,
+	stateTransferred: 2,
+	stateUploaded:    3,
+}
+
+// runState records how far a database's backup got, so -resume can continue an interrupted
+// run instead of starting over. It is removed once the backup completes.
+type runState struct {
+	RunID      string    `json:"run_id"`
+	Database   string    `json:"database"`
+	FileName   string    `json:"file_name"`
+	RemotePath string    `json:"remote_path"`
+	LocalPath  string    `json:"local_path"`
+	Stage      string    `json:"stage"`
+	Key        string    `json:"key,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// reached reports whether the recorded run completed the given stage
+func (s *runState) reached(stage string) bool {
+	return s != nil && stateOrder[s.Stage] >= stateOrder[stage]
+}
+
+func (bm *BackupManager) statePath(database string) string {
+	name := lock.Name(bm.config.Postgres.Host, bm.config.Postgres.Port, database)
+	return filepath.Join(bm.config.Backup.StateDir, "pg_backup_"+name+".state.json")
+}
+
+func (bm *BackupManager) loadState(database string) (*runState, error) {
+	data, err := os.ReadFile(bm.statePath(database))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state runState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse run state: %w", err)
+	}
+	return &state, nil
+}
+
+// saveState records that the job completed stage. Failures only cost the ability to resume.
+func (bm *BackupManager) saveState(job *databaseJob, stage, remotePath, localPath, key string) {
+	state := runState{
+		RunID:      bm.runID,
+		Database:   job.database,
+		FileName:   job.fileName,
+		RemotePath: remotePath,
+		LocalPath:  localPath,
+		Stage:      stage,
+		Key:        key,
+		UpdatedAt:  time.Now().UTC(),
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err == nil {
+		path := bm.statePath(job.database)
+		if err = os.WriteFile(path+".tmp", data, 0600); err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+	}
+	if err != nil {
+		job.logger.Warn("Failed to save run state", slog.String("error", err.Error()))
+	}
+}
+
+func (bm *BackupManager) removeState(job *databaseJob) {
+	if err := os.Remove(bm.statePath(job.database)); err != nil && !os.IsNotExist(err) {
+		job.logger.Warn("Failed to remove run state", slog.String("error", err.Error()))
+	}
+}
+
+// prepareResume looks for the state of an interrupted run. With -resume the job continues from
+// it; otherwise the files the interrupted run left behind are removed. Must be called while
+// holding the run lock so a concurrent run's state is never touched.
+func (bm *BackupManager) prepareResume(job *databaseJob) {
+	state, err := bm.loadState(job.database)
+	if err != nil {
+		job.logger.Warn("Ignoring unreadable run state", slog.String("error", err.Error()))
+		bm.removeState(job)
+		return
+	}
+	if state == nil {
+		return
+	}
+
+	if bm.resume {
+		job.logger.Info("Resuming interrupted backup",
+			slog.String("previous_run_id", state.RunID),
+			slog.String("file", state.FileName),
+			slog.String("completed_stage", state.Stage))
+		job.fileName = state.FileName
+		job.resumed = state
+		return
+	}
+
+	job.logger.Warn("Previous backup was interrupted, starting over (use -resume to continue it)",
+		slog.String("previous_run_id", state.RunID),
+		slog.String("completed_stage", state.Stage))
+	if state.RemotePath != "" {
+		bm.sshClient.RemoveRemoteFile(state.RemotePath)
+	}
+	if state.LocalPath != "" {
+		os.Remove(state.LocalPath)
+	}
+	bm.removeState(job)
+}
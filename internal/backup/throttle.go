@@ -0,0 +1,85 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+const (
+	activeConnectionsQuery = "SELECT count(*) FROM pg_stat_activity WHERE state = 'active' AND pid <> pg_backend_pid();"
+
+	// On a standby the lag is how far replay is behind; on a primary it is the slowest standby's replay lag
+	replicationLagQuery = "SELECT COALESCE(EXTRACT(EPOCH FROM CASE WHEN pg_is_in_recovery() " +
+		"THEN now() - pg_last_xact_replay_timestamp() " +
+		"ELSE (SELECT max(replay_lag) FROM pg_stat_replication) END), 0);"
+)
+
+// waitForLoad checks the source server against the throttle thresholds before the dump starts.
+// While a threshold is exceeded it waits and checks again (or aborts right away with action
+// "abort"). Thresholds that can't be queried are skipped, like the disk space check.
+func (bm *BackupManager) waitForLoad(ctx context.Context, job *databaseJob) error {
+	throttle := bm.config.Backup.Throttle
+	if throttle == nil || (throttle.MaxActiveConnections == 0 && throttle.MaxReplicationLag == 0) {
+		return nil
+	}
+
+	startTime := time.Now()
+	for {
+		reason := bm.loadExceeded(ctx, job)
+		if reason == "" {
+			if waited := time.Since(startTime); waited > time.Second {
+				job.logger.Info("Server load dropped below throttle thresholds", slog.Duration("waited", waited.Round(time.Second)))
+			}
+			return nil
+		}
+
+		if throttle.Action == "abort" {
+			return fmt.Errorf("server too busy to start backup (exit code 3): %s", reason)
+		}
+		if time.Since(startTime)+throttle.CheckInterval > throttle.MaxWait {
+			return fmt.Errorf("server too busy to start backup after waiting %v (exit code 3): %s", throttle.MaxWait, reason)
+		}
+
+		job.logger.Warn("Server busy, delaying backup",
+			slog.String("reason", reason),
+			slog.Duration("retry_in", throttle.CheckInterval))
+
+		select {
+		case <-time.After(throttle.CheckInterval):
+		case <-ctx.Done():
+			return fmt.Errorf("backup cancelled while waiting for server load to drop (exit code 3): %w", ctx.Err())
+		}
+	}
+}
+
+// loadExceeded returns why the server is considered too busy, or "" if it isn't
+func (bm *BackupManager) loadExceeded(ctx context.Context, job *databaseJob) string {
+	throttle := bm.config.Backup.Throttle
+
+	if throttle.MaxActiveConnections > 0 {
+		output, err := bm.queryScalar(ctx, job.database, activeConnectionsQuery)
+		if err != nil {
+			job.logger.Warn("Could not count active connections, skipping check", slog.String("error", err.Error()))
+		} else if active, err := strconv.Atoi(output); err != nil {
+			job.logger.Warn("Unexpected active connections output, skipping check", slog.String("output", output))
+		} else if active > throttle.MaxActiveConnections {
+			return fmt.Sprintf("%d active connections (max %d)", active, throttle.MaxActiveConnections)
+		}
+	}
+
+	if throttle.MaxReplicationLag > 0 {
+		output, err := bm.queryScalar(ctx, job.database, replicationLagQuery)
+		if err != nil {
+			job.logger.Warn("Could not determine replication lag, skipping check", slog.String("error", err.Error()))
+		} else if seconds, err := strconv.ParseFloat(output, 64); err != nil {
+			job.logger.Warn("Unexpected replication lag output, skipping check", slog.String("output", output))
+		} else if lag := time.Duration(seconds * float64(time.Second)); lag > throttle.MaxReplicationLag {
+			return fmt.Sprintf("replication lag %v (max %v)", lag.Round(time.Second), throttle.MaxReplicationLag)
+		}
+	}
+
+	return ""
+}
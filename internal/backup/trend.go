@@ -0,0 +1,150 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hra42/pg_backup/internal/lock"
+)
+
+// runHistory holds the size and duration of a database's recent successful backups, newest last
+type runHistory struct {
+	Runs []historyEntry `json:"runs"`
+}
+
+type historyEntry struct {
+	Time     time.Time `json:"time"`
+	Size     int64     `json:"size"`
+	Duration float64   `json:"duration_seconds"` // 0 for resumed runs, whose duration isn't comparable
+}
+
+func (bm *BackupManager) historyPath(database string) string {
+	name := lock.Name(bm.config.Postgres.Host, bm.config.Postgres.Port, database)
+	return filepath.Join(bm.config.Backup.StateDir, "pg_backup_"+name+".history.json")
+}
+
+// checkTrend compares a successful backup with the average of the database's recent runs and
+// adds a warning for every metric deviating more than max_deviation, as well as for a backup
+// slower than max_duration or a size change from the previous run beyond max_size_change,
+// then records the backup. A missing or unreadable history only delays the comparison.
+func (bm *BackupManager) checkTrend(job *databaseJob) {
+	trend := bm.config.Backup.Trend
+	if trend == nil || !trend.Enabled {
+		return
+	}
+
+	var history runHistory
+	path := bm.historyPath(job.database)
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &history); err != nil {
+			job.logger.Warn("Ignoring unreadable run history", slog.String("error", err.Error()))
+			history = runHistory{}
+		}
+	}
+
+	entry := historyEntry{
+		Time: time.Now().UTC(),
+		Size: job.backupSize,
+	}
+	if job.resumed == nil {
+		entry.Duration = job.duration.Seconds()
+	}
+
+	var sizes, durations []float64
+	for _, run := range history.Runs {
+		sizes = append(sizes, float64(run.Size))
+		if run.Duration > 0 {
+			durations = append(durations, run.Duration)
+		}
+	}
+	if warning := deviation("dump size", float64(entry.Size), sizes, trend.MinRuns, trend.MaxDeviation, formatSize); warning != "" {
+		bm.trendWarning(job, warning)
+	}
+	if entry.Duration > 0 {
+		formatDuration := func(seconds float64) string {
+			return (time.Duration(seconds) * time.Second).Round(time.Second).String()
+		}
+		if warning := deviation("duration", entry.Duration, durations, trend.MinRuns, trend.MaxDeviation, formatDuration); warning != "" {
+			bm.trendWarning(job, warning)
+		}
+	}
+	if trend.MaxDuration > 0 && job.duration > trend.MaxDuration {
+		bm.trendWarning(job, fmt.Sprintf("duration %s exceeds max_duration %s", job.duration.Round(time.Second), trend.MaxDuration))
+	}
+	if trend.MaxSizeChange > 0 && len(history.Runs) > 0 {
+		previous := float64(history.Runs[len(history.Runs)-1].Size)
+		if warning := deviation("dump size", float64(entry.Size), []float64{previous}, 1, trend.MaxSizeChange, formatSize); warning != "" {
+			bm.trendWarning(job, warning)
+		}
+	}
+
+	history.Runs = append(history.Runs, entry)
+	if len(history.Runs) > trend.Window {
+		history.Runs = history.Runs[len(history.Runs)-trend.Window:]
+	}
+	data, err := json.MarshalIndent(history, "", "  ")
+	if err == nil {
+		if err = os.WriteFile(path+".tmp", data, 0600); err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+	}
+	if err != nil {
+		job.logger.Warn("Failed to save run history", slog.String("error", err.Error()))
+	}
+}
+
+func (bm *BackupManager) trendWarning(job *databaseJob, warning string) {
+	job.logger.Warn("Backup deviates from recent runs", slog.String("deviation", warning))
+	job.warnings = append(job.warnings, warning)
+	job.trendWarnings = append(job.trendWarnings, warning)
+}
+
+// deviation describes how far value strays from the average of history, or returns "" while
+// history has fewer than minRuns values or value is within maxDeviation percent
+func deviation(metric string, value float64, history []float64, minRuns int, maxDeviation float64, format func(float64) string) string {
+	if len(history) < minRuns {
+		return ""
+	}
+	var sum float64
+	for _, v := range history {
+		sum += v
+	}
+	average := sum / float64(len(history))
+	if average <= 0 {
+		return ""
+	}
+
+	percent := (value - average) / average * 100
+	if math.Abs(percent) <= maxDeviation {
+		return ""
+	}
+	direction := "above"
+	if percent < 0 {
+		direction = "below"
+	}
+	if len(history) == 1 {
+		return fmt.Sprintf("%s %s is %.0f%% %s the previous run (%s)",
+			metric, format(value), math.Abs(percent), direction, format(average))
+	}
+	return fmt.Sprintf("%s %s is %.0f%% %s the average of the last %d runs (%s)",
+		metric, format(value), math.Abs(percent), direction, len(history), format(average))
+}
+
+// formatSize renders a byte count with a binary unit, e.g. 1.5 GiB
+func formatSize(bytes float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	unit := 0
+	for bytes >= 1024 && unit < len(units)-1 {
+		bytes /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%.0f %s", bytes, units[unit])
+	}
+	return fmt.Sprintf("%.1f %s", bytes, units[unit])
+}
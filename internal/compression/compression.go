@@ -0,0 +1,134 @@
+package compression
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Supported compression algorithms for the backup pipeline
+const (
+	Builtin = "builtin" // pg_dump's own zlib compression (--compress=N)
+	None    = "none"
+	Gzip    = "gzip"
+	Zstd    = "zstd"
+	LZ4     = "lz4"
+)
+
+// DumpExtension is the extension of an uncompressed (or pg_dump-compressed) custom format dump
+const DumpExtension = ".dump"
+
+var extensions = map[string]string{
+	Gzip: ".gz",
+	Zstd: ".zst",
+	LZ4:  ".lz4",
+}
+
+// IsExternal reports whether the algorithm runs as a separate stage after pg_dump
+func IsExternal(algorithm string) bool {
+	_, ok := extensions[algorithm]
+	return ok
+}
+
+// Extension returns the file extension appended to the dump file name
+func Extension(algorithm string) string {
+	return extensions[algorithm]
+}
+
+// Tool returns the name of the command line tool implementing the algorithm
+func Tool(algorithm string) string {
+	if IsExternal(algorithm) {
+		return algorithm
+	}
+	return ""
+}
+
+// CompressCommand returns a shell filter that compresses stdin to stdout
+func CompressCommand(algorithm string, level int) string {
+	switch algorithm {
+	case Gzip:
+		return fmt.Sprintf("gzip -c -%d", level)
+	case Zstd:
+		return fmt.Sprintf("zstd -q -c -T0 -%d", level)
+	case LZ4:
+		return fmt.Sprintf("lz4 -q -c -%d", level)
+	default:
+		return "cat"
+	}
+}
+
+// DecompressCommand returns a shell filter that decompresses stdin to stdout
+func DecompressCommand(algorithm string) string {
+	switch algorithm {
+	case Gzip:
+		return "gzip -d -c"
+	case Zstd:
+		return "zstd -q -d -c"
+	case LZ4:
+		return "lz4 -q -d -c"
+	default:
+		return "cat"
+	}
+}
+
+// TestCommand returns a command that checks the integrity of a compressed file without writing output
+func TestCommand(algorithm, path string) string {
+	switch algorithm {
+	case Gzip:
+		return fmt.Sprintf("gzip -t %s", path)
+	case Zstd:
+		return fmt.Sprintf("zstd -q -t %s", path)
+	case LZ4:
+		return fmt.Sprintf("lz4 -q -t %s", path)
+	default:
+		return "true"
+	}
+}
+
+// Detect returns the external algorithm a dump file was compressed with, based on its name
+func Detect(name string) string {
+	for algorithm, ext := range extensions {
+		if strings.HasSuffix(name, DumpExtension+ext) {
+			return algorithm
+		}
+	}
+	return ""
+}
+
+// TrimExtension strips the external compression extension from a dump file name
+func TrimExtension(name string) string {
+	if algorithm := Detect(name); algorithm != "" {
+		return strings.TrimSuffix(name, extensions[algorithm])
+	}
+	return name
+}
+
+// IsDumpFile reports whether the name looks like a dump produced by pg_backup
+func IsDumpFile(name string) bool {
+	return strings.HasSuffix(name, DumpExtension) || Detect(name) != ""
+}
+
+// ValidLevel reports whether level is accepted by the algorithm's command line tool
+func ValidLevel(algorithm string, level int) bool {
+	switch algorithm {
+	case Zstd:
+		return level >= 1 && level <= 19
+	case LZ4:
+		return level >= 1 && level <= 12
+	case Gzip:
+		return level >= 1 && level <= 9
+	default:
+		return level >= 0 && level <= 9
+	}
+}
+
+// DefaultLevel returns the level used when the configured one is out of range
+func DefaultLevel(algorithm string) int {
+	switch algorithm {
+	case Zstd:
+		return 3
+	case LZ4:
+		return 1
+	default:
+		return 6
+	}
+}
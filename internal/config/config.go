@@ -3,8 +3,16 @@ package config
 import (
 	"fmt"
 	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
 	"time"
 
+	"github.com/hra42/pg_backup/internal/compression"
+	"github.com/hra42/pg_backup/internal/masking"
+	"github.com/hra42/pg_backup/internal/msgtemplate"
 	"gopkg.in/yaml.v3"
 )
 
@@ -18,6 +26,13 @@ type Config struct {
 	Notification NotificationConfig `yaml:"notification"`
 	Log          LogConfig          `yaml:"log"`
 	Cleanup      *CleanupConfig     `yaml:"cleanup"`
+	Incident     IncidentConfig     `yaml:"incident"`
+	Trigger      *TriggerConfig     `yaml:"trigger"`
+	Exporters    []ExporterConfig   `yaml:"exporters,omitempty"` // Optional: commands receiving run events
+	Safety       SafetyConfig       `yaml:"safety"`
+	Scheduler    SchedulerConfig    `yaml:"scheduler"`          // Schedules of scheduled mode
+	Schedule     *ScheduleConfig    `yaml:"schedule,omitempty"` // Deprecated: flat backup schedule of older configs, moved to scheduler.backup on load
+	Warnings     []string           `yaml:"-"`                  // Problems found on load that don't stop pg_backup, logged at startup
 }
 
 type SSHConfig struct {
@@ -30,61 +45,618 @@ type SSHConfig struct {
 }
 
 type PostgresConfig struct {
-	Host     string `yaml:"host"`
-	Port     int    `yaml:"port"`
-	Database string `yaml:"database"`
-	Username string `yaml:"username"`
-	Password string `yaml:"password"`
+	Host      string          `yaml:"host"`
+	Port      int             `yaml:"port"`
+	Database  string          `yaml:"database"`
+	Databases []string        `yaml:"databases,omitempty"` // Optional: back up several databases of the same server in one run
+	Username  string          `yaml:"username"`
+	Password  string          `yaml:"password"`
+	SSLMode     string        `yaml:"sslmode,omitempty"`     // libpq sslmode, e.g. "require" or "verify-full"
+	SSLRootCert string        `yaml:"sslrootcert,omitempty"` // CA certificate path on the host running pg_dump (the SSH server)
+	SSLCert     string        `yaml:"sslcert,omitempty"`     // Client certificate path
+	SSLKey      string        `yaml:"sslkey,omitempty"`      // Client key path
+	Identity  *IdentityConfig `yaml:"identity,omitempty"` // Optional: assertions checked before dumping
+}
+
+// SSLEnv returns the libpq environment variables for the configured TLS options
+func (p *PostgresConfig) SSLEnv() map[string]string {
+	return sslEnv(p.SSLMode, p.SSLRootCert, p.SSLCert, p.SSLKey)
+}
+
+// IdentityConfig guards against dumping the wrong cluster, e.g. after a DNS change
+type IdentityConfig struct {
+	SystemIdentifier string            `yaml:"system_identifier,omitempty"` // Expected system_identifier from pg_control_system()
+	DatabaseOIDs     map[string]uint32 `yaml:"database_oids,omitempty"`     // Expected pg_database OID per database name
+	MarkerTable      string            `yaml:"marker_table,omitempty"`      // Table that must exist in every backed up database, e.g. "public.backup_marker"
 }
 
 type S3Config struct {
-	Endpoint        string `yaml:"endpoint"`
-	AccessKeyID     string `yaml:"access_key_id"`
-	SecretAccessKey string `yaml:"secret_access_key"`
-	Bucket          string `yaml:"bucket"`
-	Prefix          string `yaml:"prefix"`
-	Region          string `yaml:"region"`
+	Endpoint        string        `yaml:"endpoint"`
+	AccessKeyID     string        `yaml:"access_key_id"`
+	SecretAccessKey string        `yaml:"secret_access_key"`
+	Bucket          string        `yaml:"bucket"`
+	Prefix          string        `yaml:"prefix"`
+	Region          string        `yaml:"region"`
+	ListCacheTTL    time.Duration `yaml:"list_cache_ttl"`  // Reuse bucket listings for this long (0 = always list)
+	ListRateLimit   float64       `yaml:"list_rate_limit"` // Max ListObjects page requests per second (0 = unlimited)
 }
 
 type BackupConfig struct {
-	TempDir        string          `yaml:"temp_dir"`
-	RetentionCount int             `yaml:"retention_count"`
-	CompressionLvl int             `yaml:"compression_level"`
+	Mode           string            `yaml:"mode"`   // Where pg_dump runs: "ssh" (default, on the SSH host), "docker" (in a container there), "kubernetes" (in a pod) or "direct" (on this machine)
+	Docker         *DockerConfig     `yaml:"docker"` // Container settings for mode "docker"
+	Kubernetes     *KubernetesConfig `yaml:"kubernetes"` // Pod settings for mode "kubernetes"
+	Direct         *DirectConfig     `yaml:"direct"`     // Connection settings for mode "direct"
+	TempDir        string            `yaml:"temp_dir"`
+	RetentionCount int               `yaml:"retention_count"`
+	CompressionLvl int               `yaml:"compression_level"`
+	Compression    string            `yaml:"compression"` // "builtin" (pg_dump zlib), "zstd", "gzip", "lz4" or "none"
+	SkipDiskCheck  bool              `yaml:"skip_disk_check"`  // Skip the free disk space preflight before dumping
+	DiskSpaceRatio float64           `yaml:"disk_space_ratio"` // Expected dump size as a fraction of pg_database_size
+	Parallelism    int               `yaml:"parallelism"`      // Number of databases backed up concurrently
+	Lock           LockConfig        `yaml:"lock"`
+	Snapshot       string            `yaml:"snapshot"`        // Externally exported snapshot ID passed to pg_dump --snapshot
+	ExportSnapshot bool              `yaml:"export_snapshot"` // Export a snapshot, log its ID and dump from it
+	SnapshotFile   string            `yaml:"snapshot_file"`   // Optional local file the exported snapshot ID is written to
+	Verify         *VerifyConfig     `yaml:"verify"`          // Optional: restore each new dump into a scratch database
+	Standby        *StandbyConfig    `yaml:"standby"`         // Optional: refresh a reporting database from every successful backup
+	Throttle       *ThrottleConfig   `yaml:"throttle"`        // Optional: hold off the dump while the source server is busy
+	Trend          *TrendConfig      `yaml:"trend"`           // Optional: warn when a backup's size or duration strays from recent runs
+	RetentionAlerts *RetentionAlertConfig `yaml:"retention_alerts"` // Optional: notify about cleanups that failed or look wrong
+	SchemaOnlyTables []string        `yaml:"schema_only_tables,omitempty"` // Tables (pg_dump patterns) dumped without their data
+	Privileges     bool              `yaml:"privileges"`      // Dump grants (GRANT/REVOKE), left out by default; restore them with restore.keep_privileges
+	Globals        bool              `yaml:"globals"`         // Also store roles and tablespaces (pg_dumpall --globals-only, no passwords) with each backup
+	IntegrityCheck string            `yaml:"integrity_check"` // Read the dump's TOC with pg_restore --list: "remote", "local" or "" (off)
+	Report         ReportConfig      `yaml:"report"`
+	Retry          RetryConfig       `yaml:"retry"`
+	StateDir       string            `yaml:"state_dir"` // Directory for the run state used by -resume (default: lock.dir)
+	Schedule       *ScheduleConfig   `yaml:"schedule"` // Deprecated: moved to scheduler.backup on load
+	Schedules      []BackupJob       `yaml:"schedules,omitempty"` // Additional scheduled backups of some databases, each with its own schedule and retention
+	Env            map[string]string `yaml:"env,omitempty"` // Environment variables exported to remote commands and notifications
+	Overrides      map[string]*DatabaseOverride `yaml:"overrides,omitempty"` // Per-database settings, keyed by a name from postgres.databases
+	Labels         []string          `yaml:"labels,omitempty"`      // Labels stored in the metadata of every backup, e.g. "nightly"
+	KeepLabels     []string          `yaml:"keep_labels,omitempty"` // Backups with any of these labels are never deleted by retention
+}
+
+var labelRegex = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// ValidLabel reports whether label can tag a backup: 1-64 letters, digits, '.', '_' or '-'
+func ValidLabel(label string) bool {
+	return labelRegex.MatchString(label)
+}
+
+// DatabaseOverride replaces backup settings for one database of postgres.databases; unset
+// fields keep the backup section's value
+type DatabaseOverride struct {
+	Compression    string          `yaml:"compression"`       // Algorithm, as backup.compression
+	CompressionLvl *int            `yaml:"compression_level"` // Level for the algorithm (default: backup.compression_level if valid for it)
+	RetentionCount int             `yaml:"retention_count"`   // Backups of this database kept by retention
+	Prefix         string          `yaml:"prefix"`            // Key prefix below s3.prefix for this database's backups
+	Schedule       *ScheduleConfig `yaml:"schedule"`          // Own schedule; the database is then left out of scheduler.backup runs
+}
+
+// BackupJob is a scheduled backup of some databases of postgres.databases, configured under
+// backup.schedules. Its databases are left out of scheduler.backup runs.
+type BackupJob struct {
+	Name           string          `yaml:"name"`            // Names the task in logs and notifications, e.g. "critical-hourly"
+	Databases      []string        `yaml:"databases"`       // Databases backed up by each run
 	Schedule       *ScheduleConfig `yaml:"schedule"`
+	RetentionCount int             `yaml:"retention_count"` // Backups kept per database of the job (default: backup.retention_count)
+}
+
+// DatabaseSettings are the backup settings of one database with its override applied
+type DatabaseSettings struct {
+	Compression    string
+	CompressionLvl int
+	RetentionCount int
+	Prefix         string          // Below s3.prefix, "" for none
+	Schedule       *ScheduleConfig // scheduler.backup unless overridden
+}
+
+type VerifyConfig struct {
+	Enabled       bool       `yaml:"enabled"`
+	SSH           *SSHConfig `yaml:"ssh"`             // Optional: run the scratch restore on this host (nil = local)
+	TempDir       string     `yaml:"temp_dir"`        // Directory for the dump on the verification host
+	Host          string     `yaml:"host"`            // PostgreSQL server holding the scratch database
+	Port          int        `yaml:"port"`
+	Username      string     `yaml:"username"`
+	Password      string     `yaml:"password"`
+	Jobs          int        `yaml:"jobs"`            // Parallel pg_restore jobs
+	MinTables     int        `yaml:"min_tables"`      // Fail if fewer tables were restored (default: 1, negative disables)
+	MinRows       int64      `yaml:"min_rows"`        // Fail if fewer rows were restored in total
+	KeepOnFailure bool       `yaml:"keep_on_failure"` // Keep the scratch database for inspection when verification fails
+	Checks        []VerifyCheck `yaml:"checks,omitempty"` // Queries that must return the expected value in the scratch database
+}
+
+// VerifyCheck is an application-defined assertion about a restored database
+type VerifyCheck struct {
+	Name     string `yaml:"name"`
+	Database string `yaml:"database"` // Only run for backups of this database (default: all)
+	Query    string `yaml:"query"`    // Must return a single value, e.g. SELECT count(*) > 1000 FROM orders
+	Expect   string `yaml:"expect"`   // Expected value as printed by psql -t -A (default: "t")
+}
+
+// DockerConfig runs the PostgreSQL client tools inside a container on the SSH host, for
+// servers where PostgreSQL only exists in a container
+type DockerConfig struct {
+	Container string `yaml:"container"` // Container name or ID
+	User      string `yaml:"user"`      // Optional: user to run the tools as (docker exec -u)
+	Command   string `yaml:"command"`   // Container CLI (default "docker"), e.g. "sudo docker" or "podman"
+}
+
+// KubernetesConfig runs the PostgreSQL client tools in a pod with kubectl exec and streams the
+// dump to this machine, for clusters without SSH access to the nodes
+type KubernetesConfig struct {
+	Namespace  string `yaml:"namespace"`  // Default: "default"
+	Pod        string `yaml:"pod"`        // Pod name
+	Selector   string `yaml:"selector"`   // Or a label selector; the first running pod is used
+	Container  string `yaml:"container"`  // Optional: container within the pod
+	Context    string `yaml:"context"`    // Optional: kubeconfig context
+	Kubeconfig string `yaml:"kubeconfig"` // Optional: kubeconfig path (default: kubectl's own lookup)
+	Command    string `yaml:"command"`    // kubectl binary (default "kubectl")
+}
+
+// DirectConfig runs pg_dump on this machine against postgres.host and postgres.port, for servers
+// that forbid shell access but expose the PostgreSQL port
+type DirectConfig struct {
+	Tunnel    bool `yaml:"tunnel"`     // Reach postgres.host:port through an SSH port forward to the ssh host
+	LocalPort int  `yaml:"local_port"` // Local end of the tunnel (default: any free port)
+}
+
+// Tunneled reports whether direct mode reaches the database through an SSH tunnel
+func (b *BackupConfig) Tunneled() bool {
+	return b.Mode == "direct" && b.Direct != nil && b.Direct.Tunnel
+}
+
+// Tunneled reports whether a direct restore reaches the target through an SSH tunnel
+func (r *RestoreConfig) Tunneled() bool {
+	return r.Direct != nil && r.Direct.Tunnel
+}
+
+// StandbyConfig describes a reporting server whose database is replaced with every new backup
+type StandbyConfig struct {
+	Enabled  bool       `yaml:"enabled"`
+	SSH      *SSHConfig `yaml:"ssh"`      // Optional: run the restore on this host (nil = local)
+	TempDir  string     `yaml:"temp_dir"` // Directory for the dump on the standby host
+	Host     string     `yaml:"host"`     // PostgreSQL server holding the standby database
+	Port     int        `yaml:"port"`
+	Username string     `yaml:"username"`
+	Password string     `yaml:"password"`
+	Database string     `yaml:"database"` // Database to overwrite (default: the backed up database's name)
+	Jobs     int        `yaml:"jobs"`     // Parallel pg_restore jobs
+}
+
+// ThrottleConfig holds thresholds checked before the dump starts. A zero threshold is not checked.
+type ThrottleConfig struct {
+	MaxActiveConnections int           `yaml:"max_active_connections"` // Active backends in pg_stat_activity
+	MaxReplicationLag    time.Duration `yaml:"max_replication_lag"`    // Replay lag of the slowest standby, or of this server if it is a standby
+	Action               string        `yaml:"action"`                 // "wait" (default) until load drops, or "abort"
+	CheckInterval        time.Duration `yaml:"check_interval"`         // Time between checks while waiting (default: 1m)
+	MaxWait              time.Duration `yaml:"max_wait"`               // Abort after waiting this long (default: 30m)
+}
+
+// TrendConfig compares each backup with the average of the database's recent successful runs,
+// since a dump far smaller than usual usually means something is wrong. Deviations are sent as
+// a backup_warning notification. All thresholds, including max_duration and max_size_change,
+// need enabled; setting them without it is a configuration error.
+type TrendConfig struct {
+	Enabled       bool          `yaml:"enabled"`
+	Window        int           `yaml:"window"`          // Recent runs averaged (default: 10)
+	MinRuns       int           `yaml:"min_runs"`        // Runs recorded before comparing (default: 3)
+	MaxDeviation  float64       `yaml:"max_deviation"`   // Allowed deviation from the average in percent (default: 50)
+	MaxDuration   time.Duration `yaml:"max_duration"`    // Optional: warn when a backup takes longer than this
+	MaxSizeChange float64       `yaml:"max_size_change"` // Optional: warn when the dump size changes more than this percentage from the previous run
+}
+
+// RetentionAlertConfig notifies about retention cleanups that failed, even partially, deleted
+// more backups than expected, or left a database with fewer backups than its retention count
+// and than the previous cleanup, e.g. after objects were deleted by hand
+type RetentionAlertConfig struct {
+	Enabled      bool `yaml:"enabled"`
+	MaxDeletions int  `yaml:"max_deletions"` // Warn when a cleanup deletes more backups than this (0 = no limit)
+}
+
+type LockConfig struct {
+	Dir        string        `yaml:"dir"`         // Directory for local lock files (default: system temp dir)
+	S3         bool          `yaml:"s3"`          // Also hold a lock object in S3 to exclude runs on other hosts
+	StaleAfter time.Duration `yaml:"stale_after"` // Age after which an S3 lock left by a crashed run is taken over
+}
+
+// RetryConfig holds the retry policy of each retryable backup stage
+type RetryConfig struct {
+	SSHConnection RetryPolicy `yaml:"ssh_connection"`
+	Dump          RetryPolicy `yaml:"dump"`
+	Transfer      RetryPolicy `yaml:"transfer"`
+	Upload        RetryPolicy `yaml:"upload"`
+}
+
+type RetryPolicy struct {
+	Attempts       int           `yaml:"attempts"`        // Total attempts including the first (default: 1, no retries)
+	InitialBackoff time.Duration `yaml:"initial_backoff"` // Wait before the first retry, doubled after each attempt (default: 10s)
+	MaxBackoff     time.Duration `yaml:"max_backoff"`     // Upper bound for the wait between attempts (default: 5m)
+	MaxElapsed     time.Duration `yaml:"max_elapsed"`     // Stop retrying once this much time has passed (0 = no limit)
+}
+
+type ReportConfig struct {
+	Path   string `yaml:"path"`   // Write a JSON report of each run to this file (overwritten every run)
+	Stdout bool   `yaml:"stdout"` // Also print the report as a single JSON line on stdout
 }
 
+// TimeoutConfig limits each stage of a backup separately, so a timeout names the stage that was
+// slow. Stage limits cover all retries of the stage.
 type TimeoutConfig struct {
 	SSHConnection time.Duration `yaml:"ssh_connection"`
-	BackupOp      time.Duration `yaml:"backup_operation"`
-	Transfer      time.Duration `yaml:"transfer"`
-	S3Upload      time.Duration `yaml:"s3_upload"`
+	BackupOp      time.Duration `yaml:"backup_operation"` // pg_restore of restores and standby refreshes; default for dump and verify
+	Dump          time.Duration `yaml:"dump"`             // Dump stage of one database, including a remote integrity check
+	Transfer      time.Duration `yaml:"transfer"`         // Transfer stage, including a local integrity check
+	S3Upload      time.Duration `yaml:"s3_upload"`        // Upload stage
+	Verify        time.Duration `yaml:"verify"`           // Scratch restore and checks of backup.verify
+	Total         time.Duration `yaml:"total"`            // Budget of a whole backup run (0 = only the stage limits)
 }
 
 type RestoreConfig struct {
 	Enabled          bool            `yaml:"enabled"`
 	UseSSH           *bool           `yaml:"use_ssh"`        // Optional: explicitly enable/disable SSH (nil = auto, true = use SSH, false = local)
-	AutoInstall      bool            `yaml:"auto_install"`   // Auto-install PostgreSQL client if missing (local restore only)
+	Direct           *DirectConfig   `yaml:"direct,omitempty"` // Optional: run pg_restore on this machine against target_host, optionally through an SSH tunnel
+	AutoInstall      bool            `yaml:"auto_install"`   // Auto-install PostgreSQL client if missing (local restore, or also over SSH with auto_install_ssh)
+	AutoInstallSSH   bool            `yaml:"auto_install_ssh"` // Let auto_install install packages on the SSH restore host as well
+	PgBinDir         string          `yaml:"pg_bin_dir,omitempty"` // Directory of the pg_restore and psql to use on the restore host, instead of the newest installed pg_restore
 	SSH              *SSHConfig      `yaml:"ssh"`           // Optional SSH settings for restore target
 	TargetHost       string          `yaml:"target_host"`
+	TargetSocket     bool            `yaml:"target_socket"` // Connect through the Unix socket of a server on the restore host, e.g. with peer authentication; target_host optionally names the socket directory
 	TargetPort       int             `yaml:"target_port"`
 	TargetDatabase   string          `yaml:"target_database"`
+	TargetDatabaseTemplate string    `yaml:"target_database_template,omitempty"` // Restore into a new database named by this template, e.g. {{.Source}}_restore_{{.Timestamp}}
 	TargetUsername   string          `yaml:"target_username"`
 	TargetPassword   string          `yaml:"target_password"`
+	TargetSSLMode     string         `yaml:"target_sslmode,omitempty"`     // Defaults to postgres.sslmode
+	TargetSSLRootCert string         `yaml:"target_sslrootcert,omitempty"` // Defaults to postgres.sslrootcert
+	TargetSSLCert     string         `yaml:"target_sslcert,omitempty"`     // Defaults to postgres.sslcert
+	TargetSSLKey      string         `yaml:"target_sslkey,omitempty"`      // Defaults to postgres.sslkey
 	DropExisting     bool            `yaml:"drop_existing"`
 	ForceDisconnect  bool            `yaml:"force_disconnect"` // Force disconnect existing connections when dropping database
 	CreateDB         bool            `yaml:"create_db"`
 	Owner            string          `yaml:"owner"`
+	KeepOwner        bool            `yaml:"keep_owner"`       // Keep the original object owners (omit pg_restore --no-owner); the roles must exist on the target
+	KeepPrivileges   bool            `yaml:"keep_privileges"`  // Keep the dumped grants (omit --no-privileges); needs backup.privileges
+	KeepTablespaces  bool            `yaml:"keep_tablespaces"` // Keep the original tablespaces (omit --no-tablespaces); they must exist on the target
 	Jobs             int             `yaml:"jobs"`
-	Schedule         *ScheduleConfig `yaml:"schedule"`
+	Throttle         *RestoreThrottleConfig `yaml:"throttle,omitempty"` // Optional: limit the load the restore puts on a shared target server
+	Parallelism      int             `yaml:"parallelism"` // Databases restored concurrently by -restore -databases (default: 1)
+	DownloadConcurrency int          `yaml:"download_concurrency"` // Parts of the dump downloaded at once when pg_restore runs on this machine (default: 4)
+	SkipPreflight    bool            `yaml:"skip_preflight"`     // Skip the disk space, connection and server version checks before anything is restored
+	DiskSpaceRatio   float64         `yaml:"disk_space_ratio"`   // Expected restored database size as a multiple of the dump size (default: 3)
+	AllowOlderTarget bool            `yaml:"allow_older_target"` // Restore into a server older than the source instead of failing the preflight
+	SingleTransaction bool           `yaml:"single_transaction"` // Restore in one transaction, so a failed restore leaves nothing behind; requires jobs: 1
+	OnFailure        string          `yaml:"on_failure"` // What happens to a database drop_existing or create_db replaced when pg_restore fails: "keep" (default), "drop" or "rename" to <db>_failed_<timestamp>
+	Schedule         *ScheduleConfig `yaml:"schedule"` // Deprecated: moved to scheduler.restore on load
 	BackupKey        string          `yaml:"backup_key"` // Specific backup key to restore (optional)
+	RowFilters       []RowFilter     `yaml:"row_filters,omitempty"` // Only restore rows matching these conditions for the listed tables
+	Schemas          []string        `yaml:"schemas,omitempty"`     // Only restore the objects of these schemas
+	Tables           []string        `yaml:"tables,omitempty"`      // Only restore these tables (schema.table, or table for public) with their constraints and triggers
+	MaskingRules     string          `yaml:"masking_rules,omitempty"` // Rules file masking columns of the restored data, e.g. for staging copies of production
+	PostSQL          []PostSQL       `yaml:"post_sql,omitempty"`   // SQL run in the restored database after a successful restore, in order
+	PostHooks        []string        `yaml:"post_hooks,omitempty"`  // Shell commands run after post_sql, where pg_restore runs, with PGHOST/PGPORT/PGUSER/PGDATABASE of the target
+	Verify           *RestoreVerifyConfig `yaml:"verify,omitempty"` // Optional: checks the restored database must pass, or the restore fails
+	RestoreGlobals   bool            `yaml:"restore_globals"` // Replay the roles stored with the backup (backup.globals) before pg_restore
+	Drill            *DrillConfig    `yaml:"drill,omitempty"`         // Optional: run scheduled restores as restore drills
+	Env              map[string]string `yaml:"env,omitempty"` // Environment variables exported to restore commands and notifications
+	Production       bool            `yaml:"production"` // The target holds production data; restores count against safety.max_production_restores_per_day
+}
+
+// RestoreThrottleConfig limits the impact of a long restore on a target server other
+// databases share
+type RestoreThrottleConfig struct {
+	Settings     map[string]string `yaml:"settings,omitempty"`      // Server settings of the restore sessions, e.g. maintenance_work_mem: 256MB, passed as PGOPTIONS
+	PauseWindows []PauseWindow     `yaml:"pause_windows,omitempty"` // Times of day the restore is suspended, e.g. the target's business hours
+}
+
+// PauseWindow is a daily time range in local time. End before start wraps past midnight.
+type PauseWindow struct {
+	Start string `yaml:"start"` // HH:MM
+	End   string `yaml:"end"`   // HH:MM
+}
+
+// Contains reports whether t falls into the window
+func (w PauseWindow) Contains(t time.Time) bool {
+	start, _ := time.Parse("15:04", w.Start)
+	end, _ := time.Parse("15:04", w.End)
+	minute := t.Hour()*60 + t.Minute()
+	from := start.Hour()*60 + start.Minute()
+	to := end.Hour()*60 + end.Minute()
+	if from <= to {
+		return minute >= from && minute < to
+	}
+	return minute >= from || minute < to
+}
+
+// PGOptions renders the throttle settings as a PGOPTIONS value, sorted so it is stable
+func (t *RestoreThrottleConfig) PGOptions() string {
+	if t == nil || len(t.Settings) == 0 {
+		return ""
+	}
+	settings := make([]string, 0, len(t.Settings))
+	for setting := range t.Settings {
+		settings = append(settings, setting)
+	}
+	slices.Sort(settings)
+
+	var options []string
+	for _, setting := range settings {
+		// libpq splits PGOPTIONS at unescaped spaces
+		value := strings.NewReplacer(`\`, `\\`, " ", `\ `).Replace(t.Settings[setting])
+		options = append(options, "-c "+setting+"="+value)
+	}
+	return strings.Join(options, " ")
+}
+
+// SSLEnv returns the libpq environment variables for the target's TLS options
+func (r *RestoreConfig) SSLEnv() map[string]string {
+	return sslEnv(r.TargetSSLMode, r.TargetSSLRootCert, r.TargetSSLCert, r.TargetSSLKey)
+}
+
+// DrillConfig turns scheduled restores into restore drills: the backup is restored into a
+// scratch database on the restore target, validated, recorded and dropped again
+type DrillConfig struct {
+	Enabled       bool          `yaml:"enabled"`
+	MinTables     int           `yaml:"min_tables"`           // Fail if fewer tables were restored (default: 1, negative disables)
+	MinRows       int64         `yaml:"min_rows"`             // Fail if fewer rows were restored in total
+	KeyTables     []string      `yaml:"key_tables,omitempty"` // Tables whose row count and checksum are recorded (schema.table, or table for public)
+	Checks        []VerifyCheck `yaml:"checks,omitempty"`     // Queries that must return the expected value in the scratch database
+	KeepOnFailure bool          `yaml:"keep_on_failure"`      // Keep the scratch database for inspection when the drill fails
+	Report        ReportConfig  `yaml:"report"`               // Machine-readable outcome of each drill
+}
+
+// RestoreVerifyConfig lists the checks a restored database must pass. All of them run, so the
+// failure names every check that failed.
+type RestoreVerifyConfig struct {
+	MinTables map[string]int   `yaml:"min_tables,omitempty"` // Minimum number of tables per schema, e.g. public: 20
+	MinRows   map[string]int64 `yaml:"min_rows,omitempty"`   // Minimum row count per table (schema.table, or table for public)
+	Checks    []VerifyCheck    `yaml:"checks,omitempty"`     // Queries that must return the expected value in the restored database
+}
+
+// PostSQL is one step of restore.post_sql: a file or inline statements
+type PostSQL struct {
+	File string `yaml:"file,omitempty"` // SQL file on this machine
+	SQL  string `yaml:"sql,omitempty"`  // Inline statements
 }
 
+// Load returns the statements of the step, reading its file if it has one
+func (p PostSQL) Load() (string, error) {
+	if p.File == "" {
+		return p.SQL, nil
+	}
+	data, err := os.ReadFile(p.File)
+	if err != nil {
+		return "", fmt.Errorf("failed to read post_sql file: %w", err)
+	}
+	return string(data), nil
+}
+
+// Name identifies the step in logs and errors
+func (p PostSQL) Name() string {
+	if p.File != "" {
+		return p.File
+	}
+	return "inline SQL"
+}
+
+// RowFilter restricts the rows of one table restored from a backup
+type RowFilter struct {
+	Table string `yaml:"table"` // schema.table, or table for the public schema
+	Where string `yaml:"where"` // SQL condition applied with COPY ... FROM stdin WHERE (PostgreSQL 12+)
+}
+
+// Schema returns the schema and table name of the filtered table
+func (f RowFilter) Schema() (string, string) {
+	return SplitTableName(f.Table)
+}
+
+// SplitTableName splits schema.table into its parts; names without a schema are in public
+func SplitTableName(name string) (string, string) {
+	if schema, table, ok := strings.Cut(name, "."); ok {
+		return schema, table
+	}
+	return "public", name
+}
+
+// TargetDatabaseData is what target_database_template can refer to
+type TargetDatabaseData struct {
+	Source    string // Database the backup was taken from
+	Timestamp string // Start of the restore, UTC, e.g. 20240601_120000
+	Date      string // Day of the restore, UTC, e.g. 20240601
+}
+
+// RenderTargetDatabase names the database a restore of source started at now goes into
+func (r *RestoreConfig) RenderTargetDatabase(source string, now time.Time) (string, error) {
+	tmpl, err := template.New("target_database_template").Option("missingkey=error").Parse(r.TargetDatabaseTemplate)
+	if err != nil {
+		return "", fmt.Errorf("restore target_database_template: %w", err)
+	}
+	var name strings.Builder
+	err = tmpl.Execute(&name, TargetDatabaseData{
+		Source:    source,
+		Timestamp: now.UTC().Format("20060102_150405"),
+		Date:      now.UTC().Format("20060102"),
+	})
+	if err != nil {
+		return "", fmt.Errorf("restore target_database_template: %w", err)
+	}
+	// PostgreSQL truncates longer names, which would make two restores collide
+	if name.Len() == 0 || name.Len() > 63 || strings.ContainsAny(name.String(), " \t\n'\"") {
+		return "", fmt.Errorf("restore target_database_template: %q is not a usable database name", name.String())
+	}
+	return name.String(), nil
+}
+
+// Selective reports whether the restore is limited to some schemas or tables
+func (r *RestoreConfig) Selective() bool {
+	return len(r.Schemas) > 0 || len(r.Tables) > 0
+}
+
+// SetJobs replaces the parallel pg_restore jobs, as given on the command line
+func (r *RestoreConfig) SetJobs(jobs int) error {
+	if jobs < 1 || jobs > 8 {
+		return fmt.Errorf("jobs must be between 1 and 8, got %d", jobs)
+	}
+	if jobs > 1 && r.SingleTransaction {
+		return fmt.Errorf("jobs %d can't be combined with restore single_transaction", jobs)
+	}
+	r.Jobs = jobs
+	return nil
+}
+
+// SetTables replaces the tables to restore with a comma-separated list, as given on the command line
+func (r *RestoreConfig) SetTables(list string) error {
+	r.Tables = nil
+	for _, table := range strings.Split(list, ",") {
+		if table = strings.TrimSpace(table); table != "" {
+			r.Tables = append(r.Tables, table)
+		}
+	}
+	return validateSelection(r)
+}
+
+// NotificationConfig sends events to channels. Without routes every channel gets every event;
+// with routes an event goes to the channels of the routes it matches. webhook_url, slack,
+// discord, teams, google_chat, ntfy, gotify, pagerduty and opsgenie directly below
+// notification are shorthand for a channel of that type named after it.
 type NotificationConfig struct {
-	Enabled    bool              `yaml:"enabled"`
-	WebhookURL string            `yaml:"webhook_url"`
-	Headers    map[string]string `yaml:"headers,omitempty"`
+	Enabled       bool                      `yaml:"enabled"`
+	Channels      []NotificationChannel     `yaml:"channels,omitempty"`
+	Routes        []NotificationRoute       `yaml:"routes,omitempty"`
+	Retry         *NotificationRetryConfig  `yaml:"retry,omitempty"`  // Optional: queue failed deliveries on disk and retry them from the scheduler
+	Attach        *NotificationAttachConfig `yaml:"attach,omitempty"` // Optional: add the end of the run log and a link to the run report to failures
+	WebhookURL    string                    `yaml:"webhook_url"`      // Receives every event as JSON (optional when another channel is set)
+	Headers       map[string]string         `yaml:"headers,omitempty"`
+	SigningSecret string                    `yaml:"signing_secret,omitempty"` // Optional: sign webhook_url requests with HMAC-SHA256 so receivers can verify them
+	BodyTemplate  string                    `yaml:"body_template,omitempty"`  // Optional: send this template, rendered, to webhook_url instead of the JSON payload
+	Slack         *ChatConfig               `yaml:"slack,omitempty"`          // Optional: post events as formatted messages to a Slack incoming webhook
+	Discord       *ChatConfig               `yaml:"discord,omitempty"`        // Optional: post events as formatted messages to a Discord webhook
+	Teams         *ChatConfig               `yaml:"teams,omitempty"`          // Optional: post events as Adaptive Cards to a Microsoft Teams incoming webhook
+	GoogleChat    *ChatConfig               `yaml:"google_chat,omitempty"`    // Optional: post events as cards to a Google Chat space webhook
+	Ntfy          *NtfyConfig               `yaml:"ntfy,omitempty"`           // Optional: push events to an ntfy topic
+	Gotify        *GotifyConfig             `yaml:"gotify,omitempty"`         // Optional: push events to a Gotify application
+	PagerDuty     *PagerDutyConfig          `yaml:"pagerduty,omitempty"`      // Optional: open PagerDuty incidents on failures and resolve them on the next success
+	Opsgenie      *OpsgenieConfig           `yaml:"opsgenie,omitempty"`       // Optional: open Opsgenie alerts on failures and close them on the next success
+}
+
+// NotificationRetryConfig queues deliveries that failed, e.g. during an outage of the receiver,
+// in backup.state_dir and retries them from the scheduler with exponential backoff. It applies
+// to the notification blocks of schedules as well.
+type NotificationRetryConfig struct {
+	Enabled    bool          `yaml:"enabled"`
+	Backoff    time.Duration `yaml:"backoff"`     // Wait before the first retry, doubled after each failed one (default: 1m)
+	MaxBackoff time.Duration `yaml:"max_backoff"` // Longest wait between retries (default: 1h)
+	MaxAge     time.Duration `yaml:"max_age"`     // Give up on deliveries still failing this long after the event (default: 24h)
+}
+
+// NotificationAttachConfig adds details of the run to failure notifications, so responders see
+// what went wrong without logging in to the backup host
+type NotificationAttachConfig struct {
+	LogLines  int    `yaml:"log_lines"`  // Last lines of the run log sent along (0 = none, at most 200)
+	ReportURL string `yaml:"report_url"` // Optional: link to the run report, a template of {{.RunID}}, {{.Database}} and {{.Hostname}}
+}
+
+// NotificationChannel is a named destination of notifications; it sets exactly one type
+type NotificationChannel struct {
+	Name       string           `yaml:"name"` // Referenced by routes
+	Webhook    *WebhookConfig   `yaml:"webhook,omitempty"`
+	Slack      *ChatConfig      `yaml:"slack,omitempty"`
+	Discord    *ChatConfig      `yaml:"discord,omitempty"`
+	Teams      *ChatConfig      `yaml:"teams,omitempty"`
+	GoogleChat *ChatConfig      `yaml:"google_chat,omitempty"`
+	Ntfy       *NtfyConfig      `yaml:"ntfy,omitempty"`
+	Gotify     *GotifyConfig    `yaml:"gotify,omitempty"`
+	PagerDuty  *PagerDutyConfig `yaml:"pagerduty,omitempty"`
+	Opsgenie   *OpsgenieConfig  `yaml:"opsgenie,omitempty"`
+}
+
+// WebhookConfig posts every event as JSON to a URL
+type WebhookConfig struct {
+	URL           string            `yaml:"url"`
+	Headers       map[string]string `yaml:"headers,omitempty"`
+	SigningSecret string            `yaml:"signing_secret,omitempty"` // Optional: sign requests with HMAC-SHA256 so receivers can verify them
+	BodyTemplate  string            `yaml:"body_template,omitempty"`  // Optional: send this template, rendered, instead of the JSON payload
+}
+
+// NotificationRoute sends the events it matches to channels. A route matches an event when
+// each of its set conditions does.
+type NotificationRoute struct {
+	Events      []string `yaml:"events,omitempty"`    // Event types, e.g. backup_failure (default: all)
+	MinSeverity string   `yaml:"min_severity"`        // Skip events whose default severity is below: info (default), warning, error or critical
+	Databases   []string `yaml:"databases,omitempty"` // Database name patterns such as prod_* (default: all)
+	Channels    []string `yaml:"channels"`            // Names of the channels to notify
+}
+
+// ChatConfig posts notifications to a chat webhook as messages colored by the event's severity
+type ChatConfig struct {
+	WebhookURL  string            `yaml:"webhook_url"`
+	MinSeverity string            `yaml:"min_severity"`       // Skip events below this severity: info (default), warning, error or critical
+	Severity    map[string]string `yaml:"severity,omitempty"` // Severity per event type, e.g. backup_success: warning, instead of the default
+	Template    *MessageTemplate  `yaml:"template,omitempty"` // Optional: custom title and text of the messages
+}
+
+// MessageTemplate customizes the wording of a channel's messages with Go text/template
+// templates, which see the fields of the event such as {{.Database}}, {{.Error}} or {{.Key}}.
+// Either part may be left out to keep the built-in one.
+type MessageTemplate struct {
+	Title string `yaml:"title,omitempty"` // Replaces the one-line title, e.g. "Backup of {{.Database}} failed"
+	Body  string `yaml:"body,omitempty"`  // Replaces the fields and error details, e.g. with a runbook link
+}
+
+// NtfyConfig publishes notifications to a topic of an ntfy server. The priority follows the
+// event's severity unless set per event type.
+type NtfyConfig struct {
+	URL         string            `yaml:"url"`                // Server (default: https://ntfy.sh)
+	Topic       string            `yaml:"topic"`              // Topic of the events without one in topics
+	Topics      map[string]string `yaml:"topics,omitempty"`   // Topic per event type, e.g. backup_failure: db-alerts
+	Token       string            `yaml:"token,omitempty"`    // Optional: access token of a protected topic
+	MinSeverity string            `yaml:"min_severity"`       // Skip events below this severity: info (default), warning, error or critical
+	Priority    map[string]int    `yaml:"priority,omitempty"` // Priority per event type from 1 (min) to 5 (urgent), instead of the one of its severity
+	Template    *MessageTemplate  `yaml:"template,omitempty"` // Optional: custom title and text of the messages
+}
+
+// GotifyConfig sends notifications to an application of a Gotify server. The priority follows
+// the event's severity unless set per event type.
+type GotifyConfig struct {
+	URL         string           `yaml:"url"`                // Server, e.g. https://gotify.example.com
+	Token       string           `yaml:"token"`              // Token of the application
+	MinSeverity string           `yaml:"min_severity"`       // Skip events below this severity: info (default), warning, error or critical
+	Priority    map[string]int   `yaml:"priority,omitempty"` // Priority per event type from 0 to 10, instead of the one of its severity
+	Template    *MessageTemplate `yaml:"template,omitempty"` // Optional: custom title and text of the messages
+}
+
+// PagerDutyConfig sends backup and restore failures to the PagerDuty Events API v2. Failures of
+// the same job and database share an incident, which the next success resolves.
+type PagerDutyConfig struct {
+	RoutingKey  string           `yaml:"routing_key"`        // Integration key of an Events API v2 integration
+	Severity    string           `yaml:"severity"`           // Severity of the incidents: critical, error (default), warning or info
+	DedupPrefix string           `yaml:"dedup_prefix"`       // Start of the dedup keys (default: "pg_backup"); set one per instance when several back up databases of the same name
+	URL         string           `yaml:"url"`                // Events API endpoint (default: https://events.pagerduty.com/v2/enqueue; EU accounts: https://events.eu.pagerduty.com/v2/enqueue)
+	Template    *MessageTemplate `yaml:"template,omitempty"` // Optional: title is the incident summary; body isn't used
+}
+
+// OpsgenieConfig sends backup and restore failures to Opsgenie as alerts. Failures of the same
+// job and database share an alert, which the next success closes.
+type OpsgenieConfig struct {
+	APIKey      string           `yaml:"api_key"`            // Key of an API integration
+	Priority    string           `yaml:"priority"`           // P1 to P5 (default: P3)
+	Tags        []string         `yaml:"tags,omitempty"`     // Added to every alert along with "pg_backup"
+	DedupPrefix string           `yaml:"dedup_prefix"`       // Start of the alert aliases (default: "pg_backup"), see PagerDutyConfig
+	APIURL      string           `yaml:"api_url"`            // Default: https://api.opsgenie.com; EU accounts: https://api.eu.opsgenie.com
+	Template    *MessageTemplate `yaml:"template,omitempty"` // Optional: title is the alert message, body its description
+}
+
+// notificationEvents are the event types of package notification
+var notificationEvents = []string{
+	"backup_success", "backup_failure", "backup_warning", "restore_success", "restore_failure",
+	"restore_drill_success", "cleanup_warning", "cleanup_failure", "run_skipped", "run_missed",
+	"startup_check_failed",
 }
 
+// Severities orders the severities of notification events, least severe first
+var Severities = []string{"info", "warning", "error", "critical"}
+
 type LogConfig struct {
 	FilePath       string `yaml:"file_path"`        // Path to log file (empty = stdout)
 	MaxSize        int    `yaml:"max_size"`         // Max size in MB before rotation
@@ -95,15 +667,183 @@ type LogConfig struct {
 	RotationMinute int    `yaml:"rotation_minute"`  // Minute to rotate (0-59, for hourly/daily/weekly rotation)
 }
 
+type IncidentConfig struct {
+	UploadLogs bool   `yaml:"upload_logs"` // Upload the run log and command outputs to S3 when a job fails
+	Prefix     string `yaml:"prefix"`      // Key prefix below the S3 prefix (default: "incidents")
+}
+
+// TriggerConfig enables the HTTP endpoint that starts backups, restores and cleanups on demand
+// in scheduled mode
+type TriggerConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Listen  string `yaml:"listen"`   // Address to listen on (default: ":8080")
+	Token   string `yaml:"token"`    // Bearer token callers must send
+	TLSCert string `yaml:"tls_cert"` // Optional: certificate file (PEM) to serve HTTPS with, including intermediates
+	TLSKey  string `yaml:"tls_key"`  // Private key file (PEM) of tls_cert
+}
+
+// SafetyConfig caps destructive operations as a last line of defense against runaway automation
+// or a tampered config. -override-limits lifts the caps for one invocation.
+type SafetyConfig struct {
+	MaxProductionRestoresPerDay int  `yaml:"max_production_restores_per_day"` // Restores into a restore.production target within 24 hours (0 = unlimited)
+	MaxDeletionsPerCleanup      int  `yaml:"max_deletions_per_cleanup"`       // Backups a single retention run may delete (0 = unlimited)
+	Override                    bool `yaml:"-"`                               // Set by -override-limits
+}
+
+// DeletionLimit returns the number of backups a retention run may delete, 0 for unlimited
+func (s *SafetyConfig) DeletionLimit() int {
+	if s.Override {
+		return 0
+	}
+	return s.MaxDeletionsPerCleanup
+}
+
+// ExporterConfig runs a command for each backup and restore run that receives the run's events
+// as JSON lines on stdin, to feed monitoring backends pg_backup doesn't support itself
+type ExporterConfig struct {
+	Name     string `yaml:"name"`     // Used in logs (default: "exporter-<n>")
+	Command  string `yaml:"command"`  // Run with sh -c on the machine running pg_backup
+	Progress bool   `yaml:"progress"` // Also send progress events (transfer, upload, download)
+}
+
 type ScheduleConfig struct {
 	Enabled    bool   `yaml:"enabled"`      // Enable scheduled task
 	Type       string `yaml:"type"`         // Schedule type: "cron", "interval", "daily", "weekly", "monthly"
-	Expression string `yaml:"expression"`   // Schedule expression based on type
+	Expression string `yaml:"expression"`   // Schedule expression based on type; cron takes 5 fields, or 6 with leading seconds
+	Align      bool   `yaml:"align"`        // Interval schedules only: run on clock boundaries, e.g. 6h at 00, 06, 12 and 18:00, instead of relative to the start
+	Timezone   string `yaml:"timezone,omitempty"` // IANA time zone of cron, daily, weekly and monthly times, e.g. Europe/Berlin (default: the process's local zone)
 	RunOnStart bool   `yaml:"run_on_start"` // Run task immediately when scheduler starts
+	Overlap    string `yaml:"overlap"`      // When the previous run is still going: "reschedule" (default), "wait" (queue), "skip" (reschedule and notify) or "cancel" the previous run
+	MaxRuntime time.Duration `yaml:"max_runtime"` // Cancel a run still going after this long (0 = no limit)
+	Misfire    string `yaml:"misfire"`      // When a run was due while the scheduler was down: "skip" (default, log it), "run" once at startup, or "alert" (log and notify)
+	Jitter     time.Duration    `yaml:"jitter"`              // Random delay up to this long before each run, so many instances don't start at once
+	Blackouts  []BlackoutWindow `yaml:"blackouts,omitempty"` // Times during which scheduled runs are skipped
+	ExcludeDates []string       `yaml:"exclude_dates,omitempty"` // Days without scheduled runs: 2024-12-24, 2024-12-20..2025-01-06, or 12-24 and 12-24..01-02 every year
+	Then       []string         `yaml:"then,omitempty"`      // Backup schedules only: tasks run in order after each successful run, "cleanup" and/or "restore"
+	Notification *NotificationConfig `yaml:"notification,omitempty"` // Where the notifications of this task's runs go, instead of the notification section
+}
+
+// BlackoutWindow is a time during which scheduled runs are skipped, in the schedule's time zone.
+// Unset fields match every day or the whole day.
+type BlackoutWindow struct {
+	Name     string   `yaml:"name"`     // Shown in logs, e.g. "month-end close"
+	Weekdays []string `yaml:"weekdays"` // e.g. ["Sat", "Sun"]
+	Days     []int    `yaml:"days"`     // Days of the month; negative days count from the end, -1 is the last day
+	Start    string   `yaml:"start"`    // HH:MM (default: 00:00)
+	End      string   `yaml:"end"`      // HH:MM, after start (default: end of the day)
+}
+
+// Contains reports whether t falls into the window
+func (w BlackoutWindow) Contains(t time.Time) bool {
+	if len(w.Weekdays) > 0 && !slices.ContainsFunc(w.Weekdays, func(day string) bool {
+		return strings.EqualFold(day[:3], t.Weekday().String()[:3])
+	}) {
+		return false
+	}
+	if len(w.Days) > 0 {
+		lastDay := time.Date(t.Year(), t.Month()+1, 0, 0, 0, 0, 0, t.Location()).Day()
+		if !slices.ContainsFunc(w.Days, func(day int) bool {
+			return day == t.Day() || day < 0 && lastDay+day+1 == t.Day()
+		}) {
+			return false
+		}
+	}
+	minute := t.Hour()*60 + t.Minute()
+	if w.Start != "" {
+		start, _ := time.Parse("15:04", w.Start)
+		if minute < start.Hour()*60+start.Minute() {
+			return false
+		}
+	}
+	if w.End != "" {
+		end, _ := time.Parse("15:04", w.End)
+		if minute >= end.Hour()*60+end.Minute() {
+			return false
+		}
+	}
+	return true
+}
+
+// ExcludedOn returns the exclude_dates entry covering the day of t in the schedule's time zone
+func (s *ScheduleConfig) ExcludedOn(t time.Time) (string, bool) {
+	t = t.In(s.Location())
+	for _, entry := range s.ExcludeDates {
+		if dateRangeContains(entry, t) {
+			return entry, true
+		}
+	}
+	return "", false
+}
+
+// dateRangeContains reports whether the day of t falls into an exclude_dates entry. Dates
+// without a year repeat every year, and their ranges may wrap into January.
+func dateRangeContains(entry string, t time.Time) bool {
+	from, to, isRange := strings.Cut(entry, "..")
+	if !isRange {
+		to = from
+	}
+	// Zero-padded dates compare like their strings
+	day := t.Format("2006-01-02")
+	if len(from) == len("01-02") {
+		day = t.Format("01-02")
+		if from > to {
+			return day >= from || day <= to
+		}
+	}
+	return day >= from && day <= to
+}
+
+// Location returns the time zone the schedule's times are evaluated in
+func (s *ScheduleConfig) Location() *time.Location {
+	if s.Timezone == "" {
+		return time.Local
+	}
+	// Validated on load
+	location, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return time.Local
+	}
+	return location
 }
 
 type CleanupConfig struct {
-	Schedule *ScheduleConfig `yaml:"schedule"`
+	Schedule *ScheduleConfig `yaml:"schedule"` // Deprecated: moved to scheduler.cleanup on load
+}
+
+// SchedulerConfig holds the schedules of scheduled mode. Unlike the inline schedules of older
+// configs, a schedule here is enabled unless it sets enabled: false.
+type SchedulerConfig struct {
+	Backup  *ScheduleConfig `yaml:"backup"`  // Databases without a schedule in backup.overrides or backup.schedules
+	Restore *ScheduleConfig `yaml:"restore"` // Requires restore.enabled
+	Cleanup *ScheduleConfig `yaml:"cleanup"`
+	HA      *HAConfig       `yaml:"ha"` // Optional: several instances with this config, only one of them runs the schedules
+
+	ShutdownGrace time.Duration `yaml:"shutdown_grace"` // On SIGTERM, let running tasks finish for up to this long before canceling them (0 = cancel right away)
+	StartupCheck  string        `yaml:"startup_check"`  // Check SSH, client tools and bucket of each task on start: "warn" (default, log failures), "alert" (log and notify), "fail" (exit) or "off"
+}
+
+// HAConfig makes schedulers with the same config take turns: the instance holding a lease
+// object in S3 runs the scheduled tasks, the others stand by and take over once it stops
+// renewing the lease
+type HAConfig struct {
+	Enabled bool          `yaml:"enabled"`
+	Lease   time.Duration `yaml:"lease"` // How long the lead outlives its last renewal (default: 1m)
+}
+
+// scheduleKeys are the keys set in each schedule of the config file, to tell an omitted
+// enabled from enabled: false
+type scheduleKeys struct {
+	Schedule  map[string]any            `yaml:"schedule"`
+	Scheduler map[string]any            `yaml:"scheduler"`
+	Backup    struct {
+		Schedule map[string]any `yaml:"schedule"`
+	} `yaml:"backup"`
+	Restore struct {
+		Schedule map[string]any `yaml:"schedule"`
+	} `yaml:"restore"`
+	Cleanup struct {
+		Schedule map[string]any `yaml:"schedule"`
+	} `yaml:"cleanup"`
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -113,6 +853,9 @@ func LoadConfig(path string) (*Config, error) {
 	}
 
 	config := &Config{
+		S3: S3Config{
+			ListCacheTTL: 1 * time.Minute,
+		},
 		Timeouts: TimeoutConfig{
 			SSHConnection: 30 * time.Second,
 			BackupOp:      2 * time.Hour,
@@ -123,6 +866,11 @@ func LoadConfig(path string) (*Config, error) {
 			TempDir:        "/tmp",
 			RetentionCount: 7,
 			CompressionLvl: 6,
+			DiskSpaceRatio: 0.5,
+			Parallelism:    1,
+			Lock: LockConfig{
+				StaleAfter: 6 * time.Hour,
+			},
 		},
 		Restore: RestoreConfig{
 			Enabled:      false,
@@ -142,12 +890,24 @@ func LoadConfig(path string) (*Config, error) {
 			RotationTime:   "daily", // Default to daily rotation
 			RotationMinute: 0, // Rotate at midnight by default
 		},
+		Incident: IncidentConfig{
+			UploadLogs: false,
+			Prefix:     "incidents",
+		},
 	}
 
 	if err := yaml.Unmarshal(data, config); err != nil {
 		return nil, fmt.Errorf("failed to parse config: %w", err)
 	}
 
+	var keys scheduleKeys
+	if err := yaml.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+	if err := config.migrateSchedules(keys); err != nil {
+		return nil, fmt.Errorf("config validation failed: %w", err)
+	}
+
 	if err := config.Validate(); err != nil {
 		return nil, fmt.Errorf("config validation failed: %w", err)
 	}
@@ -156,17 +916,12 @@ func LoadConfig(path string) (*Config, error) {
 }
 
 func (c *Config) Validate() error {
-	if c.SSH.Host == "" {
-		return fmt.Errorf("SSH host is required")
-	}
-	if c.SSH.Port == 0 {
-		c.SSH.Port = 22
-	}
-	if c.SSH.Username == "" {
-		return fmt.Errorf("SSH username is required")
-	}
-	if c.SSH.Password == "" && c.SSH.KeyPath == "" {
-		return fmt.Errorf("either SSH password or key path is required")
+	// Kubernetes mode reaches the database through kubectl and direct mode over the network;
+	// SSH is only needed for restores or a tunnel then
+	if (c.Backup.Mode != "kubernetes" && c.Backup.Mode != "direct") || c.SSH.Host != "" || c.Backup.Tunneled() {
+		if err := c.validateSSH(); err != nil {
+			return err
+		}
 	}
 
 	if c.Postgres.Host == "" {
@@ -175,13 +930,36 @@ func (c *Config) Validate() error {
 	if c.Postgres.Port == 0 {
 		c.Postgres.Port = 5432
 	}
+	if err := validateSSLMode(c.Postgres.SSLMode, "PostgreSQL sslmode"); err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for _, db := range c.Postgres.Databases {
+		if db == "" {
+			return fmt.Errorf("PostgreSQL databases must not contain empty names")
+		}
+		if seen[db] {
+			return fmt.Errorf("PostgreSQL database %s is listed more than once", db)
+		}
+		seen[db] = true
+	}
 	if c.Postgres.Database == "" {
-		return fmt.Errorf("PostgreSQL database is required")
+		if len(c.Postgres.Databases) == 0 {
+			return fmt.Errorf("PostgreSQL database is required")
+		}
+		// The first listed database is the default restore target
+		c.Postgres.Database = c.Postgres.Databases[0]
 	}
 	if c.Postgres.Username == "" {
 		return fmt.Errorf("PostgreSQL username is required")
 	}
 
+	if c.Postgres.Identity != nil {
+		if err := c.validateIdentity(); err != nil {
+			return err
+		}
+	}
+
 	if c.S3.Endpoint == "" {
 		return fmt.Errorf("S3 endpoint is required")
 	}
@@ -197,115 +975,1512 @@ func (c *Config) Validate() error {
 	if c.S3.Region == "" {
 		c.S3.Region = "us-east-1"
 	}
+	if c.S3.ListCacheTTL < 0 {
+		c.S3.ListCacheTTL = 0
+	}
+	if c.S3.ListRateLimit < 0 {
+		c.S3.ListRateLimit = 0
+	}
 
 	if c.Backup.RetentionCount <= 0 {
 		c.Backup.RetentionCount = 7
 	}
-	if c.Backup.CompressionLvl < 0 || c.Backup.CompressionLvl > 9 {
-		c.Backup.CompressionLvl = 6
+	if c.Backup.Compression == "" {
+		c.Backup.Compression = compression.Builtin
+	}
+	switch c.Backup.Compression {
+	case compression.Builtin, compression.None, compression.Gzip, compression.Zstd, compression.LZ4:
+		// Valid algorithms
+	default:
+		return fmt.Errorf("invalid backup compression: %s (must be builtin, zstd, gzip, lz4, or none)", c.Backup.Compression)
+	}
+	if !compression.ValidLevel(c.Backup.Compression, c.Backup.CompressionLvl) {
+		c.Backup.CompressionLvl = compression.DefaultLevel(c.Backup.Compression)
 	}
 
-	// Validate restore config if enabled
-	if c.Restore.Enabled {
-		// Determine SSH usage
-		useSSH := true // Default to using SSH
-		if c.Restore.UseSSH != nil {
-			useSSH = *c.Restore.UseSSH
-		}
-		
-		if useSSH {
-			// If SSH is enabled, validate SSH settings
-			if c.Restore.SSH == nil {
-				// Use backup SSH config as default
-				c.Restore.SSH = &c.SSH
-			} else {
-				// Validate custom restore SSH settings
-				if c.Restore.SSH.Host == "" {
-					return fmt.Errorf("restore SSH host is required")
-				}
-				if c.Restore.SSH.Port == 0 {
-					c.Restore.SSH.Port = 22
-				}
-				if c.Restore.SSH.Username == "" {
-					return fmt.Errorf("restore SSH username is required")
-				}
-				if c.Restore.SSH.Password == "" && c.Restore.SSH.KeyPath == "" {
-					return fmt.Errorf("either restore SSH password or key path is required")
-				}
-			}
-		} else {
-			// Local restore - SSH config should be nil
-			c.Restore.SSH = nil
-		}
+	if err := c.validateOverrides(); err != nil {
+		return err
+	}
+	if err := c.validateBackupJobs(); err != nil {
+		return err
+	}
 
-		// Default to source database settings if not specified
-		if c.Restore.TargetHost == "" {
-			c.Restore.TargetHost = c.Postgres.Host
-		}
-		if c.Restore.TargetPort == 0 {
-			c.Restore.TargetPort = c.Postgres.Port
-		}
-		if c.Restore.TargetDatabase == "" {
-			c.Restore.TargetDatabase = c.Postgres.Database
-		}
-		if c.Restore.TargetUsername == "" {
-			c.Restore.TargetUsername = c.Postgres.Username
-		}
-		if c.Restore.TargetPassword == "" {
-			c.Restore.TargetPassword = c.Postgres.Password
-		}
-		if c.Restore.Jobs <= 0 {
-			c.Restore.Jobs = 1
-		}
-		if c.Restore.Jobs > 8 {
-			c.Restore.Jobs = 8
-		}
+	if c.Backup.DiskSpaceRatio <= 0 {
+		c.Backup.DiskSpaceRatio = 0.5
 	}
 
-	// Validate notification config if enabled
-	if c.Notification.Enabled {
-		if c.Notification.WebhookURL == "" {
-			return fmt.Errorf("notification webhook URL is required when notifications are enabled")
-		}
+	if c.Backup.Parallelism <= 0 {
+		c.Backup.Parallelism = 1
 	}
 
-	// Validate backup schedule if present
-	if c.Backup.Schedule != nil && c.Backup.Schedule.Enabled {
-		if err := validateSchedule(c.Backup.Schedule, "backup"); err != nil {
-			return err
+	// Configs from before the per-stage timeouts limited dumps and verification with backup_operation
+	if c.Timeouts.Dump <= 0 {
+		c.Timeouts.Dump = c.Timeouts.BackupOp
+	}
+	if c.Timeouts.Verify <= 0 {
+		c.Timeouts.Verify = c.Timeouts.BackupOp
+	}
+	if c.Timeouts.Total < 0 {
+		return fmt.Errorf("timeouts total must not be negative")
+	}
+
+	if c.Backup.Snapshot != "" && c.Backup.ExportSnapshot {
+		return fmt.Errorf("backup snapshot and export_snapshot are mutually exclusive")
+	}
+	if c.Backup.Snapshot != "" && len(c.BackupDatabases()) > 1 {
+		return fmt.Errorf("backup snapshot can only be used with a single database")
+	}
+	if c.Backup.SnapshotFile != "" && len(c.BackupDatabases()) > 1 {
+		return fmt.Errorf("backup snapshot_file can only be used with a single database")
+	}
+
+	switch c.Backup.Mode {
+	case "":
+		c.Backup.Mode = "ssh"
+	case "ssh":
+		// Valid mode
+	case "docker":
+		if c.Backup.Docker == nil || c.Backup.Docker.Container == "" {
+			return fmt.Errorf("backup docker container is required in docker mode")
+		}
+		if c.Backup.Docker.Command == "" {
+			c.Backup.Docker.Command = "docker"
+		}
+	case "kubernetes":
+		if err := validateKubernetes(c.Backup.Kubernetes); err != nil {
+			return err
+		}
+	case "direct":
+		if c.Backup.Direct != nil && (c.Backup.Direct.LocalPort < 0 || c.Backup.Direct.LocalPort > 65535) {
+			return fmt.Errorf("backup direct local_port must be between 0 and 65535")
+		}
+	default:
+		return fmt.Errorf("invalid backup mode: %s (must be ssh, docker, kubernetes or direct)", c.Backup.Mode)
+	}
+
+	for _, table := range c.Backup.SchemaOnlyTables {
+		if strings.TrimSpace(table) == "" {
+			return fmt.Errorf("backup schema_only_tables must not contain empty entries")
+		}
+	}
+
+	switch c.Backup.IntegrityCheck {
+	case "", "remote", "local":
+		// Valid modes
+	default:
+		return fmt.Errorf("invalid backup integrity_check: %s (must be remote, local, or empty)", c.Backup.IntegrityCheck)
+	}
+
+	retryPolicies := map[string]*RetryPolicy{
+		"ssh_connection": &c.Backup.Retry.SSHConnection,
+		"dump":           &c.Backup.Retry.Dump,
+		"transfer":       &c.Backup.Retry.Transfer,
+		"upload":         &c.Backup.Retry.Upload,
+	}
+	for stage, policy := range retryPolicies {
+		if err := validateRetryPolicy(policy, stage); err != nil {
+			return err
+		}
+	}
+
+	if c.Backup.Standby != nil && c.Backup.Standby.Enabled {
+		if err := validateStandby(c.Backup.Standby); err != nil {
+			return err
+		}
+		if c.Backup.Standby.Database != "" && len(c.BackupDatabases()) > 1 {
+			return fmt.Errorf("backup standby database can only be set with a single database")
+		}
+	}
+
+	if c.Backup.Throttle != nil {
+		if err := validateThrottle(c.Backup.Throttle); err != nil {
+			return err
+		}
+	}
+
+	if c.Backup.RetentionAlerts != nil && c.Backup.RetentionAlerts.MaxDeletions < 0 {
+		return fmt.Errorf("backup retention_alerts max_deletions must not be negative")
+	}
+	if t := c.Backup.Trend; t != nil && t.Enabled {
+		if err := validateTrend(t); err != nil {
+			return err
+		}
+	} else if t != nil && (t.MaxDuration != 0 || t.MaxSizeChange != 0) {
+		return fmt.Errorf("backup trend max_duration and max_size_change require trend enabled: true")
+	}
+
+	for _, label := range append(slices.Clone(c.Backup.Labels), c.Backup.KeepLabels...) {
+		if !ValidLabel(label) {
+			return fmt.Errorf("backup label %q must be 1-64 characters of letters, digits, '.', '_' or '-'", label)
+		}
+	}
+
+	if c.Backup.Verify != nil && c.Backup.Verify.Enabled {
+		if err := validateVerify(c.Backup.Verify); err != nil {
+			return err
+		}
+		if err := validateVerifyChecks(c.Backup.Verify.Checks, c.BackupDatabases()); err != nil {
+			return err
+		}
+	}
+
+	if c.Backup.Lock.Dir == "" {
+		c.Backup.Lock.Dir = os.TempDir()
+	}
+	if c.Backup.StateDir == "" {
+		c.Backup.StateDir = c.Backup.Lock.Dir
+	}
+	if c.Backup.Lock.StaleAfter <= 0 {
+		c.Backup.Lock.StaleAfter = 6 * time.Hour
+	}
+
+	if err := validateEnv(c.Backup.Env, "backup"); err != nil {
+		return err
+	}
+
+	// Validate restore config if enabled
+	if c.Restore.Enabled {
+		if err := validateEnv(c.Restore.Env, "restore"); err != nil {
+			return err
+		}
+
+		// Determine SSH usage
+		useSSH := true // Default to using SSH
+		if c.Restore.UseSSH != nil {
+			useSSH = *c.Restore.UseSSH
+		}
+		// A direct restore runs pg_restore here; SSH only carries its tunnel
+		if c.Restore.Direct != nil {
+			if c.Restore.UseSSH != nil && *c.Restore.UseSSH {
+				return fmt.Errorf("restore direct runs pg_restore on this machine and can't be combined with use_ssh: true")
+			}
+			if c.Restore.Direct.LocalPort < 0 || c.Restore.Direct.LocalPort > 65535 {
+				return fmt.Errorf("invalid restore direct local_port: %d", c.Restore.Direct.LocalPort)
+			}
+			useSSH = c.Restore.Direct.Tunnel
+		}
+		
+		if useSSH {
+			// If SSH is enabled, validate SSH settings
+			if c.Restore.SSH == nil {
+				// Use backup SSH config as default
+				if c.SSH.Host == "" {
+					return fmt.Errorf("restore SSH host is required (no ssh section to default to)")
+				}
+				c.Restore.SSH = &c.SSH
+			} else {
+				// Validate custom restore SSH settings
+				if c.Restore.SSH.Host == "" {
+					return fmt.Errorf("restore SSH host is required")
+				}
+				if c.Restore.SSH.Port == 0 {
+					c.Restore.SSH.Port = 22
+				}
+				if c.Restore.SSH.Username == "" {
+					return fmt.Errorf("restore SSH username is required")
+				}
+				if c.Restore.SSH.Password == "" && c.Restore.SSH.KeyPath == "" {
+					return fmt.Errorf("either restore SSH password or key path is required")
+				}
+			}
+		} else {
+			// Local restore - SSH config should be nil
+			c.Restore.SSH = nil
+		}
+
+		// Default to source database settings if not specified. A socket target connects
+		// as whoever runs the restore commands unless a username is given, so no credentials
+		// are taken over from the source.
+		if c.Restore.TargetSocket {
+			if c.Restore.TargetHost != "" && !strings.HasPrefix(c.Restore.TargetHost, "/") {
+				return fmt.Errorf("restore target_host must be a socket directory (an absolute path) with target_socket, got %s", c.Restore.TargetHost)
+			}
+			if c.Restore.Tunneled() {
+				return fmt.Errorf("restore target_socket can't be combined with direct.tunnel")
+			}
+		} else if c.Restore.TargetHost == "" {
+			c.Restore.TargetHost = c.Postgres.Host
+		}
+		if c.Restore.TargetPort == 0 {
+			c.Restore.TargetPort = c.Postgres.Port
+		}
+		if c.Restore.TargetDatabase == "" {
+			c.Restore.TargetDatabase = c.Postgres.Database
+		}
+		if c.Restore.TargetUsername == "" && !c.Restore.TargetSocket {
+			c.Restore.TargetUsername = c.Postgres.Username
+		}
+		if c.Restore.TargetPassword == "" && !c.Restore.TargetSocket {
+			c.Restore.TargetPassword = c.Postgres.Password
+		}
+		if c.Restore.TargetSSLMode == "" {
+			c.Restore.TargetSSLMode = c.Postgres.SSLMode
+		}
+		if c.Restore.TargetSSLRootCert == "" {
+			c.Restore.TargetSSLRootCert = c.Postgres.SSLRootCert
+		}
+		if c.Restore.TargetSSLCert == "" {
+			c.Restore.TargetSSLCert = c.Postgres.SSLCert
+		}
+		if c.Restore.TargetSSLKey == "" {
+			c.Restore.TargetSSLKey = c.Postgres.SSLKey
+		}
+		if err := validateSSLMode(c.Restore.TargetSSLMode, "restore target_sslmode"); err != nil {
+			return err
+		}
+		if c.Restore.Jobs <= 0 {
+			c.Restore.Jobs = 1
+		}
+		if c.Restore.Jobs > 8 {
+			c.Restore.Jobs = 8
+		}
+		if c.Restore.Throttle != nil {
+			if err := validateRestoreThrottle(c.Restore.Throttle); err != nil {
+				return err
+			}
+		}
+		if c.Restore.Parallelism <= 0 {
+			c.Restore.Parallelism = 1
+		}
+		if c.Restore.DownloadConcurrency <= 0 {
+			c.Restore.DownloadConcurrency = 4
+		}
+		if c.Restore.PgBinDir != "" && !strings.HasPrefix(c.Restore.PgBinDir, "/") {
+			return fmt.Errorf("restore pg_bin_dir must be an absolute path, got %s", c.Restore.PgBinDir)
+		}
+		if c.Restore.DiskSpaceRatio < 0 {
+			return fmt.Errorf("restore disk_space_ratio must not be negative")
+		}
+		if c.Restore.DiskSpaceRatio == 0 {
+			c.Restore.DiskSpaceRatio = 3
+		}
+		switch c.Restore.OnFailure {
+		case "":
+			c.Restore.OnFailure = "keep"
+		case "keep", "drop", "rename":
+			// Valid modes
+		default:
+			return fmt.Errorf("invalid restore on_failure: %s (must be keep, drop or rename)", c.Restore.OnFailure)
+		}
+		if c.Restore.SingleTransaction {
+			// pg_restore rejects --single-transaction with --jobs, and a row filtered restore
+			// runs several commands that can't share a transaction
+			if c.Restore.Jobs > 1 {
+				return fmt.Errorf("restore single_transaction requires jobs: 1, pg_restore can't restore in parallel within one transaction")
+			}
+			if len(c.Restore.RowFilters) > 0 {
+				return fmt.Errorf("restore single_transaction can't be combined with row_filters")
+			}
+		}
+		if err := validateRowFilters(c.Restore.RowFilters); err != nil {
+			return err
+		}
+		if err := validateSelection(&c.Restore); err != nil {
+			return err
+		}
+		if c.Restore.Drill != nil && c.Restore.Drill.Enabled {
+			if err := validateDrill(c.Restore.Drill, c.BackupDatabases()); err != nil {
+				return err
+			}
+		}
+		if c.Restore.MaskingRules != "" {
+			if _, err := masking.LoadRules(c.Restore.MaskingRules); err != nil {
+				return fmt.Errorf("restore masking_rules: %w", err)
+			}
+		}
+		if c.Restore.Verify != nil {
+			if err := validateRestoreVerify(c.Restore.Verify, c.BackupDatabases()); err != nil {
+				return err
+			}
+		}
+		for i, step := range c.Restore.PostSQL {
+			if (step.File == "") == (step.SQL == "") {
+				return fmt.Errorf("restore post_sql[%d]: set either file or sql", i)
+			}
+			if _, err := step.Load(); err != nil {
+				return fmt.Errorf("restore post_sql[%d]: %w", i, err)
+			}
+		}
+		for i, hook := range c.Restore.PostHooks {
+			if strings.TrimSpace(hook) == "" {
+				return fmt.Errorf("restore post_hooks[%d] is empty", i)
+			}
+		}
+		if c.Restore.TargetDatabaseTemplate != "" {
+			if !c.Restore.CreateDB {
+				return fmt.Errorf("restore target_database_template requires create_db")
+			}
+			// Restores into a new database each time can't be counted per target
+			if c.Restore.Production {
+				return fmt.Errorf("restore target_database_template can't be used with production")
+			}
+			if _, err := c.Restore.RenderTargetDatabase(c.Postgres.Database, time.Now()); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := validateNotification(&c.Notification); err != nil {
+		return fmt.Errorf("notification: %w", err)
+	}
+
+	if c.Incident.Prefix == "" {
+		c.Incident.Prefix = "incidents"
+	}
+
+	if c.Safety.MaxProductionRestoresPerDay < 0 {
+		return fmt.Errorf("safety max_production_restores_per_day must not be negative")
+	}
+	if c.Safety.MaxDeletionsPerCleanup < 0 {
+		return fmt.Errorf("safety max_deletions_per_cleanup must not be negative")
+	}
+
+	for i := range c.Exporters {
+		exporter := &c.Exporters[i]
+		if exporter.Command == "" {
+			return fmt.Errorf("exporter %d: command is required", i+1)
+		}
+		if exporter.Name == "" {
+			exporter.Name = fmt.Sprintf("exporter-%d", i+1)
+		}
+	}
+
+	if c.Trigger != nil && c.Trigger.Enabled {
+		if c.Trigger.Token == "" {
+			return fmt.Errorf("trigger token is required when the trigger endpoint is enabled")
+		}
+		if c.Trigger.Listen == "" {
+			c.Trigger.Listen = ":8080"
+		}
+		if (c.Trigger.TLSCert == "") != (c.Trigger.TLSKey == "") {
+			return fmt.Errorf("trigger tls_cert and tls_key must be set together")
+		}
+	}
+
+	// Validate backup schedule if present
+	if c.Scheduler.Backup != nil && c.Scheduler.Backup.Enabled {
+		if err := validateSchedule(c.Scheduler.Backup, "backup"); err != nil {
+			return err
 		}
 	}
 
 	// Validate restore schedule if present
-	if c.Restore.Schedule != nil && c.Restore.Schedule.Enabled {
-		if err := validateSchedule(c.Restore.Schedule, "restore"); err != nil {
+	if c.Scheduler.Restore != nil && c.Scheduler.Restore.Enabled {
+		if err := validateSchedule(c.Scheduler.Restore, "restore"); err != nil {
 			return err
 		}
+		// The scheduler would start without a restore task
+		if !c.Restore.Enabled {
+			return fmt.Errorf("restore schedule is enabled but restore.enabled is false")
+		}
 	}
 
 	// Validate cleanup schedule if present
-	if c.Cleanup != nil && c.Cleanup.Schedule != nil && c.Cleanup.Schedule.Enabled {
-		if err := validateSchedule(c.Cleanup.Schedule, "cleanup"); err != nil {
+	if c.Scheduler.Cleanup != nil && c.Scheduler.Cleanup.Enabled {
+		if err := validateSchedule(c.Scheduler.Cleanup, "cleanup"); err != nil {
 			return err
 		}
 	}
 
+	if c.Scheduler.ShutdownGrace < 0 {
+		return fmt.Errorf("scheduler.shutdown_grace must not be negative")
+	}
+	switch c.Scheduler.StartupCheck {
+	case "":
+		c.Scheduler.StartupCheck = "warn"
+	case "warn", "alert", "fail", "off":
+		// Valid policies
+	default:
+		return fmt.Errorf("invalid scheduler.startup_check: %s (must be warn, alert, fail or off)", c.Scheduler.StartupCheck)
+	}
+
+	if ha := c.Scheduler.HA; ha != nil && ha.Enabled {
+		if ha.Lease == 0 {
+			ha.Lease = time.Minute
+		}
+		// Renewed every third of the lease, which leaves time for a slow S3 request or two
+		if ha.Lease < 15*time.Second {
+			return fmt.Errorf("scheduler.ha.lease must be at least 15s")
+		}
+	}
+
+	// Only backups chain other tasks
+	if c.Scheduler.Restore != nil && len(c.Scheduler.Restore.Then) > 0 {
+		return fmt.Errorf("restore schedule: then is only supported on backup schedules")
+	}
+	if c.Scheduler.Cleanup != nil && len(c.Scheduler.Cleanup.Then) > 0 {
+		return fmt.Errorf("cleanup schedule: then is only supported on backup schedules")
+	}
+	for _, backupSchedule := range c.BackupSchedules() {
+		if slices.Contains(backupSchedule.Schedule.Then, "restore") && !c.Restore.Enabled {
+			return fmt.Errorf("%s schedule: then restore requires restore.enabled", backupSchedule.Task)
+		}
+	}
+
 	return nil
 }
 
-func validateSchedule(s *ScheduleConfig, taskName string) error {
-	if s.Type == "" {
-		return fmt.Errorf("%s schedule type is required when scheduling is enabled", taskName)
+// migrateSchedules moves the schedules of older layouts to the scheduler section: the inline
+// backup.schedule, restore.schedule and cleanup.schedule, and the flat top-level schedule,
+// which was a backup schedule. Each moved schedule adds a warning.
+func (c *Config) migrateSchedules(keys scheduleKeys) error {
+	targets := map[string]**ScheduleConfig{
+		"backup":  &c.Scheduler.Backup,
+		"restore": &c.Scheduler.Restore,
+		"cleanup": &c.Scheduler.Cleanup,
 	}
-	if s.Expression == "" {
-		return fmt.Errorf("%s schedule expression is required when scheduling is enabled", taskName)
+	for key, value := range keys.Scheduler {
+		target, ok := targets[key]
+		if !ok {
+			if key == "ha" || key == "shutdown_grace" || key == "startup_check" {
+				continue
+			}
+			return fmt.Errorf("scheduler: unknown key %s, expected backup, restore, cleanup, ha, shutdown_grace or startup_check", key)
+		}
+		set, _ := value.(map[string]any)
+		if _, ok := set["enabled"]; !ok && *target != nil {
+			(*target).Enabled = true
+		}
 	}
-	// Validate schedule type
-	switch s.Type {
-	case "cron", "interval", "daily", "weekly", "monthly":
-		// Valid types
-	default:
-		return fmt.Errorf("invalid %s schedule type: %s (must be cron, interval, daily, weekly, or monthly)", taskName, s.Type)
+	// The flat schedule was active whenever it was set
+	if _, ok := keys.Schedule["enabled"]; !ok && c.Schedule != nil {
+		c.Schedule.Enabled = true
+	}
+
+	var cleanupSchedule *ScheduleConfig
+	if c.Cleanup != nil {
+		cleanupSchedule = c.Cleanup.Schedule
+	}
+	legacy := []struct {
+		field    string
+		task     string
+		schedule *ScheduleConfig
+		keys     map[string]any
+	}{
+		{"backup.schedule", "backup", c.Backup.Schedule, keys.Backup.Schedule},
+		{"restore.schedule", "restore", c.Restore.Schedule, keys.Restore.Schedule},
+		{"cleanup.schedule", "cleanup", cleanupSchedule, keys.Cleanup.Schedule},
+		{"schedule", "backup", c.Schedule, keys.Schedule},
+	}
+	moved := make(map[string]string)
+	for _, old := range legacy {
+		if old.schedule == nil {
+			continue
+		}
+		target := targets[old.task]
+		if *target != nil {
+			other, ok := moved[old.task]
+			if !ok {
+				other = "scheduler." + old.task
+			}
+			return fmt.Errorf("%s and %s both configure the %s schedule, keep only scheduler.%s", old.field, other, old.task, old.task)
+		}
+		*target = old.schedule
+		moved[old.task] = old.field
+		c.Warnings = append(c.Warnings, fmt.Sprintf("%s is deprecated, move it to scheduler.%s", old.field, old.task))
+		if _, ok := old.keys["enabled"]; !ok && !old.schedule.Enabled && old.schedule.Expression != "" {
+			c.Warnings = append(c.Warnings, fmt.Sprintf("%s sets an expression but not enabled: true, so no %s is scheduled", old.field, old.task))
+		}
+	}
+
+	c.Schedule = nil
+	c.Backup.Schedule = nil
+	c.Restore.Schedule = nil
+	if c.Cleanup != nil {
+		c.Cleanup.Schedule = nil
 	}
 	return nil
-}
\ No newline at end of file
+}
+
+// HAEnabled reports whether the scheduler shares its schedules with other instances
+func (c *Config) HAEnabled() bool {
+	return c.Scheduler.HA != nil && c.Scheduler.HA.Enabled
+}
+
+// NotificationFor returns the notification settings of the runs of a schedule: its own if it
+// sets notification, otherwise the notification section. A nil schedule, e.g. of a run
+// started with -backup or through the trigger endpoint, gets the notification section.
+func (c *Config) NotificationFor(schedule *ScheduleConfig) *NotificationConfig {
+	if schedule != nil && schedule.Notification != nil {
+		return schedule.Notification
+	}
+	return &c.Notification
+}
+
+// ChainsTask reports whether any backup schedule runs task after its backups
+func (c *Config) ChainsTask(task string) bool {
+	for _, backupSchedule := range c.BackupSchedules() {
+		if slices.Contains(backupSchedule.Schedule.Then, task) {
+			return true
+		}
+	}
+	return false
+}
+
+// DatabaseSettings returns the backup settings of a database
+func (c *Config) DatabaseSettings(database string) DatabaseSettings {
+	settings := DatabaseSettings{
+		Compression:    c.Backup.Compression,
+		CompressionLvl: c.Backup.CompressionLvl,
+		RetentionCount: c.Backup.RetentionCount,
+		Schedule:       c.Scheduler.Backup,
+	}
+	override := c.Backup.Overrides[database]
+	if override == nil {
+		return settings
+	}
+	if override.Compression != "" {
+		settings.Compression = override.Compression
+	}
+	if override.CompressionLvl != nil {
+		settings.CompressionLvl = *override.CompressionLvl
+	} else if !compression.ValidLevel(settings.Compression, settings.CompressionLvl) {
+		settings.CompressionLvl = compression.DefaultLevel(settings.Compression)
+	}
+	if override.RetentionCount > 0 {
+		settings.RetentionCount = override.RetentionCount
+	}
+	settings.Prefix = override.Prefix
+	if override.Schedule != nil {
+		settings.Schedule = override.Schedule
+	}
+	return settings
+}
+
+// BackupSchedule is a scheduled backup task and the databases it backs up
+type BackupSchedule struct {
+	Task      string // "backup", "backup:<name>" for a job of backup.schedules, or "backup:<database>" for a database with its own schedule
+	Schedule  *ScheduleConfig
+	Databases []string
+}
+
+// BackupSchedules returns the enabled backup schedules. Each job of backup.schedules and each
+// database with its own schedule gets a task of its own, or none if that schedule is disabled;
+// the other databases share scheduler.backup.
+func (c *Config) BackupSchedules() []BackupSchedule {
+	var schedules []BackupSchedule
+	var shared []string
+	scheduled := make(map[string]bool)
+	for _, job := range c.Backup.Schedules {
+		for _, database := range job.Databases {
+			scheduled[database] = true
+		}
+		if job.Schedule != nil && job.Schedule.Enabled {
+			schedules = append(schedules, BackupSchedule{
+				Task:      "backup:" + job.Name,
+				Schedule:  job.Schedule,
+				Databases: job.Databases,
+			})
+		}
+	}
+	for _, database := range c.BackupDatabases() {
+		if scheduled[database] {
+			continue
+		}
+		override := c.Backup.Overrides[database]
+		if override == nil || override.Schedule == nil {
+			shared = append(shared, database)
+			continue
+		}
+		if override.Schedule.Enabled {
+			schedules = append(schedules, BackupSchedule{
+				Task:      "backup:" + database,
+				Schedule:  override.Schedule,
+				Databases: []string{database},
+			})
+		}
+	}
+	if c.Scheduler.Backup != nil && c.Scheduler.Backup.Enabled && len(shared) > 0 {
+		schedules = append([]BackupSchedule{{
+			Task:      "backup",
+			Schedule:  c.Scheduler.Backup,
+			Databases: shared,
+		}}, schedules...)
+	}
+	return schedules
+}
+
+// RetentionCounts returns the retention count of every database with an override or in a job of
+// backup.schedules with its own count; all other databases keep backup.retention_count
+func (c *Config) RetentionCounts() map[string]int {
+	counts := make(map[string]int)
+	for _, job := range c.Backup.Schedules {
+		if job.RetentionCount > 0 {
+			for _, database := range job.Databases {
+				counts[database] = job.RetentionCount
+			}
+		}
+	}
+	for database, override := range c.Backup.Overrides {
+		if override.RetentionCount > 0 {
+			counts[database] = override.RetentionCount
+		}
+	}
+	return counts
+}
+
+// BackupDatabases returns the databases included in a backup run
+func (c *Config) BackupDatabases() []string {
+	if len(c.Postgres.Databases) > 0 {
+		return c.Postgres.Databases
+	}
+	return []string{c.Postgres.Database}
+}
+
+func (c *Config) validateOverrides() error {
+	for database, override := range c.Backup.Overrides {
+		// Backups are only told apart by database when the names are part of the file name
+		if !slices.Contains(c.Postgres.Databases, database) {
+			return fmt.Errorf("backup override %s: not listed in postgres.databases", database)
+		}
+		if override == nil {
+			return fmt.Errorf("backup override %s: no settings", database)
+		}
+		switch override.Compression {
+		case "", compression.Builtin, compression.None, compression.Gzip, compression.Zstd, compression.LZ4:
+			// Valid algorithms
+		default:
+			return fmt.Errorf("backup override %s: invalid compression: %s (must be builtin, zstd, gzip, lz4, or none)", database, override.Compression)
+		}
+		algorithm := override.Compression
+		if algorithm == "" {
+			algorithm = c.Backup.Compression
+		}
+		if override.CompressionLvl != nil && !compression.ValidLevel(algorithm, *override.CompressionLvl) {
+			return fmt.Errorf("backup override %s: invalid compression_level %d for %s", database, *override.CompressionLvl, algorithm)
+		}
+		if override.RetentionCount < 0 {
+			return fmt.Errorf("backup override %s: retention_count must not be negative", database)
+		}
+		override.Prefix = strings.Trim(override.Prefix, "/")
+		if override.Schedule != nil && override.Schedule.Enabled {
+			if err := validateSchedule(override.Schedule, "backup of "+database); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateBackupJobs() error {
+	names := make(map[string]bool)
+	owner := make(map[string]string)
+	for i := range c.Backup.Schedules {
+		job := &c.Backup.Schedules[i]
+		if !ValidLabel(job.Name) {
+			return fmt.Errorf("backup.schedules[%d]: name %q must be 1-64 letters, digits, '.', '_' or '-'", i, job.Name)
+		}
+		if names[job.Name] {
+			return fmt.Errorf("backup.schedules: duplicate name %s", job.Name)
+		}
+		names[job.Name] = true
+		// Both would run as task backup:<name>
+		if override := c.Backup.Overrides[job.Name]; override != nil && override.Schedule != nil {
+			return fmt.Errorf("backup.schedules: name %s is taken by the schedule of database %s in backup.overrides", job.Name, job.Name)
+		}
+		if job.Schedule == nil {
+			return fmt.Errorf("backup.schedules %s: schedule is required", job.Name)
+		}
+		if len(job.Databases) == 0 {
+			return fmt.Errorf("backup.schedules %s: databases is required", job.Name)
+		}
+		for _, database := range job.Databases {
+			// Backups are only told apart by database when the names are part of the file name
+			if !slices.Contains(c.Postgres.Databases, database) {
+				return fmt.Errorf("backup.schedules %s: database %s is not listed in postgres.databases", job.Name, database)
+			}
+			// Retention counts per database, so a database can only follow one job's count
+			if other, ok := owner[database]; ok {
+				return fmt.Errorf("backup.schedules %s: database %s is already backed up by %s", job.Name, database, other)
+			}
+			owner[database] = job.Name
+			if override := c.Backup.Overrides[database]; override != nil && override.Schedule != nil {
+				return fmt.Errorf("backup.schedules %s: database %s also has a schedule in backup.overrides", job.Name, database)
+			}
+		}
+		if job.RetentionCount < 0 {
+			return fmt.Errorf("backup.schedules %s: retention_count must not be negative", job.Name)
+		}
+		if job.Schedule.Enabled {
+			if err := validateSchedule(job.Schedule, "backup job "+job.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateSSH() error {
+	if c.SSH.Host == "" {
+		return fmt.Errorf("SSH host is required")
+	}
+	if c.SSH.Port == 0 {
+		c.SSH.Port = 22
+	}
+	if c.SSH.Username == "" {
+		return fmt.Errorf("SSH username is required")
+	}
+	if c.SSH.Password == "" && c.SSH.KeyPath == "" {
+		return fmt.Errorf("either SSH password or key path is required")
+	}
+	return nil
+}
+
+func validateKubernetes(k *KubernetesConfig) error {
+	if k == nil || (k.Pod == "" && k.Selector == "") {
+		return fmt.Errorf("backup kubernetes pod or selector is required in kubernetes mode")
+	}
+	if k.Pod != "" && k.Selector != "" {
+		return fmt.Errorf("backup kubernetes pod and selector are mutually exclusive")
+	}
+	if k.Namespace == "" {
+		k.Namespace = "default"
+	}
+	if k.Command == "" {
+		k.Command = "kubectl"
+	}
+	return nil
+}
+
+func validateSSLMode(mode, field string) error {
+	switch mode {
+	case "", "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+		return nil
+	default:
+		return fmt.Errorf("invalid %s: %s (must be disable, allow, prefer, require, verify-ca or verify-full)", field, mode)
+	}
+}
+
+// sslEnv maps TLS options to the libpq environment variables understood by psql, pg_dump and
+// pg_restore. Unset options are left out so libpq defaults apply.
+func sslEnv(mode, rootCert, cert, key string) map[string]string {
+	env := make(map[string]string)
+	for name, value := range map[string]string{
+		"PGSSLMODE":     mode,
+		"PGSSLROOTCERT": rootCert,
+		"PGSSLCERT":     cert,
+		"PGSSLKEY":      key,
+	} {
+		if value != "" {
+			env[name] = value
+		}
+	}
+	return env
+}
+
+func validateSchedule(s *ScheduleConfig, taskName string) error {
+	if s.Type == "" {
+		return fmt.Errorf("%s schedule type is required when scheduling is enabled", taskName)
+	}
+	if s.Expression == "" {
+		return fmt.Errorf("%s schedule expression is required when scheduling is enabled", taskName)
+	}
+	// Validate schedule type
+	switch s.Type {
+	case "cron", "interval", "daily", "weekly", "monthly":
+		// Valid types
+	default:
+		return fmt.Errorf("invalid %s schedule type: %s (must be cron, interval, daily, weekly, or monthly)", taskName, s.Type)
+	}
+	if s.Timezone != "" {
+		if _, err := time.LoadLocation(s.Timezone); err != nil {
+			return fmt.Errorf("invalid %s schedule timezone: %w", taskName, err)
+		}
+	}
+	if s.Align && s.Type != "interval" {
+		return fmt.Errorf("%s schedule: align is only supported on interval schedules", taskName)
+	}
+	if s.Type == "cron" && !strings.HasPrefix(s.Expression, "@") {
+		if strings.HasPrefix(s.Expression, "TZ=") || strings.HasPrefix(s.Expression, "CRON_TZ=") {
+			return fmt.Errorf("%s schedule: set the time zone with timezone instead of in the cron expression", taskName)
+		}
+		if fields := len(strings.Fields(s.Expression)); fields != 5 && fields != 6 {
+			return fmt.Errorf("invalid %s cron expression %q: expected 5 fields, or 6 with seconds first", taskName, s.Expression)
+		}
+	}
+	switch s.Overlap {
+	case "":
+		s.Overlap = "reschedule"
+	case "reschedule", "wait", "skip", "cancel":
+		// Valid policies
+	default:
+		return fmt.Errorf("invalid %s schedule overlap policy: %s (must be reschedule, wait, skip or cancel)", taskName, s.Overlap)
+	}
+	if s.MaxRuntime < 0 {
+		return fmt.Errorf("%s schedule max_runtime must not be negative", taskName)
+	}
+	if s.Jitter < 0 {
+		return fmt.Errorf("%s schedule jitter must not be negative", taskName)
+	}
+	seen := make(map[string]bool)
+	for _, task := range s.Then {
+		if task != "cleanup" && task != "restore" {
+			return fmt.Errorf("invalid %s schedule then task: %s (must be cleanup or restore)", taskName, task)
+		}
+		if seen[task] {
+			return fmt.Errorf("%s schedule: then lists %s twice", taskName, task)
+		}
+		seen[task] = true
+	}
+	for i, window := range s.Blackouts {
+		if err := validateBlackout(window); err != nil {
+			return fmt.Errorf("%s schedule blackouts[%d]: %w", taskName, i, err)
+		}
+	}
+	for _, entry := range s.ExcludeDates {
+		if err := validateExcludeDate(entry); err != nil {
+			return fmt.Errorf("%s schedule exclude_dates: %w", taskName, err)
+		}
+	}
+	if s.Notification != nil {
+		if s.Notification.Retry != nil {
+			return fmt.Errorf("%s schedule notification: retry is only read from the notification section", taskName)
+		}
+		if err := validateNotification(s.Notification); err != nil {
+			return fmt.Errorf("%s schedule notification: %w", taskName, err)
+		}
+	}
+	switch s.Misfire {
+	case "":
+		s.Misfire = "skip"
+	case "skip", "run", "alert":
+		// Valid policies
+	default:
+		return fmt.Errorf("invalid %s schedule misfire policy: %s (must be skip, run or alert)", taskName, s.Misfire)
+	}
+	return nil
+}
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func validateBlackout(w BlackoutWindow) error {
+	for _, day := range w.Weekdays {
+		if len(day) < 3 || !slices.Contains(weekdayNames, strings.ToLower(day[:3])) {
+			return fmt.Errorf("invalid weekday %q", day)
+		}
+	}
+	for _, day := range w.Days {
+		if day == 0 || day < -31 || day > 31 {
+			return fmt.Errorf("invalid day %d (must be 1 to 31, or -1 to -31 from the end of the month)", day)
+		}
+	}
+	var start, end time.Time
+	var err error
+	if w.Start != "" {
+		if start, err = time.Parse("15:04", w.Start); err != nil {
+			return fmt.Errorf("invalid start %q (expected HH:MM)", w.Start)
+		}
+	}
+	if w.End != "" {
+		if end, err = time.Parse("15:04", w.End); err != nil {
+			return fmt.Errorf("invalid end %q (expected HH:MM)", w.End)
+		}
+		if !end.After(start) {
+			return fmt.Errorf("end %s must be after start %s; split windows that span midnight", w.End, w.Start)
+		}
+	}
+	return nil
+}
+
+func validateExcludeDate(entry string) error {
+	from, to, isRange := strings.Cut(entry, "..")
+	if !isRange {
+		to = from
+	}
+	layout := "2006-01-02"
+	if len(from) == len("01-02") {
+		layout = "01-02"
+	}
+	// Parsing alone accepts unpadded fields, which wouldn't compare as strings
+	for _, date := range []string{from, to} {
+		if _, err := time.Parse(layout, date); err != nil || len(date) != len(layout) {
+			return fmt.Errorf("invalid date %q in %q (expected YYYY-MM-DD, or MM-DD for every year)", date, entry)
+		}
+	}
+	if layout == "2006-01-02" && to < from {
+		return fmt.Errorf("range %q ends before it starts", entry)
+	}
+	return nil
+}
+
+func validateRetryPolicy(p *RetryPolicy, stage string) error {
+	if p.Attempts < 0 || p.InitialBackoff < 0 || p.MaxBackoff < 0 || p.MaxElapsed < 0 {
+		return fmt.Errorf("backup.retry.%s: values must not be negative", stage)
+	}
+	if p.Attempts == 0 {
+		p.Attempts = 1
+	}
+	if p.InitialBackoff == 0 {
+		p.InitialBackoff = 10 * time.Second
+	}
+	if p.MaxBackoff == 0 {
+		p.MaxBackoff = 5 * time.Minute
+	}
+	return nil
+}
+
+func validateRowFilters(filters []RowFilter) error {
+	seen := make(map[string]bool)
+	for _, filter := range filters {
+		if filter.Table == "" {
+			return fmt.Errorf("restore.row_filters: table is required")
+		}
+		if strings.TrimSpace(filter.Where) == "" {
+			return fmt.Errorf("restore.row_filters: where is required for table %s", filter.Table)
+		}
+		schema, table := filter.Schema()
+		if schema == "" || table == "" || strings.ContainsAny(filter.Table, " \t'\"") {
+			return fmt.Errorf("restore.row_filters: invalid table name %q", filter.Table)
+		}
+		if seen[schema+"."+table] {
+			return fmt.Errorf("restore.row_filters: duplicate filter for table %s", filter.Table)
+		}
+		seen[schema+"."+table] = true
+	}
+	return nil
+}
+
+func validateSelection(r *RestoreConfig) error {
+	if r.Selective() && len(r.RowFilters) > 0 {
+		return fmt.Errorf("restore.schemas and restore.tables can't be combined with restore.row_filters")
+	}
+	for _, schema := range r.Schemas {
+		if schema == "" || strings.ContainsAny(schema, ". \t'\"") {
+			return fmt.Errorf("restore.schemas: invalid schema name %q", schema)
+		}
+	}
+	for _, name := range r.Tables {
+		schema, table := SplitTableName(name)
+		if schema == "" || table == "" || strings.ContainsAny(name, " \t'\"") {
+			return fmt.Errorf("restore.tables: invalid table name %q", name)
+		}
+	}
+	return nil
+}
+
+func validateRestoreVerify(v *RestoreVerifyConfig, databases []string) error {
+	for schema, minimum := range v.MinTables {
+		if schema == "" || strings.ContainsAny(schema, ". \t'\"") {
+			return fmt.Errorf("restore verify min_tables: invalid schema name %q", schema)
+		}
+		if minimum < 0 {
+			return fmt.Errorf("restore verify min_tables: %s must not be negative", schema)
+		}
+	}
+	for table, minimum := range v.MinRows {
+		if !markerTableRegex.MatchString(table) {
+			return fmt.Errorf("restore verify min_rows: invalid table name %q", table)
+		}
+		if minimum < 0 {
+			return fmt.Errorf("restore verify min_rows: %s must not be negative", table)
+		}
+	}
+	return validateVerifyChecks(v.Checks, databases)
+}
+
+func validateDrill(d *DrillConfig, databases []string) error {
+	if d.MinTables == 0 {
+		d.MinTables = 1
+	}
+	if d.MinRows < 0 {
+		return fmt.Errorf("restore drill min_rows must not be negative")
+	}
+	for _, name := range d.KeyTables {
+		if !markerTableRegex.MatchString(name) {
+			return fmt.Errorf("restore drill key_tables: invalid table name %q", name)
+		}
+	}
+	return validateVerifyChecks(d.Checks, databases)
+}
+
+func validateStandby(s *StandbyConfig) error {
+	if s.SSH != nil {
+		if s.SSH.Host == "" {
+			return fmt.Errorf("standby SSH host is required")
+		}
+		if s.SSH.Port == 0 {
+			s.SSH.Port = 22
+		}
+		if s.SSH.Username == "" {
+			return fmt.Errorf("standby SSH username is required")
+		}
+		if s.SSH.Password == "" && s.SSH.KeyPath == "" {
+			return fmt.Errorf("either standby SSH password or key path is required")
+		}
+	}
+	if s.Username == "" {
+		return fmt.Errorf("standby username is required when the standby is enabled")
+	}
+	if s.Database != "" && strings.ContainsAny(s.Database, `"'`) {
+		return fmt.Errorf("invalid standby database: %s (must not contain quotes)", s.Database)
+	}
+	if s.Host == "" {
+		s.Host = "localhost"
+	}
+	if s.Port == 0 {
+		s.Port = 5432
+	}
+	if s.TempDir == "" {
+		s.TempDir = "/tmp"
+	}
+	if s.Jobs <= 0 {
+		s.Jobs = 1
+	}
+	return nil
+}
+
+func validateThrottle(t *ThrottleConfig) error {
+	if t.MaxActiveConnections < 0 {
+		return fmt.Errorf("backup throttle max_active_connections must not be negative")
+	}
+	if t.MaxReplicationLag < 0 {
+		return fmt.Errorf("backup throttle max_replication_lag must not be negative")
+	}
+	switch t.Action {
+	case "":
+		t.Action = "wait"
+	case "wait", "abort":
+		// Valid actions
+	default:
+		return fmt.Errorf("invalid backup throttle action: %s (must be wait or abort)", t.Action)
+	}
+	if t.CheckInterval <= 0 {
+		t.CheckInterval = time.Minute
+	}
+	if t.MaxWait <= 0 {
+		t.MaxWait = 30 * time.Minute
+	}
+	return nil
+}
+
+// settingNameRegex matches PostgreSQL setting names, including extension settings like auto_explain.log_min_duration
+var settingNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+func validateRestoreThrottle(t *RestoreThrottleConfig) error {
+	for setting := range t.Settings {
+		if !settingNameRegex.MatchString(setting) {
+			return fmt.Errorf("restore throttle settings: %q is not a valid setting name", setting)
+		}
+	}
+	for i, window := range t.PauseWindows {
+		if _, err := time.Parse("15:04", window.Start); err != nil {
+			return fmt.Errorf("restore throttle pause_windows[%d]: invalid start %q (expected HH:MM)", i, window.Start)
+		}
+		if _, err := time.Parse("15:04", window.End); err != nil {
+			return fmt.Errorf("restore throttle pause_windows[%d]: invalid end %q (expected HH:MM)", i, window.End)
+		}
+		if window.Start == window.End {
+			return fmt.Errorf("restore throttle pause_windows[%d]: start and end are both %s", i, window.Start)
+		}
+	}
+	return nil
+}
+
+func validateNotification(n *NotificationConfig) error {
+	// Schedules with notifications of their own share the queue, even when this section is off
+	if r := n.Retry; r != nil {
+		if r.Backoff == 0 {
+			r.Backoff = time.Minute
+		}
+		if r.MaxBackoff == 0 {
+			r.MaxBackoff = time.Hour
+		}
+		if r.MaxAge == 0 {
+			r.MaxAge = 24 * time.Hour
+		}
+		if r.Backoff < time.Second {
+			return fmt.Errorf("retry backoff must be at least 1s")
+		}
+		if r.MaxBackoff < r.Backoff {
+			return fmt.Errorf("retry max_backoff (%s) must not be shorter than backoff (%s)", r.MaxBackoff, r.Backoff)
+		}
+		if r.MaxAge < 0 {
+			return fmt.Errorf("retry max_age must not be negative")
+		}
+	}
+	if a := n.Attach; a != nil {
+		if a.LogLines < 0 || a.LogLines > 200 {
+			return fmt.Errorf("attach log_lines must be between 0 and 200")
+		}
+		if _, err := msgtemplate.Parse("report_url", a.ReportURL); err != nil {
+			return fmt.Errorf("invalid attach report_url: %w", err)
+		}
+	}
+	if !n.Enabled {
+		return nil
+	}
+	n.foldShorthand()
+	if len(n.Channels) == 0 {
+		return fmt.Errorf("channels, webhook_url, slack, discord, teams, google_chat, ntfy, gotify, pagerduty or opsgenie is required when notifications are enabled")
+	}
+
+	names := make(map[string]bool)
+	for i := range n.Channels {
+		channel := &n.Channels[i]
+		if channel.Name == "" {
+			return fmt.Errorf("channels[%d]: name is required", i)
+		}
+		if names[channel.Name] {
+			return fmt.Errorf("duplicate channel: %s", channel.Name)
+		}
+		names[channel.Name] = true
+		set := 0
+		types := []bool{
+			channel.Webhook != nil, channel.Slack != nil, channel.Discord != nil, channel.Teams != nil, channel.GoogleChat != nil,
+			channel.Ntfy != nil, channel.Gotify != nil, channel.PagerDuty != nil, channel.Opsgenie != nil,
+		}
+		for _, typed := range types {
+			if typed {
+				set++
+			}
+		}
+		if set != 1 {
+			return fmt.Errorf("channel %s: set exactly one of webhook, slack, discord, teams, google_chat, ntfy, gotify, pagerduty or opsgenie", channel.Name)
+		}
+		if err := validateChannel(channel); err != nil {
+			return fmt.Errorf("channel %s: %w", channel.Name, err)
+		}
+	}
+
+	for i := range n.Routes {
+		route := &n.Routes[i]
+		if len(route.Channels) == 0 {
+			return fmt.Errorf("routes[%d]: channels is required", i)
+		}
+		for _, name := range route.Channels {
+			if !names[name] {
+				return fmt.Errorf("routes[%d]: unknown channel %s", i, name)
+			}
+		}
+		for _, event := range route.Events {
+			if !slices.Contains(notificationEvents, event) {
+				return fmt.Errorf("routes[%d]: unknown event type %s", i, event)
+			}
+		}
+		if route.MinSeverity == "" {
+			route.MinSeverity = "info"
+		} else if !slices.Contains(Severities, route.MinSeverity) {
+			return fmt.Errorf("routes[%d]: invalid min_severity: %s (must be info, warning, error or critical)", i, route.MinSeverity)
+		}
+		for _, pattern := range route.Databases {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("routes[%d]: invalid database pattern %q: %w", i, pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// foldShorthand moves the channels set directly below notification into channels, named after
+// their type, ahead of the listed ones
+func (n *NotificationConfig) foldShorthand() {
+	var shorthand []NotificationChannel
+	if n.WebhookURL != "" {
+		shorthand = append(shorthand, NotificationChannel{Name: "webhook", Webhook: &WebhookConfig{
+			URL:           n.WebhookURL,
+			Headers:       n.Headers,
+			SigningSecret: n.SigningSecret,
+			BodyTemplate:  n.BodyTemplate,
+		}})
+	}
+	if n.Slack != nil {
+		shorthand = append(shorthand, NotificationChannel{Name: "slack", Slack: n.Slack})
+	}
+	if n.Discord != nil {
+		shorthand = append(shorthand, NotificationChannel{Name: "discord", Discord: n.Discord})
+	}
+	if n.Teams != nil {
+		shorthand = append(shorthand, NotificationChannel{Name: "teams", Teams: n.Teams})
+	}
+	if n.GoogleChat != nil {
+		shorthand = append(shorthand, NotificationChannel{Name: "google_chat", GoogleChat: n.GoogleChat})
+	}
+	if n.Ntfy != nil {
+		shorthand = append(shorthand, NotificationChannel{Name: "ntfy", Ntfy: n.Ntfy})
+	}
+	if n.Gotify != nil {
+		shorthand = append(shorthand, NotificationChannel{Name: "gotify", Gotify: n.Gotify})
+	}
+	if n.PagerDuty != nil {
+		shorthand = append(shorthand, NotificationChannel{Name: "pagerduty", PagerDuty: n.PagerDuty})
+	}
+	if n.Opsgenie != nil {
+		shorthand = append(shorthand, NotificationChannel{Name: "opsgenie", Opsgenie: n.Opsgenie})
+	}
+	n.Channels = append(shorthand, n.Channels...)
+	n.WebhookURL, n.Headers, n.SigningSecret, n.BodyTemplate = "", nil, "", ""
+	n.Slack, n.Discord, n.Teams, n.GoogleChat = nil, nil, nil, nil
+	n.Ntfy, n.Gotify, n.PagerDuty, n.Opsgenie = nil, nil, nil, nil
+}
+
+// validateChannel checks the settings of the type a channel sets and fills in their defaults
+func validateChannel(channel *NotificationChannel) error {
+	if wh := channel.Webhook; wh != nil {
+		if wh.URL == "" {
+			return fmt.Errorf("webhook url is required")
+		}
+		if wh.BodyTemplate != "" {
+			if _, err := msgtemplate.Parse("body_template", wh.BodyTemplate); err != nil {
+				return fmt.Errorf("invalid webhook body_template: %w", err)
+			}
+		}
+	}
+	if pd := channel.PagerDuty; pd != nil {
+		if pd.RoutingKey == "" {
+			return fmt.Errorf("pagerduty routing_key is required")
+		}
+		if pd.Severity == "" {
+			pd.Severity = "error"
+		} else if !slices.Contains(Severities, pd.Severity) {
+			return fmt.Errorf("invalid pagerduty severity: %s (must be critical, error, warning or info)", pd.Severity)
+		}
+		if pd.DedupPrefix == "" {
+			pd.DedupPrefix = "pg_backup"
+		}
+		if pd.URL == "" {
+			pd.URL = "https://events.pagerduty.com/v2/enqueue"
+		}
+		if err := validateTemplate(pd.Template); err != nil {
+			return fmt.Errorf("invalid pagerduty template: %w", err)
+		}
+	}
+	if og := channel.Opsgenie; og != nil {
+		if og.APIKey == "" {
+			return fmt.Errorf("opsgenie api_key is required")
+		}
+		switch og.Priority {
+		case "":
+			og.Priority = "P3"
+		case "P1", "P2", "P3", "P4", "P5":
+			// Valid priorities
+		default:
+			return fmt.Errorf("invalid opsgenie priority: %s (must be P1 to P5)", og.Priority)
+		}
+		if og.DedupPrefix == "" {
+			og.DedupPrefix = "pg_backup"
+		}
+		if og.APIURL == "" {
+			og.APIURL = "https://api.opsgenie.com"
+		}
+		og.APIURL = strings.TrimSuffix(og.APIURL, "/")
+		if err := validateTemplate(og.Template); err != nil {
+			return fmt.Errorf("invalid opsgenie template: %w", err)
+		}
+	}
+	if ntfy := channel.Ntfy; ntfy != nil {
+		if ntfy.Topic == "" {
+			return fmt.Errorf("ntfy topic is required")
+		}
+		if ntfy.URL == "" {
+			ntfy.URL = "https://ntfy.sh"
+		}
+		ntfy.URL = strings.TrimSuffix(ntfy.URL, "/")
+		for event := range ntfy.Topics {
+			if !slices.Contains(notificationEvents, event) {
+				return fmt.Errorf("ntfy topics: unknown event type %s", event)
+			}
+		}
+		if err := validatePush("ntfy", &ntfy.MinSeverity, ntfy.Priority, 1, 5, ntfy.Template); err != nil {
+			return err
+		}
+	}
+	if gotify := channel.Gotify; gotify != nil {
+		if gotify.URL == "" {
+			return fmt.Errorf("gotify url is required")
+		}
+		if gotify.Token == "" {
+			return fmt.Errorf("gotify token is required")
+		}
+		gotify.URL = strings.TrimSuffix(gotify.URL, "/")
+		if err := validatePush("gotify", &gotify.MinSeverity, gotify.Priority, 0, 10, gotify.Template); err != nil {
+			return err
+		}
+	}
+	chats := map[string]*ChatConfig{
+		"slack":       channel.Slack,
+		"discord":     channel.Discord,
+		"teams":       channel.Teams,
+		"google_chat": channel.GoogleChat,
+	}
+	for name, chat := range chats {
+		if chat == nil {
+			continue
+		}
+		if chat.WebhookURL == "" {
+			return fmt.Errorf("%s webhook_url is required", name)
+		}
+		if chat.MinSeverity == "" {
+			chat.MinSeverity = "info"
+		} else if !slices.Contains(Severities, chat.MinSeverity) {
+			return fmt.Errorf("invalid %s min_severity: %s (must be info, warning, error or critical)", name, chat.MinSeverity)
+		}
+		for event, severity := range chat.Severity {
+			if !slices.Contains(notificationEvents, event) {
+				return fmt.Errorf("%s severity: unknown event type %s", name, event)
+			}
+			if !slices.Contains(Severities, severity) {
+				return fmt.Errorf("invalid %s severity of %s: %s (must be info, warning, error or critical)", name, event, severity)
+			}
+		}
+		if err := validateTemplate(chat.Template); err != nil {
+			return fmt.Errorf("invalid %s template: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// validatePush checks the settings ntfy and gotify share, with priorities from low to high
+func validatePush(name string, minSeverity *string, priority map[string]int, low, high int, template *MessageTemplate) error {
+	if *minSeverity == "" {
+		*minSeverity = "info"
+	} else if !slices.Contains(Severities, *minSeverity) {
+		return fmt.Errorf("invalid %s min_severity: %s (must be info, warning, error or critical)", name, *minSeverity)
+	}
+	for event, p := range priority {
+		if !slices.Contains(notificationEvents, event) {
+			return fmt.Errorf("%s priority: unknown event type %s", name, event)
+		}
+		if p < low || p > high {
+			return fmt.Errorf("invalid %s priority of %s: %d (must be %d to %d)", name, event, p, low, high)
+		}
+	}
+	if err := validateTemplate(template); err != nil {
+		return fmt.Errorf("invalid %s template: %w", name, err)
+	}
+	return nil
+}
+
+// validateTemplate parses the parts of a message template, so a typo fails at startup instead
+// of each notification
+func validateTemplate(t *MessageTemplate) error {
+	if t == nil {
+		return nil
+	}
+	if _, err := msgtemplate.Parse("title", t.Title); err != nil {
+		return err
+	}
+	_, err := msgtemplate.Parse("body", t.Body)
+	return err
+}
+
+func validateTrend(t *TrendConfig) error {
+	if t.Window <= 0 {
+		t.Window = 10
+	}
+	if t.MinRuns <= 0 {
+		t.MinRuns = 3
+	}
+	if t.MinRuns > t.Window {
+		return fmt.Errorf("backup trend min_runs (%d) must not exceed window (%d)", t.MinRuns, t.Window)
+	}
+	if t.MaxDeviation < 0 {
+		return fmt.Errorf("backup trend max_deviation must not be negative")
+	}
+	if t.MaxDeviation == 0 {
+		t.MaxDeviation = 50
+	}
+	if t.MaxDuration < 0 {
+		return fmt.Errorf("backup trend max_duration must not be negative")
+	}
+	if t.MaxSizeChange < 0 {
+		return fmt.Errorf("backup trend max_size_change must not be negative")
+	}
+	return nil
+}
+
+func validateVerifyChecks(checks []VerifyCheck, databases []string) error {
+	seen := make(map[string]bool)
+	for i := range checks {
+		check := &checks[i]
+		if check.Name == "" {
+			return fmt.Errorf("verify check %d: name is required", i+1)
+		}
+		if seen[check.Name] {
+			return fmt.Errorf("duplicate verify check: %s", check.Name)
+		}
+		seen[check.Name] = true
+		if strings.TrimSpace(check.Query) == "" {
+			return fmt.Errorf("verify check %s: query is required", check.Name)
+		}
+		if check.Database != "" && !slices.Contains(databases, check.Database) {
+			return fmt.Errorf("verify check %s: database %s is not backed up", check.Name, check.Database)
+		}
+		if check.Expect == "" {
+			check.Expect = "t"
+		}
+	}
+	return nil
+}
+
+func validateVerify(v *VerifyConfig) error {
+	if v.SSH != nil {
+		if v.SSH.Host == "" {
+			return fmt.Errorf("verify SSH host is required")
+		}
+		if v.SSH.Port == 0 {
+			v.SSH.Port = 22
+		}
+		if v.SSH.Username == "" {
+			return fmt.Errorf("verify SSH username is required")
+		}
+		if v.SSH.Password == "" && v.SSH.KeyPath == "" {
+			return fmt.Errorf("either verify SSH password or key path is required")
+		}
+	}
+	if v.Username == "" {
+		return fmt.Errorf("verify username is required when verification is enabled")
+	}
+	if v.Host == "" {
+		v.Host = "localhost"
+	}
+	if v.Port == 0 {
+		v.Port = 5432
+	}
+	if v.TempDir == "" {
+		v.TempDir = "/tmp"
+	}
+	if v.Jobs <= 0 {
+		v.Jobs = 1
+	}
+	if v.MinTables == 0 {
+		v.MinTables = 1
+	}
+	return nil
+}
+
+var (
+	systemIdentifierRegex = regexp.MustCompile(`^[0-9]+$`)
+	markerTableRegex      = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+)
+
+func (c *Config) validateIdentity() error {
+	identity := c.Postgres.Identity
+	if identity.SystemIdentifier != "" && !systemIdentifierRegex.MatchString(identity.SystemIdentifier) {
+		return fmt.Errorf("invalid postgres identity system_identifier: %s (must be numeric)", identity.SystemIdentifier)
+	}
+	if identity.MarkerTable != "" && !markerTableRegex.MatchString(identity.MarkerTable) {
+		return fmt.Errorf("invalid postgres identity marker_table: %s (must be table or schema.table)", identity.MarkerTable)
+	}
+
+	databases := make(map[string]bool)
+	for _, db := range c.BackupDatabases() {
+		databases[db] = true
+	}
+	for db := range identity.DatabaseOIDs {
+		if !databases[db] {
+			return fmt.Errorf("postgres identity database_oids references %s, which is not backed up", db)
+		}
+	}
+	return nil
+}
+
+var envNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func validateEnv(env map[string]string, taskName string) error {
+	for key := range env {
+		if !envNameRegex.MatchString(key) {
+			return fmt.Errorf("invalid %s env variable name: %q", taskName, key)
+		}
+	}
+	return nil
+}
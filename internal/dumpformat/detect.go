@@ -0,0 +1,84 @@
+package dumpformat
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/hra42/pg_backup/internal/compression"
+	"github.com/hra42/pg_backup/internal/shell"
+)
+
+// Dump formats a restore can read. Directory format dumps are not single files and can't be
+// stored as one object.
+const (
+	Custom = "custom" // pg_dump -Fc, restored with pg_restore
+	Tar    = "tar"    // pg_dump -Ft, restored with pg_restore without --jobs
+	Plain  = "plain"  // SQL script, e.g. pg_dump -Fp or pg_dumpall, replayed with psql
+)
+
+// sniffLength covers the tar header, whose magic sits at byte 257
+const sniffLength = 512
+
+// compressionMagic are the first bytes of files written by the external compressors
+var compressionMagic = map[string][]byte{
+	compression.Gzip: {0x1f, 0x8b},
+	compression.Zstd: {0x28, 0xb5, 0x2f, 0xfd},
+	compression.LZ4:  {0x04, 0x22, 0x4d, 0x18},
+}
+
+// Kind returns the dump format of an uncompressed dump from its first bytes. Anything that is
+// neither a custom nor a tar archive is taken for an SQL script.
+func Kind(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, []byte(magic)):
+		return Custom
+	case len(header) >= 262 && bytes.Equal(header[257:262], []byte("ustar")):
+		return Tar
+	}
+	return Plain
+}
+
+// Compression returns the external algorithm a file was compressed with from its first bytes,
+// or "" if it isn't compressed by one
+func Compression(header []byte) string {
+	for name, prefix := range compressionMagic {
+		if bytes.HasPrefix(header, prefix) {
+			return name
+		}
+	}
+	return ""
+}
+
+// DetectFile returns the dump format of a local file and the external compression around it,
+// both from the file's content rather than its name, so dumps written by other tools are
+// recognized too. algorithm is "" for uncompressed files.
+func DetectFile(path string) (format, algorithm string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	header := make([]byte, sniffLength)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", "", fmt.Errorf("failed to read dump header: %w", err)
+	}
+	header = header[:n]
+
+	algorithm = Compression(header)
+	if algorithm == "" {
+		return Kind(header), "", nil
+	}
+
+	// head exits after the header, so the decompressor is stopped by SIGPIPE
+	out, err := exec.Command("sh", "-c", fmt.Sprintf("%s < %s | head -c %d",
+		compression.DecompressCommand(algorithm), shell.Quote(path), sniffLength)).Output()
+	if err != nil {
+		return "", algorithm, fmt.Errorf("failed to decompress dump header with %s: %w", algorithm, err)
+	}
+	return Kind(out), algorithm, nil
+}
@@ -0,0 +1,124 @@
+package dumpformat
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hra42/pg_backup/internal/compression"
+	"github.com/hra42/pg_backup/internal/shell"
+)
+
+// magic starts every custom format archive
+const magic = "PGDMP"
+
+// Version is the archive format version in a custom format dump's header. It changes
+// independently of the server version, so it is what decides which pg_restore can read a dump.
+type Version struct {
+	Major int
+	Minor int
+	Rev   int
+}
+
+func (v Version) String() string {
+	if v.Rev != 0 {
+		return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Rev)
+	}
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// formats maps archive versions to the first PostgreSQL major version whose pg_restore reads
+// them (K_VERS_* in pg_dump's pg_backup_archiver.h). A new format needs one line here.
+var formats = []struct {
+	Version   Version
+	MinClient int
+}{
+	{Version{1, 12, 0}, 9},  // 9.0: separate large object entries
+	{Version{1, 13, 0}, 9},  // 9.3+ minor releases of February 2018: search_path handling
+	{Version{1, 14, 0}, 12}, // 12: table access methods
+	{Version{1, 15, 0}, 16}, // 16: compression algorithm in the header
+	{Version{1, 16, 0}, 17}, // 17: large object metadata entries and relkind
+}
+
+// MinClient returns the PostgreSQL major version of the oldest pg_restore that reads the given
+// format. ok is false for formats missing from the table, e.g. ones newer than this build.
+func MinClient(v Version) (major int, ok bool) {
+	for _, f := range formats {
+		if f.Version.Major == v.Major && f.Version.Minor == v.Minor {
+			return f.MinClient, true
+		}
+	}
+	return 0, false
+}
+
+// Parse reads a version as written by String or reported by pg_restore, e.g. "1.16"
+func Parse(s string) (Version, error) {
+	parts := strings.Split(strings.TrimSpace(s), ".")
+	if len(parts) < 2 || len(parts) > 3 {
+		return Version{}, fmt.Errorf("invalid dump format version %q", s)
+	}
+	var numbers [3]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return Version{}, fmt.Errorf("invalid dump format version %q", s)
+		}
+		numbers[i] = n
+	}
+	return Version{Major: numbers[0], Minor: numbers[1], Rev: numbers[2]}, nil
+}
+
+// ReadHeader reads the format version from the start of a custom format dump
+func ReadHeader(r io.Reader) (Version, error) {
+	header := make([]byte, len(magic)+3)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return Version{}, fmt.Errorf("failed to read dump header: %w", err)
+	}
+	if !bytes.Equal(header[:len(magic)], []byte(magic)) {
+		return Version{}, fmt.Errorf("not a custom format dump (missing %s header)", magic)
+	}
+	return Version{
+		Major: int(header[len(magic)]),
+		Minor: int(header[len(magic)+1]),
+		Rev:   int(header[len(magic)+2]),
+	}, nil
+}
+
+// ReadFile reads the format version of a local dump file. Externally compressed dumps are
+// recognized by their extension and only decompressed as far as the header.
+func ReadFile(path string) (Version, error) {
+	algorithm := compression.Detect(path)
+	if algorithm == "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return Version{}, err
+		}
+		defer f.Close()
+		return ReadHeader(f)
+	}
+
+	// head exits after the header, so the decompressor is stopped by SIGPIPE
+	out, err := exec.Command("sh", "-c", fmt.Sprintf("%s < %s | head -c %d",
+		compression.DecompressCommand(algorithm), shell.Quote(path), len(magic)+3)).Output()
+	if err != nil {
+		return Version{}, fmt.Errorf("failed to decompress dump header with %s: %w", algorithm, err)
+	}
+	return ReadHeader(bytes.NewReader(out))
+}
+
+var clientVersion = regexp.MustCompile(`PostgreSQL\) (\d+)`)
+
+// ClientMajor extracts the major version from pg_restore --version output, e.g. 16 from
+// "pg_restore (PostgreSQL) 16.2"; all 9.x releases count as 9
+func ClientMajor(output string) (int, error) {
+	matches := clientVersion.FindStringSubmatch(output)
+	if matches == nil {
+		return 0, fmt.Errorf("unrecognized pg_restore version %q", strings.TrimSpace(output))
+	}
+	return strconv.Atoi(matches[1])
+}
@@ -0,0 +1,167 @@
+package events
+
+import (
+	"fmt"
+	"time"
+)
+
+// Stage names a step of a backup or restore run
+type Stage string
+
+const (
+	StageRun         Stage = "run" // A whole backup of one database or a whole restore
+	StageConnect     Stage = "ssh_connection"
+	StagePreflight   Stage = "preflight" // Run lock, identity assertions and disk space check
+	StageDump        Stage = "dump"
+	StageTransfer    Stage = "transfer"
+	StageUpload      Stage = "upload"
+	StageVerify      Stage = "verify"
+	StageStandby     Stage = "standby"
+	StageRetention   Stage = "retention"
+	StageSelect      Stage = "backup_selection"
+	StageDownload    Stage = "download"
+	StageDecompress  Stage = "decompress"
+	StageGlobals     Stage = "globals" // Replay of the roles stored with the backup, restore.restore_globals
+	StageRestore     Stage = "restore"
+	StageMask        Stage = "mask"             // Masking of restored data with restore.masking_rules
+	StagePostRestore Stage = "post_restore"     // restore.post_sql and restore.post_hooks
+	StageDrill       Stage = "drill_validation" // Checks of a restore drill's scratch database
+)
+
+// TimeoutError reports a stage that ran out of time. Setting names the expired key of the
+// timeouts section, so a slow transfer isn't mistaken for a failed dump.
+type TimeoutError struct {
+	Stage   Stage
+	Setting string // e.g. "transfer", or "total" when the run's budget ran out
+	Limit   time.Duration
+	Err     error
+}
+
+func (e *TimeoutError) Error() string {
+	if e.Setting == "total" {
+		return fmt.Sprintf("backup budget of %s (timeouts.total) ran out during the %s stage: %v", e.Limit, e.Stage, e.Err)
+	}
+	return fmt.Sprintf("%s stage timed out after %s (timeouts.%s): %v", e.Stage, e.Limit, e.Setting, e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// Job is the kind of run an event belongs to
+type Job string
+
+const (
+	JobBackup  Job = "backup"
+	JobRestore Job = "restore"
+	JobDrill   Job = "restore_drill"
+)
+
+// Event identifies the run, database and stage an event belongs to
+type Event struct {
+	RunID    string
+	Job      Job
+	Database string
+	Stage    Stage
+	Time     time.Time
+	Duration time.Duration // Set for OnComplete and OnError
+}
+
+// Progress reports bytes processed by a long running stage (transfer, upload, download)
+type Progress struct {
+	Event
+	Bytes   int64
+	Total   int64   // 0 when the total size is unknown
+	Percent float64 // Bytes as a percentage of Total, 0 when the total size is unknown
+}
+
+// Listener receives run events, so applications can drive their own UIs and metrics
+// without scraping logs. Backups of several databases run concurrently, so
+// implementations must be safe for concurrent use and should return quickly.
+type Listener interface {
+	OnStageStart(event Event)
+	OnProgress(progress Progress)
+	OnComplete(event Event)
+	OnError(event Event, err error)
+}
+
+// NopListener ignores all events. Embed it to implement only the callbacks you need.
+type NopListener struct{}
+
+func (NopListener) OnStageStart(Event)   {}
+func (NopListener) OnProgress(Progress)  {}
+func (NopListener) OnComplete(Event)     {}
+func (NopListener) OnError(Event, error) {}
+
+// Multi fans events out to several listeners in order
+type Multi []Listener
+
+func (m Multi) OnStageStart(event Event) {
+	for _, l := range m {
+		l.OnStageStart(event)
+	}
+}
+
+func (m Multi) OnProgress(progress Progress) {
+	for _, l := range m {
+		l.OnProgress(progress)
+	}
+}
+
+func (m Multi) OnComplete(event Event) {
+	for _, l := range m {
+		l.OnComplete(event)
+	}
+}
+
+func (m Multi) OnError(event Event, err error) {
+	for _, l := range m {
+		l.OnError(event, err)
+	}
+}
+
+// Emitter wraps a Listener with the run context so callers only name the stage
+type Emitter struct {
+	Listener Listener
+	RunID    string
+	Job      Job
+	Database string
+}
+
+func (e Emitter) event(stage Stage) Event {
+	return Event{
+		RunID:    e.RunID,
+		Job:      e.Job,
+		Database: e.Database,
+		Stage:    stage,
+		Time:     time.Now(),
+	}
+}
+
+// Stage runs fn between OnStageStart and OnComplete, or OnError if it fails
+func (e Emitter) Stage(stage Stage, fn func() error) error {
+	event := e.event(stage)
+	e.Listener.OnStageStart(event)
+
+	err := fn()
+	event.Duration = time.Since(event.Time)
+	if err != nil {
+		e.Listener.OnError(event, err)
+		return err
+	}
+	e.Listener.OnComplete(event)
+	return nil
+}
+
+// Progress reports progress for a stage
+func (e Emitter) Progress(stage Stage, bytes, total int64) {
+	progress := Progress{
+		Event: e.event(stage),
+		Bytes: bytes,
+		Total: total,
+	}
+	if total > 0 {
+		progress.Percent = min(float64(bytes)/float64(total)*100, 100)
+	}
+	e.Listener.OnProgress(progress)
+}
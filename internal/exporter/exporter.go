@@ -0,0 +1,210 @@
+package exporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hra42/pg_backup/internal/config"
+	"github.com/hra42/pg_backup/internal/events"
+)
+
+// queueSize bounds the events waiting for a slow exporter; further events are dropped so a
+// stuck exporter never stalls a backup
+const queueSize = 256
+
+// closeTimeout is how long an exporter may keep running after its stdin was closed
+const closeTimeout = 10 * time.Second
+
+// Message is the JSON line written to an exporter's stdin for every event
+type Message struct {
+	Type     string       `json:"type"` // stage_start, progress, complete or error
+	RunID    string       `json:"run_id"`
+	Job      events.Job   `json:"job"`
+	Database string       `json:"database,omitempty"`
+	Stage    events.Stage `json:"stage"`
+	Time     time.Time    `json:"time"`
+	Duration float64      `json:"duration_seconds,omitempty"` // complete and error
+	Bytes    int64        `json:"bytes,omitempty"`            // progress
+	Total    int64        `json:"total,omitempty"`            // progress
+	Percent  float64      `json:"percent,omitempty"`          // progress
+	Error    string       `json:"error,omitempty"`            // error
+}
+
+// Exporter is an events.Listener that streams events to an external command, one JSON line per
+// event on its stdin. The command runs for the duration of a run and sees EOF when it ends, so
+// it can translate events to any monitoring backend (StatsD, InfluxDB line protocol, ...).
+type Exporter struct {
+	progress bool
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	logger   *slog.Logger
+
+	mu      sync.Mutex
+	queue   chan []byte
+	closed  bool
+	dropped int
+	done    chan struct{}
+}
+
+// Start runs the exporter command with sh
+func Start(cfg config.ExporterConfig, logger *slog.Logger) (*Exporter, error) {
+	cmd := exec.Command("sh", "-c", cfg.Command)
+	// Own process group, so killing a stuck exporter also stops what sh started
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stdin of exporter %s: %w", cfg.Name, err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start exporter %s: %w", cfg.Name, err)
+	}
+
+	e := &Exporter{
+		progress: cfg.Progress,
+		cmd:      cmd,
+		stdin:    stdin,
+		logger:   logger.With(slog.String("exporter", cfg.Name)),
+		queue:    make(chan []byte, queueSize),
+		done:     make(chan struct{}),
+	}
+	go e.write()
+	return e, nil
+}
+
+// StartAll starts the configured exporters and returns them as one listener along with the
+// function that stops them. Exporters that fail to start are logged and skipped; monitoring
+// never fails a run.
+func StartAll(configs []config.ExporterConfig, logger *slog.Logger) (events.Listener, func()) {
+	var started []*Exporter
+	listeners := events.Multi{}
+	for _, cfg := range configs {
+		e, err := Start(cfg, logger)
+		if err != nil {
+			logger.Warn("Failed to start exporter", slog.String("error", err.Error()))
+			continue
+		}
+		started = append(started, e)
+		listeners = append(listeners, e)
+	}
+	return listeners, func() {
+		for _, e := range started {
+			e.Close()
+		}
+	}
+}
+
+// write feeds queued events to the command until the queue is closed. A command that stops
+// reading only loses its own events.
+func (e *Exporter) write() {
+	defer close(e.done)
+	broken := false
+	for line := range e.queue {
+		if broken {
+			continue
+		}
+		if _, err := e.stdin.Write(line); err != nil {
+			e.logger.Warn("Exporter stopped accepting events", slog.String("error", err.Error()))
+			broken = true
+		}
+	}
+	e.stdin.Close()
+}
+
+// Close delivers the queued events, closes the command's stdin and waits for it to exit, killing
+// it after closeTimeout
+func (e *Exporter) Close() {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return
+	}
+	e.closed = true
+	close(e.queue)
+	dropped := e.dropped
+	e.mu.Unlock()
+
+	// Killing a command that stopped reading also unblocks a pending write
+	finished := make(chan error, 1)
+	go func() {
+		<-e.done
+		finished <- e.cmd.Wait()
+	}()
+	select {
+	case err := <-finished:
+		if err != nil {
+			e.logger.Warn("Exporter exited with an error", slog.String("error", err.Error()))
+		}
+	case <-time.After(closeTimeout):
+		e.logger.Warn("Exporter did not exit after the run, killing it")
+		syscall.Kill(-e.cmd.Process.Pid, syscall.SIGKILL)
+		<-finished
+	}
+	if dropped > 0 {
+		e.logger.Warn("Exporter fell behind, events were dropped", slog.Int("dropped", dropped))
+	}
+}
+
+func (e *Exporter) send(message Message) {
+	line, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return
+	}
+	select {
+	case e.queue <- line:
+	default:
+		e.dropped++
+	}
+}
+
+func newMessage(kind string, event events.Event) Message {
+	return Message{
+		Type:     kind,
+		RunID:    event.RunID,
+		Job:      event.Job,
+		Database: event.Database,
+		Stage:    event.Stage,
+		Time:     event.Time,
+		Duration: event.Duration.Seconds(),
+	}
+}
+
+func (e *Exporter) OnStageStart(event events.Event) {
+	e.send(newMessage("stage_start", event))
+}
+
+func (e *Exporter) OnProgress(progress events.Progress) {
+	if !e.progress {
+		return
+	}
+	message := newMessage("progress", progress.Event)
+	message.Bytes = progress.Bytes
+	message.Total = progress.Total
+	message.Percent = progress.Percent
+	e.send(message)
+}
+
+func (e *Exporter) OnComplete(event events.Event) {
+	e.send(newMessage("complete", event))
+}
+
+func (e *Exporter) OnError(event events.Event, err error) {
+	message := newMessage("error", event)
+	message.Error = err.Error()
+	e.send(message)
+}
@@ -0,0 +1,77 @@
+package lock
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrLocked is returned when another run already holds the lock
+var ErrLocked = errors.New("lock is held by another run")
+
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// Name returns the lock name for a database, unique per server so two configs pointing at
+// the same database share one lock
+func Name(host string, port int, database string) string {
+	return unsafeNameChars.ReplaceAllString(fmt.Sprintf("%s_%d_%s", host, port, database), "-")
+}
+
+// Owner describes the run holding a lock; it is written into the lock file and S3 lock object
+func Owner(runID string) []byte {
+	hostname, _ := os.Hostname()
+	data, _ := json.Marshal(map[string]interface{}{
+		"run_id":      runID,
+		"hostname":    hostname,
+		"pid":         os.Getpid(),
+		"acquired_at": time.Now().UTC().Format(time.RFC3339),
+	})
+	return data
+}
+
+// FileLock is an exclusive flock on a local file. The kernel releases it when the process
+// exits, so a crashed run never leaves a stale local lock behind.
+type FileLock struct {
+	file *os.File
+}
+
+// AcquireFile takes the lock on path without blocking
+func AcquireFile(path string, owner []byte) (*FileLock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		holder, _ := io.ReadAll(file)
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%w: %s (held by %s)", ErrLocked, path, strings.TrimSpace(string(holder)))
+		}
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+
+	// Record the holder for whoever finds the lock taken; failures here don't affect locking
+	file.Truncate(0)
+	file.WriteAt(owner, 0)
+
+	return &FileLock{file: file}, nil
+}
+
+// Release unlocks the file. The file itself is left in place; removing it would let two
+// runs lock different inodes under the same path.
+func (l *FileLock) Release() error {
+	defer l.file.Close()
+	return syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+}
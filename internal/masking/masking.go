@@ -0,0 +1,117 @@
+package masking
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Masks replace a column's values with an SQL expression of the original value. All but null
+// are deterministic, so equal values stay equal and joins across tables keep working.
+var masks = map[string]string{
+	"null":   "NULL",
+	"hash":   "md5(%s::text)",
+	"email":  "'user_' || left(md5(%s::text), 12) || '@example.invalid'",
+	"name":   "'Person ' || left(md5(%s::text), 8)",
+	"phone":  "'+1-555-' || lpad((abs(hashtext(%s::text)::bigint) % 10000000)::text, 7, '0')",
+	"redact": "repeat('x', length(%s::text))",
+}
+
+// Rule masks one column
+type Rule struct {
+	Column string `yaml:"column"` // schema.table.column, or table.column for the public schema
+	Mask   string `yaml:"mask"`   // null, hash, email, name, phone or redact
+}
+
+// Rules is a masking rules file
+type Rules struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+// split returns the schema, table and column a rule masks
+func (r Rule) split() (string, string, string) {
+	parts := strings.Split(r.Column, ".")
+	if len(parts) == 2 {
+		return "public", parts[0], parts[1]
+	}
+	if len(parts) == 3 {
+		return parts[0], parts[1], parts[2]
+	}
+	return "", "", ""
+}
+
+// LoadRules reads masking rules from a YAML file
+func LoadRules(path string) (*Rules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read masking rules: %w", err)
+	}
+	var rules Rules
+	if err := yaml.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse masking rules: %w", err)
+	}
+	if len(rules.Rules) == 0 {
+		return nil, fmt.Errorf("masking rules file %s has no rules", path)
+	}
+
+	seen := make(map[string]bool)
+	for _, rule := range rules.Rules {
+		schema, table, column := rule.split()
+		if schema == "" || table == "" || column == "" {
+			return nil, fmt.Errorf("masking rule %q: column must be schema.table.column or table.column", rule.Column)
+		}
+		// yaml reads an unquoted null as no value
+		if rule.Mask == "" {
+			return nil, fmt.Errorf("masking rule %s: mask is required (quote \"null\")", rule.Column)
+		}
+		if _, ok := masks[rule.Mask]; !ok {
+			return nil, fmt.Errorf("masking rule %s: unknown mask %q", rule.Column, rule.Mask)
+		}
+		if seen[rule.Column] {
+			return nil, fmt.Errorf("masking rule %s: column is listed twice", rule.Column)
+		}
+		seen[rule.Column] = true
+	}
+	return &rules, nil
+}
+
+// Tables returns the tables the rules touch, as schema.table
+func (r *Rules) Tables() []string {
+	var tables []string
+	for _, rule := range r.Rules {
+		schema, table, _ := rule.split()
+		if name := schema + "." + table; !slices.Contains(tables, name) {
+			tables = append(tables, name)
+		}
+	}
+	return tables
+}
+
+// SQL returns one UPDATE per table that masks all of its ruled columns. The statements are
+// meant to run in a single transaction, so a failed rule leaves no table half masked.
+func (r *Rules) SQL() string {
+	var statements []string
+	for _, name := range r.Tables() {
+		var assignments []string
+		for _, rule := range r.Rules {
+			schema, table, column := rule.split()
+			if schema+"."+table != name {
+				continue
+			}
+			assignments = append(assignments, fmt.Sprintf("%s = %s",
+				quoteIdent(column), strings.ReplaceAll(masks[rule.Mask], "%s", quoteIdent(column))))
+		}
+		schema, table, _ := strings.Cut(name, ".")
+		statements = append(statements, fmt.Sprintf("UPDATE %s.%s SET %s;",
+			quoteIdent(schema), quoteIdent(table), strings.Join(assignments, ", ")))
+	}
+	return strings.Join(statements, "\n")
+}
+
+// quoteIdent quotes an SQL identifier
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
@@ -0,0 +1,48 @@
+// Package msgtemplate parses and renders the text/template templates notification messages are
+// customized with, so the configuration can be checked with the same functions the messages
+// are rendered with
+package msgtemplate
+
+import (
+	"encoding/json"
+	"strings"
+	"text/template"
+)
+
+// funcs are the functions templates can call besides the text/template builtins
+var funcs = template.FuncMap{
+	// json renders a value as JSON, e.g. a quoted and escaped string in a JSON body
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"join":  strings.Join,
+	// default returns fallback for an empty value: {{.Stage | default "unknown"}}
+	"default": func(fallback, value string) string {
+		if value == "" {
+			return fallback
+		}
+		return value
+	},
+}
+
+// Parse parses a message template. Map keys that aren't set, e.g. {{.Env.TEAM}} without TEAM,
+// render as empty strings.
+func Parse(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(funcs).Option("missingkey=zero").Parse(text)
+}
+
+// Render parses text and executes it with data
+func Render(name, text string, data any) (string, error) {
+	tmpl, err := Parse(name, text)
+	if err != nil {
+		return "", err
+	}
+	var out strings.Builder
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
@@ -0,0 +1,247 @@
+package notification
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hra42/pg_backup/internal/config"
+)
+
+// defaultSeverity is the severity of each event unless a channel's severity overrides it
+var defaultSeverity = map[EventType]string{
+	EventBackupSuccess:  "info",
+	EventRestoreSuccess: "info",
+	EventDrillSuccess:   "info",
+	EventBackupWarning:  "warning",
+	EventRunSkipped:     "warning",
+	EventRunMissed:      "warning",
+	EventBackupFailure:  "error",
+	EventRestoreFailure: "error",
+	EventCheckFailed:    "error",
+	EventCleanupWarning: "warning",
+	EventCleanupFailure: "error",
+}
+
+// severityStyle is how chat messages show a severity
+var severityStyle = map[string]struct {
+	emoji string
+	color int
+}{
+	"info":     {"✅", 0x2EB67D},
+	"warning":  {"⚠️", 0xECB22E},
+	"error":    {"❌", 0xE01E5A},
+	"critical": {"🚨", 0x8B0000},
+}
+
+// severity returns the severity of event on a chat channel
+func severity(cfg *config.ChatConfig, event EventType) string {
+	if severity, ok := cfg.Severity[string(event)]; ok {
+		return severity
+	}
+	return defaultSeverity[event]
+}
+
+// chatMessage is an event rendered for people: a title, labeled fields, and details such as
+// the error message
+type chatMessage struct {
+	Severity string
+	Title    string
+	Fields   []chatField
+	Detail   string // Shown as a code block
+	Text     string // Rendered body template, shown instead of the fields and detail
+	Footer   string
+	Time     string // RFC 3339
+}
+
+type chatField struct {
+	Name  string
+	Value string
+}
+
+// sendChat posts payload to a chat webhook, rendered by render, unless the event is below the
+// channel's min_severity
+func (n *NotificationClient) sendChat(channel string, cfg *config.ChatConfig, payload NotificationPayload, render func(chatMessage) any) error {
+	level := severity(cfg, payload.EventType)
+	if slices.Index(config.Severities, level) < slices.Index(config.Severities, cfg.MinSeverity) {
+		n.logger.Debug("Skipping chat notification below min_severity",
+			slog.String("channel", channel),
+			slog.String("event_type", string(payload.EventType)),
+			slog.String("severity", level))
+		return nil
+	}
+
+	message := newChatMessage(payload, level)
+	n.applyTemplate(channel, cfg.Template, &message, payload)
+	body, err := json.Marshal(render(message))
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s message: %w", channel, err)
+	}
+
+	n.logger.Debug("Sending chat notification",
+		slog.String("channel", channel),
+		slog.String("event_type", string(payload.EventType)),
+		slog.String("database", payload.Database))
+
+	return n.post(channel, cfg.WebhookURL, nil, body, payload.EventType)
+}
+
+// newChatMessage renders the fields of payload that are set
+func newChatMessage(payload NotificationPayload, severity string) chatMessage {
+	message := chatMessage{
+		Severity: severity,
+		Title:    eventTitle(payload),
+		Footer:   payload.Hostname + " · pg_backup " + payload.Version,
+		Time:     payload.Timestamp,
+	}
+	add := func(name, value string) {
+		message.Fields = append(message.Fields, chatField{name, value})
+	}
+
+	if payload.Database != "" {
+		add("Database", payload.Database)
+	}
+	if payload.Task != nil {
+		add("Task", *payload.Task)
+	}
+	if payload.Stage != nil {
+		add("Failed stage", *payload.Stage)
+	}
+	if payload.Duration != nil {
+		add("Duration", *payload.Duration)
+	}
+	if payload.BackupSize != nil {
+		add("Size", formatSize(float64(*payload.BackupSize)))
+	}
+	if payload.BackupKey != nil {
+		add("Backup", "`"+*payload.BackupKey+"`")
+	}
+	if payload.Tables != nil && payload.Rows != nil {
+		add("Restored", fmt.Sprintf("%d tables, %d rows", *payload.Tables, *payload.Rows))
+	}
+	if payload.ChecksPassed != nil {
+		add("Checks passed", strconv.Itoa(*payload.ChecksPassed))
+	}
+	if payload.Retries != nil {
+		add("Retries", strconv.Itoa(*payload.Retries))
+	}
+	if payload.SkippedRuns != nil {
+		add("Skipped runs", strconv.Itoa(*payload.SkippedRuns))
+	}
+	if payload.DueAt != nil {
+		add("Due at", *payload.DueAt)
+	}
+	if payload.Deleted != nil {
+		add("Deleted backups", strconv.Itoa(*payload.Deleted))
+	}
+	if payload.WarningCount != nil {
+		add("Warnings", strconv.Itoa(*payload.WarningCount))
+	}
+	if payload.IncidentKey != nil {
+		add("Incident logs", "`"+*payload.IncidentKey+"`")
+	}
+	if payload.ReportURL != nil {
+		add("Run report", *payload.ReportURL)
+	}
+	if payload.Error != nil {
+		message.Detail = *payload.Error
+	}
+	if len(payload.LogTail) > 0 {
+		message.Detail += "\n\nLast log lines:\n" + logTail(payload.LogTail, 2000)
+	}
+	// The warnings are what these events are about
+	if payload.EventType == EventBackupWarning || payload.EventType == EventCleanupWarning {
+		message.Detail = strings.Join(payload.Warnings, "\n")
+	}
+	return message
+}
+
+// logTail joins the last lines that fit in limit bytes, so messages with a length limit keep
+// the lines closest to the failure
+func logTail(lines []string, limit int) string {
+	start := len(lines)
+	for size := 0; start > 0 && size+len(lines[start-1])+1 <= limit; start-- {
+		size += len(lines[start-1]) + 1
+	}
+	if start == len(lines) {
+		return truncate(lines[len(lines)-1], limit)
+	}
+	return strings.Join(lines[start:], "\n")
+}
+
+// eventTitle summarizes an event in a sentence
+func eventTitle(payload NotificationPayload) string {
+	var task string
+	if payload.Task != nil {
+		task = *payload.Task
+	}
+	switch payload.EventType {
+	case EventBackupSuccess:
+		return "Backup of " + payload.Database + " succeeded"
+	case EventBackupFailure:
+		return "Backup of " + payload.Database + " failed"
+	case EventBackupWarning:
+		return "Backup of " + payload.Database + " deviates from recent runs"
+	case EventRestoreSuccess:
+		return "Restore into " + payload.Database + " succeeded"
+	case EventRestoreFailure:
+		if payload.Drill {
+			return "Restore drill failed"
+		}
+		return "Restore into " + payload.Database + " failed"
+	case EventDrillSuccess:
+		return "Restore drill of " + payload.Database + " passed"
+	case EventRunSkipped:
+		return "Scheduled " + task + " skipped, the previous run is still going"
+	case EventRunMissed:
+		return "Scheduled " + task + " was missed while the scheduler was down"
+	case EventCheckFailed:
+		return "Startup check of " + task + " failed"
+	case EventCleanupWarning:
+		return "Retention cleanup needs attention"
+	case EventCleanupFailure:
+		return "Retention cleanup failed"
+	}
+	return string(payload.EventType)
+}
+
+// truncate shortens s to at most limit bytes for fields with a length limit
+func truncate(s string, limit int) string {
+	if len(s) <= limit {
+		return s
+	}
+	s = s[:limit-len("…")]
+	// Don't cut a multi-byte character in half
+	for !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s + "…"
+}
+
+// formatSize renders a byte count with a binary unit, e.g. 1.5 GiB
+func formatSize(bytes float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	unit := 0
+	for bytes >= 1024 && unit < len(units)-1 {
+		bytes /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%.0f %s", bytes, units[unit])
+	}
+	return fmt.Sprintf("%.1f %s", bytes, units[unit])
+}
+
+// chatTime parses the RFC 3339 timestamp of a message, or returns the current time
+func chatTime(timestamp string) time.Time {
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return time.Now()
+	}
+	return t
+}
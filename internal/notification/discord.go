@@ -0,0 +1,51 @@
+package notification
+
+// discordPayload is a message of a Discord webhook with a single embed, colored by the severity
+type discordPayload struct {
+	Username string         `json:"username"`
+	Embeds   []discordEmbed `json:"embeds"`
+}
+
+type discordEmbed struct {
+	Title       string         `json:"title"`
+	Description string         `json:"description,omitempty"`
+	Color       int            `json:"color"`
+	Fields      []discordField `json:"fields,omitempty"`
+	Footer      discordFooter  `json:"footer"`
+	Timestamp   string         `json:"timestamp,omitempty"`
+}
+
+type discordField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline"`
+}
+
+type discordFooter struct {
+	Text string `json:"text"`
+}
+
+// discordMessage renders a message as a Discord embed, within Discord's length limits
+func discordMessage(message chatMessage) any {
+	style := severityStyle[message.Severity]
+	embed := discordEmbed{
+		Title:     truncate(style.emoji+" "+message.Title, 256),
+		Color:     style.color,
+		Footer:    discordFooter{Text: message.Footer},
+		Timestamp: message.Time,
+	}
+	for _, field := range message.Fields {
+		embed.Fields = append(embed.Fields, discordField{Name: field.Name, Value: truncate(field.Value, 1024), Inline: true})
+	}
+	if message.Detail != "" {
+		embed.Description = "```\n" + truncate(message.Detail, 4000) + "\n```"
+	}
+	if message.Text != "" {
+		embed.Description = truncate(message.Text, 4096)
+	}
+
+	return discordPayload{
+		Username: "pg_backup",
+		Embeds:   []discordEmbed{embed},
+	}
+}
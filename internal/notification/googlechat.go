@@ -0,0 +1,82 @@
+package notification
+
+import (
+	"fmt"
+	"html"
+)
+
+// googleChatPayload is a message of a Google Chat space webhook with a single card
+type googleChatPayload struct {
+	CardsV2 []googleChatCardV2 `json:"cardsV2"`
+}
+
+type googleChatCardV2 struct {
+	CardID string         `json:"cardId"`
+	Card   googleChatCard `json:"card"`
+}
+
+type googleChatCard struct {
+	Header   googleChatHeader    `json:"header"`
+	Sections []googleChatSection `json:"sections"`
+}
+
+type googleChatHeader struct {
+	Title    string `json:"title"`
+	Subtitle string `json:"subtitle,omitempty"`
+}
+
+type googleChatSection struct {
+	Widgets []googleChatWidget `json:"widgets"`
+}
+
+type googleChatWidget struct {
+	DecoratedText *googleChatDecoratedText `json:"decoratedText,omitempty"`
+	TextParagraph *googleChatText          `json:"textParagraph,omitempty"`
+}
+
+type googleChatDecoratedText struct {
+	TopLabel string `json:"topLabel"`
+	Text     string `json:"text"`
+	WrapText bool   `json:"wrapText"`
+}
+
+type googleChatText struct {
+	Text string `json:"text"`
+}
+
+// googleChatMessage renders a message as a Google Chat card. Cards have no accent color, so
+// the severity shows in the emoji and the color of the first line.
+func googleChatMessage(message chatMessage) any {
+	style := severityStyle[message.Severity]
+	status := fmt.Sprintf(`<font color="#%06X"><b>%s</b></font>`, style.color, html.EscapeString(message.Severity))
+
+	widgets := []googleChatWidget{{DecoratedText: &googleChatDecoratedText{TopLabel: "Severity", Text: status}}}
+	for _, field := range message.Fields {
+		widgets = append(widgets, googleChatWidget{DecoratedText: &googleChatDecoratedText{
+			TopLabel: field.Name,
+			Text:     truncate(html.EscapeString(field.Value), 1024),
+			WrapText: true,
+		}})
+	}
+	sections := []googleChatSection{{Widgets: widgets}}
+
+	// Body templates write the HTML subset of Google Chat themselves, e.g. <a href="...">runbook</a>
+	if message.Text != "" {
+		sections = append(sections, googleChatSection{Widgets: []googleChatWidget{{TextParagraph: &googleChatText{truncate(message.Text, 4000)}}}})
+	}
+	if message.Detail != "" {
+		detail := `<font color="#5F6368">` + html.EscapeString(truncate(message.Detail, 4000)) + "</font>"
+		sections = append(sections, googleChatSection{Widgets: []googleChatWidget{{TextParagraph: &googleChatText{detail}}}})
+	}
+
+	return googleChatPayload{CardsV2: []googleChatCardV2{{
+		CardID: "pg_backup",
+		Card: googleChatCard{
+			Header: googleChatHeader{
+				Title:    truncate(style.emoji+" "+message.Title, 200),
+				Subtitle: message.Footer + " · " + chatTime(message.Time).UTC().Format("2006-01-02 15:04 MST"),
+			},
+			Sections: sections,
+		},
+	}}}
+}
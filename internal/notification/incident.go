@@ -0,0 +1,165 @@
+package notification
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/hra42/pg_backup/internal/config"
+)
+
+// incidentKey returns the key grouping the failures of a job and database into one incident,
+// and whether the event opens or resolves it. Other events return "". The scratch database of
+// a drill changes with every run, so the drills of an instance share one key.
+func incidentKey(prefix string, payload NotificationPayload) (key string, open bool) {
+	switch payload.EventType {
+	case EventBackupFailure:
+		return prefix + ":backup:" + payload.Database, true
+	case EventBackupSuccess:
+		return prefix + ":backup:" + payload.Database, false
+	case EventRestoreFailure:
+		if payload.Drill {
+			return prefix + ":drill", true
+		}
+		return prefix + ":restore:" + payload.Database, true
+	case EventRestoreSuccess:
+		return prefix + ":restore:" + payload.Database, false
+	case EventDrillSuccess:
+		return prefix + ":drill", false
+	}
+	return "", false
+}
+
+// incidentSummary is the one-line description of an incident: the title and the error
+func incidentSummary(payload NotificationPayload) string {
+	summary := eventTitle(payload)
+	if payload.Error != nil {
+		summary += ": " + *payload.Error
+	}
+	return summary
+}
+
+// pagerDutyEvent is an event of the PagerDuty Events API v2; resolve events only need the key
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"` // trigger or resolve
+	DedupKey    string            `json:"dedup_key"`
+	Client      string            `json:"client,omitempty"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string              `json:"summary"`
+	Source        string              `json:"source"`
+	Severity      string              `json:"severity"`
+	Component     string              `json:"component,omitempty"`
+	Group         string              `json:"group,omitempty"`
+	Class         string              `json:"class,omitempty"`
+	CustomDetails NotificationPayload `json:"custom_details"`
+}
+
+// sendPagerDuty triggers an incident for a failure and resolves it on the next success of the
+// same job and database. Resolving an incident that isn't open is a no-op for PagerDuty.
+func (n *NotificationClient) sendPagerDuty(channel string, cfg *config.PagerDutyConfig, payload NotificationPayload) error {
+	key, open := incidentKey(cfg.DedupPrefix, payload)
+	if key == "" {
+		return nil
+	}
+
+	event := pagerDutyEvent{RoutingKey: cfg.RoutingKey, EventAction: "resolve", DedupKey: key}
+	if open {
+		event.EventAction = "trigger"
+		event.Client = "pg_backup"
+		event.Payload = &pagerDutyPayload{
+			Summary:       truncate(incidentSummary(payload), 1024),
+			Source:        payload.Hostname,
+			Severity:      cfg.Severity,
+			Component:     payload.Database,
+			Group:         string(payload.EventType),
+			CustomDetails: payload,
+		}
+		if payload.Stage != nil {
+			event.Payload.Class = *payload.Stage
+		}
+		if tmpl := cfg.Template; tmpl != nil {
+			if summary, ok := n.render(channel, "title", tmpl.Title, templateData(payload, cfg.Severity)); ok {
+				event.Payload.Summary = truncate(summary, 1024)
+			}
+		}
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal pagerduty event: %w", err)
+	}
+	return n.post(channel, cfg.URL, nil, body, payload.EventType)
+}
+
+// opsgenieAlert is an alert of the Opsgenie Alert API. The alias deduplicates it: further
+// failures with an open alert only raise its count.
+type opsgenieAlert struct {
+	Message     string            `json:"message"`
+	Alias       string            `json:"alias"`
+	Description string            `json:"description,omitempty"`
+	Priority    string            `json:"priority"`
+	Source      string            `json:"source"`
+	Entity      string            `json:"entity,omitempty"`
+	Tags        []string          `json:"tags"`
+	Details     map[string]string `json:"details,omitempty"`
+}
+
+type opsgenieClose struct {
+	Source string `json:"source"`
+	Note   string `json:"note"`
+}
+
+// sendOpsgenie creates an alert for a failure and closes it on the next success of the same
+// job and database
+func (n *NotificationClient) sendOpsgenie(channel string, cfg *config.OpsgenieConfig, payload NotificationPayload) error {
+	alias, open := incidentKey(cfg.DedupPrefix, payload)
+	if alias == "" {
+		return nil
+	}
+	headers := map[string]string{"Authorization": "GenieKey " + cfg.APIKey}
+
+	if !open {
+		body, err := json.Marshal(opsgenieClose{Source: payload.Hostname, Note: eventTitle(payload)})
+		if err != nil {
+			return fmt.Errorf("failed to marshal opsgenie request: %w", err)
+		}
+		endpoint := cfg.APIURL + "/v2/alerts/" + url.PathEscape(alias) + "/close?identifierType=alias"
+		return n.post(channel, endpoint, headers, body, payload.EventType)
+	}
+
+	alert := opsgenieAlert{
+		Message:  truncate(eventTitle(payload), 130),
+		Alias:    alias,
+		Priority: cfg.Priority,
+		Source:   payload.Hostname,
+		Entity:   payload.Database,
+		Tags:     append([]string{"pg_backup"}, cfg.Tags...),
+		Details:  make(map[string]string),
+	}
+	if payload.Error != nil {
+		alert.Description = truncate(*payload.Error, 15000)
+	}
+	for _, field := range newChatMessage(payload, "").Fields {
+		alert.Details[field.Name] = strings.Trim(field.Value, "`")
+	}
+	if tmpl := cfg.Template; tmpl != nil {
+		data := templateData(payload, defaultSeverity[payload.EventType])
+		if message, ok := n.render(channel, "title", tmpl.Title, data); ok {
+			alert.Message = truncate(message, 130)
+		}
+		if description, ok := n.render(channel, "body", tmpl.Body, data); ok {
+			alert.Description = truncate(description, 15000)
+		}
+	}
+
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return fmt.Errorf("failed to marshal opsgenie alert: %w", err)
+	}
+	return n.post(channel, cfg.APIURL+"/v2/alerts", headers, body, payload.EventType)
+}
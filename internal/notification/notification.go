@@ -3,14 +3,22 @@ package notification
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/hra42/pg_backup/internal/config"
+	"github.com/hra42/pg_backup/internal/msgtemplate"
+	"github.com/hra42/pg_backup/internal/runlog"
 )
 
 // EventType represents the type of notification event
@@ -19,13 +27,39 @@ type EventType string
 const (
 	EventBackupSuccess  EventType = "backup_success"
 	EventBackupFailure  EventType = "backup_failure"
+	EventBackupWarning  EventType = "backup_warning"
 	EventRestoreSuccess EventType = "restore_success"
 	EventRestoreFailure EventType = "restore_failure"
+	EventRunSkipped     EventType = "run_skipped"
+	EventRunMissed      EventType = "run_missed"
+	EventDrillSuccess   EventType = "restore_drill_success"
+	EventCleanupWarning EventType = "cleanup_warning"
+	EventCleanupFailure EventType = "cleanup_failure"
+	EventCheckFailed    EventType = "startup_check_failed"
 )
 
+// errRejected marks responses a retry won't change, such as 400 Bad Request or 401 Unauthorized
+var errRejected = errors.New("request rejected")
+
+// eventStatus is the outcome each event reports in the status field
+var eventStatus = map[EventType]string{
+	EventBackupSuccess:  "success",
+	EventRestoreSuccess: "success",
+	EventDrillSuccess:   "success",
+	EventBackupFailure:  "failure",
+	EventBackupWarning:  "warning",
+	EventRestoreFailure: "failure",
+	EventCheckFailed:    "failure",
+	EventCleanupFailure: "failure",
+	EventCleanupWarning: "warning",
+	EventRunSkipped:     "skipped",
+	EventRunMissed:      "missed",
+}
+
 // NotificationPayload represents the JSON payload sent to the webhook
 type NotificationPayload struct {
 	EventType    EventType `json:"event_type"`
+	Status       string    `json:"status"`                 // success, warning, failure, skipped or missed
 	Database     string    `json:"database"`
 	Timestamp    string    `json:"timestamp"`
 	Duration     *string   `json:"duration,omitempty"`     // Duration in human-readable format (for success events)
@@ -34,14 +68,33 @@ type NotificationPayload struct {
 	BackupKey    *string   `json:"backup_key,omitempty"`   // Backup key/identifier (for restore events)
 	Error        *string   `json:"error,omitempty"`        // Error message (for failure events)
 	Stage        *string   `json:"stage,omitempty"`        // Failed stage (for failure events)
+	IncidentKey  *string   `json:"incident_key,omitempty"` // S3 prefix holding the uploaded run log (for failure events)
+	LogTail      []string  `json:"log_tail,omitempty"`     // Last lines of the run log (for failure events with notification.attach)
+	ReportURL    *string   `json:"report_url,omitempty"`   // Link to the run report (for failure events with notification.attach)
+	Drill        bool      `json:"drill,omitempty"`        // The failed restore was a restore drill (for restore_failure)
+	Deleted      *int      `json:"deleted,omitempty"`      // Backups the cleanup deleted (for cleanup events)
+	Task         *string   `json:"task,omitempty"`         // Scheduled task that was skipped, missed or failed its check (for run_skipped, run_missed, startup_check_failed)
+	SkippedRuns  *int      `json:"skipped_runs,omitempty"` // Runs of the task skipped since the scheduler started (for run_skipped)
+	DueAt        *string   `json:"due_at,omitempty"`       // When the missed run was due (for run_missed)
+	Retries      *int      `json:"retries,omitempty"`      // Extra attempts needed by retried stages (for backup success after retries)
+	Tables       *int      `json:"tables,omitempty"`       // Tables in the scratch database (for restore_drill_success)
+	Rows         *int64    `json:"rows,omitempty"`         // Rows in the scratch database (for restore_drill_success)
+	ChecksPassed *int      `json:"checks_passed,omitempty"` // Drill checks that passed (for restore_drill_success)
+	WarningCount *int      `json:"warning_count,omitempty"` // Number of pg_dump/pg_restore warnings (for success events)
+	Warnings     []string  `json:"warnings,omitempty"`      // First warning messages (for success and backup_warning events)
 	Hostname     string    `json:"hostname,omitempty"`     // Hostname where the backup/restore ran
 	Version      string    `json:"version,omitempty"`      // Application version
+	Env          map[string]string `json:"env,omitempty"` // Job-level environment (e.g. TEAM, ENV) for routing and templating
 }
 
 type NotificationClient struct {
 	config     *config.NotificationConfig
 	logger     *slog.Logger
 	httpClient *http.Client
+	env        map[string]string
+	queue      *Queue // Failed deliveries are retried from here, if set
+	runID      string
+	recorder   *runlog.Recorder
 }
 
 func NewNotificationClient(cfg *config.NotificationConfig, logger *slog.Logger) *NotificationClient {
@@ -54,7 +107,23 @@ func NewNotificationClient(cfg *config.NotificationConfig, logger *slog.Logger)
 	}
 }
 
-func (n *NotificationClient) SendBackupSuccess(database string, duration time.Duration, backupSize int64) error {
+// SetQueue queues the deliveries that fail for the scheduler to retry; q may be nil
+func (n *NotificationClient) SetQueue(q *Queue) {
+	n.queue = q
+}
+
+// SetRun sets the run whose log and report notification.attach adds to failures
+func (n *NotificationClient) SetRun(runID string, recorder *runlog.Recorder) {
+	n.runID = runID
+	n.recorder = recorder
+}
+
+// SetEnv attaches job-level environment variables to every payload sent by this client
+func (n *NotificationClient) SetEnv(env map[string]string) {
+	n.env = env
+}
+
+func (n *NotificationClient) SendBackupSuccess(database string, duration time.Duration, backupSize int64, warnings []string, retries int) error {
 	if !n.config.Enabled {
 		return nil
 	}
@@ -72,11 +141,15 @@ func (n *NotificationClient) SendBackupSuccess(database string, duration time.Du
 		Hostname:   getHostname(),
 		Version:    getVersion(),
 	}
+	payload.setWarnings(warnings)
+	if retries > 0 {
+		payload.Retries = &retries
+	}
 
-	return n.sendWebhook(payload)
+	return n.send(payload)
 }
 
-func (n *NotificationClient) SendBackupFailure(database string, err error, stage string) error {
+func (n *NotificationClient) SendBackupFailure(database string, err error, stage string, incidentKey string) error {
 	if !n.config.Enabled {
 		return nil
 	}
@@ -92,16 +165,157 @@ func (n *NotificationClient) SendBackupFailure(database string, err error, stage
 		Hostname:  getHostname(),
 		Version:   getVersion(),
 	}
+	if incidentKey != "" {
+		payload.IncidentKey = &incidentKey
+	}
+
+	return n.send(payload)
+}
+
+// SendBackupWarning reports a successful backup whose size or duration deviates from the
+// thresholds of backup.trend, which often precedes failing backups
+func (n *NotificationClient) SendBackupWarning(database string, duration time.Duration, backupSize int64, warnings []string) error {
+	if !n.config.Enabled {
+		return nil
+	}
+
+	durationStr := duration.Round(time.Second).String()
+	durationMs := duration.Milliseconds()
+
+	payload := NotificationPayload{
+		EventType:  EventBackupWarning,
+		Database:   database,
+		Timestamp:  time.Now().UTC().Format(time.RFC3339),
+		Duration:   &durationStr,
+		DurationMs: &durationMs,
+		BackupSize: &backupSize,
+		Hostname:   getHostname(),
+		Version:    getVersion(),
+	}
+	payload.setWarnings(warnings)
+
+	return n.send(payload)
+}
+
+// SendCleanupWarning reports a retention cleanup that looks wrong, e.g. deleted more backups
+// than backup.retention_alerts allows
+func (n *NotificationClient) SendCleanupWarning(database string, deleted int, warnings []string) error {
+	if !n.config.Enabled {
+		return nil
+	}
+
+	payload := NotificationPayload{
+		EventType: EventCleanupWarning,
+		Database:  database,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Deleted:   &deleted,
+		Hostname:  getHostname(),
+		Version:   getVersion(),
+	}
+	payload.setWarnings(warnings)
 
-	return n.sendWebhook(payload)
+	return n.send(payload)
 }
 
-func (n *NotificationClient) sendWebhook(payload NotificationPayload) error {
-	if n.config.WebhookURL == "" {
-		n.logger.Warn("Webhook URL not configured, skipping notification")
+// SendCleanupFailure reports a retention cleanup that failed, possibly after deleting some
+// backups
+func (n *NotificationClient) SendCleanupFailure(database string, err error, deleted int) error {
+	if !n.config.Enabled {
 		return nil
 	}
 
+	errMsg := err.Error()
+	stage := "Cleanup"
+	payload := NotificationPayload{
+		EventType: EventCleanupFailure,
+		Database:  database,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Error:     &errMsg,
+		Stage:     &stage,
+		Deleted:   &deleted,
+		Hostname:  getHostname(),
+		Version:   getVersion(),
+	}
+
+	return n.send(payload)
+}
+
+// send delivers payload to the channels the routes send it to. A failing channel doesn't keep
+// the others from being notified, and is retried later with a queue.
+func (n *NotificationClient) send(payload NotificationPayload) error {
+	if payload.Env == nil {
+		payload.Env = n.env
+	}
+	payload.Status = eventStatus[payload.EventType]
+	n.attach(&payload)
+
+	var errs []error
+	for i := range n.config.Channels {
+		channel := &n.config.Channels[i]
+		if !n.routed(channel.Name, payload) {
+			continue
+		}
+		err := n.sendChannel(channel, payload)
+		if n.queue != nil {
+			switch {
+			case err == nil:
+				n.queue.resolve(channel, payload)
+			case !errors.Is(err, errRejected):
+				n.queue.add(channel, payload, err)
+			}
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// attach adds the end of the run log and the link to the run report to a failure of the run,
+// as configured under notification.attach
+func (n *NotificationClient) attach(payload *NotificationPayload) {
+	cfg := n.config.Attach
+	if cfg == nil || payload.Status != "failure" || n.runID == "" {
+		return
+	}
+	if n.recorder != nil {
+		payload.LogTail = n.recorder.Tail(cfg.LogLines)
+	}
+	if cfg.ReportURL != "" {
+		data := struct{ RunID, Database, Hostname string }{n.runID, payload.Database, payload.Hostname}
+		url, err := msgtemplate.Render("report_url", cfg.ReportURL, data)
+		if err != nil {
+			n.logger.Warn("Failed to render report_url, sending the notification without it", slog.String("error", err.Error()))
+			return
+		}
+		payload.ReportURL = &url
+	}
+}
+
+// sendChannel delivers payload to one channel, in the format of its type
+func (n *NotificationClient) sendChannel(channel *config.NotificationChannel, payload NotificationPayload) error {
+	switch {
+	case channel.Webhook != nil:
+		return n.sendWebhook(channel.Name, channel.Webhook, payload)
+	case channel.Slack != nil:
+		return n.sendChat(channel.Name, channel.Slack, payload, slackMessage)
+	case channel.Discord != nil:
+		return n.sendChat(channel.Name, channel.Discord, payload, discordMessage)
+	case channel.Teams != nil:
+		return n.sendChat(channel.Name, channel.Teams, payload, teamsMessage)
+	case channel.GoogleChat != nil:
+		return n.sendChat(channel.Name, channel.GoogleChat, payload, googleChatMessage)
+	case channel.Ntfy != nil:
+		return n.sendNtfy(channel.Name, channel.Ntfy, payload)
+	case channel.Gotify != nil:
+		return n.sendGotify(channel.Name, channel.Gotify, payload)
+	case channel.PagerDuty != nil:
+		return n.sendPagerDuty(channel.Name, channel.PagerDuty, payload)
+	case channel.Opsgenie != nil:
+		return n.sendOpsgenie(channel.Name, channel.Opsgenie, payload)
+	}
+	return nil
+}
+
+func (n *NotificationClient) sendWebhook(channel string, cfg *config.WebhookConfig, payload NotificationPayload) error {
 	// Marshal payload to JSON
 	jsonData, err := json.Marshal(payload)
 	if err != nil {
@@ -109,16 +323,54 @@ func (n *NotificationClient) sendWebhook(payload NotificationPayload) error {
 			slog.String("error", err.Error()))
 		return fmt.Errorf("failed to marshal payload: %w", err)
 	}
+	// A body template shapes the request for receivers that expect their own format
+	if body, ok := n.render(channel, "body_template", cfg.BodyTemplate, templateData(payload, defaultSeverity[payload.EventType])); ok {
+		jsonData = []byte(body)
+	}
+
+	n.logger.Debug("Sending webhook notification",
+		slog.String("channel", channel),
+		slog.String("url", cfg.URL),
+		slog.String("event_type", string(payload.EventType)),
+		slog.String("database", payload.Database))
 
+	headers := cfg.Headers
+	if cfg.SigningSecret != "" {
+		headers = maps.Clone(headers)
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		headers["X-PgBackup-Timestamp"] = timestamp
+		headers["X-PgBackup-Signature"] = "sha256=" + sign(cfg.SigningSecret, timestamp, jsonData)
+	}
+
+	return n.post(channel, cfg.URL, headers, jsonData, payload.EventType,
+		slog.String("url", cfg.URL))
+}
+
+// sign returns the hex HMAC-SHA256 of "<timestamp>.<body>" with secret. Signing the timestamp
+// lets receivers reject replayed requests.
+func sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// post sends a JSON body to a notification endpoint. attrs identify the endpoint in logs; chat
+// webhook URLs contain their token, so they aren't logged.
+func (n *NotificationClient) post(channel, url string, headers map[string]string, body []byte, event EventType, attrs ...any) error {
 	// Create HTTP request
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	req, err := http.NewRequestWithContext(ctx, "POST", n.config.WebhookURL, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
 	if err != nil {
 		n.logger.Error("Failed to create webhook request",
+			slog.String("channel", channel),
 			slog.String("error", err.Error()))
-		return fmt.Errorf("failed to create request: %w", err)
+		return fmt.Errorf("failed to create %s request: %w", channel, err)
 	}
 
 	// Set headers
@@ -126,42 +378,38 @@ func (n *NotificationClient) sendWebhook(payload NotificationPayload) error {
 	req.Header.Set("User-Agent", fmt.Sprintf("pg_backup/%s", getVersion()))
 
 	// Add custom headers from config
-	for key, value := range n.config.Headers {
+	for key, value := range headers {
 		req.Header.Set(key, value)
 	}
 
-	n.logger.Debug("Sending webhook notification",
-		slog.String("url", n.config.WebhookURL),
-		slog.String("event_type", string(payload.EventType)),
-		slog.String("database", payload.Database))
-
 	// Send request
 	resp, err := n.httpClient.Do(req)
 	if err != nil {
 		n.logger.Error("Failed to send webhook notification",
-			slog.String("error", err.Error()),
-			slog.String("url", n.config.WebhookURL))
-		return fmt.Errorf("webhook request failed: %w", err)
+			append([]any{slog.String("channel", channel), slog.String("error", err.Error())}, attrs...)...)
+		return fmt.Errorf("%s request failed: %w", channel, err)
 	}
 	defer resp.Body.Close()
 
 	// Check response status
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		n.logger.Error("Webhook returned error status",
-			slog.Int("status_code", resp.StatusCode),
-			slog.String("status", resp.Status),
-			slog.String("url", n.config.WebhookURL))
-		return fmt.Errorf("webhook returned status %d: %s", resp.StatusCode, resp.Status)
+			append([]any{slog.String("channel", channel), slog.Int("status_code", resp.StatusCode), slog.String("status", resp.Status)}, attrs...)...)
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+			return fmt.Errorf("%s returned status %d: %s: %w", channel, resp.StatusCode, resp.Status, errRejected)
+		}
+		return fmt.Errorf("%s returned status %d: %s", channel, resp.StatusCode, resp.Status)
 	}
 
 	n.logger.Info("Webhook notification sent successfully",
-		slog.String("event_type", string(payload.EventType)),
+		slog.String("channel", channel),
+		slog.String("event_type", string(event)),
 		slog.Int("status_code", resp.StatusCode))
 
 	return nil
 }
 
-func (n *NotificationClient) SendRestoreSuccess(database string, duration time.Duration, backupKey string) error {
+func (n *NotificationClient) SendRestoreSuccess(database string, duration time.Duration, backupKey string, warnings []string) error {
 	if !n.config.Enabled {
 		return nil
 	}
@@ -179,15 +427,32 @@ func (n *NotificationClient) SendRestoreSuccess(database string, duration time.D
 		Hostname:   getHostname(),
 		Version:    getVersion(),
 	}
+	payload.setWarnings(warnings)
+
+	return n.send(payload)
+}
+
+func (n *NotificationClient) SendRestoreFailure(database string, err error, stage string, incidentKey string) error {
+	if !n.config.Enabled {
+		return nil
+	}
 
-	return n.sendWebhook(payload)
+	return n.send(restoreFailure(database, err, stage, incidentKey))
 }
 
-func (n *NotificationClient) SendRestoreFailure(database string, err error, stage string) error {
+// SendDrillFailure reports a failed restore drill as a restore_failure marked as a drill;
+// database is its scratch database
+func (n *NotificationClient) SendDrillFailure(database string, err error, stage string, incidentKey string) error {
 	if !n.config.Enabled {
 		return nil
 	}
 
+	payload := restoreFailure(database, err, stage, incidentKey)
+	payload.Drill = true
+	return n.send(payload)
+}
+
+func restoreFailure(database string, err error, stage string, incidentKey string) NotificationPayload {
 	errMsg := err.Error()
 
 	payload := NotificationPayload{
@@ -199,8 +464,114 @@ func (n *NotificationClient) SendRestoreFailure(database string, err error, stag
 		Hostname:  getHostname(),
 		Version:   getVersion(),
 	}
+	if incidentKey != "" {
+		payload.IncidentKey = &incidentKey
+	}
+	return payload
+}
+
+// SendDrillSuccess reports a restore drill whose scratch database passed validation. Failed
+// drills are reported with SendDrillFailure, naming the failed stage.
+func (n *NotificationClient) SendDrillSuccess(database string, duration time.Duration, backupKey string, tables int, rows int64, checksPassed int, warnings []string) error {
+	if !n.config.Enabled {
+		return nil
+	}
 
-	return n.sendWebhook(payload)
+	durationStr := duration.Round(time.Second).String()
+	durationMs := duration.Milliseconds()
+
+	payload := NotificationPayload{
+		EventType:    EventDrillSuccess,
+		Database:     database,
+		Timestamp:    time.Now().UTC().Format(time.RFC3339),
+		Duration:     &durationStr,
+		DurationMs:   &durationMs,
+		BackupKey:    &backupKey,
+		Tables:       &tables,
+		Rows:         &rows,
+		ChecksPassed: &checksPassed,
+		Hostname:     getHostname(),
+		Version:      getVersion(),
+	}
+	payload.setWarnings(warnings)
+
+	return n.send(payload)
+}
+
+// SendRunSkipped reports a scheduled run that did not start because the previous run of the
+// same task was still in progress
+func (n *NotificationClient) SendRunSkipped(task, database string, skippedRuns int) error {
+	if !n.config.Enabled {
+		return nil
+	}
+
+	payload := NotificationPayload{
+		EventType:   EventRunSkipped,
+		Database:    database,
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+		Task:        &task,
+		SkippedRuns: &skippedRuns,
+		Hostname:    getHostname(),
+		Version:     getVersion(),
+	}
+
+	return n.send(payload)
+}
+
+// SendRunMissed reports a scheduled run that was due while the scheduler wasn't running
+func (n *NotificationClient) SendRunMissed(task, database string, dueAt time.Time) error {
+	if !n.config.Enabled {
+		return nil
+	}
+
+	due := dueAt.UTC().Format(time.RFC3339)
+	payload := NotificationPayload{
+		EventType: EventRunMissed,
+		Database:  database,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Task:      &task,
+		DueAt:     &due,
+		Hostname:  getHostname(),
+		Version:   getVersion(),
+	}
+
+	return n.send(payload)
+}
+
+// SendCheckFailed reports a scheduled task whose startup check failed, so it would fail when it
+// runs
+func (n *NotificationClient) SendCheckFailed(task, database string, err error) error {
+	if !n.config.Enabled {
+		return nil
+	}
+
+	errMsg := err.Error()
+	payload := NotificationPayload{
+		EventType: EventCheckFailed,
+		Database:  database,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Task:      &task,
+		Error:     &errMsg,
+		Hostname:  getHostname(),
+		Version:   getVersion(),
+	}
+
+	return n.send(payload)
+}
+
+// maxWarningsInPayload limits how many warning messages are included in a notification
+const maxWarningsInPayload = 20
+
+func (p *NotificationPayload) setWarnings(warnings []string) {
+	if len(warnings) == 0 {
+		return
+	}
+	count := len(warnings)
+	p.WarningCount = &count
+	if len(warnings) > maxWarningsInPayload {
+		warnings = warnings[:maxWarningsInPayload]
+	}
+	p.Warnings = warnings
 }
 
 // GetBackupStage determines the stage of backup failure from error message
@@ -221,6 +592,7 @@ func GetBackupStage(err error) string {
 		"exit code 5": "S3 Upload",
 		"S3":          "S3 Upload",
 		"cleanup":     "Cleanup",
+		"verification": "Verification",
 	}
 
 	for pattern, stage := range patterns {
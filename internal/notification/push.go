@@ -0,0 +1,123 @@
+package notification
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/hra42/pg_backup/internal/config"
+)
+
+// ntfyPriority and gotifyPriority are the priorities of the severities unless set per event.
+// ntfy ranges from 1 (min) to 5 (urgent), Gotify from 0 to 10.
+var (
+	ntfyPriority   = map[string]int{"info": 3, "warning": 4, "error": 5, "critical": 5}
+	gotifyPriority = map[string]int{"info": 2, "warning": 5, "error": 8, "critical": 10}
+)
+
+// ntfyTags are emoji shortcodes ntfy shows in front of the title
+var ntfyTags = map[string]string{
+	"info":     "white_check_mark",
+	"warning":  "warning",
+	"error":    "x",
+	"critical": "rotating_light",
+}
+
+// ntfyMessage is a message of ntfy's JSON publishing API
+type ntfyMessage struct {
+	Topic    string   `json:"topic"`
+	Title    string   `json:"title"`
+	Message  string   `json:"message"`
+	Priority int      `json:"priority"`
+	Tags     []string `json:"tags"`
+}
+
+// gotifyMessage is a message of Gotify's message API
+type gotifyMessage struct {
+	Title    string `json:"title"`
+	Message  string `json:"message"`
+	Priority int    `json:"priority"`
+}
+
+// pushMessage renders payload as the title and plain text of a push notification, unless the
+// event is below min_severity
+func (n *NotificationClient) pushMessage(channel, minSeverity string, tmpl *config.MessageTemplate, payload NotificationPayload) (chatMessage, string, bool) {
+	level := defaultSeverity[payload.EventType]
+	if slices.Index(config.Severities, level) < slices.Index(config.Severities, minSeverity) {
+		n.logger.Debug("Skipping push notification below min_severity",
+			slog.String("channel", channel),
+			slog.String("event_type", string(payload.EventType)),
+			slog.String("severity", level))
+		return chatMessage{}, "", false
+	}
+
+	message := newChatMessage(payload, level)
+	n.applyTemplate(channel, tmpl, &message, payload)
+	if message.Text != "" {
+		return message, truncate(message.Text, 4000), true
+	}
+	var lines []string
+	for _, field := range message.Fields {
+		lines = append(lines, field.Name+": "+strings.Trim(field.Value, "`"))
+	}
+	if message.Detail != "" {
+		lines = append(lines, "", message.Detail)
+	}
+	return message, truncate(strings.Join(lines, "\n"), 4000), true
+}
+
+// sendNtfy publishes payload to the topic of its event type
+func (n *NotificationClient) sendNtfy(channel string, cfg *config.NtfyConfig, payload NotificationPayload) error {
+	message, text, ok := n.pushMessage(channel, cfg.MinSeverity, cfg.Template, payload)
+	if !ok {
+		return nil
+	}
+
+	push := ntfyMessage{
+		Topic:    cfg.Topic,
+		Title:    message.Title,
+		Message:  text,
+		Priority: ntfyPriority[message.Severity],
+		Tags:     []string{ntfyTags[message.Severity], "pg_backup"},
+	}
+	if topic, ok := cfg.Topics[string(payload.EventType)]; ok {
+		push.Topic = topic
+	}
+	if priority, ok := cfg.Priority[string(payload.EventType)]; ok {
+		push.Priority = priority
+	}
+	body, err := json.Marshal(push)
+	if err != nil {
+		return fmt.Errorf("failed to marshal ntfy message: %w", err)
+	}
+
+	var headers map[string]string
+	if cfg.Token != "" {
+		headers = map[string]string{"Authorization": "Bearer " + cfg.Token}
+	}
+	return n.post(channel, cfg.URL, headers, body, payload.EventType, slog.String("topic", push.Topic))
+}
+
+// sendGotify sends payload to the Gotify application of the token
+func (n *NotificationClient) sendGotify(channel string, cfg *config.GotifyConfig, payload NotificationPayload) error {
+	message, text, ok := n.pushMessage(channel, cfg.MinSeverity, cfg.Template, payload)
+	if !ok {
+		return nil
+	}
+
+	push := gotifyMessage{
+		Title:    message.Title,
+		Message:  text,
+		Priority: gotifyPriority[message.Severity],
+	}
+	if priority, ok := cfg.Priority[string(payload.EventType)]; ok {
+		push.Priority = priority
+	}
+	body, err := json.Marshal(push)
+	if err != nil {
+		return fmt.Errorf("failed to marshal gotify message: %w", err)
+	}
+	return n.post(channel, cfg.URL+"/message", map[string]string{"X-Gotify-Key": cfg.Token}, body, payload.EventType)
+}
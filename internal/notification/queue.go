@@ -0,0 +1,227 @@
+package notification
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/hra42/pg_backup/internal/config"
+	"github.com/hra42/pg_backup/internal/lock"
+)
+
+// Queue keeps the deliveries that failed on disk until the scheduler gets them through, see
+// config.NotificationRetryConfig. One-shot runs of the same server add to the same file.
+type Queue struct {
+	path   string
+	retry  *config.NotificationRetryConfig
+	logger *slog.Logger
+}
+
+// queuedDelivery is an event that one channel failed to receive. It keeps the channel's
+// settings, so it reaches the receiver that missed it even after the configuration changed.
+type queuedDelivery struct {
+	Channel     config.NotificationChannel `json:"channel"`
+	Payload     NotificationPayload        `json:"payload"`
+	Attempts    int                        `json:"attempts"`
+	FirstFailed time.Time                  `json:"first_failed"`
+	NextAttempt time.Time                  `json:"next_attempt"`
+	LastError   string                     `json:"last_error"`
+}
+
+// NewQueue returns the retry queue of the configured server, or nil without notification.retry
+func NewQueue(cfg *config.Config, logger *slog.Logger) *Queue {
+	retry := cfg.Notification.Retry
+	if retry == nil || !retry.Enabled {
+		return nil
+	}
+	name := lock.Name(cfg.Postgres.Host, cfg.Postgres.Port, "notifications")
+	return &Queue{
+		path:   filepath.Join(cfg.Backup.StateDir, "pg_backup_"+name+".queue.json"),
+		retry:  retry,
+		logger: logger,
+	}
+}
+
+// update applies change to the queued deliveries, holding a lock shared with the other
+// processes using the queue. An empty queue removes the file.
+func (q *Queue) update(change func([]queuedDelivery) []queuedDelivery) error {
+	var fileLock *lock.FileLock
+	for attempt := 0; ; attempt++ {
+		var err error
+		fileLock, err = lock.AcquireFile(q.path+".lock", lock.Owner("notification-queue"))
+		if err == nil {
+			break
+		}
+		// Other processes only hold the lock to read and write the file
+		if !errors.Is(err, lock.ErrLocked) || attempt == 50 {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	defer fileLock.Release()
+
+	var deliveries []queuedDelivery
+	data, err := os.ReadFile(q.path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read notification queue %s: %w", q.path, err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &deliveries); err != nil {
+			return fmt.Errorf("failed to parse notification queue %s: %w", q.path, err)
+		}
+	}
+
+	deliveries = change(deliveries)
+	if len(deliveries) == 0 {
+		if err := os.Remove(q.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove notification queue %s: %w", q.path, err)
+		}
+		return nil
+	}
+	// The file holds the channels' tokens, like the configuration
+	data, err = json.MarshalIndent(deliveries, "", "  ")
+	if err == nil {
+		if err = os.WriteFile(q.path+".tmp", data, 0600); err == nil {
+			err = os.Rename(q.path+".tmp", q.path)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save notification queue %s: %w", q.path, err)
+	}
+	return nil
+}
+
+// empty reports whether nothing is queued, without taking the lock
+func (q *Queue) empty() bool {
+	_, err := os.Stat(q.path)
+	return os.IsNotExist(err)
+}
+
+// add queues the delivery of payload to channel that failed with err
+func (q *Queue) add(channel *config.NotificationChannel, payload NotificationPayload, err error) {
+	now := time.Now()
+	delivery := queuedDelivery{
+		Channel:     *channel,
+		Payload:     payload,
+		Attempts:    1,
+		FirstFailed: now,
+		NextAttempt: now.Add(q.retry.Backoff),
+		LastError:   err.Error(),
+	}
+	if err := q.update(func(deliveries []queuedDelivery) []queuedDelivery {
+		return append(deliveries, delivery)
+	}); err != nil {
+		q.logger.Error("Failed to queue notification for retry",
+			slog.String("channel", channel.Name),
+			slog.String("event_type", string(payload.EventType)),
+			slog.String("error", err.Error()))
+		return
+	}
+	q.logger.Warn("Queued notification for retry",
+		slog.String("channel", channel.Name),
+		slog.String("event_type", string(payload.EventType)),
+		slog.Time("next_attempt", delivery.NextAttempt))
+}
+
+// resolve drops the queued deliveries to channel that would open the incident payload just
+// resolved, so a late retry doesn't reopen it
+func (q *Queue) resolve(channel *config.NotificationChannel, payload NotificationPayload) {
+	key, open := channelIncidentKey(channel, payload)
+	if key == "" || open || q.empty() {
+		return
+	}
+	if err := q.update(func(deliveries []queuedDelivery) []queuedDelivery {
+		return slices.DeleteFunc(deliveries, func(delivery queuedDelivery) bool {
+			queuedKey, queuedOpen := channelIncidentKey(&delivery.Channel, delivery.Payload)
+			return delivery.Channel.Name == channel.Name && queuedKey == key && queuedOpen
+		})
+	}); err != nil {
+		q.logger.Warn("Failed to drop resolved notifications from the retry queue", slog.String("error", err.Error()))
+	}
+}
+
+// channelIncidentKey returns the incident key of payload on an incident channel, see
+// incidentKey, or "" on other channels
+func channelIncidentKey(channel *config.NotificationChannel, payload NotificationPayload) (string, bool) {
+	switch {
+	case channel.PagerDuty != nil:
+		return incidentKey(channel.PagerDuty.DedupPrefix, payload)
+	case channel.Opsgenie != nil:
+		return incidentKey(channel.Opsgenie.DedupPrefix, payload)
+	}
+	return "", false
+}
+
+// Retry delivers the queued deliveries that are due. One that fails again waits twice as long
+// as before, up to max_backoff; one still failing max_age after the event is dropped.
+func (q *Queue) Retry() {
+	if q.empty() {
+		return
+	}
+	now := time.Now()
+	var due []queuedDelivery
+	if err := q.update(func(deliveries []queuedDelivery) []queuedDelivery {
+		var waiting []queuedDelivery
+		for _, delivery := range deliveries {
+			if now.Before(delivery.NextAttempt) {
+				waiting = append(waiting, delivery)
+			} else {
+				due = append(due, delivery)
+			}
+		}
+		return waiting
+	}); err != nil {
+		q.logger.Error("Failed to read notification retry queue", slog.String("error", err.Error()))
+		return
+	}
+
+	// Deliveries go out in the order they failed, without the lock
+	client := NewNotificationClient(&config.NotificationConfig{Enabled: true}, q.logger)
+	var failed []queuedDelivery
+	for _, delivery := range due {
+		err := client.sendChannel(&delivery.Channel, delivery.Payload)
+		delivery.Attempts++
+		if err == nil {
+			q.logger.Info("Delivered queued notification",
+				slog.String("channel", delivery.Channel.Name),
+				slog.String("event_type", string(delivery.Payload.EventType)),
+				slog.Int("attempts", delivery.Attempts))
+			continue
+		}
+		delivery.LastError = err.Error()
+		if errors.Is(err, errRejected) || time.Since(delivery.FirstFailed) >= q.retry.MaxAge {
+			q.logger.Error("Giving up on notification",
+				slog.String("channel", delivery.Channel.Name),
+				slog.String("event_type", string(delivery.Payload.EventType)),
+				slog.String("database", delivery.Payload.Database),
+				slog.Int("attempts", delivery.Attempts),
+				slog.String("error", err.Error()))
+			continue
+		}
+		delivery.NextAttempt = time.Now().Add(q.backoff(delivery.Attempts))
+		failed = append(failed, delivery)
+	}
+
+	if len(failed) == 0 {
+		return
+	}
+	if err := q.update(func(deliveries []queuedDelivery) []queuedDelivery {
+		return append(failed, deliveries...)
+	}); err != nil {
+		q.logger.Error("Failed to requeue notifications", slog.String("error", err.Error()))
+	}
+}
+
+// backoff is the wait after attempts failed deliveries
+func (q *Queue) backoff(attempts int) time.Duration {
+	wait := q.retry.Backoff
+	for i := 1; i < attempts && wait < q.retry.MaxBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, q.retry.MaxBackoff)
+}
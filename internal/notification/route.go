@@ -0,0 +1,44 @@
+package notification
+
+import (
+	"path"
+	"slices"
+
+	"github.com/hra42/pg_backup/internal/config"
+)
+
+// routed reports whether the routes send payload to the channel named name. Without routes
+// every channel gets every event.
+func (n *NotificationClient) routed(name string, payload NotificationPayload) bool {
+	if len(n.config.Routes) == 0 {
+		return true
+	}
+	for _, route := range n.config.Routes {
+		if slices.Contains(route.Channels, name) && routeMatches(route, payload) {
+			return true
+		}
+	}
+	return false
+}
+
+// routeMatches reports whether payload meets each condition route sets. Severities are the
+// defaults of the events, as a chat channel's severity overrides only apply to that channel.
+// Skipped, missed and startup check events of cleanup and restore tasks carry the configured
+// postgres.database.
+func routeMatches(route config.NotificationRoute, payload NotificationPayload) bool {
+	if len(route.Events) > 0 && !slices.Contains(route.Events, string(payload.EventType)) {
+		return false
+	}
+	if slices.Index(config.Severities, defaultSeverity[payload.EventType]) < slices.Index(config.Severities, route.MinSeverity) {
+		return false
+	}
+	if len(route.Databases) == 0 {
+		return true
+	}
+	for _, pattern := range route.Databases {
+		if matched, _ := path.Match(pattern, payload.Database); matched && payload.Database != "" {
+			return true
+		}
+	}
+	return false
+}
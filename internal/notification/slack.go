@@ -0,0 +1,76 @@
+package notification
+
+import (
+	"fmt"
+	"strings"
+)
+
+// slackPayload is a message of a Slack incoming webhook: the text shows in notifications, the
+// attachment's blocks in the channel, with a bar in the color of the severity
+type slackPayload struct {
+	Text        string            `json:"text"`
+	Attachments []slackAttachment `json:"attachments"`
+}
+
+type slackAttachment struct {
+	Color  string       `json:"color"`
+	Blocks []slackBlock `json:"blocks"`
+}
+
+type slackBlock struct {
+	Type     string      `json:"type"`
+	Text     *slackText  `json:"text,omitempty"`
+	Fields   []slackText `json:"fields,omitempty"`
+	Elements []slackText `json:"elements,omitempty"`
+}
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// slackEscape escapes the characters Slack reserves for links and mentions
+var slackEscape = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// slackMessage renders a message as Slack blocks
+func slackMessage(message chatMessage) any {
+	style := severityStyle[message.Severity]
+	title := style.emoji + " " + slackEscape.Replace(message.Title)
+	blocks := []slackBlock{{Type: "section", Text: &slackText{"mrkdwn", "*" + title + "*"}}}
+
+	// A section holds up to 10 fields
+	var fields []slackText
+	for _, field := range message.Fields {
+		fields = append(fields, slackText{"mrkdwn", "*" + field.Name + "*\n" + truncate(slackEscape.Replace(field.Value), 1900)})
+		if len(fields) == 10 {
+			blocks = append(blocks, slackBlock{Type: "section", Fields: fields})
+			fields = nil
+		}
+	}
+	if len(fields) > 0 {
+		blocks = append(blocks, slackBlock{Type: "section", Fields: fields})
+	}
+
+	// Body templates write Slack markup themselves, e.g. <https://wiki/runbook|runbook>
+	if message.Text != "" {
+		blocks = append(blocks, slackBlock{Type: "section", Text: &slackText{"mrkdwn", truncate(message.Text, 3000)}})
+	}
+	if message.Detail != "" {
+		detail := "```" + truncate(slackEscape.Replace(message.Detail), 2900) + "```"
+		blocks = append(blocks, slackBlock{Type: "section", Text: &slackText{"mrkdwn", detail}})
+	}
+
+	// Slack shows the time in the reader's time zone
+	sent := chatTime(message.Time)
+	footer := fmt.Sprintf("%s · <!date^%d^{date_short_pretty} {time}|%s>",
+		slackEscape.Replace(message.Footer), sent.Unix(), sent.UTC().Format("2006-01-02 15:04 MST"))
+	blocks = append(blocks, slackBlock{Type: "context", Elements: []slackText{{"mrkdwn", footer}}})
+
+	return slackPayload{
+		Text: title,
+		Attachments: []slackAttachment{{
+			Color:  fmt.Sprintf("#%06X", style.color),
+			Blocks: blocks,
+		}},
+	}
+}
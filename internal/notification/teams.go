@@ -0,0 +1,107 @@
+package notification
+
+import "strings"
+
+// teamsPayload is a message of a Teams incoming webhook (an Office 365 connector or a
+// Workflows webhook) carrying a single Adaptive Card
+type teamsPayload struct {
+	Type        string            `json:"type"`
+	Attachments []teamsAttachment `json:"attachments"`
+}
+
+type teamsAttachment struct {
+	ContentType string    `json:"contentType"`
+	Content     teamsCard `json:"content"`
+}
+
+type teamsCard struct {
+	Schema  string         `json:"$schema"`
+	Type    string         `json:"type"`
+	Version string         `json:"version"`
+	Body    []teamsElement `json:"body"`
+	MSTeams map[string]any `json:"msteams"`
+}
+
+// teamsElement is a TextBlock, FactSet or Container of an Adaptive Card
+type teamsElement struct {
+	Type     string         `json:"type"`
+	Text     string         `json:"text,omitempty"`
+	Weight   string         `json:"weight,omitempty"`
+	Size     string         `json:"size,omitempty"`
+	FontType string         `json:"fontType,omitempty"`
+	IsSubtle bool           `json:"isSubtle,omitempty"`
+	Wrap     bool           `json:"wrap,omitempty"`
+	Style    string         `json:"style,omitempty"`
+	Bleed    bool           `json:"bleed,omitempty"`
+	Facts    []teamsFact    `json:"facts,omitempty"`
+	Items    []teamsElement `json:"items,omitempty"`
+}
+
+type teamsFact struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+}
+
+// teamsStyle is the container style of the card's heading per severity, as cards have no
+// free colors
+var teamsStyle = map[string]string{
+	"info":     "good",
+	"warning":  "warning",
+	"error":    "attention",
+	"critical": "attention",
+}
+
+// teamsEscape keeps values from being read as Markdown, which TextBlocks and facts render
+var teamsEscape = strings.NewReplacer("\\", "\\\\", "*", "\\*", "_", "\\_", "[", "\\[", "]", "\\]", "`", "")
+
+// teamsMessage renders a message as an Adaptive Card
+func teamsMessage(message chatMessage) any {
+	style := severityStyle[message.Severity]
+	heading := teamsElement{
+		Type:  "Container",
+		Style: teamsStyle[message.Severity],
+		Bleed: true,
+		Items: []teamsElement{{
+			Type:   "TextBlock",
+			Text:   style.emoji + " " + teamsEscape.Replace(message.Title),
+			Weight: "Bolder",
+			Size:   "Medium",
+			Wrap:   true,
+		}},
+	}
+	body := []teamsElement{heading}
+
+	if len(message.Fields) > 0 {
+		facts := teamsElement{Type: "FactSet"}
+		for _, field := range message.Fields {
+			facts.Facts = append(facts.Facts, teamsFact{Title: field.Name, Value: truncate(teamsEscape.Replace(field.Value), 1024)})
+		}
+		body = append(body, facts)
+	}
+	// Body templates write Markdown themselves, e.g. [runbook](https://wiki/runbook)
+	if message.Text != "" {
+		body = append(body, teamsElement{Type: "TextBlock", Text: truncate(message.Text, 4000), Wrap: true})
+	}
+	if message.Detail != "" {
+		body = append(body, teamsElement{Type: "TextBlock", Text: truncate(teamsEscape.Replace(message.Detail), 4000), FontType: "Monospace", Wrap: true})
+	}
+
+	// Teams shows the time in the reader's time zone
+	sent := chatTime(message.Time).UTC().Format("2006-01-02T15:04:05Z")
+	footer := teamsEscape.Replace(message.Footer) + " · {{DATE(" + sent + ", SHORT)}} {{TIME(" + sent + ")}}"
+	body = append(body, teamsElement{Type: "TextBlock", Text: footer, Size: "Small", IsSubtle: true, Wrap: true})
+
+	return teamsPayload{
+		Type: "message",
+		Attachments: []teamsAttachment{{
+			ContentType: "application/vnd.microsoft.card.adaptive",
+			Content: teamsCard{
+				Schema:  "http://adaptivecards.io/schemas/adaptive-card.json",
+				Type:    "AdaptiveCard",
+				Version: "1.4",
+				Body:    body,
+				MSTeams: map[string]any{"width": "Full"},
+			},
+		}},
+	}
+}
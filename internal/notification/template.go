@@ -0,0 +1,114 @@
+package notification
+
+import (
+	"log/slog"
+	"strings"
+
+	"github.com/hra42/pg_backup/internal/config"
+	"github.com/hra42/pg_backup/internal/msgtemplate"
+)
+
+// TemplateData is what message templates see of an event. Fields that don't apply to the
+// event are empty.
+type TemplateData struct {
+	Event       string // Event type, e.g. backup_failure
+	Status      string // success, warning, failure, skipped or missed
+	Severity    string // Severity on the channel: info, warning, error or critical
+	Title       string // The built-in title, e.g. "Backup of app failed"
+	Database    string
+	Task        string
+	Duration    string // e.g. 4m12s
+	Size        string // Backup size with a unit, e.g. 1.5 GiB
+	SizeBytes   int64
+	Key         string // Backup key
+	Stage       string // Failed stage
+	Error       string
+	IncidentKey string   // S3 prefix holding the run log of a failure
+	LogTail     []string // Last lines of the run log of a failure, with notification.attach
+	ReportURL   string   // Link to the run report of a failure, with notification.attach
+	Drill       bool
+	Warnings    []string
+	Hostname    string
+	Version     string
+	Timestamp   string // RFC 3339
+	Env         map[string]string
+}
+
+// templateData flattens payload for templates, so they don't deal with unset pointers
+func templateData(payload NotificationPayload, severity string) TemplateData {
+	data := TemplateData{
+		Event:     string(payload.EventType),
+		Status:    payload.Status,
+		Severity:  severity,
+		Title:     eventTitle(payload),
+		Database:  payload.Database,
+		Drill:     payload.Drill,
+		Warnings:  payload.Warnings,
+		Hostname:  payload.Hostname,
+		Version:   payload.Version,
+		Timestamp: payload.Timestamp,
+		Env:       payload.Env,
+	}
+	if payload.Task != nil {
+		data.Task = *payload.Task
+	}
+	if payload.Duration != nil {
+		data.Duration = *payload.Duration
+	}
+	if payload.BackupSize != nil {
+		data.Size = formatSize(float64(*payload.BackupSize))
+		data.SizeBytes = *payload.BackupSize
+	}
+	if payload.BackupKey != nil {
+		data.Key = *payload.BackupKey
+	}
+	if payload.Stage != nil {
+		data.Stage = *payload.Stage
+	}
+	if payload.Error != nil {
+		data.Error = *payload.Error
+	}
+	if payload.IncidentKey != nil {
+		data.IncidentKey = *payload.IncidentKey
+	}
+	data.LogTail = payload.LogTail
+	if payload.ReportURL != nil {
+		data.ReportURL = *payload.ReportURL
+	}
+	return data
+}
+
+// render renders a template of channel with data. It returns false when text is empty or fails
+// to render; the failure is logged and the channel falls back to its built-in text, so a broken
+// template doesn't swallow the notification.
+func (n *NotificationClient) render(channel, part, text string, data TemplateData) (string, bool) {
+	if text == "" {
+		return "", false
+	}
+	out, err := msgtemplate.Render(channel+" "+part, text, data)
+	if err != nil {
+		n.logger.Warn("Failed to render notification template, using the built-in message",
+			slog.String("channel", channel),
+			slog.String("template", part),
+			slog.String("error", err.Error()))
+		return "", false
+	}
+	// Block scalars in YAML end with a newline
+	return strings.TrimSpace(out), true
+}
+
+// applyTemplate replaces the title and the fields of a chat message with the channel's template
+func (n *NotificationClient) applyTemplate(channel string, tmpl *config.MessageTemplate, message *chatMessage, payload NotificationPayload) {
+	if tmpl == nil {
+		return
+	}
+	data := templateData(payload, message.Severity)
+	if title, ok := n.render(channel, "title", tmpl.Title, data); ok {
+		message.Title = title
+	}
+	if body, ok := n.render(channel, "body", tmpl.Body, data); ok {
+		message.Text = body
+		message.Fields = nil
+		message.Detail = ""
+	}
+}
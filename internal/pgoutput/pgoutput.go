@@ -0,0 +1,59 @@
+package pgoutput
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	// Client-side messages look like "pg_dump: error: ..." (PostgreSQL 12+) or
+	// "pg_restore: [archiver (db)] ..." (older clients)
+	clientErrorRegex   = regexp.MustCompile(`^(pg_dump|pg_dumpall|pg_restore|psql)(\[\d+\])?: (error|fatal|\[[^\]]+\])`)
+	clientWarningRegex = regexp.MustCompile(`^(pg_dump|pg_dumpall|pg_restore|psql)(\[\d+\])?: warning:`)
+
+	// Server-side messages relayed by the client, e.g. "ERROR:  relation ... does not exist"
+	// or "psql:file.sql:12: WARNING:  ..."
+	serverErrorRegex   = regexp.MustCompile(`(^|: )(ERROR|FATAL|PANIC):`)
+	serverWarningRegex = regexp.MustCompile(`(^|: )WARNING:`)
+)
+
+// Result holds the warning and error lines found in the output of a PostgreSQL client tool
+type Result struct {
+	Warnings []string
+	Errors   []string
+}
+
+// Classify splits client tool output into warnings and errors. Each line is counted at
+// most once, with errors taking precedence.
+func Classify(output string) Result {
+	var result Result
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		switch {
+		case clientWarningRegex.MatchString(line):
+			result.Warnings = append(result.Warnings, line)
+		case clientErrorRegex.MatchString(line), serverErrorRegex.MatchString(line):
+			result.Errors = append(result.Errors, line)
+		case serverWarningRegex.MatchString(line):
+			result.Warnings = append(result.Warnings, line)
+		}
+	}
+	return result
+}
+
+// HasErrors reports whether any error lines were found
+func (r Result) HasErrors() bool {
+	return len(r.Errors) > 0
+}
+
+// Summary returns at most limit lines of the given messages joined for log output
+func Summary(lines []string, limit int) string {
+	if len(lines) > limit {
+		lines = lines[:limit]
+	}
+	return strings.Join(lines, "\n")
+}
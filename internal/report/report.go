@@ -0,0 +1,184 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hra42/pg_backup/internal/events"
+)
+
+// Report is the machine-readable outcome of a backup run
+type Report struct {
+	RunID      string      `json:"run_id"`
+	Job        events.Job  `json:"job"`
+	Label      string      `json:"label,omitempty"`
+	Reason     string      `json:"reason,omitempty"`
+	StartedAt  time.Time   `json:"started_at"`
+	FinishedAt time.Time   `json:"finished_at"`
+	Duration   float64     `json:"duration_seconds"`
+	Success    bool        `json:"success"`
+	Error      string      `json:"error,omitempty"`
+	Stages     []StageInfo `json:"stages"` // Stages shared by all databases (ssh_connection, retention)
+	Databases  []Database  `json:"databases"`
+	Drill      *Drill      `json:"drill,omitempty"` // Set for restore drills
+}
+
+// Drill is the outcome of a restore drill's validation
+type Drill struct {
+	BackupKey       string        `json:"backup_key"`
+	SourceDatabase  string        `json:"source_database"`
+	ScratchDatabase string        `json:"scratch_database"`
+	Tables          int           `json:"tables"`
+	Rows            int64         `json:"rows"`
+	KeyTables       []TableResult `json:"key_tables"`
+	Checks          []CheckResult `json:"checks"`
+	Dropped         bool          `json:"dropped"` // The scratch database was dropped again
+}
+
+// TableResult is the row count and content checksum of a key table
+type TableResult struct {
+	Table    string `json:"table"`
+	Rows     int64  `json:"rows"`
+	Checksum string `json:"checksum"` // md5 over the md5 of every row, in row order of the hashes
+}
+
+// CheckResult is the outcome of one drill check
+type CheckResult struct {
+	Name     string `json:"name"`
+	Passed   bool   `json:"passed"`
+	Actual   string `json:"actual"`
+	Expected string `json:"expected"`
+}
+
+// Database is the outcome of one database's backup
+type Database struct {
+	Database string      `json:"database"`
+	Success  bool        `json:"success"`
+	Error    string      `json:"error,omitempty"`
+	Key      string      `json:"key,omitempty"`
+	Size     int64       `json:"size"`
+	SHA256   string      `json:"sha256,omitempty"`
+	Verified bool        `json:"verified"`
+	Retries  int         `json:"retries"`
+	Duration float64     `json:"duration_seconds"`
+	Warnings []string    `json:"warnings"`
+	Stages   []StageInfo `json:"stages"`
+}
+
+// StageInfo records how a stage went. Bytes and throughput are set for stages that report
+// progress (transfer, upload).
+type StageInfo struct {
+	Stage          events.Stage `json:"stage"`
+	Duration       float64      `json:"duration_seconds"`
+	Success        bool         `json:"success"`
+	Error          string       `json:"error,omitempty"`
+	Bytes          int64        `json:"bytes,omitempty"`
+	BytesPerSecond float64      `json:"bytes_per_second,omitempty"`
+}
+
+// Collector is an events.Listener that records stage outcomes per database
+type Collector struct {
+	events.NopListener
+
+	mu     sync.Mutex
+	stages map[string][]StageInfo
+	bytes  map[string]map[events.Stage]int64
+}
+
+func NewCollector() *Collector {
+	return &Collector{
+		stages: make(map[string][]StageInfo),
+		bytes:  make(map[string]map[events.Stage]int64),
+	}
+}
+
+func (c *Collector) OnProgress(progress events.Progress) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.bytes[progress.Database] == nil {
+		c.bytes[progress.Database] = make(map[events.Stage]int64)
+	}
+	c.bytes[progress.Database][progress.Stage] = progress.Bytes
+}
+
+func (c *Collector) OnComplete(event events.Event) {
+	c.record(event, nil)
+}
+
+func (c *Collector) OnError(event events.Event, err error) {
+	c.record(event, err)
+}
+
+func (c *Collector) record(event events.Event, err error) {
+	// The run stage wraps the others; its duration is reported per database instead
+	if event.Stage == events.StageRun {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	info := StageInfo{
+		Stage:    event.Stage,
+		Duration: event.Duration.Seconds(),
+		Success:  err == nil,
+		Bytes:    c.bytes[event.Database][event.Stage],
+	}
+	if err != nil {
+		info.Error = err.Error()
+	}
+	if info.Bytes > 0 && event.Duration > 0 {
+		info.BytesPerSecond = float64(info.Bytes) / event.Duration.Seconds()
+	}
+	c.stages[event.Database] = append(c.stages[event.Database], info)
+}
+
+// Stages returns the stages recorded for a database, or the shared stages for ""
+func (c *Collector) Stages(database string) []StageInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stages := c.stages[database]
+	if stages == nil {
+		return []StageInfo{}
+	}
+	return append([]StageInfo(nil), stages...)
+}
+
+// Write writes the report as a single JSON line to stdout and/or as indented JSON to path.
+// The file is written to a temporary name and renamed, so readers never see a partial report.
+func Write(r *Report, path string, stdout io.Writer) error {
+	if stdout != nil {
+		data, err := json.Marshal(r)
+		if err != nil {
+			return fmt.Errorf("failed to marshal run report: %w", err)
+		}
+		if _, err := fmt.Fprintln(stdout, string(data)); err != nil {
+			return fmt.Errorf("failed to write run report: %w", err)
+		}
+	}
+
+	if path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal run report: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create report directory: %w", err)
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write run report: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to write run report: %w", err)
+	}
+	return nil
+}
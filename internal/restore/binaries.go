@@ -0,0 +1,82 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/hra42/pg_backup/internal/dumpformat"
+	"github.com/hra42/pg_backup/internal/shell"
+)
+
+// pgRestoreCandidates lists the pg_restore binaries of the restore host as path|version lines:
+// the one on PATH and the versioned installs of the Debian/Ubuntu, RHEL and Homebrew packages
+const pgRestoreCandidates = `for f in "$(command -v pg_restore)" /usr/lib/postgresql/*/bin/pg_restore ` +
+	`/usr/pgsql-*/bin/pg_restore /usr/local/pgsql/bin/pg_restore /opt/homebrew/opt/postgresql@*/bin/pg_restore ` +
+	`/usr/local/opt/postgresql@*/bin/pg_restore; do [ -x "$f" ] && printf '%s|%s\n' "$f" "$("$f" --version 2>&1)"; done; true`
+
+// pgClient is a pg_restore binary found on the restore host
+type pgClient struct {
+	path  string
+	major int
+}
+
+// selectPgRestore picks the pg_restore the run uses: the newest one installed on the restore
+// host, or the one in restore.pg_bin_dir. minClient is the version the dump needs (0 if
+// unknown), only logged here; callers compare it with the selected version.
+func (rm *RestoreManager) selectPgRestore(ctx context.Context, minClient int) error {
+	command := pgRestoreCandidates
+	location := "the restore host"
+	if dir := rm.config.Restore.PgBinDir; dir != "" {
+		command = fmt.Sprintf(`f=%s; [ -x "$f" ] && printf '%%s|%%s\n' "$f" "$("$f" --version 2>&1)"; true`, shell.Quote(path.Join(dir, "pg_restore")))
+		location = "restore.pg_bin_dir " + dir
+	}
+	output, err := rm.executeCommand(ctx, command, 30*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to look for pg_restore: %w (output: %s)", err, strings.TrimSpace(output))
+	}
+
+	var candidates []pgClient
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		binary, version, ok := strings.Cut(line, "|")
+		if !ok {
+			continue
+		}
+		major, err := dumpformat.ClientMajor(version)
+		if err != nil {
+			rm.logger.Debug("Ignoring pg_restore with unknown version", slog.String("path", binary), slog.String("version", version))
+			continue
+		}
+		candidates = append(candidates, pgClient{path: binary, major: major})
+	}
+
+	// A newer pg_restore reads every older format, so the newest one is the best choice
+	var selected pgClient
+	for _, candidate := range candidates {
+		if candidate.major > selected.major {
+			selected = candidate
+		}
+	}
+	if selected.path == "" {
+		return fmt.Errorf("pg_restore not found in %s", location)
+	}
+	rm.pgRestore = selected
+	rm.logger.Info("Selected pg_restore",
+		slog.String("path", selected.path),
+		slog.Int("version", selected.major),
+		slog.Int("required", minClient),
+		slog.Int("candidates", len(candidates)))
+	return nil
+}
+
+// binDirPrefix puts restore.pg_bin_dir first on the PATH of a remote command, so psql comes
+// from the same installation as pg_restore
+func (rm *RestoreManager) binDirPrefix() string {
+	if rm.config.Restore.PgBinDir == "" {
+		return ""
+	}
+	return fmt.Sprintf(`export PATH=%s:"$PATH"; `, shell.Quote(rm.config.Restore.PgBinDir))
+}
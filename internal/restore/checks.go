@@ -0,0 +1,101 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/hra42/pg_backup/internal/config"
+	"github.com/hra42/pg_backup/internal/shell"
+)
+
+// schemaTablesQuery counts the tables of every user schema as schema|count lines
+const schemaTablesQuery = `SELECT table_schema || '|' || count(*)
+FROM information_schema.tables
+WHERE table_type = 'BASE TABLE' AND table_schema NOT IN ('pg_catalog', 'information_schema')
+GROUP BY table_schema ORDER BY table_schema`
+
+// verifyRestore counts the restored tables per schema and runs the checks of restore.verify.
+// Every check runs, so the error names all that failed. Without restore.verify the counts are
+// only logged and failing to get them is a warning.
+func (rm *RestoreManager) verifyRestore(ctx context.Context) error {
+	checks := rm.config.Restore.Verify
+
+	output, err := rm.databaseQuery(ctx, schemaTablesQuery)
+	if err != nil {
+		if checks == nil {
+			rm.logger.Warn("Failed to verify restore", slog.String("error", err.Error()))
+			return nil
+		}
+		return fmt.Errorf("failed to count restored tables: %w (output: %s)", err, output)
+	}
+	tables := make(map[string]int)
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		schema, count, ok := strings.Cut(line, "|")
+		if n, err := strconv.Atoi(strings.TrimSpace(count)); ok && err == nil {
+			tables[schema] = n
+		}
+	}
+	rm.logger.Info("Restore verification", slog.Any("tables_per_schema", tables))
+	if checks == nil {
+		return nil
+	}
+
+	var failed []string
+	for _, schema := range slices.Sorted(maps.Keys(checks.MinTables)) {
+		if minimum := checks.MinTables[schema]; tables[schema] < minimum {
+			failed = append(failed, fmt.Sprintf("schema %s has %d tables, expected at least %d", schema, tables[schema], minimum))
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(checks.MinRows)) {
+		schema, table := config.SplitTableName(name)
+		output, err := rm.databaseQuery(ctx, fmt.Sprintf("SELECT count(*) FROM %s.%s", quoteIdent(schema), quoteIdent(table)))
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("counting rows of %s failed: %v (output: %s)", name, err, strings.TrimSpace(output)))
+			continue
+		}
+		rows, _ := strconv.ParseInt(strings.TrimSpace(output), 10, 64)
+		rm.logger.Debug("Restored table rows", slog.String("table", name), slog.Int64("rows", rows))
+		if minimum := checks.MinRows[name]; rows < minimum {
+			failed = append(failed, fmt.Sprintf("table %s has %d rows, expected at least %d", name, rows, minimum))
+		}
+	}
+
+	for _, check := range checks.Checks {
+		if check.Database != "" && check.Database != rm.source {
+			continue
+		}
+		output, err := rm.databaseQuery(ctx, check.Query)
+		actual := strings.TrimSpace(output)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("check %s failed: %v (output: %s)", check.Name, err, actual))
+		} else if actual != check.Expect {
+			failed = append(failed, fmt.Sprintf("check %s returned %q, expected %q", check.Name, actual, check.Expect))
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("restore verification failed, %d checks failed: %s", len(failed), strings.Join(failed, "; "))
+	}
+	rm.logger.Info("Restore verification passed",
+		slog.Int("min_tables", len(checks.MinTables)),
+		slog.Int("min_rows", len(checks.MinRows)),
+		slog.Int("checks", len(checks.Checks)))
+	return nil
+}
+
+// databaseQuery runs a query in the restored database and returns its unaligned output
+func (rm *RestoreManager) databaseQuery(ctx context.Context, query string) (string, error) {
+	cmd := fmt.Sprintf(
+		"psql %s -d \"%s\" -X -t -A -v ON_ERROR_STOP=1 -c %s",
+		rm.targetArgs(),
+		rm.config.Restore.TargetDatabase,
+		shell.Quote(query),
+	)
+	return rm.executeCommand(ctx, cmd, rm.config.Timeouts.BackupOp)
+}
@@ -0,0 +1,52 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/hra42/pg_backup/internal/config"
+	"github.com/hra42/pg_backup/internal/masking"
+)
+
+// RunClone refreshes a development database from a backup: it restores into target on the
+// restore server, replacing any database of that name, masks the data when maskingRules (or
+// restore.masking_rules) is set, and runs ANALYZE before restore.post_sql. An empty backupKey
+// clones the latest backup. The production safety limits don't apply, so databases that are
+// backed up can't be the target when the restore server is the source server.
+func (rm *RestoreManager) RunClone(ctx context.Context, backupKey, target, maskingRules string) error {
+	if target == "" {
+		return fmt.Errorf("clone target database is required")
+	}
+	if rm.config.Restore.TargetHost == rm.config.Postgres.Host && rm.config.Restore.TargetPort == rm.config.Postgres.Port &&
+		slices.Contains(rm.config.BackupDatabases(), target) {
+		return fmt.Errorf("refusing to clone into %s, it is a backed up database on the source server", target)
+	}
+	if maskingRules != "" {
+		if _, err := masking.LoadRules(maskingRules); err != nil {
+			return err
+		}
+	}
+
+	// The clone settings replace the restore section for this run only
+	original := rm.config
+	cfg := *original
+	cfg.Restore.TargetDatabase = target
+	cfg.Restore.TargetDatabaseTemplate = ""
+	cfg.Restore.CreateDB = true
+	cfg.Restore.DropExisting = true
+	cfg.Restore.Production = false
+	if maskingRules != "" {
+		cfg.Restore.MaskingRules = maskingRules
+	}
+	cfg.Restore.PostSQL = append([]config.PostSQL{{SQL: "ANALYZE;"}}, original.Restore.PostSQL...)
+
+	rm.config = &cfg
+	defer func() { rm.config = original }()
+
+	rm.logger.Info("Cloning backup into development database",
+		slog.String("target_database", target),
+		slog.String("masking_rules", cfg.Restore.MaskingRules))
+	return rm.Run(ctx, backupKey)
+}
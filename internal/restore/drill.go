@@ -0,0 +1,259 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hra42/pg_backup/internal/config"
+	"github.com/hra42/pg_backup/internal/events"
+	"github.com/hra42/pg_backup/internal/report"
+	"github.com/hra42/pg_backup/internal/storage"
+	"github.com/hra42/pg_backup/internal/verify"
+)
+
+// drillRun holds the state of a restore drill while it runs
+type drillRun struct {
+	config    *config.DrillConfig
+	startedAt time.Time
+	collector *report.Collector
+	result    report.Drill
+}
+
+// RunDrill restores a backup into a scratch database on the restore target, validates it with
+// restore.drill, records the outcome in the backup's metadata and the drill report, drops the
+// scratch database and notifies. Unlike Run it never touches target_database.
+func (rm *RestoreManager) RunDrill(ctx context.Context, backupKey string) error {
+	drillConfig := rm.config.Restore.Drill
+	if drillConfig == nil {
+		drillConfig = &config.DrillConfig{MinTables: 1}
+	}
+
+	// The scratch database replaces the target for this run only
+	original, listener := rm.config, rm.listener
+	cfg := *original
+	cfg.Restore.TargetDatabase = "pg_backup_drill_" + time.Now().UTC().Format("20060102_150405")
+	cfg.Restore.TargetDatabaseTemplate = ""
+	cfg.Restore.CreateDB = true
+	cfg.Restore.DropExisting = false
+	cfg.Restore.Production = false
+	cfg.Restore.OnFailure = "keep" // finishDrill drops the scratch database unless drill.keep_on_failure
+
+	rm.drill = &drillRun{
+		config:    drillConfig,
+		startedAt: time.Now(),
+		collector: report.NewCollector(),
+		result:    report.Drill{ScratchDatabase: cfg.Restore.TargetDatabase},
+	}
+	rm.config = &cfg
+	rm.listener = events.Multi{listener, rm.drill.collector}
+	defer func() {
+		rm.config, rm.listener, rm.drill = original, listener, nil
+	}()
+
+	return rm.Run(ctx, backupKey)
+}
+
+// finishDrill validates the scratch database once the restore succeeded, then drops it,
+// records the outcome and returns the first error of the restore or the validation
+func (rm *RestoreManager) finishDrill(ctx context.Context, restoreErr error) error {
+	drill := rm.drill
+	err := restoreErr
+	if err == nil {
+		err = rm.stage(events.StageDrill, func() error {
+			return rm.validateDrill(ctx)
+		})
+	}
+
+	if err != nil && drill.config.KeepOnFailure {
+		rm.logger.Warn("Keeping scratch database of the failed drill for inspection",
+			slog.String("database", drill.result.ScratchDatabase))
+	} else {
+		rm.dropScratchDatabase()
+	}
+
+	rm.recordDrill(err)
+	return err
+}
+
+// validateDrill counts the restored tables and rows, checksums the key tables and runs the
+// drill checks. Every check runs, so the report shows all that failed.
+func (rm *RestoreManager) validateDrill(ctx context.Context) error {
+	drill := rm.drill
+	drill.result.BackupKey = rm.backupKey
+	drill.result.SourceDatabase = rm.source
+
+	output, err := rm.databaseQuery(ctx, verify.RowCountQuery)
+	if err != nil {
+		return fmt.Errorf("failed to count restored rows: %w (output: %s)", err, output)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		if line == "" {
+			continue
+		}
+		table, count, ok := strings.Cut(line, "|")
+		rows, parseErr := strconv.ParseInt(strings.TrimSpace(count), 10, 64)
+		if !ok || parseErr != nil {
+			return fmt.Errorf("unexpected row count output: %q", line)
+		}
+		rm.logger.Debug("Restored table", slog.String("table", table), slog.Int64("rows", rows))
+		drill.result.Tables++
+		drill.result.Rows += rows
+	}
+
+	drill.result.KeyTables = []report.TableResult{}
+	for _, name := range drill.config.KeyTables {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		schema, table := config.SplitTableName(name)
+		query := fmt.Sprintf(
+			`SELECT count(*) || '|' || coalesce(md5(string_agg(md5(t::text), '' ORDER BY md5(t::text))), '') FROM %s.%s t`,
+			quoteIdent(schema), quoteIdent(table))
+		output, err := rm.databaseQuery(ctx, query)
+		if err != nil {
+			return fmt.Errorf("failed to checksum key table %s: %w (output: %s)", name, err, output)
+		}
+		count, checksum, _ := strings.Cut(strings.TrimSpace(output), "|")
+		rows, _ := strconv.ParseInt(count, 10, 64)
+		drill.result.KeyTables = append(drill.result.KeyTables, report.TableResult{Table: schema + "." + table, Rows: rows, Checksum: checksum})
+		rm.logger.Info("Key table checksum", slog.String("table", schema+"."+table), slog.Int64("rows", rows), slog.String("checksum", checksum))
+	}
+
+	drill.result.Checks = []report.CheckResult{}
+	var failed []string
+	for _, check := range drill.config.Checks {
+		if check.Database != "" && check.Database != rm.source {
+			continue
+		}
+		output, err := rm.databaseQuery(ctx, check.Query)
+		result := report.CheckResult{Name: check.Name, Actual: strings.TrimSpace(output), Expected: check.Expect}
+		if err != nil {
+			result.Actual = fmt.Sprintf("error: %v (output: %s)", err, strings.TrimSpace(output))
+		}
+		result.Passed = err == nil && result.Actual == check.Expect
+		if !result.Passed {
+			failed = append(failed, fmt.Sprintf("%s returned %q, expected %q", check.Name, result.Actual, check.Expect))
+		}
+		drill.result.Checks = append(drill.result.Checks, result)
+	}
+
+	rm.logger.Info("Drill validation",
+		slog.Int("tables", drill.result.Tables),
+		slog.Int64("rows", drill.result.Rows),
+		slog.Int("checks", len(drill.result.Checks)),
+		slog.Int("failed_checks", len(failed)))
+
+	if drill.config.MinTables > 0 && drill.result.Tables < drill.config.MinTables {
+		return fmt.Errorf("drill restore contains %d tables, expected at least %d", drill.result.Tables, drill.config.MinTables)
+	}
+	if drill.result.Rows < drill.config.MinRows {
+		return fmt.Errorf("drill restore contains %d rows, expected at least %d", drill.result.Rows, drill.config.MinRows)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d drill checks failed: %s", len(failed), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// dropScratchDatabase removes the drill's scratch database, also after a failed restore
+func (rm *RestoreManager) dropScratchDatabase() {
+	dropCmd := fmt.Sprintf(
+		"psql %s -d postgres -c \"DROP DATABASE IF EXISTS \\\"%s\\\";\"",
+		rm.targetArgs(),
+		rm.config.Restore.TargetDatabase,
+	)
+	if output, err := rm.executeCommand(context.Background(), dropCmd, 5*time.Minute); err != nil {
+		rm.logger.Warn("Failed to drop drill scratch database",
+			slog.String("database", rm.config.Restore.TargetDatabase),
+			slog.String("error", err.Error()),
+			slog.String("output", output))
+		return
+	}
+	rm.drill.result.Dropped = true
+	rm.logger.Info("Dropped drill scratch database", slog.String("database", rm.config.Restore.TargetDatabase))
+}
+
+// recordDrill stores the drill's outcome in the backup's metadata and writes the drill report
+func (rm *RestoreManager) recordDrill(drillErr error) {
+	drill := rm.drill
+	finishedAt := time.Now()
+
+	if rm.backupKey != "" && !strings.HasPrefix(rm.backupKey, "@") {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if metadata, err := rm.s3Client.GetMetadata(ctx, rm.backupKey); err != nil {
+			rm.logger.Debug("No backup metadata to record the drill in", slog.String("error", err.Error()))
+		} else {
+			metadata.Drill = &storage.DrillMetadata{
+				DrilledAt: finishedAt.UTC(),
+				Tables:    drill.result.Tables,
+				Rows:      drill.result.Rows,
+				Duration:  finishedAt.Sub(drill.startedAt).Round(time.Second).String(),
+			}
+			for _, check := range drill.result.Checks {
+				if check.Passed {
+					metadata.Drill.Checks++
+				}
+			}
+			if drillErr != nil {
+				metadata.Drill.Error = drillErr.Error()
+			}
+			if err := rm.s3Client.PutMetadata(ctx, rm.backupKey, metadata); err != nil {
+				rm.logger.Warn("Failed to record drill in backup metadata", slog.String("error", err.Error()))
+			}
+		}
+	}
+
+	cfg := drill.config.Report
+	if cfg.Path == "" && !cfg.Stdout {
+		return
+	}
+	drillReport := &report.Report{
+		RunID:      rm.runID,
+		Job:        events.JobDrill,
+		StartedAt:  drill.startedAt.UTC(),
+		FinishedAt: finishedAt.UTC(),
+		Duration:   finishedAt.Sub(drill.startedAt).Seconds(),
+		Success:    drillErr == nil,
+		Stages:     drill.collector.Stages(drill.result.ScratchDatabase),
+		Databases:  []report.Database{},
+		Drill:      &drill.result,
+	}
+	if drillErr != nil {
+		drillReport.Error = drillErr.Error()
+	}
+
+	var stdout io.Writer
+	if cfg.Stdout {
+		stdout = os.Stdout
+	}
+	if err := report.Write(drillReport, cfg.Path, stdout); err != nil {
+		rm.logger.Warn("Failed to write drill report", slog.String("error", err.Error()))
+	}
+}
+
+// notifyDrillSuccess sends the notification of a drill that passed validation
+func (rm *RestoreManager) notifyDrillSuccess(duration time.Duration) {
+	passed := 0
+	for _, check := range rm.drill.result.Checks {
+		if check.Passed {
+			passed++
+		}
+	}
+	err := rm.notificationClient.SendDrillSuccess(rm.source, duration, rm.backupKey,
+		rm.drill.result.Tables, rm.drill.result.Rows, passed, rm.warnings)
+	if err != nil {
+		rm.logger.Warn("Failed to send success notification", slog.String("error", err.Error()))
+	}
+}
+
+// quoteIdent quotes an SQL identifier
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
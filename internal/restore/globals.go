@@ -0,0 +1,81 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+
+	"github.com/hra42/pg_backup/internal/shell"
+	"github.com/hra42/pg_backup/internal/storage"
+)
+
+// createRoleRegex matches the CREATE ROLE statements of pg_dumpall --globals-only
+var createRoleRegex = regexp.MustCompile(`^CREATE ROLE (.+);$`)
+
+// restoreGlobals replays the roles stored with a backup (backup.globals) on the target server,
+// so the ownership and grants in the dump find their roles. Roles that already exist are kept
+// as they are, only their attributes and memberships are reapplied.
+func (rm *RestoreManager) restoreGlobals(ctx context.Context, backupKey string, metadata *storage.BackupMetadata) error {
+	if metadata != nil && !metadata.Globals {
+		rm.logger.Warn("Backup has no globals stored, skipping restore_globals", slog.String("key", backupKey))
+		rm.warnings = append(rm.warnings, "restore_globals: backup has no globals stored")
+		return nil
+	}
+	globals, err := rm.s3Client.GetGlobals(ctx, backupKey)
+	if err != nil {
+		// Backups without metadata may still have globals, so a missing object is no error
+		rm.logger.Warn("No globals found for backup, skipping restore_globals", slog.String("error", err.Error()))
+		rm.warnings = append(rm.warnings, "restore_globals: "+err.Error())
+		return nil
+	}
+
+	script, roles := globalsScript(string(globals))
+	rm.logger.Info("Restoring globals",
+		slog.String("key", backupKey+storage.GlobalsSuffix),
+		slog.Int("roles", roles))
+
+	globalsCmd := fmt.Sprintf(
+		"psql %s -d postgres -X -v ON_ERROR_STOP=1 -c %s 2>&1",
+		rm.targetArgs(),
+		shell.Quote(script),
+	)
+	if output, err := rm.executeCommand(ctx, globalsCmd, rm.config.Timeouts.BackupOp); err != nil {
+		return fmt.Errorf("failed to restore globals: %w (output: %s)", err, output)
+	}
+
+	rm.logger.Info("Globals restored", slog.Int("roles", roles))
+	return nil
+}
+
+// globalsScript turns pg_dumpall --globals-only output into a script that can run against a
+// server that already has some of the roles. CREATE ROLE tolerates existing roles, psql
+// meta-commands are dropped and tablespaces are left out, as their directories rarely exist on
+// the target. It returns the script and the number of roles it creates.
+func globalsScript(globals string) (string, int) {
+	var b strings.Builder
+	roles := 0
+	for _, line := range strings.Split(globals, "\n") {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case strings.HasPrefix(line, `\`):
+			continue
+		case strings.HasPrefix(line, "CREATE TABLESPACE "), strings.HasPrefix(line, "ALTER TABLESPACE "):
+			b.WriteString("-- skipped: " + line + "\n")
+		case createRoleRegex.MatchString(line):
+			role := createRoleRegex.FindStringSubmatch(line)[1]
+			fmt.Fprintf(&b, "DO $pg_backup$ BEGIN CREATE ROLE %s; EXCEPTION WHEN duplicate_object THEN RAISE NOTICE 'role %%s already exists, keeping it', %s; END $pg_backup$;\n",
+				role, quoteLiteral(role))
+			roles++
+		default:
+			b.WriteString(line + "\n")
+		}
+	}
+	return b.String(), roles
+}
+
+// quoteLiteral quotes an SQL string literal
+func quoteLiteral(value string) string {
+	return `'` + strings.ReplaceAll(value, `'`, `''`) + `'`
+}
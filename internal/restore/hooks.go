@@ -0,0 +1,62 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+
+	"github.com/hra42/pg_backup/internal/shell"
+)
+
+// runPostRestore runs restore.post_sql and then restore.post_hooks against the restored
+// database, stopping at the first failure. The restored data stays in place then, but the
+// restore is reported as failed, as the target isn't ready for use.
+func (rm *RestoreManager) runPostRestore(ctx context.Context) error {
+	for i, step := range rm.config.Restore.PostSQL {
+		sql, err := step.Load()
+		if err != nil {
+			return fmt.Errorf("post_sql[%d]: %w", i, err)
+		}
+		rm.logger.Info("Running post-restore SQL", slog.String("step", step.Name()))
+
+		// psql -f - runs each statement in its own transaction, so statements like VACUUM or
+		// CREATE SUBSCRIPTION that refuse a transaction block work too
+		sqlCmd := fmt.Sprintf(
+			"printf '%%s\\n' %s | psql %s -d \"%s\" -X -v ON_ERROR_STOP=1 -f - 2>&1",
+			shell.Quote(sql),
+			rm.targetArgs(),
+			rm.config.Restore.TargetDatabase,
+		)
+		if output, err := rm.executeCommand(ctx, sqlCmd, rm.config.Timeouts.BackupOp); err != nil {
+			return fmt.Errorf("post_sql %s failed: %w (output: %s)", step.Name(), err, output)
+		}
+	}
+
+	// Hooks connect with plain psql or any libpq client; the password is already exported.
+	// A socket target without host or user leaves both to libpq's defaults.
+	env := map[string]string{
+		"PGPORT":     strconv.Itoa(rm.config.Restore.TargetPort),
+		"PGDATABASE": rm.config.Restore.TargetDatabase,
+	}
+	if rm.config.Restore.TargetHost != "" {
+		env["PGHOST"] = rm.config.Restore.TargetHost
+	}
+	if rm.config.Restore.TargetUsername != "" {
+		env["PGUSER"] = rm.config.Restore.TargetUsername
+	}
+	target := shell.EnvPrefix(env)
+	for i, hook := range rm.config.Restore.PostHooks {
+		rm.logger.Info("Running post-restore hook", slog.Int("hook", i))
+		output, err := rm.executeCommand(ctx, target+hook, rm.config.Timeouts.BackupOp)
+		if err != nil {
+			return fmt.Errorf("post_hooks[%d] failed: %w (output: %s)", i, err, output)
+		}
+		rm.logger.Debug("Post-restore hook output", slog.Int("hook", i), slog.String("output", output))
+	}
+
+	rm.logger.Info("Post-restore steps completed",
+		slog.Int("post_sql", len(rm.config.Restore.PostSQL)),
+		slog.Int("post_hooks", len(rm.config.Restore.PostHooks)))
+	return nil
+}
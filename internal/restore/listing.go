@@ -0,0 +1,152 @@
+package restore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hra42/pg_backup/internal/storage"
+)
+
+// listingMetadataReads is how many metadata objects -list-backups reads at once
+const listingMetadataReads = 8
+
+// BackupListing is one backup as shown by -list-backups
+type BackupListing struct {
+	Index     int       `json:"index"` // Position from the newest backup, as accepted by -backup-key @N
+	Key       string    `json:"key"`
+	Database  string    `json:"database"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+	AgeSecs   int64     `json:"age_seconds"`
+	Verified  string    `json:"verified"` // "yes", "failed", "no", or "unknown" without metadata
+	Pinned    bool      `json:"pinned"`
+	Labels    []string  `json:"labels,omitempty"`
+}
+
+// ListAvailableBackups lists the backups newest first, with the details of their metadata
+// objects. Backups taken before metadata existed are listed with what their key tells.
+func (rm *RestoreManager) ListAvailableBackups(ctx context.Context) ([]BackupListing, error) {
+	rm.logger.Info("Listing available backups")
+
+	backups, err := rm.s3Client.ListBackupObjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Single database backups don't carry the database in their key
+	defaultDatabase := "-"
+	if databases := rm.config.BackupDatabases(); len(databases) == 1 {
+		defaultDatabase = databases[0]
+	}
+
+	now := time.Now()
+	listings := make([]BackupListing, len(backups))
+	for i, backup := range backups {
+		created, ok := storage.BackupTime(backup.Key)
+		if !ok {
+			created = backup.LastModified
+		}
+		database := backup.Database
+		if database == "" {
+			database = defaultDatabase
+		}
+		listings[i] = BackupListing{
+			Index:     i + 1,
+			Key:       backup.Key,
+			Database:  database,
+			Size:      backup.Size,
+			CreatedAt: created,
+			AgeSecs:   max(int64(now.Sub(created).Seconds()), 0),
+			Verified:  "unknown",
+		}
+	}
+
+	sem := make(chan struct{}, listingMetadataReads)
+	var wg sync.WaitGroup
+	for i := range listings {
+		wg.Add(1)
+		go func(listing *BackupListing) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			metadata, err := rm.s3Client.GetMetadata(ctx, listing.Key)
+			if err != nil {
+				rm.logger.Debug("No metadata for backup", slog.String("key", listing.Key), slog.String("error", err.Error()))
+				return
+			}
+			listing.Pinned = metadata.Pinned
+			listing.Labels = metadata.Labels
+			if metadata.Label != "" {
+				listing.Labels = append([]string{metadata.Label}, metadata.Labels...)
+			}
+			switch {
+			case metadata.Verification != nil && metadata.Verification.Error != "":
+				listing.Verified = "failed"
+			case metadata.Verified:
+				listing.Verified = "yes"
+			default:
+				listing.Verified = "no"
+			}
+		}(&listings[i])
+	}
+	wg.Wait()
+
+	rm.logger.Info("Found backups", slog.Int("count", len(listings)))
+	return listings, nil
+}
+
+// WriteBackupList prints the backups of ListAvailableBackups as a table, or as a JSON array
+// with format "json"
+func WriteBackupList(w io.Writer, listings []BackupListing, format string) error {
+	if format == "json" {
+		if listings == nil {
+			listings = []BackupListing{}
+		}
+		data, err := json.MarshalIndent(listings, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	}
+
+	if len(listings) == 0 {
+		_, err := fmt.Fprintln(w, "No backups found")
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "#\tCREATED (UTC)\tAGE\tSIZE\tDATABASE\tVERIFIED\tPINNED\tKEY")
+	for _, listing := range listings {
+		pinned := ""
+		if listing.Pinned {
+			pinned = "pinned"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", listing.Index,
+			listing.CreatedAt.UTC().Format("2006-01-02 15:04:05"),
+			formatAge(time.Duration(listing.AgeSecs)*time.Second),
+			formatSize(float64(listing.Size)),
+			listing.Database,
+			listing.Verified,
+			pinned,
+			listing.Key)
+	}
+	return tw.Flush()
+}
+
+// formatAge renders an age with its two largest units, e.g. 3d 4h or 25m
+func formatAge(age time.Duration) string {
+	switch {
+	case age < time.Hour:
+		return fmt.Sprintf("%dm", int(age.Minutes()))
+	case age < 24*time.Hour:
+		return fmt.Sprintf("%dh %dm", int(age.Hours()), int(age.Minutes())%60)
+	}
+	return fmt.Sprintf("%dd %dh", int(age.Hours())/24, int(age.Hours())%24)
+}
@@ -0,0 +1,38 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/hra42/pg_backup/internal/masking"
+	"github.com/hra42/pg_backup/internal/shell"
+)
+
+// maskData rewrites the columns listed in restore.masking_rules on the target. psql sends all
+// statements of -c as one query, so they run in a single transaction and a failing rule leaves
+// nothing half masked. The restore fails then, as the target still holds the unmasked data.
+func (rm *RestoreManager) maskData(ctx context.Context) error {
+	rules, err := masking.LoadRules(rm.config.Restore.MaskingRules)
+	if err != nil {
+		return err
+	}
+
+	rm.logger.Info("Masking restored data",
+		slog.String("rules", rm.config.Restore.MaskingRules),
+		slog.Int("columns", len(rules.Rules)),
+		slog.Any("tables", rules.Tables()))
+
+	maskCmd := fmt.Sprintf(
+		"psql %s -d \"%s\" -X -v ON_ERROR_STOP=1 -c %s 2>&1",
+		rm.targetArgs(),
+		rm.config.Restore.TargetDatabase,
+		shell.Quote(rules.SQL()),
+	)
+	if output, err := rm.executeCommand(ctx, maskCmd, rm.config.Timeouts.BackupOp); err != nil {
+		return fmt.Errorf("masking failed, %s holds unmasked data: %w (output: %s)", rm.config.Restore.TargetDatabase, err, output)
+	}
+
+	rm.logger.Info("Restored data masked", slog.String("database", rm.config.Restore.TargetDatabase))
+	return nil
+}
@@ -0,0 +1,119 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hra42/pg_backup/internal/config"
+	"github.com/hra42/pg_backup/internal/storage"
+)
+
+// databaseRestore is the restore of one database within RunDatabases
+type databaseRestore struct {
+	database string
+	key      string
+	runID    string // Backup run recorded in the backup's metadata
+	duration time.Duration
+	err      error
+}
+
+// RunDatabases restores the newest backup of each database, or the newest taken at or before
+// asOf, into a database of the same name or the one named by restore.target_database_template.
+// Up to restore.parallelism restores run at once. Each has its own restore manager, so its own
+// connections, stages and notifications, and a failed database doesn't stop the others.
+func RunDatabases(ctx context.Context, cfg *config.Config, logger *slog.Logger, databases []string, asOf time.Time, drill bool) error {
+	s3Client, err := storage.NewS3Client(&cfg.S3, logger)
+	if err != nil {
+		return fmt.Errorf("failed to create S3 client: %w", err)
+	}
+	backups, err := s3Client.ListBackupObjects(ctx)
+	if err != nil {
+		return err
+	}
+
+	// All backups are selected up front, so a missing one fails before anything is restored
+	restores := make([]*databaseRestore, len(databases))
+	for i, database := range databases {
+		key, err := SelectDatabase(backups, database, asOf)
+		if err != nil {
+			return err
+		}
+		restores[i] = &databaseRestore{database: database, key: key}
+		if metadata, err := s3Client.GetMetadata(ctx, key); err == nil {
+			restores[i].runID = metadata.RunID
+		}
+	}
+	for _, r := range restores[1:] {
+		if r.runID == "" || r.runID != restores[0].runID {
+			logger.Warn("The selected backups were not all taken by the same backup run",
+				slog.String("database", r.database),
+				slog.String("key", r.key),
+				slog.String("first_key", restores[0].key))
+			break
+		}
+	}
+
+	logger.Info("Restoring databases",
+		slog.Any("databases", databases),
+		slog.Int("parallelism", cfg.Restore.Parallelism))
+
+	sem := make(chan struct{}, cfg.Restore.Parallelism)
+	var wg sync.WaitGroup
+	for _, r := range restores {
+		wg.Add(1)
+		go func(r *databaseRestore) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			if err := ctx.Err(); err != nil {
+				r.err = fmt.Errorf("restore cancelled before start: %w", err)
+				return
+			}
+
+			// Every restore gets its own copy, as a run renames its target database
+			dbConfig := *cfg
+			dbConfig.Restore.TargetDatabase = r.database
+			dbLogger := logger.With(slog.String("database", r.database))
+			rm, err := NewRestoreManager(&dbConfig, dbLogger)
+			if err != nil {
+				r.err = err
+				return
+			}
+
+			startTime := time.Now()
+			if drill {
+				r.err = rm.RunDrill(ctx, r.key)
+			} else {
+				r.err = rm.Run(ctx, r.key)
+			}
+			r.duration = time.Since(startTime)
+		}(r)
+	}
+	wg.Wait()
+
+	var failed []string
+	for _, r := range restores {
+		status := "succeeded"
+		attrs := []any{
+			slog.String("database", r.database),
+			slog.String("status", status),
+			slog.String("key", r.key),
+			slog.Duration("duration", r.duration.Round(time.Second)),
+		}
+		if r.err != nil {
+			attrs[1] = slog.String("status", "failed")
+			attrs = append(attrs, slog.String("error", r.err.Error()))
+			failed = append(failed, fmt.Sprintf("%s: %v", r.database, r.err))
+		}
+		logger.Info("Database restore status", attrs...)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d database restores failed: %s", len(failed), len(restores), strings.Join(failed, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package restore
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hra42/pg_backup/internal/storage"
+)
+
+// pickerRows is how many of the newest backups the picker lists
+const pickerRows = 20
+
+// IsTerminal reports whether f is a terminal someone can answer a prompt on
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// SelectByIndex resolves a reference like @3 to the key of the third newest backup
+func SelectByIndex(backups []storage.BackupObject, ref string) (string, error) {
+	index, err := strconv.Atoi(strings.TrimPrefix(ref, "@"))
+	if err != nil || index < 1 {
+		return "", fmt.Errorf("invalid backup reference %q, expected @1 for the newest backup, @2 for the one before, ...", ref)
+	}
+	if index > len(backups) {
+		return "", fmt.Errorf("backup reference %s is out of range, only %d backups exist", ref, len(backups))
+	}
+	return backups[index-1].Key, nil
+}
+
+// asOfLayouts are the accepted forms of -as-of; times without a zone are local
+var asOfLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+// ParseAsOf parses the time given to -as-of
+func ParseAsOf(value string) (time.Time, error) {
+	for _, layout := range asOfLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expected e.g. \"2024-06-01 12:00\"", value)
+}
+
+// SelectAsOf returns the key of the newest backup taken at or before asOf. A backup counts as
+// taken when its dump started, as encoded in the file name; the upload time is the fallback.
+func SelectAsOf(backups []storage.BackupObject, asOf time.Time) (string, error) {
+	var key string
+	var newest time.Time
+	for _, backup := range backups {
+		taken, ok := storage.BackupTime(backup.Key)
+		if !ok {
+			taken = backup.LastModified
+		}
+		if !taken.After(asOf) && taken.After(newest) {
+			key, newest = backup.Key, taken
+		}
+	}
+	if key == "" {
+		return "", fmt.Errorf("no backup was taken before %s", asOf.Format(time.RFC3339))
+	}
+	return key, nil
+}
+
+// SelectDatabase returns the key of the newest backup of a database of postgres.databases, or
+// the newest taken at or before asOf when it is set
+func SelectDatabase(backups []storage.BackupObject, database string, asOf time.Time) (string, error) {
+	var matching []storage.BackupObject
+	for _, backup := range backups {
+		if backup.Database == database {
+			matching = append(matching, backup)
+		}
+	}
+	if len(matching) == 0 {
+		return "", fmt.Errorf("no backups of database %s found", database)
+	}
+	if !asOf.IsZero() {
+		return SelectAsOf(matching, asOf)
+	}
+	return matching[0].Key, nil
+}
+
+// PickBackup lists the newest backups on out and asks on in which one to restore. An empty
+// answer picks the newest; numbers beyond the listed rows reach older backups.
+func (rm *RestoreManager) PickBackup(ctx context.Context, in io.Reader, out io.Writer) (string, error) {
+	backups, err := rm.s3Client.ListBackupObjects(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(backups) == 0 {
+		return "", fmt.Errorf("no backups found in S3")
+	}
+
+	// Single database backups don't carry the database in their key
+	defaultDatabase := "-"
+	if databases := rm.config.BackupDatabases(); len(databases) == 1 {
+		defaultDatabase = databases[0]
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "#\tCREATED (UTC)\tSIZE\tDATABASE\tKEY")
+	for i, backup := range backups {
+		if i == pickerRows {
+			break
+		}
+		database := backup.Database
+		if database == "" {
+			database = defaultDatabase
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", i+1,
+			backup.LastModified.UTC().Format("2006-01-02 15:04:05"),
+			formatSize(float64(backup.Size)),
+			database,
+			backup.Key)
+	}
+	w.Flush()
+	if len(backups) > pickerRows {
+		fmt.Fprintf(out, "(%d older backups not shown)\n", len(backups)-pickerRows)
+	}
+
+	fmt.Fprintf(out, "Backup to restore [1-%d, Enter for newest]: ", len(backups))
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && answer == "" {
+		return "", fmt.Errorf("no backup selected: %w", err)
+	}
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		answer = "1"
+	}
+	return SelectByIndex(backups, answer)
+}
+
+// formatSize renders a byte count with a binary unit, e.g. 1.5 GiB
+func formatSize(bytes float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	unit := 0
+	for bytes >= 1024 && unit < len(units)-1 {
+		bytes /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%.0f %s", bytes, units[unit])
+	}
+	return fmt.Sprintf("%.1f %s", bytes, units[unit])
+}
@@ -0,0 +1,111 @@
+package restore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hra42/pg_backup/internal/compression"
+	"github.com/hra42/pg_backup/internal/dumpformat"
+	"github.com/hra42/pg_backup/internal/events"
+	"github.com/hra42/pg_backup/internal/shell"
+	"github.com/hra42/pg_backup/internal/storage"
+)
+
+// streamFromS3 downloads a backup for a restore that runs on this machine, checksumming and
+// decompressing it while the following parts still download, so the dump is ready for
+// pg_restore when the last part arrives. localPath receives the uncompressed dump.
+func (rm *RestoreManager) streamFromS3(ctx context.Context, key, localPath string, metadata *storage.BackupMetadata) error {
+	rm.logger.Info("Downloading backup from S3",
+		slog.String("key", key),
+		slog.String("local_path", localPath),
+		slog.Int("concurrency", rm.config.Restore.DownloadConcurrency))
+
+	file, err := os.Create(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to create local file: %w", err)
+	}
+	defer file.Close()
+
+	reader, writer := io.Pipe()
+	hash := sha256.New()
+	downloaded := make(chan error, 1)
+	go func() {
+		lastProgress := time.Now()
+		_, err := rm.s3Client.DownloadStream(ctx, key, io.MultiWriter(hash, writer), rm.config.Restore.DownloadConcurrency, func(written, total int64) {
+			rm.events.Progress(events.StageDownload, written, total)
+			if time.Since(lastProgress) > 5*time.Second {
+				rm.logger.Info("Download progress",
+					slog.Float64("percentage", float64(written)/float64(total)*100),
+					slog.Int64("downloaded", written),
+					slog.Int64("total", total))
+				lastProgress = time.Now()
+			}
+		})
+		writer.CloseWithError(err)
+		downloaded <- err
+	}()
+
+	// A failed decompression closes the pipe, which stops the download too
+	decompressErr := rm.decompressStream(ctx, reader, file)
+	reader.CloseWithError(decompressErr)
+	if err := <-downloaded; err != nil {
+		return fmt.Errorf("S3 download failed: %w", err)
+	}
+	if decompressErr != nil {
+		return decompressErr
+	}
+
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if metadata != nil && metadata.SHA256 != "" {
+		if checksum != metadata.SHA256 {
+			return fmt.Errorf("backup checksum mismatch: downloaded %s, but the backup metadata records %s", checksum, metadata.SHA256)
+		}
+		rm.logger.Info("Backup checksum verified", slog.String("sha256", checksum))
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to verify downloaded file: %w", err)
+	}
+	if info.Size() == 0 {
+		return fmt.Errorf("downloaded file is empty")
+	}
+	rm.logger.Info("Backup downloaded successfully", slog.Int64("size", info.Size()))
+	return nil
+}
+
+// decompressStream copies a downloading dump to w, piping it through the external decompressor
+// its first bytes name, if any
+func (rm *RestoreManager) decompressStream(ctx context.Context, r io.Reader, w io.Writer) error {
+	buffered := bufio.NewReader(r)
+	header, err := buffered.Peek(8)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	algorithm := dumpformat.Compression(header)
+	if algorithm == "" {
+		_, err := io.Copy(w, buffered)
+		return err
+	}
+
+	rm.logger.Info("Decompressing backup while it downloads", slog.String("algorithm", algorithm))
+	var stderr bytes.Buffer
+	cmd := shell.Command(ctx, compression.DecompressCommand(algorithm))
+	cmd.Stdin = buffered
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to decompress backup with %s: %w (output: %s)", algorithm, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
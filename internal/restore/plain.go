@@ -0,0 +1,44 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/hra42/pg_backup/internal/pgoutput"
+)
+
+// restorePlain replays a plain SQL dump with psql. Like pg_restore, psql carries on after a
+// failed statement, and the restore fails afterwards if any statement failed; with
+// single_transaction the first error rolls everything back instead. Plain dumps keep the
+// owners and grants they were written with, so keep_owner and friends don't apply.
+func (rm *RestoreManager) restorePlain(ctx context.Context, backupPath string) error {
+	psqlCmd := fmt.Sprintf(
+		"psql %s -d \"%s\" -X",
+		rm.targetArgs(),
+		rm.config.Restore.TargetDatabase,
+	)
+	if rm.config.Restore.SingleTransaction {
+		psqlCmd += " --single-transaction -v ON_ERROR_STOP=1"
+	}
+	psqlCmd += fmt.Sprintf(" -f %s 2>&1", backupPath)
+
+	rm.logger.Info("Executing psql for plain SQL dump", slog.Bool("single_transaction", rm.config.Restore.SingleTransaction))
+	output, err := rm.executeThrottled(ctx, psqlCmd, nil)
+	result := pgoutput.Classify(output)
+	if err != nil || result.HasErrors() {
+		if len(result.Errors) > 0 {
+			return fmt.Errorf("restore of plain SQL dump failed (%d errors: %s)", len(result.Errors), pgoutput.Summary(result.Errors, 20))
+		}
+		return fmt.Errorf("restore of plain SQL dump failed: %w (output: %s)", err, output)
+	}
+
+	if len(result.Warnings) > 0 {
+		rm.warnings = append(rm.warnings, result.Warnings...)
+		rm.logger.Warn("Restore completed with warnings",
+			slog.Int("count", len(result.Warnings)),
+			slog.String("warnings", pgoutput.Summary(result.Warnings, 10)))
+	}
+	rm.logger.Info("Database restore completed successfully")
+	return nil
+}
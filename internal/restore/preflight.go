@@ -0,0 +1,196 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hra42/pg_backup/internal/shell"
+	"github.com/hra42/pg_backup/internal/storage"
+)
+
+// freeConnectionsQuery returns how many more clients the target accepts before it only admits
+// superusers
+const freeConnectionsQuery = `SELECT current_setting('max_connections')::int
+	- current_setting('superuser_reserved_connections')::int
+	- (SELECT count(*) FROM pg_stat_activity WHERE backend_type = 'client backend')`
+
+// Validate checks what the following restores need before one runs: the SSH connection or
+// tunnel to the restore host, a pg_restore there unless restore.auto_install would install one,
+// and access to the bucket
+func (rm *RestoreManager) Validate(ctx context.Context) error {
+	defer rm.cleanup()
+	rm.logger.Info("Validating restore configuration...")
+
+	if rm.tunnelClient != nil {
+		if err := rm.openTunnel(); err != nil {
+			return fmt.Errorf("SSH tunnel failed: %w", err)
+		}
+	}
+	if rm.sshClient != nil {
+		if err := rm.connectSSH(); err != nil {
+			return err
+		}
+	}
+	if err := rm.selectPgRestore(ctx, 0); err != nil {
+		if !rm.autoInstall() {
+			return err
+		}
+		rm.logger.Warn("pg_restore not found, restore.auto_install will install it on the first restore",
+			slog.String("error", err.Error()))
+	}
+	rm.pgRestore = pgClient{}
+
+	if err := rm.s3Client.ValidateBucket(ctx); err != nil {
+		return err
+	}
+	rm.logger.Info("Restore configuration validation successful")
+	return nil
+}
+
+// checkTarget fails a restore up front that would fail hours into pg_restore: a target server
+// older than the source, too few free connections for the restore jobs, or too little disk
+// space for the restored database. A check that can't query what it needs only logs why.
+func (rm *RestoreManager) checkTarget(ctx context.Context, localPath string, metadata *storage.BackupMetadata) error {
+	if err := rm.checkTargetVersion(ctx, metadata); err != nil {
+		return err
+	}
+	if err := rm.checkTargetConnections(ctx); err != nil {
+		return err
+	}
+	return rm.checkTargetDiskSpace(ctx, localPath)
+}
+
+// checkTargetVersion fails when the target's major version is older than the source's. Dumps
+// of newer servers use syntax and settings older servers reject, e.g. default_table_access_method.
+func (rm *RestoreManager) checkTargetVersion(ctx context.Context, metadata *storage.BackupMetadata) error {
+	if metadata == nil || metadata.Server == nil || metadata.Server.VersionNum == 0 {
+		rm.logger.Debug("Skipping target version check, the backup doesn't record the source version")
+		return nil
+	}
+	output, err := rm.targetQuery(ctx, "SHOW server_version_num;")
+	if err != nil {
+		rm.logger.Warn("Skipping target version check", slog.String("error", err.Error()))
+		return nil
+	}
+	targetNum, err := strconv.Atoi(output)
+	if err != nil {
+		rm.logger.Warn("Skipping target version check", slog.String("error", fmt.Sprintf("unexpected server_version_num %q", output)))
+		return nil
+	}
+
+	sourceMajor, targetMajor := metadata.Server.VersionNum/10000, targetNum/10000
+	if targetMajor >= sourceMajor || rm.config.Restore.AllowOlderTarget {
+		return nil
+	}
+	return fmt.Errorf("target server runs PostgreSQL %d but the backup was taken from PostgreSQL %d; restore onto PostgreSQL %d or newer, or set restore.allow_older_target to try anyway",
+		targetMajor, sourceMajor, sourceMajor)
+}
+
+// checkTargetConnections fails when the target can't take the connections of the restore:
+// pg_restore --jobs opens one per job plus its leader, and psql steps need one more
+func (rm *RestoreManager) checkTargetConnections(ctx context.Context) error {
+	output, err := rm.targetQuery(ctx, strings.Join(strings.Fields(freeConnectionsQuery), " "))
+	if err != nil {
+		rm.logger.Warn("Skipping connection headroom check", slog.String("error", err.Error()))
+		return nil
+	}
+	free, err := strconv.Atoi(output)
+	if err != nil {
+		rm.logger.Warn("Skipping connection headroom check", slog.String("error", fmt.Sprintf("unexpected output %q", output)))
+		return nil
+	}
+
+	needed := rm.config.Restore.Jobs + 2
+	rm.logger.Info("Connection headroom check", slog.Int("free", free), slog.Int("needed", needed))
+	if free < needed {
+		return fmt.Errorf("target server accepts %d more connections but the restore needs %d (restore.jobs %d); lower restore.jobs or raise max_connections",
+			free, needed, rm.config.Restore.Jobs)
+	}
+	return nil
+}
+
+// checkTargetDiskSpace fails when the target's data directory can't hold the restored database,
+// estimated as restore.disk_space_ratio times the dump. The directory is only measurable from
+// the host running the restore commands when the target server runs there too; a database that
+// drop_existing replaces counts as free space.
+func (rm *RestoreManager) checkTargetDiskSpace(ctx context.Context, localPath string) error {
+	if !rm.targetIsLocal() {
+		rm.logger.Debug("Skipping target disk space check, the target server doesn't run on the restore host",
+			slog.String("target_host", rm.config.Restore.TargetHost))
+		return nil
+	}
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return nil
+	}
+	dataDir, err := rm.targetQuery(ctx, "SHOW data_directory;")
+	if err != nil || dataDir == "" {
+		// data_directory is only visible to superusers and pg_read_all_settings
+		rm.logger.Warn("Skipping target disk space check, data_directory is not readable", slog.Any("error", err))
+		return nil
+	}
+	output, err := rm.executeCommand(ctx, fmt.Sprintf("df -Pk %s | tail -1", shell.Quote(dataDir)), 10*time.Second)
+	if err != nil {
+		rm.logger.Warn("Skipping target disk space check", slog.String("error", err.Error()))
+		return nil
+	}
+	free, err := parseDfAvailable(output)
+	if err != nil {
+		rm.logger.Warn("Skipping target disk space check", slog.String("error", err.Error()))
+		return nil
+	}
+
+	if rm.config.Restore.DropExisting {
+		replaced, err := rm.targetQuery(ctx, fmt.Sprintf("SELECT coalesce(sum(pg_database_size(datname)), 0) FROM pg_database WHERE datname = '%s';",
+			strings.ReplaceAll(rm.config.Restore.TargetDatabase, "'", "''")))
+		if size, convErr := strconv.ParseInt(replaced, 10, 64); err == nil && convErr == nil {
+			free += size
+		}
+	}
+
+	required := int64(float64(info.Size()) * rm.config.Restore.DiskSpaceRatio)
+	rm.logger.Info("Target disk space check",
+		slog.String("data_directory", dataDir),
+		slog.Int64("free", free),
+		slog.Int64("required", required),
+		slog.Int64("dump_size", info.Size()))
+	if free < required {
+		return fmt.Errorf("target data directory %s has %s free, but the restored database is estimated at %s (%.1f times the %s dump); free up space, or lower restore.disk_space_ratio if the estimate is too high",
+			dataDir, formatSize(float64(free)), formatSize(float64(required)), rm.config.Restore.DiskSpaceRatio, formatSize(float64(info.Size())))
+	}
+	return nil
+}
+
+// targetIsLocal reports whether the target server runs on the host that runs the restore
+// commands: connected through localhost or a Unix socket, and not through a tunnel
+func (rm *RestoreManager) targetIsLocal() bool {
+	if rm.tunnel != nil {
+		return false
+	}
+	if rm.config.Restore.TargetSocket {
+		return true
+	}
+	switch host := rm.config.Restore.TargetHost; {
+	case host == "localhost", host == "127.0.0.1", host == "::1", strings.HasPrefix(host, "/"):
+		return true
+	}
+	return false
+}
+
+// parseDfAvailable extracts the "Available" column (in KiB) from a `df -Pk` line
+func parseDfAvailable(line string) (int64, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 {
+		return 0, fmt.Errorf("unexpected df output: %q", line)
+	}
+	kb, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected df output: %q", line)
+	}
+	return kb * 1024, nil
+}
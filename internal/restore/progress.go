@@ -0,0 +1,133 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressInterval is how often a running pg_restore logs its progress
+const progressInterval = 30 * time.Second
+
+// restoreProgress follows pg_restore --verbose output. Progress is counted in table data
+// entries of the restore list, so a large table weighs as much as a small one.
+type restoreProgress struct {
+	mu       sync.Mutex
+	total    int    // Table data entries to restore, 0 when unknown
+	started  int    // Table data entries whose load started
+	finished int    // Table data entries reported finished by a parallel restore
+	parallel bool   // pg_restore --jobs reports finished items itself
+	postData bool   // Index, constraint and trigger creation started, so all data is loaded
+	current  string // Object pg_restore works on
+}
+
+// parseLine updates the progress from one line of pg_restore --verbose output, e.g.
+// `pg_restore: processing data for table "public.events"` or, with --jobs,
+// `pg_restore: finished item 3456 TABLE DATA public events`
+func (p *restoreProgress) parseLine(line string) {
+	message, ok := strings.CutPrefix(line, "pg_restore: ")
+	if !ok {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case strings.HasPrefix(message, "processing data for table "):
+		p.started++
+		p.current = "data of " + strings.Trim(strings.TrimPrefix(message, "processing data for table "), `"`)
+	case strings.HasPrefix(message, "finished item ") && strings.Contains(message, " TABLE DATA "):
+		p.parallel = true
+		p.finished++
+	case strings.HasPrefix(message, "creating "):
+		object := strings.TrimPrefix(message, "creating ")
+		p.current = object
+		if p.started > 0 && !strings.HasPrefix(object, "TABLE ") {
+			p.postData = true
+		}
+	}
+}
+
+// done returns the table data entries that finished loading. A serial restore loads one table
+// at a time, so starting the next table, or post-data, finishes the previous one.
+func (p *restoreProgress) done() int {
+	switch {
+	case p.parallel:
+		return p.finished
+	case p.postData:
+		return p.started
+	case p.started > 0:
+		return p.started - 1
+	}
+	return 0
+}
+
+// log writes one progress line
+func (p *restoreProgress) log(logger *slog.Logger, elapsed time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	attrs := []any{
+		slog.Int("tables_loaded", p.done()),
+		slog.String("current", p.current),
+		slog.Duration("elapsed", elapsed.Round(time.Second)),
+	}
+	if p.total > 0 {
+		percent := min(p.done()*100/p.total, 100)
+		attrs = append(attrs, slog.String("percent", fmt.Sprintf("%d%%", percent)), slog.Int("tables_total", p.total))
+	}
+	logger.Info("Restore progress", attrs...)
+}
+
+// executeRestore runs a pg_restore command and logs its progress every progressInterval, so a
+// restore of several hours doesn't look hung
+func (rm *RestoreManager) executeRestore(ctx context.Context, restoreCmd string, total int) (string, error) {
+	progress := &restoreProgress{total: total}
+	startTime := time.Now()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				progress.log(rm.logger, time.Since(startTime))
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	output, err := rm.executeThrottled(ctx, restoreCmd, progress.parseLine)
+	close(stop)
+	wg.Wait()
+	return output, err
+}
+
+// countDataEntries returns how many table data entries the restore loads, for the progress
+// percentage; 0 when the backup can't be listed
+func (rm *RestoreManager) countDataEntries(ctx context.Context, pgRestorePath, backupPath string) int {
+	listing, err := rm.executeCommand(ctx, fmt.Sprintf("%s -l %s", pgRestorePath, backupPath), 5*time.Minute)
+	if err != nil {
+		rm.logger.Debug("Failed to list backup contents for progress", slog.String("error", err.Error()))
+		return 0
+	}
+	if rm.config.Restore.Selective() {
+		listing, _ = selectTOC(listing, rm.config.Restore.Schemas, rm.config.Restore.Tables)
+	}
+
+	count := 0
+	for _, line := range strings.Split(listing, "\n") {
+		if entry, ok := parseTOCEntry(line); ok && entry.Type == "TABLE DATA" {
+			count++
+		}
+	}
+	return count
+}
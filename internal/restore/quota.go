@@ -0,0 +1,71 @@
+package restore
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hra42/pg_backup/internal/lock"
+)
+
+// quotaWindow is the period safety.max_production_restores_per_day applies to
+const quotaWindow = 24 * time.Hour
+
+// restoreLog records when restores into a production target started
+type restoreLog struct {
+	Restores []time.Time `json:"restores"`
+}
+
+func (rm *RestoreManager) restoreLogPath() string {
+	r := rm.config.Restore
+	name := lock.Name(r.TargetHost, r.TargetPort, r.TargetDatabase)
+	return filepath.Join(rm.config.Backup.StateDir, "pg_backup_"+name+".restores.json")
+}
+
+// checkRestoreQuota refuses a restore into a production target once
+// safety.max_production_restores_per_day restores started within the last 24 hours, and records
+// the restore otherwise. Restores with -override-limits are recorded but never refused.
+func (rm *RestoreManager) checkRestoreQuota() error {
+	limit := rm.config.Safety.MaxProductionRestoresPerDay
+	if !rm.config.Restore.Production || limit == 0 {
+		return nil
+	}
+
+	var history restoreLog
+	path := rm.restoreLogPath()
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read restore log %s: %w", path, err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &history); err != nil {
+			return fmt.Errorf("failed to parse restore log %s: %w", path, err)
+		}
+	}
+
+	now := time.Now().UTC()
+	var recent []time.Time
+	for _, t := range history.Restores {
+		if now.Sub(t) < quotaWindow {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= limit && !rm.config.Safety.Override {
+		return fmt.Errorf("%d restores into production database %s within 24 hours reached safety.max_production_restores_per_day; rerun with -override-limits if this is intended",
+			len(recent), rm.config.Restore.TargetDatabase)
+	}
+
+	history.Restores = append(recent, now)
+	data, err = json.MarshalIndent(history, "", "  ")
+	if err == nil {
+		if err = os.WriteFile(path+".tmp", data, 0600); err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to record restore in %s: %w", path, err)
+	}
+	return nil
+}
@@ -1,19 +1,29 @@
 package restore
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"log/slog"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/hra42/pg_backup/internal/compression"
 	"github.com/hra42/pg_backup/internal/config"
+	"github.com/hra42/pg_backup/internal/dumpformat"
+	"github.com/hra42/pg_backup/internal/events"
+	"github.com/hra42/pg_backup/internal/exporter"
 	"github.com/hra42/pg_backup/internal/notification"
+	"github.com/hra42/pg_backup/internal/pgoutput"
 	"github.com/hra42/pg_backup/internal/rsync"
+	"github.com/hra42/pg_backup/internal/runlog"
+	"github.com/hra42/pg_backup/internal/shell"
 	"github.com/hra42/pg_backup/internal/ssh"
 	"github.com/hra42/pg_backup/internal/storage"
 )
@@ -21,20 +31,53 @@ import (
 type RestoreManager struct {
 	config             *config.Config
 	sshClient          *ssh.SSHClient
+	tunnelClient       *ssh.SSHClient // SSH connection carrying the tunnel of a direct restore
+	tunnel             *ssh.Tunnel
+	tunneled           tunneledTarget // Target settings to restore when the tunnel closes
 	s3Client           *storage.S3Client
 	notificationClient *notification.NotificationClient
 	logger             *slog.Logger
+	listener           events.Listener
+	events             events.Emitter
+	runID              string
+	recorder           *runlog.Recorder
+	warnings           []string
+	asOf               time.Time // Pick the newest backup taken before this time instead of the latest
+	backupKey          string    // Backup restored by the current run, once selected
+	source             string    // Database the backup was taken from
+	dumpFormat         string    // Format of the backup restored by the current run, see dumpformat.Kind
+	pgRestore          pgClient  // pg_restore of the current run, once selected
+	replacedTarget     bool      // The current run dropped or created target_database before pg_restore
+	drill              *drillRun // Set while RunDrill runs
 }
 
 func NewRestoreManager(cfg *config.Config, logger *slog.Logger) (*RestoreManager, error) {
 	var sshClient *ssh.SSHClient
 	var err error
+
+	// Capture everything logged during a run so it can be uploaded if the run fails
+	recorder := runlog.NewRecorder()
+	logger = slog.New(recorder.Handler(logger.Handler()))
 	
 	// Check if SSH is needed for restore
 	useSSH := true
 	if cfg.Restore.UseSSH != nil {
 		useSSH = *cfg.Restore.UseSSH
 	}
+	var tunnelClient *ssh.SSHClient
+	if cfg.Restore.Direct != nil {
+		useSSH = false
+		if cfg.Restore.Tunneled() {
+			sshConfig := cfg.Restore.SSH
+			if sshConfig == nil {
+				sshConfig = &cfg.SSH
+			}
+			tunnelClient, err = ssh.NewSSHClient(sshConfig, logger)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create SSH client for restore tunnel: %w", err)
+			}
+		}
+	}
 	
 	if useSSH {
 		// Use restore SSH config if provided, otherwise use backup SSH config
@@ -58,16 +101,39 @@ func NewRestoreManager(cfg *config.Config, logger *slog.Logger) (*RestoreManager
 	}
 
 	notificationClient := notification.NewNotificationClient(&cfg.Notification, logger)
+	notificationClient.SetEnv(cfg.Restore.Env)
+	notificationClient.SetQueue(notification.NewQueue(cfg, logger))
 
 	return &RestoreManager{
 		config:             cfg,
 		sshClient:          sshClient,
+		tunnelClient:       tunnelClient,
 		s3Client:           s3Client,
 		notificationClient: notificationClient,
 		logger:             logger,
+		listener:           events.NopListener{},
+		recorder:           recorder,
 	}, nil
 }
 
+// SetListener registers a listener for stage, progress and completion events
+func (rm *RestoreManager) SetListener(listener events.Listener) {
+	rm.listener = listener
+}
+
+// SetAsOf makes runs without a backup key restore the newest backup taken at or before asOf
+func (rm *RestoreManager) SetAsOf(asOf time.Time) {
+	rm.asOf = asOf
+}
+
+// SetNotification sends the notifications of the following runs according to cfg instead of
+// the notification section, e.g. to the target of the schedule running them
+func (rm *RestoreManager) SetNotification(cfg *config.NotificationConfig) {
+	rm.notificationClient = notification.NewNotificationClient(cfg, rm.logger)
+	rm.notificationClient.SetEnv(rm.config.Restore.Env)
+	rm.notificationClient.SetQueue(notification.NewQueue(rm.config, rm.logger))
+}
+
 func (rm *RestoreManager) Run(ctx context.Context, backupKey string) error {
 	defer rm.cleanup()
 	startTime := time.Now()
@@ -76,44 +142,219 @@ func (rm *RestoreManager) Run(ctx context.Context, backupKey string) error {
 		return fmt.Errorf("restore feature is not enabled in configuration")
 	}
 
+	if err := rm.checkRestoreQuota(); err != nil {
+		return err
+	}
+	if rm.config.Restore.Production && rm.config.Safety.Override {
+		rm.logger.Warn("Safety limits overridden for restore into production database",
+			slog.String("target_database", rm.config.Restore.TargetDatabase))
+	}
+
+	rm.recorder.Reset()
+	rm.warnings = nil
+	rm.backupKey = backupKey
+	rm.source = ""
+	rm.dumpFormat = dumpformat.Custom
+	rm.replacedTarget = false
+	rm.pgRestore = pgClient{}
+	rm.runID = uuid.New().String()
+	rm.notificationClient.SetRun(rm.runID, rm.recorder)
+
+	job := events.JobRestore
+	if rm.drill != nil {
+		job = events.JobDrill
+	}
+
+	exporters, stopExporters := exporter.StartAll(rm.config.Exporters, rm.logger)
+	defer stopExporters()
+	rm.events = events.Emitter{
+		Listener: events.Multi{rm.listener, exporters},
+		RunID:    rm.runID,
+		Job:      job,
+		Database: rm.config.Restore.TargetDatabase,
+	}
+
 	rm.logger.Info("Starting restore process", 
+		slog.String("run_id", rm.runID),
 		slog.String("backup_key", backupKey),
 		slog.String("target_database", rm.config.Restore.TargetDatabase))
 
+	err := rm.events.Stage(events.StageRun, func() error {
+		// The tunnel stays open until a drill has dropped its scratch database
+		if rm.tunnelClient != nil {
+			if err := rm.stage(events.StageConnect, rm.openTunnel); err != nil {
+				return err
+			}
+			defer rm.closeTunnel()
+		}
+		err := rm.restore(ctx, backupKey)
+		if rm.drill != nil {
+			err = rm.finishDrill(ctx, err)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	duration := time.Since(startTime)
+	rm.logger.Info("Restore completed successfully", 
+		slog.String("database", rm.config.Restore.TargetDatabase),
+		slog.Duration("duration", duration),
+		slog.Int("warnings", len(rm.warnings)))
+
+	// Send success notification
+	if rm.drill != nil {
+		rm.notifyDrillSuccess(duration)
+	} else if rm.notificationClient != nil {
+		if err := rm.notificationClient.SendRestoreSuccess(rm.config.Restore.TargetDatabase, duration, backupKey, rm.warnings); err != nil {
+			rm.logger.Warn("Failed to send success notification", slog.String("error", err.Error()))
+		}
+	}
+
+	return nil
+}
+
+// restore runs the download, transfer and pg_restore stages for one backup
+func (rm *RestoreManager) restore(ctx context.Context, backupKey string) error {
+	if backupKey == "" && !rm.asOf.IsZero() {
+		err := rm.stage(events.StageSelect, func() error {
+			backups, err := rm.s3Client.ListBackupObjects(ctx)
+			if err != nil {
+				return err
+			}
+			backupKey, err = SelectAsOf(backups, rm.asOf)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		rm.logger.Info("Using newest backup before the requested time",
+			slog.Time("as_of", rm.asOf),
+			slog.String("key", backupKey))
+	}
+
 	// If no specific backup key provided, get the latest
 	if backupKey == "" {
-		latest, err := rm.s3Client.GetLatestBackup(ctx)
+		err := rm.stage(events.StageSelect, func() error {
+			// The pointer names the database, so it only helps when a single one is backed up;
+			// buckets written before pointers existed fall back to listing
+			if databases := rm.config.BackupDatabases(); len(databases) == 1 {
+				pointer, err := rm.s3Client.GetLatestPointer(ctx, databases[0])
+				if err == nil {
+					backupKey = pointer.Key
+					return nil
+				}
+				rm.logger.Debug("No latest pointer available", slog.String("error", err.Error()))
+			}
+			latest, err := rm.s3Client.GetLatestBackup(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to get latest backup: %w", err)
+			}
+			backupKey = latest
+			return nil
+		})
 		if err != nil {
-			rm.notificationClient.SendRestoreFailure(rm.config.Restore.TargetDatabase, err, "backup_selection")
-			return fmt.Errorf("failed to get latest backup: %w", err)
+			return err
 		}
-		backupKey = latest
 		rm.logger.Info("Using latest backup", slog.String("key", backupKey))
 	}
 
-	// Download backup from S3
+	// @N picks the N-th newest backup, as numbered by -list-backups
+	if strings.HasPrefix(backupKey, "@") {
+		ref := backupKey
+		err := rm.stage(events.StageSelect, func() error {
+			backups, err := rm.s3Client.ListBackupObjects(ctx)
+			if err != nil {
+				return err
+			}
+			backupKey, err = SelectByIndex(backups, ref)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		rm.logger.Info("Using backup by index", slog.String("ref", ref), slog.String("key", backupKey))
+	}
+
+	// Backups taken before metadata existed simply skip the compatibility check
+	metadata, err := rm.s3Client.GetMetadata(ctx, backupKey)
+	if err != nil {
+		rm.logger.Debug("No backup metadata available", slog.String("error", err.Error()))
+		metadata = nil
+	}
+	rm.backupKey = backupKey
+	rm.source = rm.sourceDatabase(backupKey, metadata)
+
+	if rm.config.Restore.TargetDatabaseTemplate != "" {
+		if err := rm.nameTargetDatabase(); err != nil {
+			return err
+		}
+	}
+
+	// Download backup from S3. When pg_restore runs on this machine the dump is decompressed
+	// while it downloads; otherwise it is transferred compressed and decompressed there.
 	localBackupPath := filepath.Join(os.TempDir(), filepath.Base(backupKey))
-	if err := rm.downloadFromS3(ctx, backupKey, localBackupPath); err != nil {
-		rm.notificationClient.SendRestoreFailure(rm.config.Restore.TargetDatabase, err, "download")
+	streamed := rm.sshClient == nil
+	if streamed {
+		localBackupPath = filepath.Join(os.TempDir(), compression.TrimExtension(filepath.Base(backupKey)))
+	}
+	if err := rm.stage(events.StageDownload, func() error {
+		if streamed {
+			return rm.streamFromS3(ctx, backupKey, localBackupPath, metadata)
+		}
+		return rm.downloadFromS3(ctx, backupKey, localBackupPath)
+	}); err != nil {
 		return err
 	}
 	defer os.Remove(localBackupPath)
 
+	// The content decides how to restore, so dumps written by other tools work whatever their name
+	algorithm := compression.Detect(localBackupPath)
+	if format, detected, err := dumpformat.DetectFile(localBackupPath); err != nil {
+		rm.logger.Warn("Failed to detect dump format, assuming a custom format dump", slog.String("error", err.Error()))
+	} else {
+		rm.dumpFormat, algorithm = format, detected
+		rm.logger.Info("Detected dump format", slog.String("format", format), slog.String("compression", algorithm))
+	}
+	if rm.dumpFormat == dumpformat.Plain && (rm.config.Restore.Selective() || len(rm.config.Restore.RowFilters) > 0) {
+		return fmt.Errorf("backup %s is a plain SQL dump; restore.schemas, tables and row_filters need a custom or tar format dump", backupKey)
+	}
+
 	// Check if we're using SSH or local restore
 	useSSH := rm.sshClient != nil
 	var restoreFilePath string
 	
 	if useSSH {
 		// Connect to SSH
-		if err := rm.connectSSH(); err != nil {
-			rm.notificationClient.SendRestoreFailure(rm.config.Restore.TargetDatabase, err, "ssh_connection")
+		if err := rm.stage(events.StageConnect, rm.connectSSH); err != nil {
 			return err
 		}
+	}
+
+	// pg_restore runs on the restore host, so its version is checked once that is reachable.
+	// Only custom format dumps carry an archive version. The target checks run before
+	// anything on the target changes.
+	if err := rm.stage(events.StagePreflight, func() error {
+		if rm.dumpFormat == dumpformat.Custom {
+			if err := rm.checkDumpFormat(ctx, localBackupPath, metadata); err != nil {
+				return err
+			}
+		}
+		if rm.config.Restore.SkipPreflight {
+			return nil
+		}
+		return rm.checkTarget(ctx, localBackupPath, metadata)
+	}); err != nil {
+		return err
+	}
 
+	if useSSH {
 		// Transfer backup to remote server
 		remoteBackupPath := filepath.Join(rm.config.Backup.TempDir, filepath.Base(backupKey))
-		if err := rm.transferToRemote(localBackupPath, remoteBackupPath); err != nil {
-			rm.notificationClient.SendRestoreFailure(rm.config.Restore.TargetDatabase, err, "transfer")
+		if err := rm.stage(events.StageTransfer, func() error {
+			return rm.transferToRemote(ctx, localBackupPath, remoteBackupPath)
+		}); err != nil {
 			return err
 		}
 		defer rm.sshClient.RemoveRemoteFile(remoteBackupPath)
@@ -124,37 +365,251 @@ func (rm *RestoreManager) Run(ctx context.Context, backupKey string) error {
 		restoreFilePath = localBackupPath
 	}
 
+	// Decompress externally compressed dumps on the host that runs pg_restore
+	if algorithm != "" {
+		var decompressedPath string
+		err := rm.stage(events.StageDecompress, func() error {
+			var err error
+			decompressedPath, err = rm.decompressDump(ctx, restoreFilePath, algorithm)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		defer rm.executeCommand(context.Background(), fmt.Sprintf("rm -f %s", decompressedPath), 10*time.Second)
+		restoreFilePath = decompressedPath
+	}
+
+	if rm.config.Restore.RestoreGlobals {
+		err := rm.stage(events.StageGlobals, func() error {
+			return rm.restoreGlobals(ctx, backupKey, metadata)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
 	// Perform restore
-	if err := rm.performRestore(restoreFilePath); err != nil {
-		rm.notificationClient.SendRestoreFailure(rm.config.Restore.TargetDatabase, err, "restore")
+	err = rm.stage(events.StageRestore, func() error {
+		if metadata != nil && metadata.Server != nil {
+			rm.checkCompatibility(ctx, metadata.Server)
+		}
+		if err := rm.performRestore(ctx, restoreFilePath); err != nil {
+			return rm.discardFailedRestore(err)
+		}
+		return nil
+	})
+	if err != nil {
 		return err
 	}
 
-	duration := time.Since(startTime)
-	rm.logger.Info("Restore completed successfully", 
-		slog.String("database", rm.config.Restore.TargetDatabase),
-		slog.Duration("duration", duration))
+	// Checks run on the data as restored, before masking and post_sql change it
+	err = rm.stage(events.StageVerify, func() error {
+		return rm.verifyRestore(ctx)
+	})
+	if err != nil {
+		return err
+	}
 
-	// Send success notification
-	if rm.notificationClient != nil {
-		if err := rm.notificationClient.SendRestoreSuccess(rm.config.Restore.TargetDatabase, duration, backupKey); err != nil {
-			rm.logger.Warn("Failed to send success notification", slog.String("error", err.Error()))
+	if rm.config.Restore.MaskingRules != "" {
+		if err := rm.stage(events.StageMask, func() error {
+			return rm.maskData(ctx)
+		}); err != nil {
+			return err
 		}
 	}
 
+	if len(rm.config.Restore.PostSQL) > 0 || len(rm.config.Restore.PostHooks) > 0 {
+		// Drills restore into a scratch database that is dropped again; hooks such as
+		// recreating a subscription must not run against it
+		if rm.drill != nil {
+			rm.logger.Info("Skipping post_sql and post_hooks for the drill's scratch database")
+			return nil
+		}
+		return rm.stage(events.StagePostRestore, func() error {
+			return rm.runPostRestore(ctx)
+		})
+	}
 	return nil
 }
 
-func (rm *RestoreManager) ListAvailableBackups(ctx context.Context) ([]string, error) {
-	rm.logger.Info("Listing available backups")
-	
-	backups, err := rm.s3Client.ListBackups(ctx)
+// nameTargetDatabase renders restore.target_database_template for this run, so each restore
+// lands in a fresh database instead of overwriting the previous one
+func (rm *RestoreManager) nameTargetDatabase() error {
+	target, err := rm.config.Restore.RenderTargetDatabase(rm.source, time.Now())
 	if err != nil {
-		return nil, fmt.Errorf("failed to list backups: %w", err)
+		return err
 	}
+	rm.config.Restore.TargetDatabase = target
+	rm.events.Database = target
+	rm.logger.Info("Restoring into new database", slog.String("source", rm.source), slog.String("target_database", target))
+	return nil
+}
 
-	rm.logger.Info("Found backups", slog.Int("count", len(backups)))
-	return backups, nil
+// sourceDatabase returns the database a backup was taken from, preferring its metadata over
+// the name encoded in the key; single database backups without either are of the configured one
+func (rm *RestoreManager) sourceDatabase(backupKey string, metadata *storage.BackupMetadata) string {
+	if metadata != nil && metadata.Database != "" {
+		return metadata.Database
+	}
+	if source := storage.BackupDatabase(backupKey); source != "" {
+		return source
+	}
+	return rm.config.BackupDatabases()[0]
+}
+
+// checkCompatibility compares the source server recorded in the backup metadata with the
+// pg_restore client and the target server, and warns about anything likely to fail mid-restore
+func (rm *RestoreManager) checkCompatibility(ctx context.Context, source *storage.ServerMetadata) {
+	sourceMajor := source.VersionNum / 10000
+	rm.logger.Info("Checking restore compatibility",
+		slog.String("source_version", source.Version),
+		slog.Int("source_extensions", len(source.Extensions)))
+
+	if clientMajor := rm.pgRestore.major; rm.pgRestore.path != "" && clientMajor < sourceMajor {
+		rm.addWarning(fmt.Sprintf("pg_restore %d is older than the source server (PostgreSQL %d) and may not read this dump", clientMajor, sourceMajor))
+	}
+
+	targetOutput, err := rm.targetQuery(ctx, "SHOW server_version_num;")
+	if targetNum, convErr := strconv.Atoi(targetOutput); err == nil && convErr == nil && targetNum/10000 < sourceMajor {
+		rm.addWarning(fmt.Sprintf("target server (PostgreSQL %d) is older than the source server (PostgreSQL %d)", targetNum/10000, sourceMajor))
+	}
+
+	if len(source.Extensions) == 0 {
+		return
+	}
+	available, err := rm.targetQuery(ctx, "SELECT string_agg(name, ',') FROM pg_available_extensions;")
+	if err != nil {
+		rm.logger.Warn("Failed to list extensions available on the target", slog.String("error", err.Error()))
+		return
+	}
+	availableSet := make(map[string]bool)
+	for _, name := range strings.Split(available, ",") {
+		availableSet[name] = true
+	}
+
+	var missing []string
+	for name := range source.Extensions {
+		if !availableSet[name] {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		rm.addWarning(fmt.Sprintf("extensions missing on the target server: %s", strings.Join(missing, ", ")))
+	}
+}
+
+// checkDumpFormat makes sure the pg_restore on the restore host reads the dump's archive format
+// before anything is transferred or dropped. The format comes from the backup metadata, or from
+// the dump header for backups taken before it was recorded.
+func (rm *RestoreManager) checkDumpFormat(ctx context.Context, localPath string, metadata *storage.BackupMetadata) error {
+	var format dumpformat.Version
+	var err error
+	if metadata != nil && metadata.DumpFormat != "" {
+		format, err = dumpformat.Parse(metadata.DumpFormat)
+	} else {
+		format, err = dumpformat.ReadFile(localPath)
+	}
+	if err != nil {
+		rm.logger.Warn("Skipping dump format check", slog.String("error", err.Error()))
+		return nil
+	}
+
+	minClient, ok := dumpformat.MinClient(format)
+	if !ok {
+		rm.addWarning(fmt.Sprintf("dump format %s is unknown to this pg_backup version, pg_restore decides whether it can read it", format))
+		return nil
+	}
+
+	if err := rm.selectPgRestore(ctx, minClient); err != nil {
+		// A missing pg_restore is reported (or installed) by performRestore
+		rm.logger.Warn("Failed to determine the pg_restore version", slog.String("error", err.Error()))
+		return nil
+	}
+	clientMajor := rm.pgRestore.major
+	rm.logger.Info("Checking dump format",
+		slog.String("dump_format", format.String()),
+		slog.Int("required_client", minClient),
+		slog.Int("client", clientMajor))
+	if clientMajor >= minClient {
+		return nil
+	}
+
+	if rm.autoInstall() {
+		if err := rm.tryInstallSpecificPostgreSQLVersion(ctx, strconv.Itoa(minClient)); err != nil {
+			rm.logger.Error("Failed to auto-install newer PostgreSQL version", slog.String("error", err.Error()))
+		} else if err := rm.selectPgRestore(ctx, minClient); err == nil && rm.pgRestore.major >= minClient {
+			return nil
+		}
+	}
+	return fmt.Errorf("backup has dump format %s, which requires pg_restore %d or newer, but the newest pg_restore on the restore host is %d; install the PostgreSQL %d client tools or point restore.pg_bin_dir at them",
+		format, minClient, rm.pgRestore.major, minClient)
+}
+
+func (rm *RestoreManager) addWarning(warning string) {
+	rm.logger.Warn("Restore compatibility warning", slog.String("warning", warning))
+	rm.warnings = append(rm.warnings, warning)
+}
+
+// targetArgs returns the psql and pg_restore options selecting the target server and user.
+// With restore.target_socket, -h only names a socket directory and without a username libpq
+// connects as the operating system user, as peer authentication expects.
+func (rm *RestoreManager) targetArgs() string {
+	args := fmt.Sprintf("-p %d", rm.config.Restore.TargetPort)
+	if rm.config.Restore.TargetHost != "" {
+		args = fmt.Sprintf("-h %s %s", rm.config.Restore.TargetHost, args)
+	}
+	if rm.config.Restore.TargetUsername != "" {
+		args += fmt.Sprintf(" -U %s", rm.config.Restore.TargetUsername)
+	}
+	return args
+}
+
+// targetQuery runs a single-value query against the target server's postgres database
+func (rm *RestoreManager) targetQuery(ctx context.Context, query string) (string, error) {
+	cmd := fmt.Sprintf(
+		"psql %s -d postgres -t -A -c \"%s\"",
+		rm.targetArgs(),
+		query,
+	)
+	output, err := rm.executeCommand(ctx, cmd, 30*time.Second)
+	if err != nil {
+		return "", fmt.Errorf("%w (output: %s)", err, output)
+	}
+	return strings.TrimSpace(output), nil
+}
+
+// stage runs fn as a named stage, emitting listener events and the failure notification
+func (rm *RestoreManager) stage(stage events.Stage, fn func() error) error {
+	err := rm.events.Stage(stage, fn)
+	if err != nil {
+		rm.notifyFailure(err, string(stage))
+	}
+	return err
+}
+
+// notifyFailure uploads the run's evidence (if enabled) and sends the failure notification
+func (rm *RestoreManager) notifyFailure(err error, stage string) {
+	incidentKey := ""
+	if rm.config.Incident.UploadLogs {
+		// Use a fresh context so evidence is preserved even when the run was cancelled
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+		defer cancel()
+
+		key, uploadErr := rm.s3Client.UploadIncident(ctx, rm.config.Incident.Prefix, rm.runID, rm.recorder.Files())
+		if uploadErr != nil {
+			rm.logger.Warn("Failed to upload incident logs", slog.String("error", uploadErr.Error()))
+		} else {
+			incidentKey = key
+		}
+	}
+
+	if rm.drill != nil {
+		rm.notificationClient.SendDrillFailure(rm.config.Restore.TargetDatabase, err, stage, incidentKey)
+		return
+	}
+	rm.notificationClient.SendRestoreFailure(rm.config.Restore.TargetDatabase, err, stage, incidentKey)
 }
 
 func (rm *RestoreManager) connectSSH() error {
@@ -183,7 +638,8 @@ func (rm *RestoreManager) downloadFromS3(ctx context.Context, key string, localP
 		slog.String("local_path", localPath))
 
 	lastProgress := time.Now()
-	err := rm.s3Client.DownloadFile(ctx, key, localPath, func(downloaded int64) {
+	err := rm.s3Client.DownloadFile(ctx, key, localPath, func(downloaded, total int64) {
+		rm.events.Progress(events.StageDownload, downloaded, total)
 		if time.Since(lastProgress) > 5*time.Second {
 			rm.logger.Info("Download progress", slog.Int64("downloaded", downloaded))
 			lastProgress = time.Now()
@@ -207,7 +663,7 @@ func (rm *RestoreManager) downloadFromS3(ctx context.Context, key string, localP
 	return nil
 }
 
-func (rm *RestoreManager) transferToRemote(localPath, remotePath string) error {
+func (rm *RestoreManager) transferToRemote(ctx context.Context, localPath, remotePath string) error {
 	rm.logger.Info("Transferring backup to remote server",
 		slog.String("local", localPath),
 		slog.String("remote", remotePath))
@@ -220,8 +676,9 @@ func (rm *RestoreManager) transferToRemote(localPath, remotePath string) error {
 	rsyncClient := rsync.NewRsyncClient(sshConfig, rm.logger)
 	
 	lastProgress := time.Now()
-	err := rsyncClient.UploadFile(localPath, remotePath, rm.config.Timeouts.Transfer, 
+	err := rsyncClient.UploadFile(ctx, localPath, remotePath, rm.config.Timeouts.Transfer, 
 		func(transferred, total int64) {
+			rm.events.Progress(events.StageTransfer, transferred, total)
 			if time.Since(lastProgress) > 5*time.Second {
 				percentage := float64(transferred) / float64(total) * 100
 				rm.logger.Info("Transfer progress",
@@ -253,22 +710,108 @@ func (rm *RestoreManager) transferToRemote(localPath, remotePath string) error {
 	return nil
 }
 
-func (rm *RestoreManager) executeCommand(command string, timeout time.Duration) (string, error) {
+func (rm *RestoreManager) decompressDump(ctx context.Context, path, algorithm string) (string, error) {
+	// Files named by other tools may lack the extension, e.g. a gzipped backup.sql
+	outPath := strings.TrimSuffix(path, compression.Extension(algorithm))
+	if outPath == path {
+		outPath += ".decompressed"
+	}
+	rm.logger.Info("Decompressing backup",
+		slog.String("algorithm", algorithm),
+		slog.String("input", path),
+		slog.String("output", outPath))
+
+	decompressCmd := fmt.Sprintf("%s < %s > %s", compression.DecompressCommand(algorithm), path, outPath)
+	if output, err := rm.executeCommand(ctx, decompressCmd, rm.config.Timeouts.Transfer); err != nil {
+		rm.executeCommand(context.Background(), fmt.Sprintf("rm -f %s", outPath), 10*time.Second)
+		return "", fmt.Errorf("failed to decompress backup with %s: %w (output: %s)", algorithm, err, output)
+	}
+
+	return outPath, nil
+}
+
+// executeCommand runs a command on the restore host. The target password is passed through
+// stdin (remote) or the environment (local), never as part of the command line. The command,
+// along with every process it started (e.g. pg_restore and its parallel workers), is stopped
+// when ctx is canceled; cleanup that must outlive the run passes context.Background().
+func (rm *RestoreManager) executeCommand(ctx context.Context, command string, timeout time.Duration) (string, error) {
+	return rm.executeCommandStream(ctx, command, timeout, nil)
+}
+
+// executeCommandStream is executeCommand that hands every output line to onLine as it arrives
+func (rm *RestoreManager) executeCommandStream(ctx context.Context, command string, timeout time.Duration, onLine func(string)) (string, error) {
 	if rm.sshClient != nil {
-		// Execute via SSH
-		return rm.sshClient.ExecuteCommand(command, timeout)
+		// Execute via SSH with the job environment exported in front of the command
+		output, err := rm.sshClient.ExecuteCommandStream(
+			ctx,
+			rm.binDirPrefix()+shell.EnvPrefix(rm.config.Restore.Env)+shell.EnvPrefix(rm.config.Restore.SSLEnv())+shell.PgPassPrelude+command,
+			shell.PgPassInput(rm.config.Restore.TargetPassword),
+			timeout,
+			onLine)
+		rm.recordOutput(output, err)
+		return output, err
 	}
 	
 	// Execute locally
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 	
-	cmd := exec.CommandContext(ctx, "sh", "-c", command)
-	output, err := cmd.CombinedOutput()
-	return string(output), err
+	cmd := shell.Command(ctx, command)
+	cmd.Env = os.Environ()
+	if dir := rm.config.Restore.PgBinDir; dir != "" {
+		cmd.Env = append(cmd.Env, "PATH="+dir+":"+os.Getenv("PATH"))
+	}
+	cmd.Env = append(cmd.Env, shell.EnvList(rm.config.Restore.Env)...)
+	cmd.Env = append(cmd.Env, shell.EnvList(rm.config.Restore.SSLEnv())...)
+	if rm.config.Restore.TargetPassword != "" {
+		cmd.Env = append(cmd.Env, "PGPASSWORD="+rm.config.Restore.TargetPassword)
+	}
+	var output bytes.Buffer
+	cmd.Stdout = ssh.LineTee(&output, onLine)
+	cmd.Stderr = cmd.Stdout
+	err := cmd.Run()
+	rm.recordOutput(output.String(), err)
+	return output.String(), err
 }
 
-func (rm *RestoreManager) tryInstallPostgreSQLClient() error {
+// recordOutput keeps command output for incident evidence; the command itself is not
+// recorded because it may contain credentials
+func (rm *RestoreManager) recordOutput(output string, err error) {
+	rm.recorder.RecordOutput("command", output)
+	if err != nil {
+		rm.recorder.RecordOutput("command_error", err.Error())
+	}
+}
+
+// autoInstall reports whether missing or outdated client tools may be installed on the restore
+// host: with restore.auto_install on this machine, and with auto_install_ssh on an SSH host too
+func (rm *RestoreManager) autoInstall() bool {
+	return rm.config.Restore.AutoInstall && (rm.sshClient == nil || rm.config.Restore.AutoInstallSSH)
+}
+
+// asRoot makes an install command run as root on the restore host, through sudo unless the
+// commands run as root already. Over SSH sudo must not prompt (-n), as no one could answer.
+func (rm *RestoreManager) asRoot(ctx context.Context, command string) (string, error) {
+	root := os.Geteuid() == 0
+	if rm.sshClient != nil {
+		output, err := rm.executeCommand(ctx, "id -u", 5*time.Second)
+		root = err == nil && strings.TrimSpace(output) == "0"
+	}
+	if root {
+		return command, nil
+	}
+	if _, err := rm.executeCommand(ctx, "command -v sudo", 5*time.Second); err != nil {
+		return "", fmt.Errorf("not running as root and sudo not available")
+	}
+	sudo := "sudo"
+	if rm.sshClient != nil {
+		sudo = "sudo -n"
+	}
+	// sh -c keeps every command of a chain such as apt-get update && apt-get install privileged
+	return fmt.Sprintf("%s sh -c %s", sudo, shell.Quote(command)), nil
+}
+
+func (rm *RestoreManager) tryInstallPostgreSQLClient(ctx context.Context) error {
 	rm.logger.Info("Attempting to auto-install PostgreSQL client tools...")
 	
 	// Detect the package manager and OS
@@ -287,7 +830,7 @@ else
     echo "unknown"
 fi`
 	
-	output, err := rm.executeCommand(detectCmd, 10*time.Second)
+	output, err := rm.executeCommand(ctx, detectCmd, 10*time.Second)
 	if err != nil {
 		return fmt.Errorf("failed to detect package manager: %w", err)
 	}
@@ -298,42 +841,24 @@ fi`
 	var installCmd string
 	switch packageManager {
 	case "apt":
-		// Check if running as root or with sudo
 		installCmd = "apt-get update && apt-get install -y postgresql-client"
-		if os.Geteuid() != 0 {
-			// Not root, try with sudo
-			if _, err := rm.executeCommand("command -v sudo", 5*time.Second); err == nil {
-				installCmd = "sudo " + installCmd
-			} else {
-				return fmt.Errorf("not running as root and sudo not available")
-			}
+		if installCmd, err = rm.asRoot(ctx, installCmd); err != nil {
+			return err
 		}
 	case "yum":
 		installCmd = "yum install -y postgresql"
-		if os.Geteuid() != 0 {
-			if _, err := rm.executeCommand("command -v sudo", 5*time.Second); err == nil {
-				installCmd = "sudo " + installCmd
-			} else {
-				return fmt.Errorf("not running as root and sudo not available")
-			}
+		if installCmd, err = rm.asRoot(ctx, installCmd); err != nil {
+			return err
 		}
 	case "dnf":
 		installCmd = "dnf install -y postgresql"
-		if os.Geteuid() != 0 {
-			if _, err := rm.executeCommand("command -v sudo", 5*time.Second); err == nil {
-				installCmd = "sudo " + installCmd
-			} else {
-				return fmt.Errorf("not running as root and sudo not available")
-			}
+		if installCmd, err = rm.asRoot(ctx, installCmd); err != nil {
+			return err
 		}
 	case "apk":
 		installCmd = "apk add --no-cache postgresql-client"
-		if os.Geteuid() != 0 {
-			if _, err := rm.executeCommand("command -v sudo", 5*time.Second); err == nil {
-				installCmd = "sudo " + installCmd
-			} else {
-				return fmt.Errorf("not running as root and sudo not available")
-			}
+		if installCmd, err = rm.asRoot(ctx, installCmd); err != nil {
+			return err
 		}
 	case "brew":
 		installCmd = "brew install postgresql"
@@ -344,7 +869,7 @@ fi`
 	rm.logger.Info("Installing PostgreSQL client tools...", slog.String("command", installCmd))
 	
 	// Execute installation with extended timeout
-	output, err = rm.executeCommand(installCmd, 5*time.Minute)
+	output, err = rm.executeCommand(ctx, installCmd, 5*time.Minute)
 	if err != nil {
 		return fmt.Errorf("installation failed: %w (output: %s)", err, output)
 	}
@@ -353,36 +878,14 @@ fi`
 	return nil
 }
 
-func (rm *RestoreManager) tryInstallSpecificPostgreSQLVersion(version string) error {
-	rm.logger.Info("Attempting to install specific PostgreSQL version", slog.String("version", version))
-	
-	// Map version numbers to major versions (1.16 = PostgreSQL 16, 1.15 = PostgreSQL 15, etc.)
-	majorVersion := ""
-	switch version {
-	case "1.16":
-		majorVersion = "16"
-	case "1.15":
-		majorVersion = "15"
-	case "1.14":
-		majorVersion = "14"
-	case "1.13":
-		majorVersion = "13"
-	default:
-		// Try to extract major version from the format
-		if strings.HasPrefix(version, "1.") {
-			majorVersion = strings.TrimPrefix(version, "1.")
-		}
-	}
-	
-	if majorVersion == "" {
-		return fmt.Errorf("unable to determine PostgreSQL major version from backup version %s", version)
-	}
-	
-	rm.logger.Info("Detected PostgreSQL major version", slog.String("major_version", majorVersion))
+// tryInstallSpecificPostgreSQLVersion installs the client tools of the given PostgreSQL major
+// version, adding the PostgreSQL APT repository if the distribution doesn't ship them
+func (rm *RestoreManager) tryInstallSpecificPostgreSQLVersion(ctx context.Context, majorVersion string) error {
+	rm.logger.Info("Attempting to install specific PostgreSQL version", slog.String("major_version", majorVersion))
 	
 	// Detect package manager
 	detectCmd := `command -v apt-get || command -v yum || command -v dnf || command -v apk || echo "unknown"`
-	output, err := rm.executeCommand(detectCmd, 10*time.Second)
+	output, err := rm.executeCommand(ctx, detectCmd, 10*time.Second)
 	if err != nil {
 		return fmt.Errorf("failed to detect package manager: %w", err)
 	}
@@ -398,11 +901,11 @@ func (rm *RestoreManager) tryInstallSpecificPostgreSQLVersion(version string) er
 		codename := "bookworm" // Default to Debian 12
 		
 		// Try method 1: /etc/os-release
-		if output, err := rm.executeCommand("grep VERSION_CODENAME /etc/os-release 2>/dev/null | cut -d= -f2", 5*time.Second); err == nil && output != "" {
+		if output, err := rm.executeCommand(ctx, "grep VERSION_CODENAME /etc/os-release 2>/dev/null | cut -d= -f2", 5*time.Second); err == nil && output != "" {
 			codename = strings.TrimSpace(strings.Trim(output, "\""))
-		} else if output, err := rm.executeCommand("grep UBUNTU_CODENAME /etc/os-release 2>/dev/null | cut -d= -f2", 5*time.Second); err == nil && output != "" {
+		} else if output, err := rm.executeCommand(ctx, "grep UBUNTU_CODENAME /etc/os-release 2>/dev/null | cut -d= -f2", 5*time.Second); err == nil && output != "" {
 			codename = strings.TrimSpace(strings.Trim(output, "\""))
-		} else if output, err := rm.executeCommand("head -1 /etc/debian_version 2>/dev/null", 5*time.Second); err == nil && output != "" {
+		} else if output, err := rm.executeCommand(ctx, "head -1 /etc/debian_version 2>/dev/null", 5*time.Second); err == nil && output != "" {
 			// Map Debian version numbers to codenames
 			version := strings.TrimSpace(output)
 			if strings.HasPrefix(version, "12") {
@@ -419,32 +922,25 @@ func (rm *RestoreManager) tryInstallSpecificPostgreSQLVersion(version string) er
 		// Simpler approach: try to install from official repos first, then add PostgreSQL repo if needed
 		installCmd = fmt.Sprintf("apt-get update && apt-get install -y postgresql-client-%s", majorVersion)
 		
-		// Execute with elevated privileges if needed
-		if os.Geteuid() != 0 {
-			if _, err := rm.executeCommand("command -v sudo", 5*time.Second); err == nil {
-				installCmd = "sudo " + installCmd
-			} else {
-				return fmt.Errorf("not running as root and sudo not available")
-			}
+		if installCmd, err = rm.asRoot(ctx, installCmd); err != nil {
+			return err
 		}
 		
 		// Try simple installation first
 		rm.logger.Info("Attempting direct installation from system repositories")
-		if output, err := rm.executeCommand(installCmd, 2*time.Minute); err != nil {
+		if output, err := rm.executeCommand(ctx, installCmd, 2*time.Minute); err != nil {
 			rm.logger.Info("Direct installation failed, adding PostgreSQL APT repository", slog.String("error", err.Error()))
 			
 			// If that fails, add the PostgreSQL APT repository
 			// First ensure lsb-release is installed and get the codename
 			lsbInstallCmd := "apt-get update && apt-get install -y lsb-release"
-			if os.Geteuid() != 0 {
-				if _, err := rm.executeCommand("command -v sudo", 5*time.Second); err == nil {
-					lsbInstallCmd = "sudo " + lsbInstallCmd
-				}
+			if cmd, err := rm.asRoot(ctx, lsbInstallCmd); err == nil {
+				lsbInstallCmd = cmd
 			}
-			rm.executeCommand(lsbInstallCmd, 1*time.Minute)
+			rm.executeCommand(ctx, lsbInstallCmd, 1*time.Minute)
 			
 			// Get the actual codename
-			codenameOutput, _ := rm.executeCommand("lsb_release -cs", 5*time.Second)
+			codenameOutput, _ := rm.executeCommand(ctx, "lsb_release -cs", 5*time.Second)
 			actualCodename := strings.TrimSpace(codenameOutput)
 			if actualCodename == "" {
 				actualCodename = codename // fallback to detected codename
@@ -460,17 +956,11 @@ func (rm *RestoreManager) tryInstallSpecificPostgreSQLVersion(version string) er
 				apt-get install -y postgresql-client-%s
 			`, actualCodename, majorVersion)
 			
-			if os.Geteuid() != 0 {
-				if _, err := rm.executeCommand("command -v sudo", 5*time.Second); err == nil {
-					installCmd = fmt.Sprintf("sudo sh -c '%s'", repoSetupCmd)
-				} else {
-					return fmt.Errorf("not running as root and sudo not available for repository setup")
-				}
-			} else {
-				installCmd = repoSetupCmd
+			if installCmd, err = rm.asRoot(ctx, repoSetupCmd); err != nil {
+				return err
 			}
 			
-			output, err = rm.executeCommand(installCmd, 5*time.Minute)
+			output, err = rm.executeCommand(ctx, installCmd, 5*time.Minute)
 			if err != nil {
 				return fmt.Errorf("failed to install PostgreSQL %s client: %w (output: %s)", majorVersion, err, output)
 			}
@@ -478,22 +968,14 @@ func (rm *RestoreManager) tryInstallSpecificPostgreSQLVersion(version string) er
 	case "yum", "dnf":
 		// For RHEL/CentOS/Fedora
 		installCmd = fmt.Sprintf("%s install -y postgresql%s", packageManager, majorVersion)
-		if os.Geteuid() != 0 {
-			if _, err := rm.executeCommand("command -v sudo", 5*time.Second); err == nil {
-				installCmd = "sudo " + installCmd
-			} else {
-				return fmt.Errorf("not running as root and sudo not available")
-			}
+		if installCmd, err = rm.asRoot(ctx, installCmd); err != nil {
+			return err
 		}
 	case "apk":
 		// For Alpine Linux
 		installCmd = fmt.Sprintf("apk add --no-cache postgresql%s-client", majorVersion)
-		if os.Geteuid() != 0 {
-			if _, err := rm.executeCommand("command -v sudo", 5*time.Second); err == nil {
-				installCmd = "sudo " + installCmd
-			} else {
-				return fmt.Errorf("not running as root and sudo not available")
-			}
+		if installCmd, err = rm.asRoot(ctx, installCmd); err != nil {
+			return err
 		}
 	default:
 		return fmt.Errorf("unsupported package manager for automatic PostgreSQL %s installation", majorVersion)
@@ -503,97 +985,54 @@ func (rm *RestoreManager) tryInstallSpecificPostgreSQLVersion(version string) er
 		slog.String("version", majorVersion),
 		slog.String("command", installCmd))
 	
-	output, err = rm.executeCommand(installCmd, 5*time.Minute)
+	output, err = rm.executeCommand(ctx, installCmd, 5*time.Minute)
 	if err != nil {
 		return fmt.Errorf("failed to install PostgreSQL %s client: %w (output: %s)", majorVersion, err, output)
 	}
 	
 	// Verify installation
 	versionCheck := fmt.Sprintf("pg_restore --version | grep -q 'pg_restore (PostgreSQL) %s'", majorVersion)
-	if _, err := rm.executeCommand(versionCheck, 10*time.Second); err == nil {
+	if _, err := rm.executeCommand(ctx, versionCheck, 10*time.Second); err == nil {
 		rm.logger.Info("Successfully installed PostgreSQL client", slog.String("version", majorVersion))
 	}
 	
 	return nil
 }
 
-func (rm *RestoreManager) performRestore(backupPath string) error {
+func (rm *RestoreManager) performRestore(ctx context.Context, backupPath string) error {
 	rm.logger.Info("Performing database restore",
 		slog.String("backup_file", backupPath),
 		slog.String("target_database", rm.config.Restore.TargetDatabase),
 		slog.Bool("local", rm.sshClient == nil))
 
-	// Check PostgreSQL version first
-	pgVersionCmd := "pg_restore --version 2>&1 | grep -o 'PostgreSQL) [0-9]*' | grep -o '[0-9]*'"
-	versionOutput, err := rm.executeCommand(pgVersionCmd, 10*time.Second)
-	if err == nil && versionOutput != "" {
-		currentVersion := strings.TrimSpace(versionOutput)
-		rm.logger.Info("PostgreSQL client version detected", slog.String("version", currentVersion))
-	}
-	
-	// Check if pg_restore exists and get its path
-	pgRestorePath := ""
-	output, err := rm.executeCommand("which pg_restore || command -v pg_restore || type pg_restore 2>/dev/null", 10*time.Second)
-	if err != nil || strings.TrimSpace(output) == "" {
-		// Try common PostgreSQL installation paths
-		commonPaths := []string{
-			"/usr/bin/pg_restore",
-			"/usr/local/bin/pg_restore",
-			"/opt/homebrew/bin/pg_restore",
-			"/usr/pgsql-*/bin/pg_restore",
-			"/usr/lib/postgresql/*/bin/pg_restore",
-		}
-		
-		found := false
-		for _, path := range commonPaths {
-			checkCmd := fmt.Sprintf("test -x %s && echo %s", path, path)
-			if output, err := rm.executeCommand(checkCmd, 5*time.Second); err == nil && strings.TrimSpace(output) != "" {
-				found = true
-				pgRestorePath = strings.TrimSpace(output)
-				rm.logger.Info("Found pg_restore at", slog.String("path", pgRestorePath))
-				break
-			}
-		}
-		
-		if !found {
+	// The dump format check usually selected pg_restore already
+	if rm.pgRestore.path == "" {
+		if err := rm.selectPgRestore(ctx, 0); err != nil {
 			location := "remote server"
 			if rm.sshClient == nil {
 				location = "local system"
-				rm.logger.Warn("pg_restore not found on local system")
-				
-				// Try to auto-install PostgreSQL client tools if enabled
-				if rm.config.Restore.AutoInstall {
-					if err := rm.tryInstallPostgreSQLClient(); err != nil {
-						rm.logger.Error("Failed to auto-install PostgreSQL client tools",
-							slog.String("error", err.Error()),
-							slog.String("hint", "Please install manually with: apt-get install postgresql-client or yum install postgresql"))
-						return fmt.Errorf("pg_restore not found on %s and auto-install failed: %w", location, err)
-					}
-					
-					// Check again after installation
-					output, err = rm.executeCommand("which pg_restore", 10*time.Second)
-					if err != nil || strings.TrimSpace(output) == "" {
-						return fmt.Errorf("pg_restore still not found after installation attempt")
-					}
-					pgRestorePath = strings.TrimSpace(output)
-					rm.logger.Info("PostgreSQL client tools installed successfully", 
-						slog.String("pg_restore", pgRestorePath))
-				} else {
-					rm.logger.Error("pg_restore not found. Please install PostgreSQL client tools.",
-						slog.String("hint", "Install with: apt-get install postgresql-client or yum install postgresql"),
-						slog.String("note", "Or enable auto_install in restore config"))
-					return fmt.Errorf("pg_restore not found on %s (auto-install disabled)", location)
-				}
-			} else {
-				return fmt.Errorf("pg_restore not found on %s", location)
 			}
+			if !rm.autoInstall() {
+				rm.logger.Error("pg_restore not found. Please install PostgreSQL client tools.",
+					slog.String("error", err.Error()),
+					slog.String("hint", "Install with: apt-get install postgresql-client or yum install postgresql, or set restore.pg_bin_dir"))
+				return fmt.Errorf("pg_restore not found on %s: %w", location, err)
+			}
+
+			rm.logger.Warn("pg_restore not found, trying auto_install", slog.String("location", location))
+			if err := rm.tryInstallPostgreSQLClient(ctx); err != nil {
+				rm.logger.Error("Failed to auto-install PostgreSQL client tools",
+					slog.String("error", err.Error()),
+					slog.String("hint", "Please install manually with: apt-get install postgresql-client or yum install postgresql"))
+				return fmt.Errorf("pg_restore not found on %s and auto-install failed: %w", location, err)
+			}
+			if err := rm.selectPgRestore(ctx, 0); err != nil {
+				return fmt.Errorf("pg_restore still not found after installation attempt: %w", err)
+			}
+			rm.logger.Info("PostgreSQL client tools installed successfully", slog.String("pg_restore", rm.pgRestore.path))
 		}
-	} else {
-		pgRestorePath = strings.TrimSpace(output)
-		rm.logger.Info("Found pg_restore", slog.String("path", pgRestorePath))
 	}
-
-	pgPassword := fmt.Sprintf("PGPASSWORD='%s'", rm.config.Restore.TargetPassword)
+	pgRestorePath := rm.pgRestore.path
 
 	// Drop existing database if configured
 	if rm.config.Restore.DropExisting {
@@ -603,15 +1042,12 @@ func (rm *RestoreManager) performRestore(backupPath string) error {
 		if rm.config.Restore.ForceDisconnect {
 			rm.logger.Info("Force disconnect enabled - terminating existing connections to database")
 			terminateCmd := fmt.Sprintf(
-				"%s psql -h %s -p %d -U %s -d postgres -c \"SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = '%s' AND pid <> pg_backend_pid();\"",
-				pgPassword,
-				rm.config.Restore.TargetHost,
-				rm.config.Restore.TargetPort,
-				rm.config.Restore.TargetUsername,
+				"psql %s -d postgres -c \"SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = '%s' AND pid <> pg_backend_pid();\"",
+				rm.targetArgs(),
 				rm.config.Restore.TargetDatabase,
 			)
 			
-			if output, err := rm.executeCommand(terminateCmd, 10*time.Second); err != nil {
+			if output, err := rm.executeCommand(ctx, terminateCmd, 10*time.Second); err != nil {
 				// Log but don't fail if we can't terminate connections (might not have permissions)
 				rm.logger.Warn("Failed to terminate existing connections", 
 					slog.String("error", err.Error()),
@@ -621,21 +1057,22 @@ func (rm *RestoreManager) performRestore(backupPath string) error {
 			}
 			
 			// Small delay to ensure connections are closed
-			time.Sleep(1 * time.Second)
+			select {
+			case <-time.After(1 * time.Second):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
 		}
 		
 		// Now drop the database
 		// Quote database name to handle special characters
 		dropCmd := fmt.Sprintf(
-			"%s psql -h %s -p %d -U %s -d postgres -c \"DROP DATABASE IF EXISTS \\\"%s\\\";\"",
-			pgPassword,
-			rm.config.Restore.TargetHost,
-			rm.config.Restore.TargetPort,
-			rm.config.Restore.TargetUsername,
+			"psql %s -d postgres -c \"DROP DATABASE IF EXISTS \\\"%s\\\";\"",
+			rm.targetArgs(),
 			rm.config.Restore.TargetDatabase,
 		)
 		
-		if output, err := rm.executeCommand(dropCmd, 30*time.Second); err != nil {
+		if output, err := rm.executeCommand(ctx, dropCmd, 30*time.Second); err != nil {
 			// Check if error is due to active connections
 			if strings.Contains(output, "being accessed by other users") {
 				// Try a more aggressive approach - force disconnect
@@ -644,23 +1081,24 @@ func (rm *RestoreManager) performRestore(backupPath string) error {
 				// For PostgreSQL 9.2+, we can use FORCE option (but it's not available in all versions)
 				// Try alternative: revoke connect and terminate
 				revokeCmd := fmt.Sprintf(
-					"%s psql -h %s -p %d -U %s -d postgres -c \"REVOKE CONNECT ON DATABASE \\\"%s\\\" FROM PUBLIC; SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = '%s';\"",
-					pgPassword,
-					rm.config.Restore.TargetHost,
-					rm.config.Restore.TargetPort,
-					rm.config.Restore.TargetUsername,
+					"psql %s -d postgres -c \"REVOKE CONNECT ON DATABASE \\\"%s\\\" FROM PUBLIC; SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = '%s';\"",
+					rm.targetArgs(),
 					rm.config.Restore.TargetDatabase,
 					rm.config.Restore.TargetDatabase,
 				)
 				
-				if _, err := rm.executeCommand(revokeCmd, 10*time.Second); err != nil {
+				if _, err := rm.executeCommand(ctx, revokeCmd, 10*time.Second); err != nil {
 					rm.logger.Warn("Failed to revoke connections", slog.String("error", err.Error()))
 				}
 				
 				// Wait a bit and try dropping again
-				time.Sleep(2 * time.Second)
+				select {
+				case <-time.After(2 * time.Second):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
 				
-				if output, err := rm.executeCommand(dropCmd, 30*time.Second); err != nil {
+				if output, err := rm.executeCommand(ctx, dropCmd, 30*time.Second); err != nil {
 					return fmt.Errorf("failed to drop existing database after terminating connections: %w (output: %s)", err, output)
 				}
 			} else {
@@ -669,6 +1107,7 @@ func (rm *RestoreManager) performRestore(backupPath string) error {
 		}
 		
 		rm.logger.Info("Database dropped successfully")
+		rm.replacedTarget = true
 	}
 
 	// Create database if configured
@@ -677,11 +1116,8 @@ func (rm *RestoreManager) performRestore(backupPath string) error {
 		
 		// Quote database name to handle special characters
 		createCmd := fmt.Sprintf(
-			"%s psql -h %s -p %d -U %s -d postgres -c \"CREATE DATABASE \\\"%s\\\"",
-			pgPassword,
-			rm.config.Restore.TargetHost,
-			rm.config.Restore.TargetPort,
-			rm.config.Restore.TargetUsername,
+			"psql %s -d postgres -c \"CREATE DATABASE \\\"%s\\\"",
+			rm.targetArgs(),
 			rm.config.Restore.TargetDatabase,
 		)
 		
@@ -691,42 +1127,73 @@ func (rm *RestoreManager) performRestore(backupPath string) error {
 		}
 		createCmd += ";\""
 		
-		if output, err := rm.executeCommand(createCmd, 30*time.Second); err != nil {
+		if output, err := rm.executeCommand(ctx, createCmd, 30*time.Second); err != nil {
 			// Check if database already exists
 			if !strings.Contains(err.Error(), "already exists") && !strings.Contains(output, "already exists") {
 				return fmt.Errorf("failed to create database: %w (output: %s)", err, output)
 			}
 			rm.logger.Info("Database already exists, continuing with restore")
+		} else {
+			rm.replacedTarget = true
 		}
 	}
 
+	if rm.dumpFormat == dumpformat.Plain {
+		return rm.restorePlain(ctx, backupPath)
+	}
+
 	// Build pg_restore command
 	// Quote database name to handle special characters
 	restoreCmd := fmt.Sprintf(
-		"%s %s -h %s -p %d -U %s -d \"%s\" --verbose --no-owner --no-privileges --no-tablespaces",
-		pgPassword,
+		"%s %s -d \"%s\" --verbose",
 		pgRestorePath,
-		rm.config.Restore.TargetHost,
-		rm.config.Restore.TargetPort,
-		rm.config.Restore.TargetUsername,
+		rm.targetArgs(),
 		rm.config.Restore.TargetDatabase,
 	)
 
-	// Add parallel jobs if configured
-	if rm.config.Restore.Jobs > 1 {
+	// Ownership, grants and tablespaces are left to the target unless configured otherwise
+	if !rm.config.Restore.KeepOwner {
+		restoreCmd += " --no-owner"
+	}
+	if !rm.config.Restore.KeepPrivileges {
+		restoreCmd += " --no-privileges"
+	}
+	if !rm.config.Restore.KeepTablespaces {
+		restoreCmd += " --no-tablespaces"
+	}
+
+	// Add parallel jobs if configured; config validation keeps them apart from single_transaction
+	if rm.config.Restore.Jobs > 1 && rm.dumpFormat == dumpformat.Tar {
+		rm.logger.Warn("pg_restore can't restore tar format dumps in parallel, ignoring jobs", slog.Int("jobs", rm.config.Restore.Jobs))
+	} else if rm.config.Restore.Jobs > 1 {
 		restoreCmd += fmt.Sprintf(" --jobs=%d", rm.config.Restore.Jobs)
 	}
+	if rm.config.Restore.SingleTransaction {
+		restoreCmd += " --single-transaction"
+	}
 
 	// Add clean option if not creating new database
 	if !rm.config.Restore.CreateDB && rm.config.Restore.DropExisting {
 		restoreCmd += " --clean --if-exists"
 	}
 
-	restoreCmd += fmt.Sprintf(" %s 2>&1", backupPath)
+	var output string
+	var err error
+	if len(rm.config.Restore.RowFilters) > 0 {
+		restoreCmd = rm.filteredRestoreCommand(restoreCmd, pgRestorePath, backupPath)
+	} else if rm.config.Restore.Selective() {
+		restoreCmd, err = rm.selectiveRestoreCommand(ctx, restoreCmd, pgRestorePath, backupPath)
+		if err != nil {
+			return err
+		}
+	} else {
+		restoreCmd += fmt.Sprintf(" %s 2>&1", backupPath)
+	}
 
 	// Execute restore (with extended timeout)
-	rm.logger.Info("Executing pg_restore command", slog.Int("jobs", rm.config.Restore.Jobs))
-	output, err = rm.executeCommand(restoreCmd, rm.config.Timeouts.BackupOp)
+	dataEntries := rm.countDataEntries(ctx, pgRestorePath, backupPath)
+	rm.logger.Info("Executing pg_restore command", slog.Int("jobs", rm.config.Restore.Jobs), slog.Int("tables", dataEntries))
+	output, err = rm.executeRestore(ctx, restoreCmd, dataEntries)
 	
 	if err != nil {
 		// Check for version mismatch
@@ -739,129 +1206,47 @@ func (rm *RestoreManager) performRestore(backupPath string) error {
 				backupVersion = matches[1]
 			}
 			
-			// Check current PostgreSQL version
-			currentVersionCmd := "pg_restore --version 2>&1 | grep -o 'PostgreSQL) [0-9]*' | grep -o '[0-9]*'"
-			currentVersionOutput, _ := rm.executeCommand(currentVersionCmd, 5*time.Second)
-			currentVersion := strings.TrimSpace(currentVersionOutput)
-			
 			rm.logger.Error("PostgreSQL version mismatch",
 				slog.String("backup_version", backupVersion),
-				slog.String("current_version", currentVersion),
+				slog.Int("current_version", rm.pgRestore.major),
 				slog.String("error", "The backup was created with a newer PostgreSQL version"),
 				slog.String("solution", "Please upgrade PostgreSQL client tools to match the backup version"))
 			
-			// Check if backup version is 1.16 (PostgreSQL 16/17) and we have version 16
-			if backupVersion == "1.16" {
-				rm.logger.Info("Backup has dump format version 1.16")
-				rm.logger.Info("This format is used by PostgreSQL 17 or newer development versions")
-				
-				// Check if it's actually a PostgreSQL custom dump
-				magicCmd := fmt.Sprintf("hexdump -C %s | head -n 1", backupPath)
-				magicOutput, _ := rm.executeCommand(magicCmd, 5*time.Second)
-				
-				// PostgreSQL custom format should start with "PGDMP"
-				if !strings.Contains(magicOutput, "50 47 44 4d 50") { // PGDMP in hex
-					rm.logger.Error("File does not appear to be a valid PostgreSQL custom format dump")
-					return fmt.Errorf("invalid backup file format - not a PostgreSQL custom dump")
-				}
-				
-				// Try to install PostgreSQL 17 client tools
-				if rm.sshClient == nil && rm.config.Restore.AutoInstall {
-					rm.logger.Info("Attempting to install PostgreSQL 17 client tools to handle format version 1.16...")
-					
-					// Install PostgreSQL 17
-					installCmd := "apt-get update && apt-get install -y postgresql-client-17"
-					if os.Geteuid() != 0 {
-						if _, err := rm.executeCommand("command -v sudo", 5*time.Second); err == nil {
-							installCmd = "sudo " + installCmd
-						}
-					}
-					
-					if output, err := rm.executeCommand(installCmd, 2*time.Minute); err != nil {
-						rm.logger.Info("Direct installation of PostgreSQL 17 failed, adding PostgreSQL APT repository", slog.String("error", err.Error()))
-						
-						// Add PostgreSQL APT repository for version 17
-						lsbInstallCmd := "apt-get update && apt-get install -y lsb-release"
-						if os.Geteuid() != 0 {
-							if _, err := rm.executeCommand("command -v sudo", 5*time.Second); err == nil {
-								lsbInstallCmd = "sudo " + lsbInstallCmd
-							}
-						}
-						rm.executeCommand(lsbInstallCmd, 1*time.Minute)
-						
-						codenameOutput, _ := rm.executeCommand("lsb_release -cs", 5*time.Second)
-						actualCodename := strings.TrimSpace(codenameOutput)
-						if actualCodename == "" {
-							actualCodename = "bookworm"
-						}
-						
-						repoSetupCmd := fmt.Sprintf(`
-							apt-get install -y wget ca-certificates &&
-							wget --quiet -O - https://www.postgresql.org/media/keys/ACCC4CF8.asc | apt-key add - &&
-							echo "deb http://apt.postgresql.org/pub/repos/apt/ %s-pgdg main" > /etc/apt/sources.list.d/pgdg.list &&
-							apt-get update &&
-							apt-get install -y postgresql-client-17
-						`, actualCodename)
-						
-						if os.Geteuid() != 0 {
-							if _, err := rm.executeCommand("command -v sudo", 5*time.Second); err == nil {
-								installCmd = fmt.Sprintf("sudo sh -c '%s'", repoSetupCmd)
-							}
-						} else {
-							installCmd = repoSetupCmd
-						}
-						
-						output, err = rm.executeCommand(installCmd, 5*time.Minute)
-						if err != nil {
-							rm.logger.Error("Failed to install PostgreSQL 17 client tools", 
-								slog.String("error", err.Error()),
-								slog.String("output", output))
-							return fmt.Errorf("restore failed - backup requires PostgreSQL 17 or newer (dump format 1.16): %w", err)
-						}
-					}
-					
-					// Check if pg_restore 17 is now available
-					versionCheck := "pg_restore --version 2>&1 | grep -o 'PostgreSQL) [0-9]*' | grep -o '[0-9]*'"
-					newVersion, _ := rm.executeCommand(versionCheck, 5*time.Second)
-					newVersion = strings.TrimSpace(newVersion)
-					
-					if newVersion == "17" {
-						rm.logger.Info("PostgreSQL 17 client tools installed successfully, retrying restore...")
-						output, err = rm.executeCommand(restoreCmd, rm.config.Timeouts.BackupOp)
-						if err == nil {
-							rm.logger.Info("Restore succeeded with PostgreSQL 17 client")
-							goto restore_success
-						}
-					}
+			// The format table knows which client reads the dump; unknown formats fall back to
+			// a client matching the format's minor number, as older pg_dump versions did
+			requiredMajor := ""
+			if format, parseErr := dumpformat.Parse(backupVersion); parseErr == nil {
+				if minClient, ok := dumpformat.MinClient(format); ok {
+					requiredMajor = strconv.Itoa(minClient)
+				} else {
+					requiredMajor = strconv.Itoa(format.Minor)
 				}
-				
-				rm.logger.Error("The backup was created with PostgreSQL 17 or newer",
-					slog.String("dump_format", "1.16"),
-					slog.String("solution", "Please install PostgreSQL 17 client tools or enable auto_install in config"))
-				
-				return fmt.Errorf("restore failed - backup requires PostgreSQL 17 or newer (dump format 1.16): %w (output: %s)", err, output)
 			}
-			
-			// Try to suggest installation of newer version
-			if rm.sshClient == nil && rm.config.Restore.AutoInstall {
-				rm.logger.Info("Attempting to install newer PostgreSQL client tools...")
-				if err := rm.tryInstallSpecificPostgreSQLVersion(backupVersion); err != nil {
+
+			if rm.autoInstall() && requiredMajor != "" {
+				rm.logger.Info("Attempting to install newer PostgreSQL client tools...",
+					slog.String("dump_format", backupVersion),
+					slog.String("required_version", requiredMajor))
+				if err := rm.tryInstallSpecificPostgreSQLVersion(ctx, requiredMajor); err != nil {
 					rm.logger.Error("Failed to auto-install newer PostgreSQL version",
 						slog.String("error", err.Error()))
 				} else {
 					// Retry the restore with new version
 					rm.logger.Info("Retrying restore with updated PostgreSQL client...")
-					output, err = rm.executeCommand(restoreCmd, rm.config.Timeouts.BackupOp)
+					output, err = rm.executeRestore(ctx, restoreCmd, dataEntries)
 					if err == nil {
 						rm.logger.Info("Restore succeeded with updated PostgreSQL client")
 						goto restore_success
 					}
 				}
 			}
-			
-			return fmt.Errorf("restore failed due to PostgreSQL version mismatch - backup requires PostgreSQL %s or newer: %w (output: %s)", backupVersion, err, output)
-		} else if strings.Contains(output, "WARNING") && !strings.Contains(output, "ERROR") {
-			rm.logger.Warn("Restore completed with warnings", slog.String("output", output))
+
+			if requiredMajor != "" {
+				return fmt.Errorf("restore failed - backup requires PostgreSQL %s or newer client tools (dump format %s): %w (output: %s)", requiredMajor, backupVersion, err, output)
+			}
+			return fmt.Errorf("restore failed due to PostgreSQL version mismatch (dump format %s): %w (output: %s)", backupVersion, err, output)
+		} else if result := pgoutput.Classify(output); result.HasErrors() {
+			return fmt.Errorf("restore failed: %w (%d errors: %s)", err, len(result.Errors), pgoutput.Summary(result.Errors, 20))
 		} else {
 			return fmt.Errorf("restore failed: %w (output: %s)", err, output)
 		}
@@ -869,31 +1254,70 @@ func (rm *RestoreManager) performRestore(backupPath string) error {
 	
 restore_success:
 
-	// Verify restore by checking table count
-	// Quote database name to handle special characters
-	verifyCmd := fmt.Sprintf(
-		"%s psql -h %s -p %d -U %s -d \"%s\" -t -c \"SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = 'public';\"",
-		pgPassword,
-		rm.config.Restore.TargetHost,
-		rm.config.Restore.TargetPort,
-		rm.config.Restore.TargetUsername,
+	// Warnings don't fail the restore but are surfaced in the summary and notification
+	if warnings := pgoutput.Classify(output).Warnings; len(warnings) > 0 {
+		rm.warnings = append(rm.warnings, warnings...)
+		rm.logger.Warn("Restore completed with warnings",
+			slog.Int("count", len(warnings)),
+			slog.String("warnings", pgoutput.Summary(warnings, 10)))
+	}
+
+	rm.logger.Info("Database restore completed successfully")
+	return nil
+}
+
+// filteredRestoreCommand builds a restore that skips the data of tables with row filters in the
+// main pg_restore pass, streams their data through COPY ... FROM stdin WHERE <filter>, and
+// creates indexes and constraints last so they are built on the filtered rows only
+func (rm *RestoreManager) filteredRestoreCommand(restoreCmd, pgRestorePath, backupPath string) string {
+	tocPath := backupPath + ".toc"
+	psqlCmd := fmt.Sprintf(
+		"psql %s -d \"%s\" -v ON_ERROR_STOP=1",
+		rm.targetArgs(),
 		rm.config.Restore.TargetDatabase,
 	)
 
-	tableCount, err := rm.executeCommand(verifyCmd, 30*time.Second)
-	if err != nil {
-		rm.logger.Warn("Failed to verify restore", slog.String("error", err.Error()))
-	} else {
-		count := strings.TrimSpace(tableCount)
-		rm.logger.Info("Restore verification", slog.String("public_tables", count))
+	// Comment out the TABLE DATA entries of filtered tables in the restore list
+	var matches []string
+	for _, filter := range rm.config.Restore.RowFilters {
+		schema, table := filter.Schema()
+		matches = append(matches, fmt.Sprintf(`($6 == "%s" && $7 == "%s")`, schema, table))
 	}
+	awkProgram := fmt.Sprintf(`{ if ($4 == "TABLE" && $5 == "DATA" && (%s)) print ";" $0; else print }`, strings.Join(matches, " || "))
 
-	rm.logger.Info("Database restore completed successfully")
-	return nil
+	steps := []string{
+		fmt.Sprintf("%s -l %s | awk %s > %s", pgRestorePath, backupPath, shell.Quote(awkProgram), tocPath),
+		fmt.Sprintf("%s --section=pre-data --section=data -L %s %s", restoreCmd, tocPath, backupPath),
+	}
+
+	// psql substitutes :where with the filter, so the condition needs no escaping for sed
+	for _, filter := range rm.config.Restore.RowFilters {
+		schema, table := filter.Schema()
+		rm.logger.Info("Restoring table with row filter",
+			slog.String("table", schema+"."+table),
+			slog.String("where", filter.Where))
+		steps = append(steps, fmt.Sprintf(
+			"%s -a -n %s -t %s -f - %s | sed %s | %s -v where=%s",
+			pgRestorePath,
+			shell.Quote(schema),
+			shell.Quote(table),
+			backupPath,
+			shell.Quote(`s/^\(COPY .*\) FROM stdin;$/\1 FROM stdin WHERE :where;/`),
+			psqlCmd,
+			shell.Quote(filter.Where),
+		))
+	}
+
+	// --clean already dropped everything in the pre-data pass
+	postDataCmd := strings.Replace(restoreCmd, " --clean --if-exists", "", 1)
+	steps = append(steps, fmt.Sprintf("%s --section=post-data %s", postDataCmd, backupPath))
+
+	return fmt.Sprintf("(%s) 2>&1; status=$?; rm -f %s; exit $status", strings.Join(steps, " && "), tocPath)
 }
 
 func (rm *RestoreManager) cleanup() {
 	if rm.sshClient != nil {
 		rm.sshClient.Close()
 	}
+	rm.closeTunnel()
 }
\ No newline at end of file
@@ -0,0 +1,65 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// discardFailedRestore applies restore.on_failure to the database a failed restore left half
+// populated, and returns restoreErr noting what happened to it. Only a database this run dropped
+// or created is touched, so a failure before pg_restore started never removes existing data.
+func (rm *RestoreManager) discardFailedRestore(restoreErr error) error {
+	mode := rm.config.Restore.OnFailure
+	if !rm.replacedTarget || mode == "" || mode == "keep" {
+		return restoreErr
+	}
+	database := rm.config.Restore.TargetDatabase
+
+	// Monitoring or application connections would block the DROP or RENAME
+	terminate := fmt.Sprintf("SELECT count(pg_terminate_backend(pid)) FROM pg_stat_activity WHERE datname = '%s' AND pid <> pg_backend_pid();",
+		strings.ReplaceAll(database, "'", "''"))
+	if _, err := rm.targetQuery(context.Background(), terminate); err != nil {
+		rm.logger.Warn("Failed to terminate connections to the partially restored database", slog.String("error", err.Error()))
+	}
+
+	var statement, renamed string
+	if mode == "rename" {
+		renamed = failedDatabaseName(database, time.Now())
+		statement = fmt.Sprintf("ALTER DATABASE \\\"%s\\\" RENAME TO \\\"%s\\\";", database, renamed)
+	} else {
+		statement = fmt.Sprintf("DROP DATABASE IF EXISTS \\\"%s\\\";", database)
+	}
+	cmd := fmt.Sprintf(
+		"psql %s -d postgres -c \"%s\"",
+		rm.targetArgs(),
+		statement,
+	)
+	if output, err := rm.executeCommand(context.Background(), cmd, 5*time.Minute); err != nil {
+		rm.logger.Error("Failed to clean up the partially restored database",
+			slog.String("database", database),
+			slog.String("on_failure", mode),
+			slog.String("error", err.Error()),
+			slog.String("output", output))
+		return fmt.Errorf("%w; cleaning up the partially restored database %s failed: %v", restoreErr, database, err)
+	}
+
+	if renamed != "" {
+		rm.logger.Warn("Renamed the partially restored database", slog.String("database", database), slog.String("renamed_to", renamed))
+		return fmt.Errorf("%w; the partially restored database was renamed to %s", restoreErr, renamed)
+	}
+	rm.logger.Warn("Dropped the partially restored database", slog.String("database", database))
+	return fmt.Errorf("%w; the partially restored database %s was dropped", restoreErr, database)
+}
+
+// failedDatabaseName returns <database>_failed_<timestamp>, shortening the database name so the
+// result fits PostgreSQL's 63 byte identifier limit
+func failedDatabaseName(database string, now time.Time) string {
+	suffix := "_failed_" + now.UTC().Format("20060102_150405")
+	if limit := 63 - len(suffix); len(database) > limit {
+		database = database[:limit]
+	}
+	return database + suffix
+}
@@ -0,0 +1,93 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/hra42/pg_backup/internal/config"
+	"github.com/hra42/pg_backup/internal/shell"
+)
+
+// pauseCheckInterval is how often a restore with pause windows checks the clock
+const pauseCheckInterval = time.Minute
+
+// executeThrottled runs the command loading the dump with restore.throttle applied: its
+// settings are passed to the restore sessions as PGOPTIONS, and during a pause window the
+// command's process group is suspended with SIGSTOP until the window ends.
+func (rm *RestoreManager) executeThrottled(ctx context.Context, command string, onLine func(string)) (string, error) {
+	throttle := rm.config.Restore.Throttle
+	if options := throttle.PGOptions(); options != "" {
+		rm.logger.Info("Applying restore session settings", slog.String("pgoptions", options))
+		command = fmt.Sprintf("export PGOPTIONS=%s; %s", shell.Quote(options), command)
+	}
+	if throttle == nil || len(throttle.PauseWindows) == 0 {
+		return rm.executeCommandStream(ctx, command, rm.config.Timeouts.BackupOp, onLine)
+	}
+
+	// Both the local shell and the one sshd starts lead their process group, so the PID
+	// recorded here names pg_restore and everything else the command runs
+	pidFile := fmt.Sprintf("/tmp/pg_backup_restore_%d.pid", time.Now().UnixNano())
+	command = fmt.Sprintf("echo $$ > %s; ( %s ); rc=$?; rm -f %s; exit $rc", pidFile, command, pidFile)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		rm.pauseDuringWindows(ctx, pidFile, throttle.PauseWindows, stop)
+	}()
+
+	output, err := rm.executeCommandStream(ctx, command, rm.config.Timeouts.BackupOp, onLine)
+	close(stop)
+	wg.Wait()
+	return output, err
+}
+
+// pauseDuringWindows suspends the process group in pidFile while the clock is in one of the
+// windows and resumes it afterwards. A suspended group is resumed when stop closes, so a
+// restore canceled during a window still receives its termination signal.
+func (rm *RestoreManager) pauseDuringWindows(ctx context.Context, pidFile string, windows []config.PauseWindow, stop <-chan struct{}) {
+	paused := false
+	var pausedAt time.Time
+	signal := func(ctx context.Context, sig string) bool {
+		cmd := fmt.Sprintf("pid=$(cat %s 2>/dev/null) && kill -%s -- -$pid", pidFile, sig)
+		if _, err := rm.executeCommand(ctx, cmd, 10*time.Second); err != nil {
+			rm.logger.Debug("Failed to signal restore", slog.String("signal", sig), slog.String("error", err.Error()))
+			return false
+		}
+		return true
+	}
+
+	ticker := time.NewTicker(pauseCheckInterval)
+	defer ticker.Stop()
+	for {
+		inWindow := slices.ContainsFunc(windows, func(w config.PauseWindow) bool { return w.Contains(time.Now()) })
+		switch {
+		case inWindow && !paused:
+			// The PID file may not exist yet right after the start; the next check retries
+			if signal(ctx, "STOP") {
+				paused, pausedAt = true, time.Now()
+				rm.logger.Warn("Restore paused for a pause window")
+			}
+		case !inWindow && paused:
+			if signal(ctx, "CONT") {
+				paused = false
+				rm.logger.Info("Restore resumed after a pause window", slog.Duration("paused", time.Since(pausedAt).Round(time.Second)))
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			// Also after the run was canceled, a suspended group can't react to its termination
+			if paused {
+				signal(context.WithoutCancel(ctx), "CONT")
+			}
+			return
+		}
+	}
+}
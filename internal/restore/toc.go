@@ -0,0 +1,161 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/hra42/pg_backup/internal/config"
+	"github.com/hra42/pg_backup/internal/shell"
+)
+
+// Object types of pg_restore -l made of several words; all others are a single word
+var multiWordTypes = []string{
+	"TABLE DATA",
+	"FK CONSTRAINT",
+	"SEQUENCE SET",
+	"SEQUENCE OWNED BY",
+	"MATERIALIZED VIEW DATA",
+	"MATERIALIZED VIEW",
+	"FOREIGN TABLE",
+	"DEFAULT ACL",
+	"ROW SECURITY",
+	"EVENT TRIGGER",
+	"FOREIGN DATA WRAPPER",
+	"USER MAPPING",
+	"LARGE OBJECT",
+	"BLOB METADATA",
+	"TEXT SEARCH CONFIGURATION",
+	"TEXT SEARCH DICTIONARY",
+	"TEXT SEARCH PARSER",
+	"TEXT SEARCH TEMPLATE",
+	"PUBLICATION TABLE",
+	"PUBLICATION TABLES IN SCHEMA",
+	"OPERATOR CLASS",
+	"OPERATOR FAMILY",
+}
+
+// Object types whose name starts with the table they belong to, e.g. "events events_pkey"
+var tableAttachedTypes = map[string]bool{
+	"CONSTRAINT":    true,
+	"FK CONSTRAINT": true,
+	"DEFAULT":       true,
+	"TRIGGER":       true,
+	"POLICY":        true,
+	"ROW SECURITY":  true,
+	"RULE":          true,
+}
+
+// tocEntry is one line of a pg_restore -l listing:
+// "<id>; <catalog oid> <oid> <type> <schema> <name> <owner>"
+type tocEntry struct {
+	Type   string
+	Schema string
+	Name   string
+}
+
+// parseTOCEntry parses a listing line; comments and blank lines are not entries
+func parseTOCEntry(line string) (tocEntry, bool) {
+	_, rest, ok := strings.Cut(line, "; ")
+	if !ok || strings.HasPrefix(line, ";") {
+		return tocEntry{}, false
+	}
+	fields := strings.SplitN(rest, " ", 3)
+	if len(fields) < 3 {
+		return tocEntry{}, false
+	}
+	rest = fields[2]
+
+	var entry tocEntry
+	for _, objectType := range multiWordTypes {
+		if strings.HasPrefix(rest, objectType+" ") {
+			entry.Type = objectType
+			break
+		}
+	}
+	if entry.Type == "" {
+		entry.Type, _, _ = strings.Cut(rest, " ")
+	}
+	rest = strings.TrimPrefix(rest, entry.Type+" ")
+
+	// The owner is the last word and may be empty, which leaves a trailing space
+	entry.Schema, rest, ok = strings.Cut(rest, " ")
+	if !ok {
+		return tocEntry{}, false
+	}
+	if i := strings.LastIndex(rest, " "); i >= 0 {
+		rest = rest[:i]
+	}
+	entry.Name = rest
+	return entry, true
+}
+
+// selectTOC keeps the listing entries that belong to the given schemas or tables. A table
+// brings its data, constraints, defaults, triggers, policies and rules along; indexes that
+// aren't constraints are matched by their own name, so they can be listed like tables.
+func selectTOC(listing string, schemas, tables []string) (string, int) {
+	wantedSchemas := make(map[string]bool)
+	for _, schema := range schemas {
+		wantedSchemas[schema] = true
+	}
+	wantedTables := make(map[string]bool)
+	for _, name := range tables {
+		schema, table := config.SplitTableName(name)
+		wantedTables[schema+"."+table] = true
+	}
+
+	var selected []string
+	count := 0
+	for _, line := range strings.Split(strings.TrimRight(listing, "\r\n"), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		entry, ok := parseTOCEntry(line)
+		if !ok {
+			// Keep the header, so the list reads like pg_restore -l output
+			if strings.HasPrefix(line, ";") {
+				selected = append(selected, line)
+			}
+			continue
+		}
+
+		parent, _, _ := strings.Cut(entry.Name, " ")
+		match := wantedSchemas[entry.Schema] ||
+			(entry.Type == "SCHEMA" && wantedSchemas[entry.Name]) ||
+			wantedTables[entry.Schema+"."+entry.Name] ||
+			(tableAttachedTypes[entry.Type] && wantedTables[entry.Schema+"."+parent]) ||
+			(entry.Type == "COMMENT" && wantedTables[entry.Schema+"."+strings.TrimPrefix(entry.Name, "TABLE ")])
+		if match {
+			selected = append(selected, line)
+			count++
+		}
+	}
+	return strings.Join(selected, "\n") + "\n", count
+}
+
+// selectiveRestoreCommand builds a restore of only the objects in restore.schemas and
+// restore.tables. The backup's listing is filtered here and written next to the backup as
+// the restore list for pg_restore -L.
+func (rm *RestoreManager) selectiveRestoreCommand(ctx context.Context, restoreCmd, pgRestorePath, backupPath string) (string, error) {
+	listing, err := rm.executeCommand(ctx, fmt.Sprintf("%s -l %s", pgRestorePath, backupPath), 5*time.Minute)
+	if err != nil {
+		return "", fmt.Errorf("failed to list backup contents: %w (output: %s)", err, listing)
+	}
+
+	list, count := selectTOC(listing, rm.config.Restore.Schemas, rm.config.Restore.Tables)
+	if count == 0 {
+		return "", fmt.Errorf("no objects in the backup match restore.schemas %v and restore.tables %v",
+			rm.config.Restore.Schemas, rm.config.Restore.Tables)
+	}
+	rm.logger.Info("Restoring selected objects only",
+		slog.Any("schemas", rm.config.Restore.Schemas),
+		slog.Any("tables", rm.config.Restore.Tables),
+		slog.Int("entries", count))
+
+	tocPath := backupPath + ".toc"
+	if output, err := rm.executeCommand(ctx, fmt.Sprintf("printf '%%s' %s > %s", shell.Quote(list), tocPath), 30*time.Second); err != nil {
+		return "", fmt.Errorf("failed to write restore list: %w (output: %s)", err, output)
+	}
+
+	return fmt.Sprintf("(%s -L %s %s) 2>&1; status=$?; rm -f %s; exit $status", restoreCmd, tocPath, backupPath, tocPath), nil
+}
@@ -0,0 +1,61 @@
+package restore
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"strconv"
+)
+
+// openTunnel forwards a local port to target_host:target_port as seen from the SSH host and
+// points the restore at it for this run. Commands keep target_host as the host name and reach
+// 127.0.0.1 through PGHOSTADDR, so sslmode verify-full still checks the right certificate.
+func (rm *RestoreManager) openTunnel() error {
+	sshConfig := rm.config.Restore.SSH
+	if sshConfig == nil {
+		sshConfig = &rm.config.SSH
+	}
+	remote := net.JoinHostPort(rm.config.Restore.TargetHost, strconv.Itoa(rm.config.Restore.TargetPort))
+	rm.logger.Info("Opening SSH tunnel for direct restore",
+		slog.String("ssh_host", sshConfig.Host),
+		slog.String("target", remote))
+	if err := rm.tunnelClient.Connect(rm.config.Timeouts.SSHConnection); err != nil {
+		return fmt.Errorf("SSH connection failed: %w", err)
+	}
+
+	tunnel, err := rm.tunnelClient.Forward(remote, rm.config.Restore.Direct.LocalPort)
+	if err != nil {
+		rm.tunnelClient.Close()
+		return err
+	}
+	rm.tunnel = tunnel
+	rm.tunneled = tunneledTarget{port: rm.config.Restore.TargetPort, env: rm.config.Restore.Env}
+
+	env := maps.Clone(rm.config.Restore.Env)
+	if env == nil {
+		env = make(map[string]string)
+	}
+	env["PGHOSTADDR"] = "127.0.0.1"
+	rm.config.Restore.Env = env
+	rm.config.Restore.TargetPort = tunnel.Port()
+	return nil
+}
+
+// closeTunnel closes the tunnel and points the restore back at the configured target
+func (rm *RestoreManager) closeTunnel() {
+	if rm.tunnel == nil {
+		return
+	}
+	rm.config.Restore.TargetPort = rm.tunneled.port
+	rm.config.Restore.Env = rm.tunneled.env
+	rm.tunnel.Close()
+	rm.tunnel = nil
+	rm.tunnelClient.Close()
+}
+
+// tunneledTarget is the configured target port and environment replaced while a tunnel is open
+type tunneledTarget struct {
+	port int
+	env  map[string]string
+}
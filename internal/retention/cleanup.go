@@ -0,0 +1,107 @@
+package retention
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/hra42/pg_backup/internal/config"
+	"github.com/hra42/pg_backup/internal/lock"
+	"github.com/hra42/pg_backup/internal/notification"
+	"github.com/hra42/pg_backup/internal/storage"
+)
+
+// cleanupState records how many backups of each database the last cleanup left, so the next
+// one can tell backups that disappeared in between
+type cleanupState struct {
+	UpdatedAt time.Time      `json:"updated_at"`
+	Kept      map[string]int `json:"kept"`
+}
+
+func cleanupStatePath(cfg *config.Config) string {
+	name := lock.Name(cfg.Postgres.Host, cfg.Postgres.Port, "retention")
+	return filepath.Join(cfg.Backup.StateDir, "pg_backup_"+name+".cleanup.json")
+}
+
+// Cleanup applies the retention policy of cfg. With backup.retention_alerts it then notifies
+// about a cleanup that failed, even partially, with cleanup_failure, and about one that looks
+// wrong with cleanup_warning.
+func Cleanup(ctx context.Context, cfg *config.Config, s3Client *storage.S3Client, notifier *notification.NotificationClient, logger *slog.Logger) error {
+	result, err := s3Client.CleanupOldBackups(ctx, cfg.Backup.RetentionCount, cfg.RetentionCounts(), cfg.Backup.KeepLabels, cfg.Safety.DeletionLimit())
+	alerts := cfg.Backup.RetentionAlerts
+	if alerts == nil || !alerts.Enabled {
+		return err
+	}
+
+	if err != nil {
+		if notifyErr := notifier.SendCleanupFailure(cfg.Postgres.Database, err, result.Deleted); notifyErr != nil {
+			logger.Warn("Failed to send cleanup failure notification", slog.String("error", notifyErr.Error()))
+		}
+	}
+	// The bucket couldn't be listed, so there is nothing to compare
+	if result.Kept == nil {
+		return err
+	}
+
+	var warnings []string
+	if alerts.MaxDeletions > 0 && result.Deleted > alerts.MaxDeletions {
+		warnings = append(warnings, fmt.Sprintf("cleanup deleted %d backups, more than retention_alerts max_deletions (%d)", result.Deleted, alerts.MaxDeletions))
+	}
+	warnings = append(warnings, shrunk(cfg, result.Kept, logger)...)
+	if len(warnings) > 0 {
+		for _, warning := range warnings {
+			logger.Warn("Retention cleanup needs attention", slog.String("warning", warning))
+		}
+		if notifyErr := notifier.SendCleanupWarning(cfg.Postgres.Database, result.Deleted, warnings); notifyErr != nil {
+			logger.Warn("Failed to send cleanup warning notification", slog.String("error", notifyErr.Error()))
+		}
+	}
+	return err
+}
+
+// shrunk returns a warning for each database left with fewer backups than its retention count
+// and than the previous cleanup left, then records kept for the next cleanup. Cleanup never
+// deletes below the retention count itself, so these backups were deleted by something else.
+// Databases that are still building up their backups don't warn. A missing or unreadable
+// state only skips the comparison.
+func shrunk(cfg *config.Config, kept map[string]int, logger *slog.Logger) []string {
+	path := cleanupStatePath(cfg)
+	var previous cleanupState
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &previous); err != nil {
+			logger.Warn("Ignoring unreadable cleanup state", slog.String("path", path), slog.String("error", err.Error()))
+		}
+	}
+
+	policy := Policy{RetentionCount: cfg.Backup.RetentionCount, Databases: cfg.RetentionCounts()}
+	var warnings []string
+	for _, database := range slices.Sorted(maps.Keys(previous.Kept)) {
+		before, now := previous.Kept[database], kept[database]
+		if now < before && now < policy.count(database) {
+			name := database
+			// Backups of a single database don't carry its name
+			if name == "" {
+				name = cfg.Postgres.Database
+			}
+			warnings = append(warnings, fmt.Sprintf("%s has %d backups, fewer than its retention count of %d and the %d the last cleanup left",
+				name, now, policy.count(database), before))
+		}
+	}
+
+	data, err := json.MarshalIndent(cleanupState{UpdatedAt: time.Now().UTC(), Kept: kept}, "", "  ")
+	if err == nil {
+		if err = os.WriteFile(path+".tmp", data, 0600); err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+	}
+	if err != nil {
+		logger.Warn("Failed to save cleanup state", slog.String("error", err.Error()))
+	}
+	return warnings
+}
@@ -0,0 +1,180 @@
+package retention
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hra42/pg_backup/internal/storage"
+	"gopkg.in/yaml.v3"
+)
+
+// Policy is a retention policy; a proposed policy file uses the same keys as the backup section
+// of the configuration
+type Policy struct {
+	RetentionCount int            `yaml:"retention_count"`     // Backups kept per database
+	Databases      map[string]int `yaml:"databases,omitempty"` // Backups kept of these databases instead
+}
+
+// count returns the number of backups the policy keeps of a database, named as configured or
+// as backup keys carry it
+func (p Policy) count(database string) int {
+	if count, ok := p.Databases[database]; ok {
+		return count
+	}
+	for name, count := range p.Databases {
+		if storage.KeyDatabase(name) == storage.KeyDatabase(database) {
+			return count
+		}
+	}
+	return p.RetentionCount
+}
+
+// LoadPolicy reads a proposed policy from a YAML file
+func LoadPolicy(path string) (Policy, error) {
+	var policy Policy
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return policy, fmt.Errorf("failed to read policy file: %w", err)
+	}
+	if err := yaml.Unmarshal(data, &policy); err != nil {
+		return policy, fmt.Errorf("failed to parse policy file: %w", err)
+	}
+	if policy.RetentionCount <= 0 {
+		return policy, fmt.Errorf("retention_count must be positive in policy file %s", path)
+	}
+	for database, count := range policy.Databases {
+		if count <= 0 {
+			return policy, fmt.Errorf("retention count of %s must be positive in policy file %s", database, path)
+		}
+	}
+	return policy, nil
+}
+
+// Outcome is what a policy does with one backup
+type Outcome struct {
+	Key       string
+	Database  string
+	CreatedAt time.Time
+	Size      int64
+	Deleted   bool      // Deleted under the proposed policy
+	DeletedAt time.Time // When the proposed policy would have deleted it
+	Current   bool      // Deleted under the current policy
+}
+
+// Simulation is the outcome of replaying the bucket's backups against a proposed policy
+type Simulation struct {
+	Proposed Policy
+	Current  Policy
+	Since    time.Time
+	Outcomes []Outcome // Backups created since Since, newest first
+}
+
+// Simulate replays backups (newest first, as listed by storage.ListBackupObjects) against the
+// proposed policy, as if it had been applied after every backup. Each backup is deleted when
+// the backup that pushes it out of the policy is taken. Only backups that still exist can be
+// replayed, so backups the current policy already deleted never show up.
+func Simulate(backups []storage.BackupObject, proposed, current Policy, since time.Time) *Simulation {
+	sim := &Simulation{
+		Proposed: proposed,
+		Current:  current,
+		Since:    since,
+	}
+
+	// Backups seen so far per database; all of them are newer than the current one
+	byDatabase := make(map[string][]storage.BackupObject)
+	for _, backup := range backups {
+		newer := byDatabase[backup.Database]
+		byDatabase[backup.Database] = append(newer, backup)
+		if backup.LastModified.Before(since) {
+			continue
+		}
+
+		outcome := Outcome{
+			Key:       backup.Key,
+			Database:  backup.Database,
+			CreatedAt: backup.LastModified,
+			Size:      backup.Size,
+			Current:   len(newer) >= current.count(backup.Database),
+		}
+		if count := proposed.count(backup.Database); len(newer) >= count {
+			outcome.Deleted = true
+			outcome.DeletedAt = newer[len(newer)-count].LastModified
+		}
+		sim.Outcomes = append(sim.Outcomes, outcome)
+	}
+	return sim
+}
+
+// Write prints a summary per database followed by the outcome of every backup
+func (s *Simulation) Write(w io.Writer) error {
+	type summary struct {
+		backups, kept, deleted, currentKept int
+		freed                               int64
+	}
+	var databases []string
+	summaries := make(map[string]*summary)
+	for _, outcome := range s.Outcomes {
+		sum, ok := summaries[outcome.Database]
+		if !ok {
+			sum = &summary{}
+			summaries[outcome.Database] = sum
+			databases = append(databases, outcome.Database)
+		}
+		sum.backups++
+		if outcome.Deleted {
+			sum.deleted++
+			sum.freed += outcome.Size
+		} else {
+			sum.kept++
+		}
+		if !outcome.Current {
+			sum.currentKept++
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Retention simulation of retention_count %d (current %d) for backups since %s\n",
+		s.Proposed.RetentionCount, s.Current.RetentionCount, s.Since.Format("2006-01-02"))
+	for _, database := range slices.Sorted(maps.Keys(s.Proposed.Databases)) {
+		fmt.Fprintf(tw, "  %s: %d (current %d)\n", database, s.Proposed.Databases[database], s.Current.count(database))
+	}
+	fmt.Fprintln(tw)
+	if len(s.Outcomes) == 0 {
+		fmt.Fprintln(tw, "No backups in this period")
+		return tw.Flush()
+	}
+
+	fmt.Fprintln(tw, "DATABASE\tBACKUPS\tKEPT\tDELETED\tKEPT (CURRENT)\tFREED BYTES")
+	for _, database := range databases {
+		sum := summaries[database]
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\n",
+			displayDatabase(database), sum.backups, sum.kept, sum.deleted, sum.currentKept, sum.freed)
+	}
+
+	fmt.Fprintln(tw, "\nKEY\tDATABASE\tCREATED\tPROPOSED\tCURRENT")
+	for _, outcome := range s.Outcomes {
+		proposed := "kept"
+		if outcome.Deleted {
+			proposed = "deleted " + outcome.DeletedAt.UTC().Format("2006-01-02 15:04")
+		}
+		current := "kept"
+		if outcome.Current {
+			current = "deleted"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+			outcome.Key, displayDatabase(outcome.Database), outcome.CreatedAt.UTC().Format("2006-01-02 15:04"), proposed, current)
+	}
+	return tw.Flush()
+}
+
+func displayDatabase(database string) string {
+	if database == "" {
+		return "-"
+	}
+	return database
+}
@@ -0,0 +1,54 @@
+package retry
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/hra42/pg_backup/internal/config"
+)
+
+// Do runs fn until it succeeds or the policy is exhausted, doubling the wait between attempts
+// up to MaxBackoff. It returns the number of attempts made. Cancellation of ctx stops retrying.
+func Do(ctx context.Context, policy config.RetryPolicy, logger *slog.Logger, name string, fn func() error) (int, error) {
+	startTime := time.Now()
+	backoff := policy.InitialBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			if attempt > 1 {
+				logger.Info(fmt.Sprintf("%s succeeded after retries", name), slog.Int("attempts", attempt))
+			}
+			return attempt, nil
+		}
+
+		if attempt >= policy.Attempts || ctx.Err() != nil {
+			return attempt, err
+		}
+		if policy.MaxElapsed > 0 && time.Since(startTime)+backoff > policy.MaxElapsed {
+			logger.Warn(fmt.Sprintf("%s retry budget exhausted", name),
+				slog.Int("attempts", attempt),
+				slog.Duration("elapsed", time.Since(startTime)))
+			return attempt, err
+		}
+
+		logger.Warn(fmt.Sprintf("%s failed, retrying", name),
+			slog.String("error", err.Error()),
+			slog.Int("attempt", attempt),
+			slog.Int("max_attempts", policy.Attempts),
+			slog.Duration("backoff", backoff))
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return attempt, err
+		}
+
+		backoff *= 2
+		if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
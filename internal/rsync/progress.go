@@ -0,0 +1,55 @@
+package rsync
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// progressArgs makes rsync (3.1+) print a single whole-transfer progress line instead of
+// per-file output, e.g. "     32,768  45%    1.23MB/s    0:00:02 (xfr#1, to-chk=0/1)"
+var progressArgs = []string{"--info=progress2", "--no-inc-recursive"}
+
+// scanProgressLines is a bufio.SplitFunc that splits on both '\r' and '\n'. rsync redraws
+// its progress line with carriage returns, so splitting on newlines alone only yields the
+// final update.
+func scanProgressLines(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// parseProgress parses a --info=progress2 line into the bytes transferred so far and the
+// percentage done. Byte counts may be grouped with ',' or '.' depending on rsync's locale.
+func parseProgress(line string) (transferred int64, percent int, ok bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || !strings.HasSuffix(fields[1], "%") {
+		return 0, 0, false
+	}
+
+	digits := strings.NewReplacer(",", "", ".", "", "'", "").Replace(fields[0])
+	transferred, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || transferred < 0 {
+		return 0, 0, false
+	}
+	percent, err = strconv.Atoi(strings.TrimSuffix(fields[1], "%"))
+	if err != nil || percent < 0 || percent > 100 {
+		return 0, 0, false
+	}
+	return transferred, percent, true
+}
+
+// estimateTotal derives the transfer size from a progress update when it isn't known up front
+func estimateTotal(transferred int64, percent int) int64 {
+	if percent <= 0 {
+		return 0
+	}
+	return transferred * 100 / int64(percent)
+}
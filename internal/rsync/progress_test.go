@@ -0,0 +1,119 @@
+package rsync
+
+import (
+	"bufio"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseProgress(t *testing.T) {
+	tests := []struct {
+		name        string
+		line        string
+		transferred int64
+		percent     int
+		ok          bool
+	}{
+		{"progress2", "     32,768  45%    1.23MB/s    0:00:02 (xfr#1, to-chk=0/1)", 32768, 45, true},
+		{"done", "  1,073,741,824 100%  112.45MB/s    0:00:09 (xfr#1, to-chk=0/1)", 1073741824, 100, true},
+		{"start", "              0   0%    0.00kB/s    0:00:00", 0, 0, true},
+		{"no separators", "   5242880  12%   10.00MB/s    0:00:30", 5242880, 12, true},
+		{"dot separators", "  1.048.576  50%    2,00MB/s    0:00:01", 1048576, 50, true},
+		{"apostrophe separators", "  1'048'576  50%    2.00MB/s    0:00:01", 1048576, 50, true},
+		{"file list", "sending incremental file list", 0, 0, false},
+		{"file name", "backup_20240115_103000.dump", 0, 0, false},
+		{"summary", "sent 1,073,872,987 bytes  received 35 bytes  113,039,265.47 bytes/sec", 0, 0, false},
+		{"empty", "", 0, 0, false},
+		{"percent cut off", "     32,768  4", 0, 0, false},
+		{"count cut off", "  45%    1.23MB/s", 0, 0, false},
+		{"percent out of range", "     32,768  145%    1.23MB/s", 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transferred, percent, ok := parseProgress(tt.line)
+			if ok != tt.ok || transferred != tt.transferred || percent != tt.percent {
+				t.Errorf("parseProgress(%q) = %d, %d, %v, want %d, %d, %v",
+					tt.line, transferred, percent, ok, tt.transferred, tt.percent, tt.ok)
+			}
+		})
+	}
+}
+
+func TestScanProgressLines(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		lines  []string
+	}{
+		{
+			name:   "carriage returns",
+			output: "     32,768  45%    1.23MB/s    0:00:02\r     65,536  90%    1.23MB/s    0:00:01\r     72,817 100%    1.23MB/s    0:00:00 (xfr#1, to-chk=0/1)\n",
+			lines: []string{
+				"     32,768  45%    1.23MB/s    0:00:02",
+				"     65,536  90%    1.23MB/s    0:00:01",
+				"     72,817 100%    1.23MB/s    0:00:00 (xfr#1, to-chk=0/1)",
+			},
+		},
+		{
+			name:   "mixed with file list",
+			output: "sending incremental file list\nbackup.dump\n\r      1,024  10%\r",
+			lines:  []string{"sending incremental file list", "backup.dump", "", "      1,024  10%"},
+		},
+		{
+			name:   "partial last line",
+			output: "      1,024  10%\r      2,0",
+			lines:  []string{"      1,024  10%", "      2,0"},
+		},
+		{
+			name:   "empty",
+			output: "",
+			lines:  nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scanner := bufio.NewScanner(strings.NewReader(tt.output))
+			scanner.Split(scanProgressLines)
+			var lines []string
+			for scanner.Scan() {
+				lines = append(lines, scanner.Text())
+			}
+			if err := scanner.Err(); err != nil {
+				t.Fatalf("scan failed: %v", err)
+			}
+			if !slices.Equal(lines, tt.lines) {
+				t.Errorf("lines = %q, want %q", lines, tt.lines)
+			}
+		})
+	}
+}
+
+// A progress line split across reads is only returned once it is complete
+func TestScanProgressLinesPartialRead(t *testing.T) {
+	advance, token, err := scanProgressLines([]byte("     32,76"), false)
+	if advance != 0 || token != nil || err != nil {
+		t.Fatalf("partial line = %d, %q, %v, want a request for more data", advance, token, err)
+	}
+	advance, token, _ = scanProgressLines([]byte("     32,768  45%\r     65"), false)
+	if advance != 17 || string(token) != "     32,768  45%" {
+		t.Fatalf("complete line = %d, %q", advance, token)
+	}
+}
+
+func TestEstimateTotal(t *testing.T) {
+	tests := []struct {
+		transferred int64
+		percent     int
+		total       int64
+	}{
+		{32768, 45, 72817},
+		{1073741824, 100, 1073741824},
+		{1024, 0, 0},
+	}
+	for _, tt := range tests {
+		if total := estimateTotal(tt.transferred, tt.percent); total != tt.total {
+			t.Errorf("estimateTotal(%d, %d) = %d, want %d", tt.transferred, tt.percent, total, tt.total)
+		}
+	}
+}
@@ -8,8 +8,6 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
-	"strconv"
 	"strings"
 	"time"
 
@@ -28,7 +26,7 @@ func NewRsyncClient(cfg *config.SSHConfig, logger *slog.Logger) *RsyncClient {
 	}
 }
 
-func (r *RsyncClient) DownloadFile(remotePath, localPath string, timeout time.Duration, progressFn func(int64, int64)) error {
+func (r *RsyncClient) DownloadFile(ctx context.Context, remotePath, localPath string, timeout time.Duration, progressFn func(int64, int64)) error {
 	// Ensure local directory exists
 	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
 		return fmt.Errorf("failed to create local directory: %w", err)
@@ -39,19 +37,19 @@ func (r *RsyncClient) DownloadFile(remotePath, localPath string, timeout time.Du
 	remoteSpec := fmt.Sprintf("%s@%s:%s", r.config.Username, r.config.Host, remotePath)
 	
 	args := []string{
-		"-avz",          // archive, verbose, compress
-		"--progress",    // show progress
+		"-az",           // archive, compress
 		"--partial",     // keep partial files
 		"-e", sshCmd,    // SSH command
 		remoteSpec,
 		localPath,
 	}
+	args = append(progressArgs, args...)
 
 	r.logger.Info("Starting rsync transfer",
 		slog.String("remote", remotePath),
 		slog.String("local", localPath))
 
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
 	cmd := exec.CommandContext(ctx, "rsync", args...)
@@ -72,35 +70,23 @@ func (r *RsyncClient) DownloadFile(remotePath, localPath string, timeout time.Du
 		return fmt.Errorf("failed to start rsync: %w", err)
 	}
 
-	// Parse progress output
-	progressRegex := regexp.MustCompile(`\s+(\d+)\s+(\d+)%`)
+	// Parse progress output. The remote size isn't known up front, so the total is
+	// estimated from each update's percentage.
 	scanner := bufio.NewScanner(stdout)
+	scanner.Split(scanProgressLines)
 	
 	go func() {
-		var totalSize int64
 		for scanner.Scan() {
 			line := scanner.Text()
-			r.logger.Debug("rsync output", slog.String("line", line))
-			
-			// Parse progress info
-			if matches := progressRegex.FindStringSubmatch(line); len(matches) >= 3 {
-				if transferred, err := strconv.ParseInt(matches[1], 10, 64); err == nil {
-					if progressFn != nil && totalSize > 0 {
-						progressFn(transferred, totalSize)
-					}
+			transferred, percent, ok := parseProgress(line)
+			if !ok {
+				if strings.TrimSpace(line) != "" {
+					r.logger.Debug("rsync output", slog.String("line", line))
 				}
+				continue
 			}
-			
-			// Try to extract total size from initial output
-			if strings.Contains(line, "total size") {
-				parts := strings.Fields(line)
-				for i, part := range parts {
-					if part == "size" && i+2 < len(parts) {
-						if size, err := strconv.ParseInt(strings.ReplaceAll(parts[i+2], ",", ""), 10, 64); err == nil {
-							totalSize = size
-						}
-					}
-				}
+			if totalSize := estimateTotal(transferred, percent); progressFn != nil && totalSize > 0 {
+				progressFn(transferred, totalSize)
 			}
 		}
 	}()
@@ -120,6 +106,9 @@ func (r *RsyncClient) DownloadFile(remotePath, localPath string, timeout time.Du
 		if ctx.Err() == context.DeadlineExceeded {
 			return fmt.Errorf("rsync timed out after %v", timeout)
 		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("rsync canceled: %w", ctx.Err())
+		}
 		return fmt.Errorf("rsync failed: %w\nstderr: %s", err, stderrOutput)
 	}
 
@@ -141,7 +130,7 @@ func (r *RsyncClient) DownloadFile(remotePath, localPath string, timeout time.Du
 	return nil
 }
 
-func (r *RsyncClient) UploadFile(localPath, remotePath string, timeout time.Duration, progressFn func(int64, int64)) error {
+func (r *RsyncClient) UploadFile(ctx context.Context, localPath, remotePath string, timeout time.Duration, progressFn func(int64, int64)) error {
 	// Verify local file exists
 	stat, err := os.Stat(localPath)
 	if err != nil {
@@ -153,20 +142,20 @@ func (r *RsyncClient) UploadFile(localPath, remotePath string, timeout time.Dura
 	remoteSpec := fmt.Sprintf("%s@%s:%s", r.config.Username, r.config.Host, remotePath)
 	
 	args := []string{
-		"-avz",          // archive, verbose, compress
-		"--progress",    // show progress
+		"-az",           // archive, compress
 		"--partial",     // keep partial files
 		"-e", sshCmd,    // SSH command
 		localPath,
 		remoteSpec,
 	}
+	args = append(progressArgs, args...)
 
 	r.logger.Info("Starting rsync upload",
 		slog.String("local", localPath),
 		slog.String("remote", remotePath),
 		slog.Int64("size", stat.Size()))
 
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
 	cmd := exec.CommandContext(ctx, "rsync", args...)
@@ -188,22 +177,22 @@ func (r *RsyncClient) UploadFile(localPath, remotePath string, timeout time.Dura
 	}
 
 	// Parse progress output
-	progressRegex := regexp.MustCompile(`\s+(\d+)\s+(\d+)%`)
 	scanner := bufio.NewScanner(stdout)
+	scanner.Split(scanProgressLines)
 	
 	go func() {
 		totalSize := stat.Size()
 		for scanner.Scan() {
 			line := scanner.Text()
-			r.logger.Debug("rsync output", slog.String("line", line))
-			
-			// Parse progress info
-			if matches := progressRegex.FindStringSubmatch(line); len(matches) >= 3 {
-				if transferred, err := strconv.ParseInt(matches[1], 10, 64); err == nil {
-					if progressFn != nil {
-						progressFn(transferred, totalSize)
-					}
+			transferred, _, ok := parseProgress(line)
+			if !ok {
+				if strings.TrimSpace(line) != "" {
+					r.logger.Debug("rsync output", slog.String("line", line))
 				}
+				continue
+			}
+			if progressFn != nil {
+				progressFn(transferred, totalSize)
 			}
 		}
 	}()
@@ -223,6 +212,9 @@ func (r *RsyncClient) UploadFile(localPath, remotePath string, timeout time.Dura
 		if ctx.Err() == context.DeadlineExceeded {
 			return fmt.Errorf("rsync timed out after %v", timeout)
 		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("rsync canceled: %w", ctx.Err())
+		}
 		return fmt.Errorf("rsync failed: %w\nstderr: %s", err, stderrOutput)
 	}
 
@@ -0,0 +1,145 @@
+package runlog
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// maxOutputSize caps each captured command output so a verbose pg_restore cannot exhaust memory
+const maxOutputSize = 1024 * 1024
+
+// maxLogSize caps the captured run log the same way; a long run keeps its most recent lines
+const maxLogSize = 16 * 1024 * 1024
+
+// Recorder captures the log lines and command outputs of a single run so they can be
+// preserved as evidence when the run fails
+type Recorder struct {
+	mu      sync.Mutex
+	log     bytes.Buffer
+	outputs []capturedOutput
+}
+
+type capturedOutput struct {
+	name   string
+	output string
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// Handler returns a slog.Handler that records every log record before passing it to next
+func (r *Recorder) Handler(next slog.Handler) slog.Handler {
+	return &teeHandler{
+		next:     next,
+		recorder: r,
+		capture:  slog.NewTextHandler(&recorderWriter{recorder: r}, &slog.HandlerOptions{Level: slog.LevelDebug}),
+	}
+}
+
+// Reset discards everything captured so far; called at the start of each run
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.log.Reset()
+	r.outputs = nil
+}
+
+// RecordOutput stores the output of an external command under the given name
+func (r *Recorder) RecordOutput(name, output string) {
+	if output == "" {
+		return
+	}
+	if len(output) > maxOutputSize {
+		output = output[len(output)-maxOutputSize:]
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.outputs = append(r.outputs, capturedOutput{name: name, output: output})
+}
+
+// Tail returns the last n lines of the run log
+func (r *Recorder) Tail(n int) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if n <= 0 || r.log.Len() == 0 {
+		return nil
+	}
+	lines := strings.Split(strings.TrimSuffix(r.log.String(), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
+
+// Files returns the captured run log and command outputs keyed by file name
+func (r *Recorder) Files() map[string][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	files := map[string][]byte{
+		"run.log": append([]byte(nil), r.log.Bytes()...),
+	}
+	for i, out := range r.outputs {
+		files[fmt.Sprintf("outputs/%02d_%s.txt", i+1, out.name)] = []byte(out.output)
+	}
+	return files
+}
+
+type recorderWriter struct {
+	recorder *Recorder
+}
+
+func (w *recorderWriter) Write(p []byte) (int, error) {
+	w.recorder.mu.Lock()
+	defer w.recorder.mu.Unlock()
+	n, err := w.recorder.log.Write(p)
+	if excess := w.recorder.log.Len() - maxLogSize; excess > 0 {
+		// Drop whole lines, so the log still starts with a complete record
+		if i := bytes.IndexByte(w.recorder.log.Bytes()[excess:], '\n'); i >= 0 {
+			excess += i + 1
+		}
+		w.recorder.log.Next(excess)
+	}
+	return n, err
+}
+
+type teeHandler struct {
+	next     slog.Handler
+	recorder *Recorder
+	capture  slog.Handler
+}
+
+func (h *teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	// Always capture debug output for incidents, even when the console log level is higher
+	return true
+}
+
+func (h *teeHandler) Handle(ctx context.Context, record slog.Record) error {
+	h.capture.Handle(ctx, record)
+	if h.next.Enabled(ctx, record.Level) {
+		return h.next.Handle(ctx, record)
+	}
+	return nil
+}
+
+func (h *teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &teeHandler{
+		next:     h.next.WithAttrs(attrs),
+		recorder: h.recorder,
+		capture:  h.capture.WithAttrs(attrs),
+	}
+}
+
+func (h *teeHandler) WithGroup(name string) slog.Handler {
+	return &teeHandler{
+		next:     h.next.WithGroup(name),
+		recorder: h.recorder,
+		capture:  h.capture.WithGroup(name),
+	}
+}
@@ -0,0 +1,82 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// checkTasks checks what each scheduled task needs before its first run, so a broken SSH key
+// or bucket policy shows up on start rather than when the task fires: the SSH connection,
+// pg_dump or pg_restore and the bucket. Failures are logged, notified or fail the start as
+// scheduler.startup_check says.
+func (s *Scheduler) checkTasks(ctx context.Context) error {
+	mode := s.config.Scheduler.StartupCheck
+	if mode == "off" {
+		return nil
+	}
+
+	var tasks []string
+	for _, task := range scheduledTasks(s.config) {
+		tasks = append(tasks, task.name)
+	}
+	// Chained tasks run as part of a backup, but need their own access
+	for _, chained := range []string{"restore", "cleanup"} {
+		if s.config.ChainsTask(chained) && !slices.Contains(tasks, chained) {
+			tasks = append(tasks, chained)
+		}
+	}
+	if len(tasks) == 0 {
+		return nil
+	}
+
+	s.logger.Info("Checking scheduled tasks", slog.Int("tasks", len(tasks)))
+	s.notifyService("STATUS=Checking scheduled tasks")
+	var errs []error
+	for _, task := range tasks {
+		err := s.checkTask(ctx, task)
+		if err == nil {
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		s.logger.Error(fmt.Sprintf("Startup check of %s failed", task),
+			slog.String("task", task),
+			slog.String("error", err.Error()))
+		errs = append(errs, fmt.Errorf("%s: %w", task, err))
+		if mode == "alert" {
+			if err := s.notifier(s.scheduleFor(task)).SendCheckFailed(task, s.config.Postgres.Database, err); err != nil {
+				s.logger.Warn("Failed to send startup check notification", slog.String("error", err.Error()))
+			}
+		}
+	}
+
+	if len(errs) == 0 {
+		s.logger.Info("Scheduled tasks checked successfully")
+		return nil
+	}
+	if mode == "fail" {
+		return fmt.Errorf("startup check failed: %w", errors.Join(errs...))
+	}
+	s.logger.Warn("Starting with failed startup checks, the affected tasks will fail when they run",
+		slog.Int("failed", len(errs)))
+	return nil
+}
+
+// checkTask checks a single task, see checkTasks
+func (s *Scheduler) checkTask(ctx context.Context, task string) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	switch task {
+	case "restore":
+		return s.restoreManager.Validate(ctx)
+	case "cleanup":
+		return s.s3Client.ValidateBucket(ctx)
+	}
+	return s.backupManagers[task].Validate()
+}
@@ -0,0 +1,177 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/hra42/pg_backup/internal/config"
+	"github.com/hra42/pg_backup/internal/trigger"
+)
+
+// errBlackout ends a scheduled run that fell into a blackout window without running the task
+var errBlackout = errors.New("run skipped during blackout window")
+
+// errSuperseded cancels a run of a task with overlap "cancel" when its next run starts
+var errSuperseded = errors.New("canceled by the next scheduled run")
+
+// errDraining ends a scheduled run that became due while the scheduler shuts down
+var errDraining = errors.New("scheduler is shutting down")
+
+// errShutdownGrace cancels the runs still going when scheduler.shutdown_grace is over
+var errShutdownGrace = errors.New("scheduler shut down after shutdown_grace")
+
+// activeRun is a run of a task in progress
+type activeRun struct {
+	cancel  context.CancelCauseFunc
+	done    chan struct{}
+	started time.Time
+}
+
+// dispatch wraps a task with the schedule's run policies: overlap "cancel", max_runtime,
+// jitter, blackout windows and the scheduler lease of scheduler.ha. The blackout and lease
+// checks follow the jitter, so a delayed start can't slip into a window.
+func (s *Scheduler) dispatch(name string, schedule *config.ScheduleConfig, task func(ctx context.Context) error) func() error {
+	return func() (err error) {
+		if s.draining.Load() {
+			s.logger.Info(fmt.Sprintf("Skipped scheduled %s, the scheduler is shutting down", name))
+			return errDraining
+		}
+
+		ctx, cancel := context.WithCancelCause(s.runCtx)
+		defer cancel(nil)
+		run := &activeRun{cancel: cancel, done: make(chan struct{}), started: time.Now()}
+		s.startRun(name, run)
+		defer s.finishRun(name, run)
+		s.recordStart(name, run.started)
+		defer func() {
+			s.recordResult(name, run.started, err)
+		}()
+
+		if schedule.MaxRuntime > 0 {
+			var cancelTimeout context.CancelFunc
+			ctx, cancelTimeout = context.WithTimeoutCause(ctx, schedule.MaxRuntime,
+				fmt.Errorf("%s exceeded max_runtime of %s", name, schedule.MaxRuntime))
+			defer cancelTimeout()
+		}
+
+		if schedule.Jitter > 0 {
+			delay := rand.N(schedule.Jitter)
+			s.logger.Info(fmt.Sprintf("Delaying %s by jitter", name), slog.Duration("delay", delay.Round(time.Second)))
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return context.Cause(ctx)
+			}
+		}
+
+		now := time.Now().In(schedule.Location())
+		for _, window := range schedule.Blackouts {
+			if window.Contains(now) {
+				s.logger.Warn(fmt.Sprintf("Skipped scheduled %s during blackout window", name),
+					slog.String("task", name),
+					slog.String("window", window.Name))
+				return errBlackout
+			}
+		}
+		if entry, ok := schedule.ExcludedOn(now); ok {
+			s.logger.Warn(fmt.Sprintf("Skipped scheduled %s on excluded date", name),
+				slog.String("task", name),
+				slog.String("exclude_date", entry))
+			return errBlackout
+		}
+
+		if s.config.HAEnabled() && !s.leading.Load() {
+			s.logger.Info(fmt.Sprintf("Skipped scheduled %s, another instance holds the scheduler lease", name),
+				slog.String("task", name))
+			return errStandby
+		}
+
+		err = task(ctx)
+		// Name why the run was stopped, the task itself only sees a canceled context
+		if cause := context.Cause(ctx); err != nil && cause != nil && !errors.Is(cause, context.Canceled) {
+			s.logger.Error(fmt.Sprintf("Stopped scheduled %s", name),
+				slog.String("task", name),
+				slog.String("reason", cause.Error()),
+				slog.Duration("runtime", time.Since(run.started).Round(time.Second)))
+			return fmt.Errorf("%w: %w", cause, err)
+		}
+		return err
+	}
+}
+
+// startRun registers a run of a task. With overlap "cancel" a previous run still going is
+// canceled first, and the new run waits until it has cleaned up.
+func (s *Scheduler) startRun(name string, run *activeRun) {
+	s.activeMu.Lock()
+	previous := s.active[name]
+	s.active[name] = run
+	s.activeMu.Unlock()
+	s.reportServiceStatus()
+
+	if previous == nil {
+		return
+	}
+	s.logger.Warn(fmt.Sprintf("Previous %s still running, canceling it", name),
+		slog.String("task", name),
+		slog.Duration("runtime", time.Since(previous.started).Round(time.Second)))
+	previous.cancel(errSuperseded)
+	<-previous.done
+}
+
+// drain waits up to scheduler.shutdown_grace for running tasks and triggered runs to finish,
+// while no new runs start
+func (s *Scheduler) drain(triggerServer *trigger.Server) {
+	grace := s.config.Scheduler.ShutdownGrace
+	s.draining.Store(true)
+
+	s.activeMu.Lock()
+	running := slices.Sorted(maps.Keys(s.active))
+	done := make([]chan struct{}, 0, len(s.active))
+	for _, run := range s.active {
+		done = append(done, run.done)
+	}
+	s.activeMu.Unlock()
+
+	s.logger.Info("Waiting for running tasks to finish",
+		slog.String("tasks", strings.Join(running, ", ")),
+		slog.Duration("shutdown_grace", grace))
+	s.notifyService("STOPPING=1\nSTATUS=Waiting up to " + grace.String() + " for running tasks to finish")
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	for _, runDone := range done {
+		select {
+		case <-runDone:
+		case <-ctx.Done():
+		}
+	}
+	// Stops accepting requests and waits for the triggered runs still being answered
+	if triggerServer != nil {
+		if err := triggerServer.Shutdown(ctx); err != nil && ctx.Err() == nil {
+			s.logger.Warn("Failed to stop trigger endpoint", slog.String("error", err.Error()))
+		}
+	}
+
+	if ctx.Err() != nil {
+		s.logger.Warn("Running tasks didn't finish within shutdown_grace, canceling them")
+		return
+	}
+	s.logger.Info("Running tasks finished")
+}
+
+func (s *Scheduler) finishRun(name string, run *activeRun) {
+	s.activeMu.Lock()
+	if s.active[name] == run {
+		delete(s.active, name)
+	}
+	s.activeMu.Unlock()
+	s.reportServiceStatus()
+	close(run.done)
+}
@@ -0,0 +1,93 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/hra42/pg_backup/internal/lock"
+)
+
+// errStandby ends a scheduled run on an instance that doesn't hold the scheduler lease
+var errStandby = errors.New("run left to the active instance")
+
+// errLeaseLost cancels the runs of an instance that lost the scheduler lease
+var errLeaseLost = errors.New("scheduler lease lost to another instance")
+
+// leaseName names the lease object of the configured server, shared by all instances
+func (s *Scheduler) leaseName() string {
+	return lock.Name(s.config.Postgres.Host, s.config.Postgres.Port, "scheduler")
+}
+
+// holdLease competes for the scheduler lease until ctx is done. The holder renews it every
+// third of the lease; the others try to take it over, which succeeds once the holder hasn't
+// renewed it for a whole lease. An instance that can't renew for a whole lease steps down and
+// cancels its runs, as another instance may have taken over by then.
+func (s *Scheduler) holdLease(ctx context.Context) {
+	lease := s.config.Scheduler.HA.Lease
+	name := s.leaseName()
+	owner := s.leaseOwner
+
+	ticker := time.NewTicker(lease / 3)
+	defer ticker.Stop()
+	var renewed time.Time
+	for {
+		if s.leading.Load() {
+			err := s.s3Client.RenewLock(ctx, name, owner)
+			switch {
+			case err == nil:
+				renewed = time.Now()
+			case errors.Is(err, lock.ErrLocked) || time.Since(renewed) >= lease:
+				s.stepDown(err)
+			case ctx.Err() == nil:
+				s.logger.Warn("Failed to renew scheduler lease", slog.String("error", err.Error()))
+			}
+		} else {
+			err := s.s3Client.AcquireLock(ctx, name, owner, lease)
+			switch {
+			case err == nil:
+				renewed = time.Now()
+				s.leading.Store(true)
+				s.logger.Info("Holding the scheduler lease, this instance runs the scheduled tasks")
+				s.reportServiceStatus()
+			case !errors.Is(err, lock.ErrLocked) && ctx.Err() == nil:
+				s.logger.Warn("Failed to acquire scheduler lease", slog.String("error", err.Error()))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// stepDown gives up the lead after the lease was lost and cancels the runs in progress
+func (s *Scheduler) stepDown(err error) {
+	s.leading.Store(false)
+	s.logger.Error("Lost the scheduler lease, standing by",
+		slog.String("lease", s.leaseName()),
+		slog.String("error", err.Error()))
+
+	s.activeMu.Lock()
+	for _, run := range s.active {
+		run.cancel(errLeaseLost)
+	}
+	s.activeMu.Unlock()
+	s.reportServiceStatus()
+}
+
+// releaseLease removes the lease object on shutdown, so a standby instance takes over without
+// waiting for the lease to run out. A lease another instance has taken over is left alone.
+func (s *Scheduler) releaseLease() {
+	if !s.leading.Swap(false) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := s.s3Client.ReleaseLock(ctx, s.leaseName(), s.leaseOwner); err != nil {
+		s.logger.Warn("Failed to release scheduler lease", slog.String("error", err.Error()))
+	}
+}
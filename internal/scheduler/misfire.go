@@ -0,0 +1,50 @@
+package scheduler
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+	"github.com/hra42/pg_backup/internal/config"
+)
+
+// misfireGrace is how late a recorded due time may be before the run counts as missed, so a
+// quick restart around a due time doesn't report it
+const misfireGrace = time.Minute
+
+// checkMisfire applies the schedule's misfire policy if the task was due while the scheduler
+// wasn't running. Must be called before the job's next run is recorded, i.e. before the
+// scheduler starts.
+func (s *Scheduler) checkMisfire(task string, job gocron.Job, schedule *config.ScheduleConfig) {
+	s.stateMu.Lock()
+	dueAt := s.state.Tasks[task].NextRun
+	s.stateMu.Unlock()
+	if dueAt.IsZero() || time.Since(dueAt) < misfireGrace {
+		return
+	}
+
+	s.logger.Warn(fmt.Sprintf("Missed scheduled %s run while the scheduler was down", task),
+		slog.String("task", task),
+		slog.Time("due_at", dueAt),
+		slog.String("misfire", schedule.Misfire))
+
+	switch schedule.Misfire {
+	case "run":
+		// run_on_start already runs the task once
+		if schedule.RunOnStart {
+			return
+		}
+		s.logger.Info(fmt.Sprintf("Running missed %s now", task))
+		go func() {
+			time.Sleep(2 * time.Second) // Same delay as run_on_start
+			if err := job.RunNow(); err != nil {
+				s.logger.Error(fmt.Sprintf("Failed to run missed %s", task), slog.String("error", err.Error()))
+			}
+		}()
+	case "alert":
+		if err := s.notifier(schedule).SendRunMissed(task, s.config.Postgres.Database, dueAt); err != nil {
+			s.logger.Warn("Failed to send missed run notification", slog.String("error", err.Error()))
+		}
+	}
+}
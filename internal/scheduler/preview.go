@@ -0,0 +1,177 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+	"github.com/hra42/pg_backup/internal/config"
+)
+
+// previewRuns is how many fire times -schedule -dry-run shows per task
+const previewRuns = 5
+
+// scheduledTask is a task the configuration schedules
+type scheduledTask struct {
+	name     string
+	schedule *config.ScheduleConfig
+}
+
+// scheduledTasks returns the enabled scheduled tasks of cfg, in the order the scheduler adds
+// them
+func scheduledTasks(cfg *config.Config) []scheduledTask {
+	var tasks []scheduledTask
+	for _, backupSchedule := range cfg.BackupSchedules() {
+		tasks = append(tasks, scheduledTask{backupSchedule.Task, backupSchedule.Schedule})
+	}
+	if cfg.Scheduler.Restore != nil && cfg.Scheduler.Restore.Enabled {
+		tasks = append(tasks, scheduledTask{"restore", cfg.Scheduler.Restore})
+	}
+	if cfg.Scheduler.Cleanup != nil && cfg.Scheduler.Cleanup.Enabled {
+		tasks = append(tasks, scheduledTask{"cleanup", cfg.Scheduler.Cleanup})
+	}
+	return tasks
+}
+
+// PreviewRun is an upcoming fire time of a task
+type PreviewRun struct {
+	Time    time.Time `json:"time"`
+	Skipped string    `json:"skipped,omitempty"` // Why the run would be skipped, e.g. "blackout month-end close"
+}
+
+// TaskPreview is the upcoming fire times of one scheduled task, as shown by -schedule -dry-run
+type TaskPreview struct {
+	Task       string        `json:"task"`
+	Type       string        `json:"type"`
+	Expression string        `json:"expression"`
+	Timezone   string        `json:"timezone,omitempty"`
+	Jitter     time.Duration `json:"jitter,omitempty"` // Runs start up to this much later
+	NextRuns   []PreviewRun  `json:"next_runs"`
+	Error      string        `json:"error,omitempty"`
+}
+
+// Preview builds the configured schedules the way the scheduler does, in a scheduler of its
+// own whose tasks do nothing, and returns the next fire times of each. A schedule that can't
+// be built or never fires gets an error instead, so it is caught before it's deployed.
+func Preview(cfg *config.Config) ([]TaskPreview, error) {
+	preview, err := gocron.NewScheduler()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create scheduler: %w", err)
+	}
+	defer preview.Shutdown()
+
+	s := &Scheduler{config: cfg}
+	tasks := scheduledTasks(cfg)
+	previews := make([]TaskPreview, len(tasks))
+	jobs := make([]gocron.Job, len(tasks))
+	for i, task := range tasks {
+		previews[i] = TaskPreview{
+			Task:       task.name,
+			Type:       task.schedule.Type,
+			Expression: task.schedule.Expression,
+			Timezone:   task.schedule.Timezone,
+			Jitter:     task.schedule.Jitter,
+			NextRuns:   []PreviewRun{},
+		}
+		jobDef, err := s.createJobDefinition(task.schedule)
+		if err == nil {
+			jobs[i], err = preview.NewJob(jobDef, gocron.NewTask(func() {}))
+		}
+		if err != nil {
+			previews[i].Error = err.Error()
+		}
+	}
+
+	// Jobs only know their next runs once the scheduler runs
+	preview.Start()
+	for i, job := range jobs {
+		if job == nil {
+			continue
+		}
+		times, err := job.NextRuns(previewRuns)
+		if err != nil {
+			previews[i].Error = err.Error()
+			continue
+		}
+		location := tasks[i].schedule.Location()
+		for _, next := range times {
+			if next.IsZero() {
+				continue
+			}
+			run := PreviewRun{Time: next.In(location)}
+			for _, window := range tasks[i].schedule.Blackouts {
+				if window.Contains(run.Time) {
+					run.Skipped = "blackout " + window.Name
+					break
+				}
+			}
+			if entry, ok := tasks[i].schedule.ExcludedOn(run.Time); ok && run.Skipped == "" {
+				run.Skipped = "excluded " + entry
+			}
+			previews[i].NextRuns = append(previews[i].NextRuns, run)
+		}
+		if len(previews[i].NextRuns) == 0 {
+			previews[i].Error = "the schedule never fires"
+		}
+	}
+	return previews, nil
+}
+
+// PreviewError returns an error naming the tasks whose schedule failed in previews, or nil
+func PreviewError(previews []TaskPreview) error {
+	var errs []error
+	for _, preview := range previews {
+		if preview.Error != "" {
+			errs = append(errs, fmt.Errorf("%s: %s", preview.Task, preview.Error))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// WritePreview prints the fire times of Preview per task, or as a JSON array with format "json"
+func WritePreview(w io.Writer, previews []TaskPreview, format string) error {
+	if format == "json" {
+		if previews == nil {
+			previews = []TaskPreview{}
+		}
+		data, err := json.MarshalIndent(previews, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	}
+
+	if len(previews) == 0 {
+		_, err := fmt.Fprintln(w, "No scheduled tasks configured")
+		return err
+	}
+	for i, preview := range previews {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		schedule := preview.Type + " " + preview.Expression
+		if preview.Timezone != "" {
+			schedule += " (" + preview.Timezone + ")"
+		}
+		fmt.Fprintf(w, "%s: %s\n", preview.Task, schedule)
+		if preview.Error != "" {
+			fmt.Fprintf(w, "  error: %s\n", preview.Error)
+			continue
+		}
+		for _, run := range preview.NextRuns {
+			line := "  " + run.Time.Format("2006-01-02 15:04:05 MST Mon")
+			if run.Skipped != "" {
+				line += " (skipped, " + run.Skipped + ")"
+			}
+			fmt.Fprintln(w, line)
+		}
+		if preview.Jitter > 0 {
+			fmt.Fprintf(w, "  each run starts up to %s later (jitter)\n", preview.Jitter)
+		}
+	}
+	return nil
+}
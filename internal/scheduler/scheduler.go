@@ -2,51 +2,91 @@ package scheduler
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-co-op/gocron/v2"
 	"github.com/google/uuid"
 	"github.com/hra42/pg_backup/internal/backup"
 	"github.com/hra42/pg_backup/internal/config"
+	"github.com/hra42/pg_backup/internal/lock"
+	"github.com/hra42/pg_backup/internal/notification"
 	"github.com/hra42/pg_backup/internal/restore"
+	"github.com/hra42/pg_backup/internal/retention"
 	"github.com/hra42/pg_backup/internal/storage"
+	"github.com/hra42/pg_backup/internal/trigger"
 )
 
 type Scheduler struct {
 	config        *config.Config
 	logger        *slog.Logger
 	scheduler     gocron.Scheduler
-	backupManager *backup.BackupManager
+	backupManagers map[string]*backup.BackupManager // Per backup task, see config.BackupSchedules
 	restoreManager *restore.RestoreManager
 	s3Client      *storage.S3Client
 	jobs          map[string]uuid.UUID // Map task name to job ID
+	runCtx        context.Context      // Canceled on shutdown, so running jobs stop and clean up
+	notificationQueue *notification.Queue // Failed notification deliveries, retried while running; nil without notification.retry
+
+	skippedMu sync.Mutex
+	skipped   map[string]int // Runs skipped per task because the previous run was still going
+
+	stateMu sync.Mutex
+	state   scheduleState // Due times per task, persisted to detect runs missed while down
+
+	activeMu sync.Mutex
+	active   map[string]*activeRun // Running run per task
+
+	restoreMu sync.Mutex // Serializes runs of restoreManager
+	cleanupMu sync.Mutex // Serializes scheduled and triggered cleanups
+
+	leading    atomic.Bool // Holds the scheduler lease of scheduler.ha
+	leaseOwner []byte      // Written into the lease object while this instance holds it
+	draining   atomic.Bool // Shutting down; no new runs start
 }
 
 func NewScheduler(cfg *config.Config, logger *slog.Logger) (*Scheduler, error) {
-	s, err := gocron.NewScheduler()
-	if err != nil {
-		return nil, fmt.Errorf("failed to create scheduler: %w", err)
+	scheduler := &Scheduler{
+		config:             cfg,
+		logger:             logger,
+		jobs:               make(map[string]uuid.UUID),
+		runCtx:             context.Background(),
+		backupManagers:     make(map[string]*backup.BackupManager),
+		skipped:            make(map[string]int),
+		active:             make(map[string]*activeRun),
+		notificationQueue:  notification.NewQueue(cfg, logger),
+		leaseOwner:         lock.Owner(uuid.NewString()),
 	}
 
-	scheduler := &Scheduler{
-		config:    cfg,
-		logger:    logger,
-		scheduler: s,
-		jobs:      make(map[string]uuid.UUID),
+	// Running jobs are canceled on shutdown and get this long to clean up after themselves
+	s, err := gocron.NewScheduler(
+		gocron.WithSchedulerMonitor(&overlapMonitor{scheduler: scheduler}),
+		gocron.WithStopTimeout(45*time.Second),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create scheduler: %w", err)
 	}
+	scheduler.scheduler = s
 
 	// Initialize managers as needed
-	if cfg.Backup.Schedule != nil && cfg.Backup.Schedule.Enabled {
+	// Each backup task gets its own manager, so tasks on different schedules can run at once
+	for _, backupSchedule := range cfg.BackupSchedules() {
 		backupManager, err := backup.NewBackupManager(cfg, logger)
 		if err != nil {
 			return nil, fmt.Errorf("failed to initialize backup manager: %w", err)
 		}
-		scheduler.backupManager = backupManager
+		backupManager.SetDatabases(backupSchedule.Databases)
+		backupManager.SetNotification(cfg.NotificationFor(backupSchedule.Schedule))
+		scheduler.backupManagers[backupSchedule.Task] = backupManager
 	}
 
-	if cfg.Restore.Enabled && cfg.Restore.Schedule != nil && cfg.Restore.Schedule.Enabled {
+	triggerEnabled := cfg.Trigger != nil && cfg.Trigger.Enabled
+	if cfg.Restore.Enabled && (cfg.Scheduler.Restore != nil && cfg.Scheduler.Restore.Enabled || cfg.ChainsTask("restore") || triggerEnabled) {
 		restoreManager, err := restore.NewRestoreManager(cfg, logger)
 		if err != nil {
 			return nil, fmt.Errorf("failed to initialize restore manager: %w", err)
@@ -54,10 +94,10 @@ func NewScheduler(cfg *config.Config, logger *slog.Logger) (*Scheduler, error) {
 		scheduler.restoreManager = restoreManager
 	}
 
-	if cfg.Cleanup != nil && cfg.Cleanup.Schedule != nil && cfg.Cleanup.Schedule.Enabled {
+	if cfg.Scheduler.Cleanup != nil && cfg.Scheduler.Cleanup.Enabled || cfg.ChainsTask("cleanup") || cfg.HAEnabled() || triggerEnabled {
 		s3Client, err := storage.NewS3Client(&cfg.S3, logger)
 		if err != nil {
-			return nil, fmt.Errorf("failed to initialize S3 client for cleanup: %w", err)
+			return nil, fmt.Errorf("failed to initialize S3 client: %w", err)
 		}
 		scheduler.s3Client = s3Client
 	}
@@ -67,64 +107,139 @@ func NewScheduler(cfg *config.Config, logger *slog.Logger) (*Scheduler, error) {
 
 func (s *Scheduler) Start(ctx context.Context) error {
 	s.logger.Info("Starting scheduler")
+	s.runCtx = ctx
+	cancelRuns := context.CancelCauseFunc(func(error) {})
+	if s.config.Scheduler.ShutdownGrace > 0 {
+		// Running tasks outlive the shutdown signal by up to the grace period
+		s.runCtx, cancelRuns = context.WithCancelCause(context.WithoutCancel(ctx))
+		defer cancelRuns(nil)
+	}
+	s.loadState()
+
+	// Before taking the lease, so an instance that can't run the tasks leaves them to another
+	if err := s.checkTasks(ctx); err != nil {
+		return err
+	}
 
-	// Schedule backup job if configured
-	if s.config.Backup.Schedule != nil && s.config.Backup.Schedule.Enabled {
-		job, err := s.scheduleJob("backup", s.config.Backup.Schedule, s.runBackup)
+	// Standby instances schedule their jobs too, so they are ready to take over. The lease is
+	// held until running tasks have stopped.
+	if s.config.HAEnabled() {
+		go s.holdLease(s.runCtx)
+	}
+	if s.notificationQueue != nil {
+		go s.retryNotifications(s.runCtx)
+	}
+
+	// Schedule backup jobs if configured
+	for _, backupSchedule := range s.config.BackupSchedules() {
+		task := backupSchedule.Task
+		then := backupSchedule.Schedule.Then
+		job, err := s.scheduleJob(task, backupSchedule.Schedule, func(ctx context.Context) error {
+			if err := s.runBackup(ctx, task); err != nil {
+				return err
+			}
+			return s.runChained(ctx, task, then)
+		})
 		if err != nil {
-			return fmt.Errorf("failed to schedule backup job: %w", err)
+			return fmt.Errorf("failed to schedule %s job: %w", task, err)
 		}
-		s.jobs["backup"] = job.ID()
+		s.jobs[task] = job.ID()
 		s.logger.Info("Backup job scheduled",
 			slog.String("job_id", job.ID().String()),
-			slog.String("type", s.config.Backup.Schedule.Type),
-			slog.String("expression", s.config.Backup.Schedule.Expression))
+			slog.String("task", task),
+			slog.String("databases", strings.Join(backupSchedule.Databases, ", ")),
+			slog.String("type", backupSchedule.Schedule.Type),
+			slog.String("expression", backupSchedule.Schedule.Expression))
 	}
 
 	// Schedule restore job if configured
-	if s.config.Restore.Enabled && s.config.Restore.Schedule != nil && s.config.Restore.Schedule.Enabled {
-		job, err := s.scheduleJob("restore", s.config.Restore.Schedule, s.runRestore)
+	if s.config.Scheduler.Restore != nil && s.config.Scheduler.Restore.Enabled {
+		job, err := s.scheduleJob("restore", s.config.Scheduler.Restore, func(ctx context.Context) error {
+			return s.runRestore(ctx, "restore")
+		})
 		if err != nil {
 			return fmt.Errorf("failed to schedule restore job: %w", err)
 		}
 		s.jobs["restore"] = job.ID()
 		s.logger.Info("Restore job scheduled",
 			slog.String("job_id", job.ID().String()),
-			slog.String("type", s.config.Restore.Schedule.Type),
-			slog.String("expression", s.config.Restore.Schedule.Expression))
+			slog.String("type", s.config.Scheduler.Restore.Type),
+			slog.String("expression", s.config.Scheduler.Restore.Expression))
 	}
 
 	// Schedule cleanup job if configured
-	if s.config.Cleanup != nil && s.config.Cleanup.Schedule != nil && s.config.Cleanup.Schedule.Enabled {
-		job, err := s.scheduleJob("cleanup", s.config.Cleanup.Schedule, s.runCleanup)
+	if s.config.Scheduler.Cleanup != nil && s.config.Scheduler.Cleanup.Enabled {
+		job, err := s.scheduleJob("cleanup", s.config.Scheduler.Cleanup, func(ctx context.Context) error {
+			return s.runCleanup(ctx, "cleanup")
+		})
 		if err != nil {
 			return fmt.Errorf("failed to schedule cleanup job: %w", err)
 		}
 		s.jobs["cleanup"] = job.ID()
 		s.logger.Info("Cleanup job scheduled",
 			slog.String("job_id", job.ID().String()),
-			slog.String("type", s.config.Cleanup.Schedule.Type),
-			slog.String("expression", s.config.Cleanup.Schedule.Expression))
+			slog.String("type", s.config.Scheduler.Cleanup.Type),
+			slog.String("expression", s.config.Scheduler.Cleanup.Expression))
 	}
 
-	if len(s.jobs) == 0 {
+	triggerEnabled := s.config.Trigger != nil && s.config.Trigger.Enabled
+	if len(s.jobs) == 0 && !triggerEnabled {
 		return fmt.Errorf("no scheduled tasks configured")
 	}
 
 	// Start the scheduler
 	s.scheduler.Start()
 
+	// Jobs only know their next run once the scheduler runs
+	for _, job := range s.scheduler.Jobs() {
+		s.recordNextRun(strings.TrimPrefix(job.Name(), "pg_"), job)
+	}
+
 	s.logger.Info("Scheduler started",
 		slog.Int("scheduled_jobs", len(s.jobs)))
+	s.notifyService("READY=1\nSTATUS=Idle")
+	go s.watchdog(s.runCtx)
+
+	serverErr := make(chan error, 1)
+	var triggerServer *trigger.Server
+	if triggerEnabled {
+		tasks := trigger.Tasks{Cleanup: s.triggerCleanup}
+		if s.restoreManager != nil {
+			tasks.Restore = s.triggerRestore
+		}
+		triggerServer = trigger.NewServer(s.runCtx, s.config, s.logger, tasks)
+		go func() {
+			serverErr <- triggerServer.ListenAndServe()
+		}()
+		defer func() {
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := triggerServer.Shutdown(shutdownCtx); err != nil {
+				s.logger.Warn("Failed to stop trigger endpoint", slog.String("error", err.Error()))
+			}
+		}()
+	}
 
 	// Wait for context cancellation
-	<-ctx.Done()
+	select {
+	case <-ctx.Done():
+	case err := <-serverErr:
+		if err != nil {
+			s.Stop()
+			return fmt.Errorf("trigger endpoint failed: %w", err)
+		}
+		<-ctx.Done()
+	}
 
 	s.logger.Info("Stopping scheduler")
+	if s.config.Scheduler.ShutdownGrace > 0 {
+		s.drain(triggerServer)
+		cancelRuns(errShutdownGrace)
+	}
 	return s.Stop()
 }
 
-func (s *Scheduler) scheduleJob(name string, schedule *config.ScheduleConfig, task func() error) (gocron.Job, error) {
+func (s *Scheduler) scheduleJob(name string, schedule *config.ScheduleConfig, task func(ctx context.Context) error) (gocron.Job, error) {
 	// Create job definition based on schedule type
 	jobDef, err := s.createJobDefinition(schedule)
 	if err != nil {
@@ -132,11 +247,8 @@ func (s *Scheduler) scheduleJob(name string, schedule *config.ScheduleConfig, ta
 	}
 
 	// Create the job with error handling
-	job, err := s.scheduler.NewJob(
-		jobDef,
-		gocron.NewTask(task),
+	options := []gocron.JobOption{
 		gocron.WithName(fmt.Sprintf("pg_%s", name)),
-		gocron.WithSingletonMode(gocron.LimitModeReschedule),
 		gocron.WithEventListeners(
 			gocron.AfterJobRuns(func(jobID uuid.UUID, jobName string) {
 				s.afterJobRun(jobID, jobName, name)
@@ -145,18 +257,26 @@ func (s *Scheduler) scheduleJob(name string, schedule *config.ScheduleConfig, ta
 				s.afterJobError(jobID, jobName, name, err)
 			}),
 		),
-	)
+	}
+	// "cancel" lets the new run start, and dispatch stops the previous one
+	if schedule.Overlap != "cancel" {
+		options = append(options, gocron.WithSingletonMode(limitMode(schedule.Overlap)))
+	}
+	job, err := s.scheduler.NewJob(jobDef, gocron.NewTask(s.dispatch(name, schedule, task)), options...)
 
 	if err != nil {
 		return nil, err
 	}
 
-	// If run on start is enabled, trigger the job immediately
+	s.checkMisfire(name, job, schedule)
+
+	// If run on start is enabled, trigger the job immediately. RunNow goes through the
+	// scheduler so the overlap policy applies to it as well.
 	if schedule.RunOnStart {
 		s.logger.Info(fmt.Sprintf("Running %s on start as configured", name))
 		go func() {
 			time.Sleep(2 * time.Second) // Small delay to ensure everything is initialized
-			if err := task(); err != nil {
+			if err := job.RunNow(); err != nil {
 				s.logger.Error(fmt.Sprintf("Failed to run initial %s", name), 
 					slog.String("error", err.Error()))
 			}
@@ -166,15 +286,128 @@ func (s *Scheduler) scheduleJob(name string, schedule *config.ScheduleConfig, ta
 	return job, nil
 }
 
+// limitMode maps a schedule's overlap policy to the gocron singleton mode. "skip" behaves like
+// "reschedule"; the difference is the notification sent by overlapMonitor.
+func limitMode(overlap string) gocron.LimitMode {
+	if overlap == "wait" {
+		return gocron.LimitModeWait
+	}
+	return gocron.LimitModeReschedule
+}
+
+// scheduleFor returns the schedule configuration of a task
+func (s *Scheduler) scheduleFor(task string) *config.ScheduleConfig {
+	switch task {
+	case "restore":
+		return s.config.Scheduler.Restore
+	case "cleanup":
+		return s.config.Scheduler.Cleanup
+	}
+	for _, backupSchedule := range s.config.BackupSchedules() {
+		if backupSchedule.Task == task {
+			return backupSchedule.Schedule
+		}
+	}
+	return nil
+}
+
+// notifier returns a notification client sending to the target of schedule, see
+// config.NotificationFor
+func (s *Scheduler) notifier(schedule *config.ScheduleConfig) *notification.NotificationClient {
+	client := notification.NewNotificationClient(s.config.NotificationFor(schedule), s.logger)
+	client.SetQueue(s.notificationQueue)
+	return client
+}
+
+// retryNotifications retries the queued notification deliveries until ctx is done, including
+// those queued by one-shot runs or before this start
+func (s *Scheduler) retryNotifications(ctx context.Context) {
+	ticker := time.NewTicker(min(s.config.Notification.Retry.Backoff, time.Minute))
+	defer ticker.Stop()
+	for {
+		s.notificationQueue.Retry()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runOverlapped is called when a scheduled run finds the previous run of the task still going
+func (s *Scheduler) runOverlapped(task string) {
+	schedule := s.scheduleFor(task)
+	if schedule == nil {
+		return
+	}
+
+	if schedule.Overlap == "wait" {
+		s.logger.Warn(fmt.Sprintf("Previous %s still running, queued the next run", task),
+			slog.String("task", task))
+		return
+	}
+
+	s.skippedMu.Lock()
+	s.skipped[task]++
+	skipped := s.skipped[task]
+	s.skippedMu.Unlock()
+
+	s.logger.Warn(fmt.Sprintf("Previous %s still running, skipped scheduled run", task),
+		slog.String("task", task),
+		slog.String("overlap", schedule.Overlap),
+		slog.Int("skipped_runs", skipped))
+
+	if schedule.Overlap == "skip" {
+		if err := s.notifier(schedule).SendRunSkipped(task, s.config.Postgres.Database, skipped); err != nil {
+			s.logger.Warn("Failed to send skipped run notification", slog.String("error", err.Error()))
+		}
+	}
+}
+
+// overlapMonitor reports singleton limit hits back to the scheduler; all other scheduler
+// events are ignored
+type overlapMonitor struct {
+	scheduler *Scheduler
+}
+
+func (m *overlapMonitor) ConcurrencyLimitReached(limitType string, job gocron.Job) {
+	if limitType != "singleton" {
+		return
+	}
+	// Sent from gocron's executor, so don't block it on the webhook
+	go m.scheduler.runOverlapped(strings.TrimPrefix(job.Name(), "pg_"))
+}
+
+func (m *overlapMonitor) SchedulerStarted()                                    {}
+func (m *overlapMonitor) SchedulerStopped()                                    {}
+func (m *overlapMonitor) SchedulerShutdown()                                   {}
+func (m *overlapMonitor) JobRegistered(gocron.Job)                             {}
+func (m *overlapMonitor) JobUnregistered(gocron.Job)                           {}
+func (m *overlapMonitor) JobStarted(gocron.Job)                                {}
+func (m *overlapMonitor) JobRunning(gocron.Job)                                {}
+func (m *overlapMonitor) JobFailed(gocron.Job, error)                          {}
+func (m *overlapMonitor) JobCompleted(gocron.Job)                              {}
+func (m *overlapMonitor) JobExecutionTime(gocron.Job, time.Duration)           {}
+func (m *overlapMonitor) JobSchedulingDelay(gocron.Job, time.Time, time.Time) {}
+
 func (s *Scheduler) createJobDefinition(schedule *config.ScheduleConfig) (gocron.JobDefinition, error) {
 	switch schedule.Type {
 	case "cron":
-		return gocron.CronJob(schedule.Expression, false), nil
+		// A sixth field makes the expression start with seconds
+		withSeconds := len(strings.Fields(schedule.Expression)) == 6
+		return gocron.CronJob(zonedCron(schedule.Timezone, schedule.Expression), withSeconds), nil
 	case "interval":
 		duration, err := time.ParseDuration(schedule.Expression)
 		if err != nil {
 			return nil, fmt.Errorf("invalid interval duration: %w", err)
 		}
+		if schedule.Align {
+			expression, err := alignedCron(duration)
+			if err != nil {
+				return nil, err
+			}
+			return gocron.CronJob(zonedCron(schedule.Timezone, expression), duration < time.Minute), nil
+		}
 		return gocron.DurationJob(duration), nil
 	case "daily":
 		// Parse time in HH:MM format
@@ -182,6 +415,9 @@ func (s *Scheduler) createJobDefinition(schedule *config.ScheduleConfig) (gocron
 		if err != nil {
 			return nil, fmt.Errorf("invalid daily time format (expected HH:MM): %w", err)
 		}
+		if schedule.Timezone != "" {
+			return gocron.CronJob(zonedCron(schedule.Timezone, fmt.Sprintf("%d %d * * *", t.Minute(), t.Hour())), false), nil
+		}
 		return gocron.DailyJob(1, gocron.NewAtTimes(
 			gocron.NewAtTime(uint(t.Hour()), uint(t.Minute()), 0),
 		)), nil
@@ -195,6 +431,9 @@ func (s *Scheduler) createJobDefinition(schedule *config.ScheduleConfig) (gocron
 		if err != nil {
 			return nil, fmt.Errorf("invalid time format in weekly schedule: %w", err)
 		}
+		if schedule.Timezone != "" {
+			return gocron.CronJob(zonedCron(schedule.Timezone, fmt.Sprintf("%d %d * * %d", t.Minute(), t.Hour(), weekday)), false), nil
+		}
 		return gocron.WeeklyJob(1, 
 			gocron.NewWeekdays(weekday),
 			gocron.NewAtTimes(
@@ -210,6 +449,9 @@ func (s *Scheduler) createJobDefinition(schedule *config.ScheduleConfig) (gocron
 		if err != nil {
 			return nil, fmt.Errorf("invalid time format in monthly schedule: %w", err)
 		}
+		if schedule.Timezone != "" {
+			return gocron.CronJob(zonedCron(schedule.Timezone, fmt.Sprintf("%d %d %d * *", t.Minute(), t.Hour(), day)), false), nil
+		}
 		return gocron.MonthlyJob(1,
 			gocron.NewDaysOfTheMonth(day),
 			gocron.NewAtTimes(
@@ -220,14 +462,42 @@ func (s *Scheduler) createJobDefinition(schedule *config.ScheduleConfig) (gocron
 	}
 }
 
-func (s *Scheduler) runBackup() error {
-	ctx, cancel := context.WithTimeout(context.Background(), s.config.Timeouts.BackupOp)
-	defer cancel()
+// alignedCron returns the cron expression running an aligned interval on the clock boundaries
+// it divides, e.g. "0 */6 * * *" for 6h. Only seconds dividing a minute, minutes dividing an
+// hour and hours dividing a day have one; as cron expressions they stay on the boundaries
+// across daylight saving time changes and restarts.
+func alignedCron(interval time.Duration) (string, error) {
+	switch {
+	case interval <= 0:
+		// Rejected below
+	case interval < time.Minute && interval%time.Second == 0 && time.Minute%interval == 0:
+		return fmt.Sprintf("*/%d * * * * *", interval/time.Second), nil
+	case interval < time.Hour && interval%time.Minute == 0 && time.Hour%interval == 0:
+		return fmt.Sprintf("*/%d * * * *", interval/time.Minute), nil
+	case interval == 24*time.Hour:
+		return "0 0 * * *", nil
+	case interval < 24*time.Hour && interval%time.Hour == 0 && 24*time.Hour%interval == 0:
+		return fmt.Sprintf("0 */%d * * *", interval/time.Hour), nil
+	}
+	return "", fmt.Errorf("align needs seconds that divide a minute, minutes that divide an hour or hours that divide a day, e.g. 15m or 6h, not %s", interval)
+}
+
+// zonedCron prefixes a cron expression with the schedule's time zone, so its times are
+// evaluated there instead of in the process's local zone. Daily, weekly and monthly schedules
+// with a time zone become cron expressions too, as gocron only zones those scheduler-wide.
+func zonedCron(timezone, expression string) string {
+	if timezone == "" {
+		return expression
+	}
+	return "CRON_TZ=" + timezone + " " + expression
+}
 
-	s.logger.Info("Starting scheduled backup")
+func (s *Scheduler) runBackup(ctx context.Context, task string) error {
+	s.logger.Info("Starting scheduled backup", slog.String("task", task))
 	startTime := time.Now()
 
-	if err := s.backupManager.Run(ctx, false); err != nil {
+	// The run limits itself with the stage timeouts and timeouts.total
+	if err := s.backupManagers[task].Run(ctx, false); err != nil {
 		s.logger.Error("Scheduled backup failed",
 			slog.String("error", err.Error()),
 			slog.Duration("duration", time.Since(startTime)))
@@ -239,48 +509,120 @@ func (s *Scheduler) runBackup() error {
 	return nil
 }
 
-func (s *Scheduler) runRestore() error {
-	ctx, cancel := context.WithTimeout(context.Background(), s.config.Timeouts.BackupOp)
+// runRestore runs the scheduled restore, or the restore chained to the backup task, and notifies
+// the target of the task's schedule
+func (s *Scheduler) runRestore(ctx context.Context, task string) error {
+	// The scheduled, chained and triggered restores share the restore manager
+	s.restoreMu.Lock()
+	defer s.restoreMu.Unlock()
+
+	// Use backup key from config if specified, otherwise use latest
+	return s.restoreBackup(ctx, "scheduled", s.config.Restore.BackupKey, s.scheduleFor(task))
+}
+
+// triggerRestore runs a restore requested through the trigger endpoint, unless one is running
+func (s *Scheduler) triggerRestore(ctx context.Context, backupKey string) error {
+	if !s.restoreMu.TryLock() {
+		return trigger.ErrBusy
+	}
+	defer s.restoreMu.Unlock()
+
+	if backupKey == "" {
+		backupKey = s.config.Restore.BackupKey
+	}
+	return s.restoreBackup(ctx, "triggered", backupKey, nil)
+}
+
+// restoreBackup restores backupKey, or the latest backup if empty, as a drill when
+// restore.drill is enabled, and notifies the target of schedule. The caller holds restoreMu.
+func (s *Scheduler) restoreBackup(ctx context.Context, origin, backupKey string, schedule *config.ScheduleConfig) error {
+	ctx, cancel := context.WithTimeout(ctx, s.config.Timeouts.BackupOp)
 	defer cancel()
+	s.restoreManager.SetNotification(s.config.NotificationFor(schedule))
 
-	s.logger.Info("Starting scheduled restore")
+	s.logger.Info(fmt.Sprintf("Starting %s restore", origin), slog.String("backup_key", backupKey))
 	startTime := time.Now()
 
-	// Use backup key from config if specified, otherwise use latest
-	backupKey := s.config.Restore.BackupKey
-	
-	if err := s.restoreManager.Run(ctx, backupKey); err != nil {
-		s.logger.Error("Scheduled restore failed",
+	run := s.restoreManager.Run
+	if drill := s.config.Restore.Drill; drill != nil && drill.Enabled {
+		run = s.restoreManager.RunDrill
+	}
+	if err := run(ctx, backupKey); err != nil {
+		s.logger.Error(fmt.Sprintf("%s restore failed", capitalize(origin)),
 			slog.String("error", err.Error()),
 			slog.Duration("duration", time.Since(startTime)))
 		return err
 	}
 
-	s.logger.Info("Scheduled restore completed successfully",
+	s.logger.Info(fmt.Sprintf("%s restore completed successfully", capitalize(origin)),
 		slog.Duration("duration", time.Since(startTime)))
 	return nil
 }
 
-func (s *Scheduler) runCleanup() error {
-	ctx, cancel := context.WithTimeout(context.Background(), s.config.Timeouts.BackupOp)
+func (s *Scheduler) runCleanup(ctx context.Context, task string) error {
+	s.cleanupMu.Lock()
+	defer s.cleanupMu.Unlock()
+	return s.cleanup(ctx, "scheduled", s.scheduleFor(task))
+}
+
+// triggerCleanup runs a cleanup requested through the trigger endpoint, unless one is running
+func (s *Scheduler) triggerCleanup(ctx context.Context) error {
+	if !s.cleanupMu.TryLock() {
+		return trigger.ErrBusy
+	}
+	defer s.cleanupMu.Unlock()
+	return s.cleanup(ctx, "triggered", nil)
+}
+
+// cleanup applies the retention policy and notifies the target of schedule about failures and
+// anomalies, see retention.Cleanup. The caller holds cleanupMu.
+func (s *Scheduler) cleanup(ctx context.Context, origin string, schedule *config.ScheduleConfig) error {
+	ctx, cancel := context.WithTimeout(ctx, s.config.Timeouts.BackupOp)
 	defer cancel()
 
-	s.logger.Info("Starting scheduled cleanup",
+	s.logger.Info(fmt.Sprintf("Starting %s cleanup", origin),
 		slog.Int("retention_count", s.config.Backup.RetentionCount))
 	startTime := time.Now()
 
-	if err := s.s3Client.CleanupOldBackups(ctx, s.config.Backup.RetentionCount); err != nil {
-		s.logger.Error("Scheduled cleanup failed",
+	if err := retention.Cleanup(ctx, s.config, s.s3Client, s.notifier(schedule), s.logger); err != nil {
+		s.logger.Error(fmt.Sprintf("%s cleanup failed", capitalize(origin)),
 			slog.String("error", err.Error()),
 			slog.Duration("duration", time.Since(startTime)))
 		return err
 	}
 
-	s.logger.Info("Scheduled cleanup completed successfully",
+	s.logger.Info(fmt.Sprintf("%s cleanup completed successfully", capitalize(origin)),
 		slog.Duration("duration", time.Since(startTime)))
 	return nil
 }
 
+// capitalize upper-cases the first letter of an ASCII word, for log messages
+func capitalize(word string) string {
+	if word == "" {
+		return word
+	}
+	return strings.ToUpper(word[:1]) + word[1:]
+}
+
+// runChained runs the tasks a backup schedule lists under then, in order, after a successful
+// backup. The first failing task fails the run and skips the rest.
+func (s *Scheduler) runChained(ctx context.Context, task string, then []string) error {
+	for _, next := range then {
+		s.logger.Info(fmt.Sprintf("Running %s after %s", next, task))
+		var err error
+		switch next {
+		case "cleanup":
+			err = s.runCleanup(ctx, task)
+		case "restore":
+			err = s.runRestore(ctx, task)
+		}
+		if err != nil {
+			return fmt.Errorf("%s succeeded, but the chained %s failed: %w", task, next, err)
+		}
+	}
+	return nil
+}
+
 func (s *Scheduler) afterJobRun(jobID uuid.UUID, jobName string, taskType string) {
 	s.logger.Info(fmt.Sprintf("%s job completed successfully", taskType),
 		slog.String("job_id", jobID.String()),
@@ -295,12 +637,24 @@ func (s *Scheduler) afterJobRun(jobID uuid.UUID, jobName string, taskType string
 				s.logger.Info(fmt.Sprintf("Next %s scheduled", taskType),
 					slog.Time("next_run", nextRun))
 			}
+			s.recordNextRun(taskType, job)
 			break
 		}
 	}
 }
 
 func (s *Scheduler) afterJobError(jobID uuid.UUID, jobName string, taskType string, err error) {
+	for _, job := range s.scheduler.Jobs() {
+		if job.ID() == jobID {
+			s.recordNextRun(taskType, job)
+			break
+		}
+	}
+
+	if errors.Is(err, errBlackout) || errors.Is(err, errStandby) || errors.Is(err, errDraining) {
+		// Logged by dispatch; the task didn't run, so there is nothing to report
+		return
+	}
 	s.logger.Error(fmt.Sprintf("%s job failed", taskType),
 		slog.String("job_id", jobID.String()),
 		slog.String("job_name", jobName),
@@ -309,7 +663,12 @@ func (s *Scheduler) afterJobError(jobID uuid.UUID, jobName string, taskType stri
 
 func (s *Scheduler) Stop() error {
 	s.logger.Info("Shutting down scheduler")
-	return s.scheduler.Shutdown()
+	s.notifyService("STOPPING=1\nSTATUS=Waiting for running tasks to stop")
+	err := s.scheduler.Shutdown()
+	if s.config.HAEnabled() {
+		s.releaseLease()
+	}
+	return err
 }
 
 // Helper functions for parsing schedule expressions
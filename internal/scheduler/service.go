@@ -0,0 +1,59 @@
+package scheduler
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/hra42/pg_backup/internal/systemd"
+)
+
+// notifyService reports a state to systemd when the scheduler runs as a Type=notify service
+func (s *Scheduler) notifyService(state string) {
+	if _, err := systemd.Notify(state); err != nil {
+		s.logger.Warn("Failed to notify systemd", slog.String("error", err.Error()))
+	}
+}
+
+// reportServiceStatus shows the running tasks in systemctl status
+func (s *Scheduler) reportServiceStatus() {
+	s.activeMu.Lock()
+	running := slices.Sorted(maps.Keys(s.active))
+	s.activeMu.Unlock()
+
+	if len(running) == 0 {
+		if s.config.HAEnabled() && !s.leading.Load() {
+			s.notifyService("STATUS=Standby, another instance holds the scheduler lease")
+			return
+		}
+		s.notifyService("STATUS=Idle")
+		return
+	}
+	s.notifyService("STATUS=Running " + strings.Join(running, ", "))
+}
+
+// watchdog pings the systemd watchdog at half its interval until ctx is done. Each ping first
+// asks the gocron scheduler for its jobs, so a wedged scheduler loop stops the pings and
+// systemd restarts the service.
+func (s *Scheduler) watchdog(ctx context.Context) {
+	interval := systemd.WatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	s.logger.Debug("Pinging systemd watchdog", slog.Duration("interval", interval/2))
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.scheduler.Jobs()
+			s.notifyService("WATCHDOG=1")
+		}
+	}
+}
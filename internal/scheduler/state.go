@@ -0,0 +1,149 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+	"github.com/hra42/pg_backup/internal/config"
+	"github.com/hra42/pg_backup/internal/lock"
+)
+
+// Results of a task's last run
+const (
+	resultSuccess = "success"
+	resultFailed  = "failed"
+	resultSkipped = "skipped" // Blackout window
+	resultStandby = "standby" // Left to the instance holding the scheduler lease
+)
+
+// scheduleState records when each task last ran, how it went and when it is due next, so a
+// scheduler started after downtime can tell which runs it missed and -schedule-status can
+// report on a running scheduler
+type scheduleState struct {
+	PID       int                  `json:"pid"`
+	UpdatedAt time.Time            `json:"updated_at"`
+	Tasks     map[string]taskState `json:"tasks"`
+}
+
+type taskState struct {
+	LastRun      time.Time  `json:"last_run,omitempty"`
+	LastResult   string     `json:"last_result,omitempty"`
+	LastDuration string     `json:"last_duration,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+	RunningSince *time.Time `json:"running_since,omitempty"`
+	NextRun      time.Time  `json:"next_run"`
+}
+
+// statePath is the schedule state file of the configured server
+func statePath(cfg *config.Config) string {
+	name := lock.Name(cfg.Postgres.Host, cfg.Postgres.Port, "scheduler")
+	return filepath.Join(cfg.Backup.StateDir, "pg_backup_"+name+".schedule.json")
+}
+
+// readState reads a schedule state file; a missing file is an empty state
+func readState(path string) (scheduleState, error) {
+	state := scheduleState{Tasks: make(map[string]taskState)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return scheduleState{Tasks: make(map[string]taskState)}, fmt.Errorf("failed to parse schedule state: %w", err)
+	}
+	if state.Tasks == nil {
+		state.Tasks = make(map[string]taskState)
+	}
+	return state, nil
+}
+
+// loadState reads the recorded state. An unreadable file starts empty, which only costs the
+// detection of runs missed before this start. Runs recorded as running ended with the last
+// process.
+func (s *Scheduler) loadState() {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+
+	state, err := readState(statePath(s.config))
+	if err != nil {
+		s.logger.Warn("Ignoring unreadable schedule state", slog.String("path", statePath(s.config)), slog.String("error", err.Error()))
+	}
+	for task, taskState := range state.Tasks {
+		taskState.RunningSince = nil
+		state.Tasks[task] = taskState
+	}
+	s.state = state
+}
+
+// updateState changes the state of a task and saves the file. Failures are logged; they only
+// cost misfire detection and status reporting.
+func (s *Scheduler) updateState(task string, update func(*taskState)) {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+
+	state := s.state.Tasks[task]
+	update(&state)
+	s.state.Tasks[task] = state
+	s.state.PID = os.Getpid()
+	s.state.UpdatedAt = time.Now()
+
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	if err == nil {
+		path := statePath(s.config)
+		if err = os.WriteFile(path+".tmp", data, 0600); err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+	}
+	if err != nil {
+		s.logger.Warn("Failed to save schedule state", slog.String("error", err.Error()))
+	}
+}
+
+// recordNextRun stores when a task is due next
+func (s *Scheduler) recordNextRun(task string, job gocron.Job) {
+	nextRun, err := job.NextRun()
+	if err != nil || nextRun.IsZero() {
+		return
+	}
+	s.updateState(task, func(state *taskState) {
+		state.NextRun = nextRun
+	})
+}
+
+// recordStart marks a task as running
+func (s *Scheduler) recordStart(task string, started time.Time) {
+	s.updateState(task, func(state *taskState) {
+		state.RunningSince = &started
+	})
+}
+
+// recordResult stores the outcome of a run that started at started. A run skipped for a
+// blackout window or left to the active instance still counts as a run, so it isn't reported
+// as missed.
+func (s *Scheduler) recordResult(task string, started time.Time, err error) {
+	s.updateState(task, func(state *taskState) {
+		state.RunningSince = nil
+		state.LastRun = started
+		state.LastDuration = time.Since(started).Round(time.Second).String()
+		state.LastError = ""
+		switch {
+		case err == nil:
+			state.LastResult = resultSuccess
+		case errors.Is(err, errBlackout):
+			state.LastResult = resultSkipped
+		case errors.Is(err, errStandby):
+			state.LastResult = resultStandby
+		default:
+			state.LastResult = resultFailed
+			state.LastError = err.Error()
+		}
+	})
+}
@@ -0,0 +1,150 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hra42/pg_backup/internal/config"
+)
+
+// TaskStatus is one scheduled task as reported by -schedule-status
+type TaskStatus struct {
+	Task         string     `json:"task"`
+	Type         string     `json:"type"`
+	Expression   string     `json:"expression"`
+	Timezone     string     `json:"timezone,omitempty"`
+	LastRun      *time.Time `json:"last_run,omitempty"`
+	LastResult   string     `json:"last_result,omitempty"` // "success", "failed" or "skipped"
+	LastDuration string     `json:"last_duration,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+	RunningSince *time.Time `json:"running_since,omitempty"`
+	NextRun      *time.Time `json:"next_run,omitempty"`
+	Overdue      bool       `json:"overdue"` // The next run is past due, e.g. because the scheduler isn't running
+}
+
+// Status is the state of the scheduler of a configuration, as recorded by the running scheduler
+type Status struct {
+	StatePath string       `json:"state_path"`
+	PID       int          `json:"pid,omitempty"`
+	Running   bool         `json:"running"` // The process that last wrote the state still exists
+	UpdatedAt *time.Time   `json:"updated_at,omitempty"`
+	Tasks     []TaskStatus `json:"tasks"`
+}
+
+// ReadStatus reports the tasks scheduled by cfg with the results the scheduler recorded in its
+// state file. It reads the file only, so it works while the scheduler runs in another process.
+func ReadStatus(cfg *config.Config) (*Status, error) {
+	path := statePath(cfg)
+	state, err := readState(path)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &Status{StatePath: path, PID: state.PID, Tasks: []TaskStatus{}}
+	if !state.UpdatedAt.IsZero() {
+		status.UpdatedAt = &state.UpdatedAt
+	}
+	// Signal 0 only checks that the process exists; EPERM means it runs as another user
+	if state.PID > 0 {
+		err := syscall.Kill(state.PID, 0)
+		status.Running = err == nil || err == syscall.EPERM
+	}
+
+	add := func(task string, schedule *config.ScheduleConfig) {
+		taskStatus := TaskStatus{
+			Task:       task,
+			Type:       schedule.Type,
+			Expression: schedule.Expression,
+			Timezone:   schedule.Timezone,
+		}
+		recorded, ok := state.Tasks[task]
+		if ok {
+			if !recorded.LastRun.IsZero() {
+				taskStatus.LastRun = &recorded.LastRun
+			}
+			taskStatus.LastResult = recorded.LastResult
+			taskStatus.LastDuration = recorded.LastDuration
+			taskStatus.LastError = recorded.LastError
+			// A run recorded by a process that no longer exists was cut short
+			if status.Running {
+				taskStatus.RunningSince = recorded.RunningSince
+			}
+			if !recorded.NextRun.IsZero() {
+				taskStatus.NextRun = &recorded.NextRun
+				taskStatus.Overdue = time.Since(recorded.NextRun) > misfireGrace && taskStatus.RunningSince == nil
+			}
+		}
+		status.Tasks = append(status.Tasks, taskStatus)
+	}
+	for _, task := range scheduledTasks(cfg) {
+		add(task.name, task.schedule)
+	}
+	return status, nil
+}
+
+// Write prints the status as a table, or as JSON with format "json"
+func (s *Status) Write(w io.Writer, format string) error {
+	if format == "json" {
+		data, err := json.MarshalIndent(s, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	}
+
+	switch {
+	case s.UpdatedAt == nil:
+		fmt.Fprintf(w, "No scheduler has recorded its state in %s yet\n", s.StatePath)
+	case s.Running:
+		fmt.Fprintf(w, "Scheduler running (pid %d), state updated %s\n", s.PID, s.UpdatedAt.Format(time.RFC3339))
+	default:
+		fmt.Fprintf(w, "Scheduler not running (last pid %d), state updated %s\n", s.PID, s.UpdatedAt.Format(time.RFC3339))
+	}
+	if len(s.Tasks) == 0 {
+		_, err := fmt.Fprintln(w, "No scheduled tasks configured")
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TASK\tSCHEDULE\tLAST RUN\tRESULT\tDURATION\tNEXT RUN")
+	for _, task := range s.Tasks {
+		schedule := task.Type + " " + task.Expression
+		if task.Timezone != "" {
+			schedule += " (" + task.Timezone + ")"
+		}
+		lastRun, result, nextRun := "-", "-", "-"
+		if task.LastRun != nil {
+			lastRun = task.LastRun.Format("2006-01-02 15:04:05 MST")
+			result = task.LastResult
+		}
+		duration := task.LastDuration
+		if task.RunningSince != nil {
+			result = "running"
+			duration = time.Since(*task.RunningSince).Round(time.Second).String()
+		}
+		if duration == "" {
+			duration = "-"
+		}
+		if task.NextRun != nil {
+			nextRun = task.NextRun.Format("2006-01-02 15:04:05 MST")
+			if task.Overdue {
+				nextRun += " (overdue)"
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", task.Task, schedule, lastRun, result, duration, nextRun)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, task := range s.Tasks {
+		if task.LastError != "" && task.RunningSince == nil {
+			fmt.Fprintf(w, "%s failed: %s\n", task.Task, task.LastError)
+		}
+	}
+	return nil
+}
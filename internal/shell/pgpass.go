@@ -0,0 +1,23 @@
+package shell
+
+import "strings"
+
+// PgPassPrelude makes the command following it authenticate with the password sent as the first
+// line of stdin (see PgPassInput). The line is written to a mktemp file (mode 0600) exported as
+// PGPASSFILE and removed when the shell exits, so the password never shows up in the command
+// line that other users can see in ps. Commands reading stdin get the input after that line.
+const PgPassPrelude = `PGPASSFILE=$(mktemp) || exit 1; export PGPASSFILE; ` +
+	`trap 'rm -f "$PGPASSFILE"' EXIT; trap 'rm -f "$PGPASSFILE"; exit 143' HUP INT TERM; ` +
+	`IFS= read -r pgpass_entry; printf '%s\n' "$pgpass_entry" > "$PGPASSFILE"; unset pgpass_entry; `
+
+// PgPassInput renders the stdin line PgPassPrelude expects: a .pgpass entry matching any server
+func PgPassInput(password string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, ":", `\:`).Replace(password)
+	return "*:*:*:*:" + escaped + "\n"
+}
+
+// PasswordEnvPrelude is the PgPassPrelude variant for tools that can't read a file on this
+// host, e.g. inside a container: the first stdin line is exported as PGPASSWORD, which is then
+// forwarded by name (docker exec -e PGPASSWORD) and so stays out of the command line as well.
+// The line is the bare password followed by a newline.
+const PasswordEnvPrelude = `IFS= read -r PGPASSWORD; export PGPASSWORD; `
@@ -0,0 +1,47 @@
+package shell
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Quote wraps a value in single quotes so it is passed verbatim to a POSIX shell
+func Quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// EnvPrefix renders environment variables as "export K='v'; " statements that can be
+// prepended to a shell command. Keys are sorted so the generated command is stable.
+func EnvPrefix(env map[string]string) string {
+	if len(env) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, key := range keys {
+		fmt.Fprintf(&b, "export %s=%s; ", key, Quote(env[key]))
+	}
+	return b.String()
+}
+
+// EnvList renders environment variables as KEY=value pairs for exec.Cmd.Env
+func EnvList(env map[string]string) []string {
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	list := make([]string, 0, len(env))
+	for _, key := range keys {
+		list = append(list, key+"="+env[key])
+	}
+	return list
+}
@@ -0,0 +1,78 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hra42/pg_backup/internal/shell"
+)
+
+// NewLocalClient returns a client that runs commands on this machine with sh instead of over
+// SSH, for backup modes that reach the database without an SSH host (e.g. kubectl exec).
+// Connect and Close are no-ops.
+func NewLocalClient(logger *slog.Logger) *SSHClient {
+	return &SSHClient{
+		logger: logger,
+		local:  true,
+	}
+}
+
+func executeLocal(ctx context.Context, command, input string, timeout time.Duration, onLine func(string)) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := shell.Command(ctx, command)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = LineTee(&stdout, onLine)
+	cmd.Stderr = &stderr
+	if input != "" {
+		cmd.Stdin = strings.NewReader(input)
+	}
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", fmt.Errorf("command timed out after %v", timeout)
+		}
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("command canceled: %w", ctx.Err())
+		}
+		if stderr.Len() > 0 {
+			return stdout.String(), fmt.Errorf("command failed: %w\nstderr: %s", err, stderr.String())
+		}
+		return stdout.String(), fmt.Errorf("command failed: %w", err)
+	}
+	return stdout.String(), nil
+}
+
+func startLocalSession(command string) (*Session, error) {
+	cmd := exec.Command("sh", "-c", command)
+	sess := &Session{
+		wait:      cmd.Wait,
+		terminate: func() { cmd.Process.Signal(syscall.SIGTERM) },
+		release:   func() {},
+	}
+	cmd.Stderr = &sess.stderr
+
+	var err error
+	sess.stdin, err = cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stdin: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stdout: %w", err)
+	}
+	sess.stdout = bufio.NewReader(stdout)
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start command: %w", err)
+	}
+	return sess, nil
+}
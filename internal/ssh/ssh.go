@@ -1,10 +1,14 @@
 package ssh
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -16,6 +20,7 @@ type SSHClient struct {
 	config *config.SSHConfig
 	client *ssh.Client
 	logger *slog.Logger
+	local  bool // Run commands on this machine instead (see NewLocalClient)
 }
 
 func NewSSHClient(cfg *config.SSHConfig, logger *slog.Logger) (*SSHClient, error) {
@@ -26,6 +31,10 @@ func NewSSHClient(cfg *config.SSHConfig, logger *slog.Logger) (*SSHClient, error
 }
 
 func (s *SSHClient) Connect(timeout time.Duration) error {
+	if s.local {
+		return nil
+	}
+
 	s.logger.Info("Establishing SSH connection",
 		slog.String("host", s.config.Host),
 		slog.Int("port", s.config.Port))
@@ -76,6 +85,27 @@ func (s *SSHClient) Connect(timeout time.Duration) error {
 }
 
 func (s *SSHClient) ExecuteCommand(cmd string, timeout time.Duration) (string, error) {
+	return s.ExecuteCommandWithInput(cmd, "", timeout)
+}
+
+// ExecuteCommandWithInput runs cmd with input on its stdin, e.g. a secret that must not be
+// part of the command line
+func (s *SSHClient) ExecuteCommandWithInput(cmd, input string, timeout time.Duration) (string, error) {
+	return s.ExecuteCommandContext(context.Background(), cmd, input, timeout)
+}
+
+// ExecuteCommandContext is ExecuteCommandWithInput that stops the command, along with every
+// process it started (e.g. pg_dump and its compressor), when ctx is canceled
+func (s *SSHClient) ExecuteCommandContext(ctx context.Context, cmd, input string, timeout time.Duration) (string, error) {
+	return s.ExecuteCommandStream(ctx, cmd, input, timeout, nil)
+}
+
+// ExecuteCommandStream is ExecuteCommandContext that also hands every line of stdout to onLine
+// as it is written, e.g. to report the progress of a long pg_restore. onLine may be nil.
+func (s *SSHClient) ExecuteCommandStream(ctx context.Context, cmd, input string, timeout time.Duration, onLine func(string)) (string, error) {
+	if s.local {
+		return executeLocal(ctx, cmd, input, timeout, onLine)
+	}
 	if s.client == nil {
 		return "", fmt.Errorf("SSH client not connected")
 	}
@@ -86,9 +116,18 @@ func (s *SSHClient) ExecuteCommand(cmd string, timeout time.Duration) (string, e
 	}
 	defer session.Close()
 
+	// sshd starts the shell as a session leader, so its PID names the process group of
+	// everything the command runs. The subshell keeps the command's own traps and exits from
+	// skipping the removal of the PID file.
+	pidFile := fmt.Sprintf("/tmp/pg_backup_%d.pid", time.Now().UnixNano())
+	cmd = fmt.Sprintf("echo $$ > %s; ( %s ); rc=$?; rm -f %s; exit $rc", pidFile, cmd, pidFile)
+
 	var stdout, stderr bytes.Buffer
-	session.Stdout = &stdout
+	session.Stdout = LineTee(&stdout, onLine)
 	session.Stderr = &stderr
+	if input != "" {
+		session.Stdin = strings.NewReader(input)
+	}
 
 	done := make(chan error, 1)
 	go func() {
@@ -98,21 +137,161 @@ func (s *SSHClient) ExecuteCommand(cmd string, timeout time.Duration) (string, e
 	select {
 	case err := <-done:
 		if err != nil {
+			// Return stdout alongside the error so callers can inspect tool output on failure
 			stderrStr := stderr.String()
 			if stderrStr != "" {
-				return "", fmt.Errorf("command failed: %w\nstderr: %s", err, stderrStr)
+				return stdout.String(), fmt.Errorf("command failed: %w\nstderr: %s", err, stderrStr)
 			}
-			return "", fmt.Errorf("command failed: %w", err)
+			return stdout.String(), fmt.Errorf("command failed: %w", err)
 		}
 		return stdout.String(), nil
+	case <-ctx.Done():
+		s.killRemote(pidFile)
+		return "", fmt.Errorf("command canceled: %w", ctx.Err())
 	case <-time.After(timeout):
-		session.Signal(ssh.SIGTERM)
-		time.Sleep(5 * time.Second)
-		session.Signal(ssh.SIGKILL)
+		s.killRemote(pidFile)
 		return "", fmt.Errorf("command timed out after %v", timeout)
 	}
 }
 
+// LineTee returns a writer that writes to w and calls onLine with every complete line, without
+// its line ending. It returns w itself when onLine is nil. Not safe for concurrent writes.
+func LineTee(w io.Writer, onLine func(string)) io.Writer {
+	if onLine == nil {
+		return w
+	}
+	return &lineTee{w: w, onLine: onLine}
+}
+
+type lineTee struct {
+	w       io.Writer
+	onLine  func(string)
+	partial []byte
+}
+
+func (t *lineTee) Write(p []byte) (int, error) {
+	t.partial = append(t.partial, p...)
+	for {
+		i := bytes.IndexByte(t.partial, '\n')
+		if i < 0 {
+			break
+		}
+		t.onLine(strings.TrimRight(string(t.partial[:i]), "\r"))
+		t.partial = t.partial[i+1:]
+	}
+	return t.w.Write(p)
+}
+
+// killRemote terminates the process group recorded in pidFile, falling back to the shell alone
+// if it doesn't lead a group (e.g. behind a forced command)
+func (s *SSHClient) killRemote(pidFile string) {
+	killCmd := fmt.Sprintf(
+		`pid=$(cat %s 2>/dev/null) && { kill -TERM -- -$pid 2>/dev/null || kill -TERM $pid; }; rm -f %s`,
+		pidFile, pidFile)
+	if _, err := s.ExecuteCommand(killCmd, 10*time.Second); err != nil {
+		s.logger.Warn("Failed to stop remote command", slog.String("error", err.Error()))
+	}
+}
+
+// Session is a long-running remote command whose stdin stays open, e.g. a psql session
+// holding a transaction while other commands run
+type Session struct {
+	stdin     io.WriteCloser
+	stdout    *bufio.Reader
+	stderr    bytes.Buffer
+	wait      func() error
+	terminate func()
+	release   func()
+}
+
+// StartSession starts cmd and returns immediately; the caller feeds it with Write and must Close it
+func (s *SSHClient) StartSession(cmd string) (*Session, error) {
+	if s.local {
+		return startLocalSession(cmd)
+	}
+	if s.client == nil {
+		return nil, fmt.Errorf("SSH client not connected")
+	}
+
+	session, err := s.client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create SSH session: %w", err)
+	}
+
+	sess := &Session{
+		wait:      session.Wait,
+		terminate: func() { session.Signal(ssh.SIGTERM) },
+		release:   func() { session.Close() },
+	}
+	sess.stdin, err = session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("failed to open stdin: %w", err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("failed to open stdout: %w", err)
+	}
+	sess.stdout = bufio.NewReader(stdout)
+	session.Stderr = &sess.stderr
+
+	if err := session.Start(cmd); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("failed to start command: %w", err)
+	}
+	return sess, nil
+}
+
+// Write sends input to the command's stdin
+func (s *Session) Write(input string) error {
+	_, err := io.WriteString(s.stdin, input)
+	return err
+}
+
+// ReadLine returns the next line of output without the trailing newline
+func (s *Session) ReadLine(timeout time.Duration) (string, error) {
+	type result struct {
+		line string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		line, err := s.stdout.ReadString('\n')
+		done <- result{line: strings.TrimRight(line, "\r\n"), err: err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return "", fmt.Errorf("failed to read output: %w (stderr: %s)", r.err, strings.TrimSpace(s.stderr.String()))
+		}
+		return r.line, nil
+	case <-time.After(timeout):
+		return "", fmt.Errorf("no output after %v", timeout)
+	}
+}
+
+// Close closes stdin, waits briefly for the command to exit and tears down the session
+func (s *Session) Close() error {
+	s.stdin.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.wait()
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(10 * time.Second):
+		s.terminate()
+		err = fmt.Errorf("command did not exit after stdin was closed")
+	}
+	s.release()
+	return err
+}
+
 func (s *SSHClient) RemoveRemoteFile(remotePath string) error {
 	// Use SSH command to remove the file
 	_, err := s.ExecuteCommand(fmt.Sprintf("rm -f %s", remotePath), 10*time.Second)
@@ -125,6 +304,9 @@ func (s *SSHClient) RemoveRemoteFile(remotePath string) error {
 }
 
 func (s *SSHClient) Close() {
+	if s.local {
+		return
+	}
 	if s.client != nil {
 		s.client.Close()
 		s.client = nil
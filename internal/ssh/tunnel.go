@@ -0,0 +1,136 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+)
+
+// Tunnel forwards connections to a port on this machine's loopback interface through the SSH
+// connection to an address reachable from the SSH host, like ssh -L
+type Tunnel struct {
+	listener net.Listener
+	logger   *slog.Logger
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// Forward listens on 127.0.0.1:localPort (0 picks a free port) and forwards every connection
+// to remoteAddr as seen from the SSH host. The tunnel stops when it or the client is closed.
+func (s *SSHClient) Forward(remoteAddr string, localPort int) (*Tunnel, error) {
+	if s.local || s.client == nil {
+		return nil, fmt.Errorf("SSH client not connected")
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", localPort))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for tunnel: %w", err)
+	}
+
+	t := &Tunnel{
+		listener: listener,
+		logger:   s.logger,
+		conns:    make(map[net.Conn]struct{}),
+	}
+	t.wg.Add(1)
+	go t.serve(s, remoteAddr)
+
+	s.logger.Info("SSH tunnel opened",
+		slog.String("local", listener.Addr().String()),
+		slog.String("remote", remoteAddr))
+	return t, nil
+}
+
+// Port returns the local port the tunnel listens on
+func (t *Tunnel) Port() int {
+	return t.listener.Addr().(*net.TCPAddr).Port
+}
+
+// Close stops accepting connections and closes the forwarded ones
+func (t *Tunnel) Close() error {
+	err := t.listener.Close()
+	t.mu.Lock()
+	t.closed = true
+	for conn := range t.conns {
+		conn.Close()
+	}
+	t.mu.Unlock()
+	t.wg.Wait()
+	return err
+}
+
+func (t *Tunnel) serve(s *SSHClient, remoteAddr string) {
+	defer t.wg.Done()
+	for {
+		local, err := t.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				t.logger.Warn("SSH tunnel stopped accepting connections", slog.String("error", err.Error()))
+			}
+			return
+		}
+
+		remote, err := s.client.Dial("tcp", remoteAddr)
+		if err != nil {
+			t.logger.Warn("SSH tunnel failed to reach remote address",
+				slog.String("remote", remoteAddr),
+				slog.String("error", err.Error()))
+			local.Close()
+			continue
+		}
+
+		if !t.track(local, remote) {
+			return
+		}
+		t.wg.Add(1)
+		go t.pipe(local, remote)
+	}
+}
+
+// track registers connections for Close; it closes them instead once the tunnel is closed
+func (t *Tunnel) track(conns ...net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, conn := range conns {
+		if t.closed {
+			conn.Close()
+			continue
+		}
+		t.conns[conn] = struct{}{}
+	}
+	return !t.closed
+}
+
+// pipe copies both directions until either side closes, then closes both
+func (t *Tunnel) pipe(local, remote net.Conn) {
+	defer t.wg.Done()
+
+	var once sync.Once
+	closeBoth := func() {
+		local.Close()
+		remote.Close()
+	}
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(remote, local)
+		once.Do(closeBoth)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(local, remote)
+		once.Do(closeBoth)
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+
+	t.mu.Lock()
+	delete(t.conns, local)
+	delete(t.conns, remote)
+	t.mu.Unlock()
+}
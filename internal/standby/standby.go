@@ -0,0 +1,219 @@
+package standby
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hra42/pg_backup/internal/compression"
+	"github.com/hra42/pg_backup/internal/config"
+	"github.com/hra42/pg_backup/internal/pgoutput"
+	"github.com/hra42/pg_backup/internal/rsync"
+	"github.com/hra42/pg_backup/internal/shell"
+	"github.com/hra42/pg_backup/internal/ssh"
+)
+
+// maxIdentifierLength is PostgreSQL's NAMEDATALEN - 1
+const maxIdentifierLength = 63
+
+// Seeder refreshes the standby database from a new dump. The dump is restored into a staging
+// database next to it, which then replaces the standby database, so readers only lose their
+// connections for the moment of the swap and a failed restore leaves the old copy in place.
+// It holds the SSH connection of the refresh, so use one Seeder per dump.
+type Seeder struct {
+	config    *config.Config
+	standby   *config.StandbyConfig
+	sshClient *ssh.SSHClient
+	logger    *slog.Logger
+}
+
+func NewSeeder(cfg *config.Config, logger *slog.Logger) *Seeder {
+	return &Seeder{
+		config:  cfg,
+		standby: cfg.Backup.Standby,
+		logger:  logger,
+	}
+}
+
+// Host returns the host the standby restore runs on, for logs
+func (s *Seeder) Host() string {
+	if s.standby.SSH != nil {
+		return s.standby.SSH.Host
+	}
+	return "local"
+}
+
+// Target returns the standby database refreshed from backups of database
+func (s *Seeder) Target(database string) string {
+	if s.standby.Database != "" {
+		return s.standby.Database
+	}
+	return database
+}
+
+// Seed restores the dump at localPath into the standby database of database, replacing it
+func (s *Seeder) Seed(ctx context.Context, localPath, database string) error {
+	startTime := time.Now()
+	target := s.Target(database)
+	staging := StagingName(target)
+	logger := s.logger.With(slog.String("standby_database", target))
+	logger.Info("Stage 4c: Refreshing standby database", slog.String("host", s.Host()))
+
+	dumpPath := localPath
+	if s.standby.SSH != nil {
+		sshClient, err := ssh.NewSSHClient(s.standby.SSH, logger)
+		if err != nil {
+			return fmt.Errorf("failed to create SSH client: %w", err)
+		}
+		if err := sshClient.Connect(s.config.Timeouts.SSHConnection); err != nil {
+			return fmt.Errorf("SSH connection to standby host failed: %w", err)
+		}
+		s.sshClient = sshClient
+		defer func() {
+			sshClient.Close()
+			s.sshClient = nil
+		}()
+
+		dumpPath = filepath.Join(s.standby.TempDir, filepath.Base(localPath))
+		rsyncClient := rsync.NewRsyncClient(s.standby.SSH, logger)
+		if err := rsyncClient.UploadFile(ctx, localPath, dumpPath, s.config.Timeouts.Transfer, nil); err != nil {
+			return fmt.Errorf("failed to copy dump to standby host: %w", err)
+		}
+		defer s.executeCommand(fmt.Sprintf("rm -f %s", dumpPath), 10*time.Second)
+	}
+
+	if algorithm := compression.Detect(dumpPath); algorithm != "" {
+		outPath := compression.TrimExtension(dumpPath)
+		if s.standby.SSH == nil {
+			// Never decompress next to the caller's file
+			outPath = filepath.Join(os.TempDir(), "standby_"+filepath.Base(outPath))
+		}
+		decompressCmd := fmt.Sprintf("%s < %s > %s", compression.DecompressCommand(algorithm), dumpPath, outPath)
+		if output, err := s.executeCommandContext(ctx, decompressCmd, s.config.Timeouts.Transfer); err != nil {
+			s.executeCommand(fmt.Sprintf("rm -f %s", outPath), 10*time.Second)
+			return fmt.Errorf("failed to decompress dump with %s: %w (output: %s)", algorithm, err, output)
+		}
+		defer s.executeCommand(fmt.Sprintf("rm -f %s", outPath), 10*time.Second)
+		dumpPath = outPath
+	}
+
+	// A staging database left behind by a failed refresh is replaced
+	if err := s.dropDatabase(staging); err != nil {
+		return err
+	}
+	createCmd := s.psqlCommand("postgres", "-c "+shell.Quote(fmt.Sprintf("CREATE DATABASE \"%s\"", staging)))
+	if output, err := s.executeCommand(createCmd, time.Minute); err != nil {
+		return fmt.Errorf("failed to create staging database %s: %w (output: %s)", staging, err, output)
+	}
+
+	if err := s.restore(ctx, logger, dumpPath, staging); err != nil {
+		if dropErr := s.dropDatabase(staging); dropErr != nil {
+			logger.Warn("Failed to drop staging database", slog.String("error", dropErr.Error()))
+		}
+		return err
+	}
+
+	if err := s.swap(staging, target); err != nil {
+		return err
+	}
+
+	logger.Info("Standby database refreshed", slog.Duration("duration", time.Since(startTime)))
+	return nil
+}
+
+func (s *Seeder) restore(ctx context.Context, logger *slog.Logger, dumpPath, staging string) error {
+	restoreCmd := fmt.Sprintf(
+		"pg_restore -h %s -p %d -U %s -d \"%s\" --no-owner --no-privileges --jobs=%d %s 2>&1",
+		s.standby.Host,
+		s.standby.Port,
+		s.standby.Username,
+		staging,
+		s.standby.Jobs,
+		dumpPath,
+	)
+	output, err := s.executeCommandContext(ctx, restoreCmd, s.config.Timeouts.BackupOp)
+	classified := pgoutput.Classify(output)
+	if classified.HasErrors() {
+		return fmt.Errorf("standby restore reported %d errors: %s", len(classified.Errors), pgoutput.Summary(classified.Errors, 10))
+	}
+	if err != nil {
+		return fmt.Errorf("standby restore failed: %w (output: %s)", err, output)
+	}
+	if len(classified.Warnings) > 0 {
+		logger.Warn("Standby restore reported warnings", slog.Int("count", len(classified.Warnings)))
+	}
+	return nil
+}
+
+// swap replaces the standby database with the freshly restored staging database. New
+// connections to the old copy are refused before its sessions are terminated, so none
+// sneak in before the drop.
+func (s *Seeder) swap(staging, target string) error {
+	statements := []string{
+		fmt.Sprintf("DO $$BEGIN IF EXISTS (SELECT 1 FROM pg_database WHERE datname = '%s') THEN ALTER DATABASE \"%s\" ALLOW_CONNECTIONS false; END IF; END$$", target, target),
+		fmt.Sprintf("SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = '%s' AND pid <> pg_backend_pid()", target),
+		fmt.Sprintf("DROP DATABASE IF EXISTS \"%s\"", target),
+		fmt.Sprintf("ALTER DATABASE \"%s\" RENAME TO \"%s\"", staging, target),
+	}
+	args := "-q"
+	for _, statement := range statements {
+		args += " -c " + shell.Quote(statement)
+	}
+	if output, err := s.executeCommand(s.psqlCommand("postgres", args), time.Minute); err != nil {
+		return fmt.Errorf("failed to replace standby database %s: %w (output: %s)", target, err, output)
+	}
+	return nil
+}
+
+func (s *Seeder) dropDatabase(name string) error {
+	dropCmd := s.psqlCommand("postgres", "-c "+shell.Quote(fmt.Sprintf("DROP DATABASE IF EXISTS \"%s\"", name)))
+	if output, err := s.executeCommand(dropCmd, time.Minute); err != nil {
+		return fmt.Errorf("failed to drop database %s: %w (output: %s)", name, err, output)
+	}
+	return nil
+}
+
+func (s *Seeder) psqlCommand(database, args string) string {
+	return fmt.Sprintf(
+		"psql -h %s -p %d -U %s -d \"%s\" -v ON_ERROR_STOP=1 %s",
+		s.standby.Host,
+		s.standby.Port,
+		s.standby.Username,
+		database,
+		args,
+	)
+}
+
+func (s *Seeder) executeCommand(command string, timeout time.Duration) (string, error) {
+	return s.executeCommandContext(context.Background(), command, timeout)
+}
+
+// executeCommandContext runs a command that stops when ctx is canceled. Cleanup uses
+// executeCommand, so it still runs after cancellation.
+func (s *Seeder) executeCommandContext(ctx context.Context, command string, timeout time.Duration) (string, error) {
+	if s.sshClient != nil {
+		return s.sshClient.ExecuteCommandContext(ctx, shell.EnvPrefix(s.config.Backup.Env)+shell.PgPassPrelude+command, shell.PgPassInput(s.standby.Password), timeout)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := shell.Command(ctx, command)
+	cmd.Env = append(os.Environ(), shell.EnvList(s.config.Backup.Env)...)
+	cmd.Env = append(cmd.Env, "PGPASSWORD="+s.standby.Password)
+	output, err := cmd.CombinedOutput()
+	return string(output), err
+}
+
+// StagingName returns the name the standby copy is restored under before the swap, truncated
+// to fit PostgreSQL's identifier limit
+func StagingName(target string) string {
+	const suffix = "_seeding"
+	if len(target)+len(suffix) > maxIdentifierLength {
+		target = target[:maxIdentifierLength-len(suffix)]
+	}
+	return target + suffix
+}
@@ -1,12 +1,21 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -15,7 +24,10 @@ import (
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/hra42/pg_backup/internal/compression"
 	"github.com/hra42/pg_backup/internal/config"
+	"github.com/hra42/pg_backup/internal/lock"
 )
 
 type S3Client struct {
@@ -24,6 +36,12 @@ type S3Client struct {
 	uploader   *manager.Uploader
 	downloader *manager.Downloader
 	logger     *slog.Logger
+
+	// Bucket listing cache shared by GetLatestBackup, ListBackups and CleanupOldBackups
+	listMu       sync.Mutex
+	listCache    []types.Object
+	listCachedAt time.Time
+	lastListPage time.Time
 }
 
 func NewS3Client(s3Config *config.S3Config, logger *slog.Logger) (*S3Client, error) {
@@ -84,19 +102,22 @@ func (s *S3Client) ValidateBucket(ctx context.Context) error {
 	return nil
 }
 
-func (s *S3Client) UploadFile(ctx context.Context, localPath string, progressFn func(int64)) error {
+// UploadFile uploads a backup file and returns the S3 key it was stored under, below
+// subPrefix within the configured prefix if set. progressFn is called at most once per second
+// with the bytes uploaded so far and the file size, and once more when the upload completed.
+func (s *S3Client) UploadFile(ctx context.Context, localPath, subPrefix string, progressFn func(int64, int64)) (string, error) {
 	file, err := os.Open(localPath)
 	if err != nil {
-		return fmt.Errorf("failed to open file for upload: %w", err)
+		return "", fmt.Errorf("failed to open file for upload: %w", err)
 	}
 	defer file.Close()
 
 	stat, err := file.Stat()
 	if err != nil {
-		return fmt.Errorf("failed to stat file: %w", err)
+		return "", fmt.Errorf("failed to stat file: %w", err)
 	}
 
-	key := s.generateBackupKey(filepath.Base(localPath))
+	key := s.generateBackupKey(subPrefix, filepath.Base(localPath))
 	s.logger.Info("Starting S3 upload",
 		slog.String("file", localPath),
 		slog.String("bucket", s.config.Bucket),
@@ -122,8 +143,17 @@ func (s *S3Client) UploadFile(ctx context.Context, localPath string, progressFn
 	}
 
 	result, err := s.uploader.Upload(ctx, uploadInput)
+	s.invalidateListCache()
 	if err != nil {
-		return fmt.Errorf("S3 upload failed: %w", err)
+		// The uploader aborts failed multipart uploads itself, but not once ctx is canceled
+		var multipartErr manager.MultiUploadFailure
+		if errors.As(err, &multipartErr) {
+			s.abortUpload(key, multipartErr.UploadID())
+		}
+		return "", fmt.Errorf("S3 upload failed: %w", err)
+	}
+	if progressFn != nil {
+		progressFn(stat.Size(), stat.Size())
 	}
 
 	headOutput, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
@@ -131,11 +161,12 @@ func (s *S3Client) UploadFile(ctx context.Context, localPath string, progressFn
 		Key:    aws.String(key),
 	})
 	if err != nil {
-		return fmt.Errorf("failed to verify uploaded object: %w", err)
+		return "", fmt.Errorf("failed to verify uploaded object: %w", err)
 	}
 
 	if headOutput.ContentLength == nil || *headOutput.ContentLength != stat.Size() {
-		return fmt.Errorf("uploaded file size mismatch")
+		s.deletePartialObject(key)
+		return "", fmt.Errorf("uploaded file size mismatch")
 	}
 
 	s.logger.Info("S3 upload completed successfully",
@@ -143,45 +174,760 @@ func (s *S3Client) UploadFile(ctx context.Context, localPath string, progressFn
 		slog.String("etag", *result.ETag),
 		slog.Int64("size", stat.Size()))
 
+	return key, nil
+}
+
+// abortUpload aborts a failed multipart upload so its parts stop being billed. It runs on its own
+// context because the upload's may already be canceled.
+func (s *S3Client) abortUpload(key, uploadID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.config.Bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+	if err != nil {
+		s.logger.Warn("Failed to abort multipart upload, it is aborted by the next run",
+			slog.String("key", key),
+			slog.String("error", err.Error()))
+		return
+	}
+	s.logger.Info("Aborted failed multipart upload", slog.String("key", key))
+}
+
+// deletePartialObject removes an uploaded object that failed verification
+func (s *S3Client) deletePartialObject(key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(key),
+	})
+	s.invalidateListCache()
+	if err != nil {
+		s.logger.Warn("Failed to delete partial upload", slog.String("key", key), slog.String("error", err.Error()))
+		return
+	}
+	s.logger.Info("Deleted partial upload", slog.String("key", key))
+}
+
+// AbortIncompleteUploads aborts the multipart uploads under the prefix that were started more
+// than olderThan ago, e.g. by runs that crashed mid-upload. Incomplete uploads don't show up in
+// listings but their parts are billed until aborted. Younger uploads may still be running on
+// another host and are left alone. Returns the number of aborted uploads.
+func (s *S3Client) AbortIncompleteUploads(ctx context.Context, olderThan time.Duration) (int, error) {
+	cutoff := time.Now().Add(-olderThan)
+	input := &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(s.config.Bucket),
+		Prefix: aws.String(s.config.Prefix),
+	}
+
+	aborted := 0
+	for {
+		output, err := s.client.ListMultipartUploads(ctx, input)
+		if err != nil {
+			return aborted, fmt.Errorf("failed to list multipart uploads: %w", err)
+		}
+		for _, upload := range output.Uploads {
+			if upload.Key == nil || upload.UploadId == nil || upload.Initiated == nil || upload.Initiated.After(cutoff) {
+				continue
+			}
+			_, err := s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(s.config.Bucket),
+				Key:      upload.Key,
+				UploadId: upload.UploadId,
+			})
+			if err != nil {
+				return aborted, fmt.Errorf("failed to abort multipart upload of %s: %w", *upload.Key, err)
+			}
+			aborted++
+			s.logger.Info("Aborted incomplete multipart upload",
+				slog.String("key", *upload.Key),
+				slog.Time("initiated", *upload.Initiated))
+		}
+		if output.IsTruncated == nil || !*output.IsTruncated {
+			return aborted, nil
+		}
+		input.KeyMarker = output.NextKeyMarker
+		input.UploadIdMarker = output.NextUploadIdMarker
+	}
+}
+
+// MetadataSuffix is appended to a backup key to form the key of its metadata object
+const MetadataSuffix = ".meta.json"
+
+// GlobalsSuffix is appended to a backup key to form the key of its roles and tablespaces dump
+const GlobalsSuffix = ".globals.sql"
+
+// BackupMetadata is stored next to each backup as <key>.meta.json
+type BackupMetadata struct {
+	Database     string                `json:"database"`
+	RunID        string                `json:"run_id,omitempty"` // Backup run that took the backup, shared by the databases of one run
+	Label        string                `json:"label,omitempty"`  // Label of the run that took the backup, e.g. "pre-upgrade"
+	Labels       []string              `json:"labels,omitempty"` // Labels from backup.labels
+	Reason       string                `json:"reason,omitempty"` // Why the backup was taken
+	CreatedAt    time.Time             `json:"created_at"`
+	Size         int64                 `json:"size"`
+	SHA256       string                `json:"sha256,omitempty"`
+	Compression  string                `json:"compression"`
+	DumpFormat   string                `json:"dump_format,omitempty"` // Archive format version from the dump header, e.g. 1.16
+	Verified     bool                  `json:"verified"`
+	Pinned       bool                  `json:"pinned,omitempty"` // Never deleted by retention cleanup
+	Globals      bool                  `json:"globals,omitempty"` // Roles and tablespaces are stored at <key>.globals.sql
+	PinnedAt     *time.Time            `json:"pinned_at,omitempty"`
+	Verification *VerificationMetadata `json:"verification,omitempty"`
+	Drill        *DrillMetadata        `json:"drill,omitempty"` // Last restore drill of the backup
+	Promotion    *PromotionMetadata    `json:"promotion,omitempty"`
+	Server       *ServerMetadata       `json:"server,omitempty"`
+}
+
+// HasLabel reports whether the backup carries any of labels, as its run label or in Labels
+func (m *BackupMetadata) HasLabel(labels []string) bool {
+	for _, label := range labels {
+		if m.Label == label || slices.Contains(m.Labels, label) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServerMetadata describes the PostgreSQL server a backup was taken from
+type ServerMetadata struct {
+	Version    string            `json:"version"`     // SELECT version()
+	VersionNum int               `json:"version_num"` // server_version_num, e.g. 160002
+	Extensions map[string]string `json:"extensions"`  // extension name -> installed version
+}
+
+// PromotionMetadata records where a promoted backup was copied from
+type PromotionMetadata struct {
+	SourceBucket string    `json:"source_bucket"`
+	SourceKey    string    `json:"source_key"`
+	PromotedAt   time.Time `json:"promoted_at"`
+}
+
+// VerificationMetadata records the outcome of a scratch restore of the backup
+type VerificationMetadata struct {
+	VerifiedAt time.Time `json:"verified_at"`
+	Host       string    `json:"host"`
+	Tables     int       `json:"tables"`
+	Rows       int64     `json:"rows"`
+	Checks     int       `json:"checks,omitempty"` // Custom verify checks that passed
+	Duration   string    `json:"duration"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// DrillMetadata records the outcome of the last restore drill of the backup
+type DrillMetadata struct {
+	DrilledAt time.Time `json:"drilled_at"`
+	Tables    int       `json:"tables"`
+	Rows      int64     `json:"rows"`
+	Checks    int       `json:"checks,omitempty"` // Drill checks that passed
+	Duration  string    `json:"duration"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// PutMetadata writes the metadata object for a backup, replacing any previous version
+func (s *S3Client) PutMetadata(ctx context.Context, backupKey string, metadata *BackupMetadata) error {
+	return s.putMetadata(ctx, s.config.Bucket, backupKey, metadata)
+}
+
+func (s *S3Client) putMetadata(ctx context.Context, bucket, backupKey string, metadata *BackupMetadata) error {
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal backup metadata: %w", err)
+	}
+
+	_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(backupKey + MetadataSuffix),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload backup metadata: %w", err)
+	}
 	return nil
 }
 
-func (s *S3Client) CleanupOldBackups(ctx context.Context, retentionCount int) error {
-	s.logger.Info("Starting backup cleanup",
-		slog.Int("retention_count", retentionCount))
+// SetPinned pins or unpins a backup. Pinned backups are kept by CleanupOldBackups regardless
+// of the retention policy. Backups without metadata get a minimal metadata file.
+func (s *S3Client) SetPinned(ctx context.Context, key string, pinned bool) error {
+	headOutput, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get object metadata: %w", err)
+	}
+
+	metadata, err := s.GetMetadata(ctx, key)
+	if err != nil {
+		s.logger.Debug("No metadata for backup, creating it",
+			slog.String("error", err.Error()))
+		metadata = &BackupMetadata{
+			Database:    BackupDatabase(key),
+			CreatedAt:   aws.ToTime(headOutput.LastModified),
+			Size:        aws.ToInt64(headOutput.ContentLength),
+			Compression: compression.Detect(key),
+		}
+	}
+
+	metadata.Pinned = pinned
+	metadata.PinnedAt = nil
+	if pinned {
+		now := time.Now().UTC()
+		metadata.PinnedAt = &now
+	}
+	return s.PutMetadata(ctx, key, metadata)
+}
+
+// PutGlobals stores the pg_dumpall --globals-only output taken with a backup
+func (s *S3Client) PutGlobals(ctx context.Context, backupKey string, sql []byte) error {
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.config.Bucket),
+		Key:         aws.String(backupKey + GlobalsSuffix),
+		Body:        bytes.NewReader(sql),
+		ContentType: aws.String("application/sql"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload globals: %w", err)
+	}
+	return nil
+}
+
+// GetGlobals reads the globals dump stored with a backup by PutGlobals
+func (s *S3Client) GetGlobals(ctx context.Context, backupKey string) ([]byte, error) {
+	output, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(backupKey + GlobalsSuffix),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get globals: %w", err)
+	}
+	defer output.Body.Close()
+
+	sql, err := io.ReadAll(output.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read globals: %w", err)
+	}
+	return sql, nil
+}
+
+// GetMetadata reads the metadata object for a backup; backups taken before metadata existed
+// return an error
+func (s *S3Client) GetMetadata(ctx context.Context, backupKey string) (*BackupMetadata, error) {
+	output, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(backupKey + MetadataSuffix),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get backup metadata: %w", err)
+	}
+	defer output.Body.Close()
+
+	var metadata BackupMetadata
+	if err := json.NewDecoder(output.Body).Decode(&metadata); err != nil {
+		return nil, fmt.Errorf("failed to parse backup metadata: %w", err)
+	}
+	return &metadata, nil
+}
+
+// LatestPointerName is the name of the object pointing at the newest backup of a database,
+// stored at <prefix><database>/latest.json
+const LatestPointerName = "latest.json"
+
+// LatestPointer lets restores and external tools resolve the newest backup of a database with a
+// single GET instead of listing the bucket
+type LatestPointer struct {
+	Database  string    `json:"database"`
+	Key       string    `json:"key"`
+	SHA256    string    `json:"sha256,omitempty"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// PutLatestPointer points the latest.json of the pointer's database at its backup. A pointer to a
+// newer backup is left alone, so a resumed older run never moves it back.
+func (s *S3Client) PutLatestPointer(ctx context.Context, pointer *LatestPointer) error {
+	if current, err := s.GetLatestPointer(ctx, pointer.Database); err == nil && current.CreatedAt.After(pointer.CreatedAt) {
+		s.logger.Debug("Latest pointer already references a newer backup", slog.String("key", current.Key))
+		return nil
+	}
+
+	data, err := json.MarshalIndent(pointer, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal latest pointer: %w", err)
+	}
+	_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.config.Bucket),
+		Key:         aws.String(s.latestPointerKey(pointer.Database)),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload latest pointer: %w", err)
+	}
+	return nil
+}
+
+// GetLatestPointer reads the latest.json of a database; databases whose last backup predates
+// the pointer return an error
+func (s *S3Client) GetLatestPointer(ctx context.Context, database string) (*LatestPointer, error) {
+	output, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(s.latestPointerKey(database)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get latest pointer: %w", err)
+	}
+	defer output.Body.Close()
+
+	var pointer LatestPointer
+	if err := json.NewDecoder(output.Body).Decode(&pointer); err != nil {
+		return nil, fmt.Errorf("failed to parse latest pointer: %w", err)
+	}
+	if pointer.Key == "" {
+		return nil, fmt.Errorf("latest pointer of %s has no key", database)
+	}
+	return &pointer, nil
+}
+
+func (s *S3Client) latestPointerKey(database string) string {
+	prefix := s.config.Prefix
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return prefix + database + "/" + LatestPointerName
+}
+
+// maxCopyObjectSize is the largest object a single CopyObject request can copy
+const maxCopyObjectSize = 5 * 1024 * 1024 * 1024
+
+// ParseLocation splits a promotion target of the form [s3://]bucket[/prefix]
+func ParseLocation(location string) (bucket, prefix string, err error) {
+	location = strings.TrimPrefix(location, "s3://")
+	bucket, prefix, _ = strings.Cut(location, "/")
+	if bucket == "" {
+		return "", "", fmt.Errorf("invalid location %q: expected bucket[/prefix]", location)
+	}
+	return bucket, strings.Trim(prefix, "/"), nil
+}
+
+// PromoteBackup copies a backup and its metadata to destBucket/destPrefix without downloading
+// it, for refreshing another environment from this one. The copy is done server-side when the
+// object fits in a single CopyObject request and streamed through this process otherwise.
+// Returns the destination key.
+func (s *S3Client) PromoteBackup(ctx context.Context, key, destBucket, destPrefix string) (string, error) {
+	destKey := filepath.Base(key)
+	if destPrefix != "" {
+		destKey = strings.TrimSuffix(destPrefix, "/") + "/" + destKey
+	}
+	if destBucket == s.config.Bucket && destKey == key {
+		return "", fmt.Errorf("promotion target is the source backup itself")
+	}
+
+	headOutput, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get object metadata: %w", err)
+	}
+	size := aws.ToInt64(headOutput.ContentLength)
+
+	s.logger.Info("Promoting backup",
+		slog.String("source", s.config.Bucket+"/"+key),
+		slog.String("destination", destBucket+"/"+destKey),
+		slog.Int64("size", size))
+
+	copied := false
+	if size <= maxCopyObjectSize {
+		_, err := s.client.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:     aws.String(destBucket),
+			Key:        aws.String(destKey),
+			CopySource: aws.String((&url.URL{Path: s.config.Bucket + "/" + key}).EscapedPath()),
+		})
+		if err == nil {
+			copied = true
+		} else {
+			s.logger.Warn("Server-side copy failed, streaming the backup instead",
+				slog.String("error", err.Error()))
+		}
+	}
+
+	if !copied {
+		output, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(s.config.Bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to read backup: %w", err)
+		}
+		defer output.Body.Close()
+
+		_, err = s.uploader.Upload(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(destBucket),
+			Key:    aws.String(destKey),
+			Body:   output.Body,
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to copy backup: %w", err)
+		}
+	}
+	s.invalidateListCache()
+
+	metadata, err := s.GetMetadata(ctx, key)
+	if err != nil {
+		s.logger.Debug("No metadata for source backup, recording promotion only",
+			slog.String("error", err.Error()))
+		metadata = &BackupMetadata{
+			Database:    BackupDatabase(key),
+			CreatedAt:   aws.ToTime(headOutput.LastModified),
+			Size:        size,
+			Compression: compression.Detect(key),
+		}
+	}
+	metadata.Promotion = &PromotionMetadata{
+		SourceBucket: s.config.Bucket,
+		SourceKey:    key,
+		PromotedAt:   time.Now().UTC(),
+	}
+	if metadata.Globals {
+		_, err := s.client.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:     aws.String(destBucket),
+			Key:        aws.String(destKey + GlobalsSuffix),
+			CopySource: aws.String((&url.URL{Path: s.config.Bucket + "/" + key + GlobalsSuffix}).EscapedPath()),
+		})
+		if err != nil {
+			s.logger.Warn("Failed to copy globals, the promoted backup has none", slog.String("error", err.Error()))
+			metadata.Globals = false
+		}
+	}
+	if err := s.putMetadata(ctx, destBucket, destKey, metadata); err != nil {
+		return "", err
+	}
+
+	s.logger.Info("Backup promoted",
+		slog.String("key", destKey),
+		slog.Bool("server_side", copied))
+
+	return destKey, nil
+}
+
+// UploadIncident stores the given evidence files below <prefix>/<incidentPrefix>/<runID>/ and
+// returns the key prefix they were written to
+func (s *S3Client) UploadIncident(ctx context.Context, incidentPrefix, runID string, files map[string][]byte) (string, error) {
+	prefix := s.config.Prefix
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	incidentKey := fmt.Sprintf("%s%s/%s/", prefix, strings.Trim(incidentPrefix, "/"), runID)
+
+	for name, data := range files {
+		key := incidentKey + name
+		_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:      aws.String(s.config.Bucket),
+			Key:         aws.String(key),
+			Body:        bytes.NewReader(data),
+			ContentType: aws.String("text/plain; charset=utf-8"),
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to upload incident file %s: %w", name, err)
+		}
+		s.logger.Debug("Uploaded incident file", slog.String("key", key), slog.Int("size", len(data)))
+	}
+
+	s.logger.Info("Incident evidence uploaded",
+		slog.String("key", incidentKey),
+		slog.Int("files", len(files)))
+
+	return incidentKey, nil
+}
+
+// AcquireLock creates the lock object <prefix>locks/<name>.lock with a conditional write so
+// only one run can hold it. A lock older than staleAfter is assumed to be left behind by a
+// crashed run and is replaced.
+func (s *S3Client) AcquireLock(ctx context.Context, name string, owner []byte, staleAfter time.Duration) error {
+	key := s.lockKey(name)
+
+	for attempt := 0; attempt < 2; attempt++ {
+		_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:      aws.String(s.config.Bucket),
+			Key:         aws.String(key),
+			Body:        bytes.NewReader(owner),
+			ContentType: aws.String("application/json"),
+			IfNoneMatch: aws.String("*"),
+		})
+		if err == nil {
+			s.logger.Debug("Acquired S3 lock", slog.String("key", key))
+			return nil
+		}
+		if !isConditionFailed(err) {
+			return fmt.Errorf("failed to create S3 lock %s: %w", key, err)
+		}
+
+		head, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(s.config.Bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			// The holder may have just released it; report it as held rather than guessing
+			return fmt.Errorf("%w: S3 lock %s", lock.ErrLocked, key)
+		}
+		if head.LastModified == nil || time.Since(*head.LastModified) < staleAfter {
+			return fmt.Errorf("%w: S3 lock %s (held since %s)", lock.ErrLocked, key, aws.ToTime(head.LastModified).Format(time.RFC3339))
+		}
+
+		s.logger.Warn("Taking over stale S3 lock",
+			slog.String("key", key),
+			slog.Time("acquired_at", *head.LastModified))
+
+		// Only delete the exact lock we inspected, not one a concurrent run just created
+		_, err = s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket:  aws.String(s.config.Bucket),
+			Key:     aws.String(key),
+			IfMatch: head.ETag,
+		})
+		if err != nil && !isConditionFailed(err) {
+			return fmt.Errorf("failed to remove stale S3 lock %s: %w", key, err)
+		}
+	}
+
+	return fmt.Errorf("%w: S3 lock %s", lock.ErrLocked, key)
+}
+
+// ReleaseLock removes the lock object AcquireLock created for owner. A lock another owner has
+// taken over in the meantime is left alone and reported with lock.ErrLocked.
+func (s *S3Client) ReleaseLock(ctx context.Context, name string, owner []byte) error {
+	key := s.lockKey(name)
+
+	current, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(key),
+	})
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read S3 lock %s: %w", key, err)
+	}
+	holder, err := io.ReadAll(current.Body)
+	current.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read S3 lock %s: %w", key, err)
+	}
+	if !bytes.Equal(holder, owner) {
+		return fmt.Errorf("%w: S3 lock %s (held by %s)", lock.ErrLocked, key, strings.TrimSpace(string(holder)))
+	}
+
+	// Only delete the version we read, not one a taking over run just wrote
+	_, err = s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket:  aws.String(s.config.Bucket),
+		Key:     aws.String(key),
+		IfMatch: current.ETag,
+	})
+	if isConditionFailed(err) {
+		return fmt.Errorf("%w: S3 lock %s", lock.ErrLocked, key)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to release S3 lock %s: %w", key, err)
+	}
+	s.logger.Debug("Released S3 lock", slog.String("key", key))
+	return nil
+}
+
+// RenewLock rewrites the lock object AcquireLock created for owner, which restarts its age for
+// stale detection. It fails with lock.ErrLocked once another owner has taken the lock over.
+func (s *S3Client) RenewLock(ctx context.Context, name string, owner []byte) error {
+	key := s.lockKey(name)
+
+	current, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(key),
+	})
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		// Removed by hand or taken over and released again; recreate it unless someone was faster
+		_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:      aws.String(s.config.Bucket),
+			Key:         aws.String(key),
+			Body:        bytes.NewReader(owner),
+			ContentType: aws.String("application/json"),
+			IfNoneMatch: aws.String("*"),
+		})
+		if isConditionFailed(err) {
+			return fmt.Errorf("%w: S3 lock %s", lock.ErrLocked, key)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to renew S3 lock %s: %w", key, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read S3 lock %s: %w", key, err)
+	}
+	holder, err := io.ReadAll(current.Body)
+	current.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read S3 lock %s: %w", key, err)
+	}
+	if !bytes.Equal(holder, owner) {
+		return fmt.Errorf("%w: S3 lock %s (held by %s)", lock.ErrLocked, key, strings.TrimSpace(string(holder)))
+	}
+
+	// Only replace the version we read, not one a taking over run just wrote
+	_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.config.Bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(owner),
+		ContentType: aws.String("application/json"),
+		IfMatch:     current.ETag,
+	})
+	if isConditionFailed(err) {
+		return fmt.Errorf("%w: S3 lock %s", lock.ErrLocked, key)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to renew S3 lock %s: %w", key, err)
+	}
+	s.logger.Debug("Renewed S3 lock", slog.String("key", key))
+	return nil
+}
+
+func (s *S3Client) lockKey(name string) string {
+	prefix := s.config.Prefix
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return fmt.Sprintf("%slocks/%s.lock", prefix, name)
+}
+
+// isConditionFailed reports whether a conditional request lost against an existing object
+func isConditionFailed(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "PreconditionFailed", "ConditionalRequestConflict":
+			return true
+		}
+	}
+	return false
+}
+
+// listObjects returns every object below the configured prefix. Results are cached for
+// list_cache_ttl so one invocation doesn't paginate a large bucket several times, and page
+// requests are spaced out according to list_rate_limit.
+func (s *S3Client) listObjects(ctx context.Context) ([]types.Object, error) {
+	s.listMu.Lock()
+	defer s.listMu.Unlock()
+
+	if s.listCache != nil && time.Since(s.listCachedAt) < s.config.ListCacheTTL {
+		s.logger.Debug("Using cached bucket listing",
+			slog.Int("objects", len(s.listCache)),
+			slog.Duration("age", time.Since(s.listCachedAt)))
+		return s.listCache, nil
+	}
 
 	prefix := s.config.Prefix
 	if prefix != "" && !strings.HasSuffix(prefix, "/") {
 		prefix += "/"
 	}
 
-	// List all backup objects
 	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
 		Bucket: aws.String(s.config.Bucket),
 		Prefix: aws.String(prefix),
 	})
 
+	var objects []types.Object
+	pages := 0
+	for paginator.HasMorePages() {
+		if err := s.waitForListSlot(ctx); err != nil {
+			return nil, err
+		}
+
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, page.Contents...)
+		pages++
+	}
+
+	s.logger.Debug("Listed bucket",
+		slog.Int("objects", len(objects)),
+		slog.Int("pages", pages))
+
+	s.listCache = objects
+	s.listCachedAt = time.Now()
+	return objects, nil
+}
+
+// waitForListSlot blocks until the next ListObjects page request is allowed by list_rate_limit
+func (s *S3Client) waitForListSlot(ctx context.Context) error {
+	if s.config.ListRateLimit <= 0 {
+		return nil
+	}
+
+	interval := time.Duration(float64(time.Second) / s.config.ListRateLimit)
+	if wait := interval - time.Since(s.lastListPage); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	s.lastListPage = time.Now()
+	return nil
+}
+
+// invalidateListCache drops the cached listing after the bucket contents changed
+func (s *S3Client) invalidateListCache() {
+	s.listMu.Lock()
+	defer s.listMu.Unlock()
+	s.listCache = nil
+}
+
+// CleanupResult is what a retention run did. Kept is nil when the bucket couldn't be listed.
+type CleanupResult struct {
+	Deleted int            // Backups deleted
+	Failed  int            // Backups that failed to delete
+	Kept    map[string]int // Backups left per database, keyed like BackupDatabase
+}
+
+// CleanupOldBackups keeps the newest retentionCount backups of each database and deletes the
+// rest; databases in overrides keep their own count instead. Older backups with any of
+// keepLabels in their metadata are kept as well. Nothing is deleted if more than maxDeletions
+// backups would be (0 = unlimited).
+func (s *S3Client) CleanupOldBackups(ctx context.Context, retentionCount int, overrides map[string]int, keepLabels []string, maxDeletions int) (CleanupResult, error) {
+	var result CleanupResult
+	// The overrides name databases as configured, the keys as sanitized
+	keyOverrides := make(map[string]int, len(overrides))
+	for database, count := range overrides {
+		keyOverrides[KeyDatabase(database)] = count
+	}
+	s.logger.Info("Starting backup cleanup",
+		slog.Int("retention_count", retentionCount))
+
+	objects, err := s.listObjects(ctx)
+	if err != nil {
+		s.logger.Error("Failed to list objects", slog.String("error", err.Error()))
+		return result, fmt.Errorf("failed to list backups: %w", err)
+	}
+
 	type backupInfo struct {
 		Key          *string
 		LastModified *time.Time
 	}
 	var allBackups []backupInfo
 
-	for paginator.HasMorePages() {
-		page, err := paginator.NextPage(ctx)
-		if err != nil {
-			s.logger.Error("Failed to list objects", slog.String("error", err.Error()))
-			return fmt.Errorf("failed to list backups: %w", err)
-		}
-
-		for _, obj := range page.Contents {
-			// Only include files that match our backup pattern
-			if obj.Key != nil && strings.HasPrefix(filepath.Base(*obj.Key), "backup-") && strings.HasSuffix(*obj.Key, ".dump") {
-				allBackups = append(allBackups, backupInfo{
-					Key:          obj.Key,
-					LastModified: obj.LastModified,
-				})
-			}
+	for _, obj := range objects {
+		// Only include files that match our backup pattern
+		if obj.Key != nil && strings.HasPrefix(filepath.Base(*obj.Key), "backup-") && compression.IsDumpFile(*obj.Key) {
+			allBackups = append(allBackups, backupInfo{
+				Key:          obj.Key,
+				LastModified: obj.LastModified,
+			})
 		}
 	}
 
@@ -197,78 +943,170 @@ func (s *S3Client) CleanupOldBackups(ctx context.Context, retentionCount int) er
 	}
 
 	s.logger.Info("Found backups", slog.Int("total", len(allBackups)))
-
-	// Keep only the most recent backups
-	if len(allBackups) <= retentionCount {
-		s.logger.Info("No backups to delete", 
-			slog.Int("current_count", len(allBackups)),
-			slog.Int("retention_count", retentionCount))
-		return nil
+	result.Kept = make(map[string]int)
+	for _, backup := range allBackups {
+		result.Kept[BackupDatabase(*backup.Key)]++
 	}
 
-	// Delete older backups
+	// Keep only the most recent backups of each database
 	var objectsToDelete []types.ObjectIdentifier
-	for i := retentionCount; i < len(allBackups); i++ {
+	kept := make(map[string]int)
+	for _, backup := range allBackups {
+		database := BackupDatabase(*backup.Key)
+		count := retentionCount
+		if override, ok := keyOverrides[database]; ok {
+			count = override
+		}
+		if kept[database] < count {
+			kept[database]++
+			continue
+		}
+		// Backups without metadata are neither pinned nor labeled and are deleted as usual
+		if metadata, err := s.GetMetadata(ctx, *backup.Key); err == nil {
+			if metadata.Pinned {
+				s.logger.Info("Keeping pinned backup", slog.String("key", *backup.Key))
+				continue
+			}
+			if len(keepLabels) > 0 && metadata.HasLabel(keepLabels) {
+				s.logger.Info("Keeping labeled backup",
+					slog.String("key", *backup.Key),
+					slog.String("label", metadata.Label),
+					slog.String("labels", strings.Join(metadata.Labels, ",")))
+				continue
+			}
+		}
+		// Deleting the globals object of a backup that has none is a no-op
 		objectsToDelete = append(objectsToDelete, types.ObjectIdentifier{
-			Key: allBackups[i].Key,
+			Key: backup.Key,
+		}, types.ObjectIdentifier{
+			Key: aws.String(*backup.Key + MetadataSuffix),
+		}, types.ObjectIdentifier{
+			Key: aws.String(*backup.Key + GlobalsSuffix),
 		})
 		s.logger.Debug("Marking for deletion",
-			slog.String("key", *allBackups[i].Key),
-			slog.Time("modified", *allBackups[i].LastModified))
+			slog.String("key", *backup.Key),
+			slog.Time("modified", *backup.LastModified))
+	}
+
+	if len(objectsToDelete) == 0 {
+		s.logger.Info("No backups to delete", 
+			slog.Int("current_count", len(allBackups)),
+			slog.Int("retention_count", retentionCount))
+		return result, nil
+	}
+
+	if maxDeletions > 0 && len(objectsToDelete)/objectsPerBackup > maxDeletions {
+		return result, fmt.Errorf("retention would delete %d backups, more than safety.max_deletions_per_cleanup (%d); nothing was deleted, rerun with -override-limits if this is intended",
+			len(objectsToDelete)/objectsPerBackup, maxDeletions)
 	}
 
-	if len(objectsToDelete) > 0 {
+	// DeleteObjects takes at most maxDeleteKeys keys per request
+	var failures []error
+	for batch := range slices.Chunk(objectsToDelete, maxDeleteKeys) {
 		deleteInput := &s3.DeleteObjectsInput{
 			Bucket: aws.String(s.config.Bucket),
 			Delete: &types.Delete{
-				Objects: objectsToDelete,
+				Objects: batch,
 				Quiet:   aws.Bool(false),
 			},
 		}
 
 		deleteOutput, err := s.client.DeleteObjects(ctx, deleteInput)
+		s.invalidateListCache()
 		if err != nil {
-			return fmt.Errorf("failed to delete old backups: %w", err)
+			return result, fmt.Errorf("failed to delete old backups after deleting %d: %w", result.Deleted, err)
 		}
 
 		for _, deleted := range deleteOutput.Deleted {
 			s.logger.Info("Deleted old backup", slog.String("key", *deleted.Key))
+			// The metadata and globals objects go along with their dump
+			if compression.IsDumpFile(*deleted.Key) {
+				result.Deleted++
+				result.Kept[BackupDatabase(*deleted.Key)]--
+			}
 		}
-		
-		var errors []error
+
 		for _, failed := range deleteOutput.Errors {
 			s.logger.Error("Failed to delete object",
 				slog.String("key", *failed.Key),
 				slog.String("error", *failed.Message))
-			errors = append(errors, fmt.Errorf("delete failed for %s: %s", *failed.Key, *failed.Message))
-		}
-		
-		if len(errors) > 0 {
-			return fmt.Errorf("cleanup completed with %d errors", len(errors))
+			failures = append(failures, fmt.Errorf("delete failed for %s: %s", *failed.Key, *failed.Message))
+			if compression.IsDumpFile(*failed.Key) {
+				result.Failed++
+			}
 		}
 	}
+	if len(failures) > 0 {
+		return result, fmt.Errorf("cleanup completed with %d errors", len(failures))
+	}
 
 	s.logger.Info("Cleanup completed",
-		slog.Int("deleted_count", len(objectsToDelete)),
-		slog.Int("kept_count", retentionCount))
+		slog.Int("deleted_count", result.Deleted),
+		slog.Int("kept_count", len(allBackups)-result.Deleted))
 
-	return nil
+	return result, nil
 }
 
-func (s *S3Client) generateBackupKey(filename string) string {
+// maxDeleteKeys is the most keys S3 accepts in one DeleteObjects request
+const maxDeleteKeys = 1000
+
+// objectsPerBackup is how many objects cleanup deletes per backup: the dump, its metadata and
+// its globals
+const objectsPerBackup = 3
+
+// backupNameRegex matches dump file names: backup_<ts>.dump for single database runs and
+// backup_<database>_<ts>.dump when several databases are configured
+var backupNameRegex = regexp.MustCompile(`backup_(?:(.+)_)?(\d{8}_\d{6})\.dump`)
+
+// unsafeKeyChars are replaced with "-" in the database names of backup keys
+var unsafeKeyChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// KeyDatabase returns a database name the way backup keys carry it, which is what
+// BackupDatabase returns for them
+func KeyDatabase(database string) string {
+	return unsafeKeyChars.ReplaceAllString(database, "-")
+}
+
+// BackupDatabase returns the database encoded in a backup key, or "" for single database backups
+func BackupDatabase(key string) string {
+	match := backupNameRegex.FindStringSubmatch(filepath.Base(key))
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+// BackupTime returns when the dump of a backup key started, as encoded in its file name (UTC)
+func BackupTime(key string) (time.Time, bool) {
+	match := backupNameRegex.FindStringSubmatch(filepath.Base(key))
+	if match == nil {
+		return time.Time{}, false
+	}
+	t, err := time.Parse("20060102_150405", match[2])
+	return t, err == nil
+}
+
+func (s *S3Client) generateBackupKey(subPrefix, filename string) string {
 	timestamp := time.Now().UTC().Format("20060102-150405")
 	prefix := s.config.Prefix
 	if prefix != "" && !strings.HasSuffix(prefix, "/") {
 		prefix += "/"
 	}
+	if subPrefix != "" {
+		prefix += subPrefix + "/"
+	}
 	return fmt.Sprintf("%sbackup-%s-%s", prefix, timestamp, filename)
 }
 
+// progressReader reports how far the uploader has read the file. Progress is the reader's
+// position rather than a running total, so rereading after a Seek (e.g. when a request is
+// retried) never counts bytes twice or exceeds the file size. The uploader buffers parts
+// ahead of sending them, so progress can run ahead of the acknowledged upload by a few parts.
 type progressReader struct {
 	reader     *os.File
 	size       int64
-	read       int64
-	progressFn func(int64)
+	read       int64 // Current position in the file
+	progressFn func(int64, int64)
 	lastReport time.Time
 	logger     *slog.Logger
 }
@@ -278,7 +1116,7 @@ func (pr *progressReader) Read(p []byte) (int, error) {
 	if n > 0 {
 		pr.read += int64(n)
 		if pr.progressFn != nil && time.Since(pr.lastReport) > time.Second {
-			pr.progressFn(pr.read)
+			pr.progressFn(pr.read, pr.size)
 			percentage := float64(pr.read) / float64(pr.size) * 100
 			pr.logger.Info("Upload progress",
 				slog.Float64("percentage", percentage),
@@ -291,10 +1129,16 @@ func (pr *progressReader) Read(p []byte) (int, error) {
 }
 
 func (pr *progressReader) Seek(offset int64, whence int) (int64, error) {
-	return pr.reader.Seek(offset, whence)
+	position, err := pr.reader.Seek(offset, whence)
+	if err == nil {
+		pr.read = position
+	}
+	return position, err
 }
 
-func (s *S3Client) DownloadFile(ctx context.Context, key string, localPath string, progressFn func(int64)) error {
+// DownloadFile downloads a backup to localPath. progressFn is called with the downloaded and
+// total size once the download completed.
+func (s *S3Client) DownloadFile(ctx context.Context, key string, localPath string, progressFn func(int64, int64)) error {
 	s.logger.Info("Starting S3 download",
 		slog.String("bucket", s.config.Bucket),
 		slog.String("key", key),
@@ -334,7 +1178,7 @@ func (s *S3Client) DownloadFile(ctx context.Context, key string, localPath strin
 
 	// Call progress function with final size
 	if progressFn != nil {
-		progressFn(numBytes)
+		progressFn(numBytes, totalSize)
 	}
 
 	s.logger.Info("S3 download completed successfully",
@@ -344,36 +1188,117 @@ func (s *S3Client) DownloadFile(ctx context.Context, key string, localPath strin
 	return nil
 }
 
-func (s *S3Client) GetLatestBackup(ctx context.Context) (string, error) {
-	s.logger.Info("Getting latest backup from S3")
+// streamPartSize is the size of the ranged requests DownloadStream fetches concurrently
+const streamPartSize = 16 * 1024 * 1024
 
-	prefix := s.config.Prefix
-	if prefix != "" && !strings.HasSuffix(prefix, "/") {
-		prefix += "/"
+// DownloadStream writes a backup to w in order while up to concurrency ranged requests fetch
+// the following parts, so whatever consumes w runs alongside the download. At most
+// concurrency parts are held in memory. progressFn is called with the written and total size
+// after every part.
+func (s *S3Client) DownloadStream(ctx context.Context, key string, w io.Writer, concurrency int, progressFn func(int64, int64)) (int64, error) {
+	headOutput, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get object metadata: %w", err)
+	}
+	totalSize := aws.ToInt64(headOutput.ContentLength)
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	s.logger.Info("Starting S3 streaming download",
+		slog.String("bucket", s.config.Bucket),
+		slog.String("key", key),
+		slog.Int64("bytes", totalSize),
+		slog.Int("concurrency", concurrency))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type part struct {
+		data []byte
+		err  error
 	}
+	// Parts are handed to the writer in order; the semaphore is released once a part is
+	// written, which bounds the parts fetched ahead of the writer
+	slots := make(chan chan part, concurrency)
+	sem := make(chan struct{}, concurrency)
+	go func() {
+		defer close(slots)
+		for start := int64(0); start < totalSize && ctx.Err() == nil; start += streamPartSize {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			end := min(start+streamPartSize, totalSize) - 1
+			slot := make(chan part, 1)
+			slots <- slot
+			go func() {
+				data, err := s.getRange(ctx, key, start, end)
+				slot <- part{data: data, err: err}
+			}()
+		}
+	}()
 
-	// List all backup objects
-	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+	var written int64
+	for slot := range slots {
+		p := <-slot
+		if p.err != nil {
+			return written, fmt.Errorf("S3 download failed at byte %d: %w", written, p.err)
+		}
+		if _, err := w.Write(p.data); err != nil {
+			return written, err
+		}
+		written += int64(len(p.data))
+		<-sem
+		if progressFn != nil {
+			progressFn(written, totalSize)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return written, err
+	}
+	if written != totalSize {
+		return written, fmt.Errorf("S3 download incomplete: got %d of %d bytes", written, totalSize)
+	}
+
+	s.logger.Info("S3 streaming download completed", slog.String("key", key), slog.Int64("size", written))
+	return written, nil
+}
+
+// getRange fetches the bytes start through end (inclusive) of an object
+func (s *S3Client) getRange(ctx context.Context, key string, start, end int64) ([]byte, error) {
+	output, err := s.client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(s.config.Bucket),
-		Prefix: aws.String(prefix),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
 	})
+	if err != nil {
+		return nil, err
+	}
+	defer output.Body.Close()
+	return io.ReadAll(output.Body)
+}
+
+func (s *S3Client) GetLatestBackup(ctx context.Context) (string, error) {
+	s.logger.Info("Getting latest backup from S3")
+
+	objects, err := s.listObjects(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to list backups: %w", err)
+	}
 
 	var latestBackup *types.Object
 	var latestTime time.Time
 
-	for paginator.HasMorePages() {
-		page, err := paginator.NextPage(ctx)
-		if err != nil {
-			return "", fmt.Errorf("failed to list backups: %w", err)
-		}
-
-		for _, obj := range page.Contents {
-			// Only include backup files
-			if obj.Key != nil && strings.Contains(*obj.Key, "backup_") && strings.HasSuffix(*obj.Key, ".dump") {
-				if obj.LastModified != nil && obj.LastModified.After(latestTime) {
-					latestTime = *obj.LastModified
-					latestBackup = &obj
-				}
+	for _, obj := range objects {
+		// Only include backup files
+		if obj.Key != nil && strings.Contains(*obj.Key, "backup_") && compression.IsDumpFile(*obj.Key) {
+			if obj.LastModified != nil && obj.LastModified.After(latestTime) {
+				latestTime = *obj.LastModified
+				latestBackup = &obj
 			}
 		}
 	}
@@ -389,58 +1314,42 @@ func (s *S3Client) GetLatestBackup(ctx context.Context) (string, error) {
 	return *latestBackup.Key, nil
 }
 
-func (s *S3Client) ListBackups(ctx context.Context) ([]string, error) {
-	s.logger.Info("Listing all backups from S3")
-
-	prefix := s.config.Prefix
-	if prefix != "" && !strings.HasSuffix(prefix, "/") {
-		prefix += "/"
-	}
-
-	// List all backup objects
-	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
-		Bucket: aws.String(s.config.Bucket),
-		Prefix: aws.String(prefix),
-	})
+// BackupObject is a backup file in the bucket
+type BackupObject struct {
+	Key          string
+	Database     string // As encoded in the key, "" for single database backups
+	Size         int64
+	LastModified time.Time
+}
 
-	type backupInfo struct {
-		Key          string
-		LastModified time.Time
+// ListBackupObjects returns the backup files retention applies to, newest first
+func (s *S3Client) ListBackupObjects(ctx context.Context) ([]BackupObject, error) {
+	objects, err := s.listObjects(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
 	}
-	var backups []backupInfo
 
-	for paginator.HasMorePages() {
-		page, err := paginator.NextPage(ctx)
-		if err != nil {
-			return nil, fmt.Errorf("failed to list backups: %w", err)
+	var backups []BackupObject
+	for _, obj := range objects {
+		if obj.Key == nil || obj.LastModified == nil {
+			continue
 		}
-
-		for _, obj := range page.Contents {
-			// Only include backup files
-			if obj.Key != nil && strings.Contains(*obj.Key, "backup_") && strings.HasSuffix(*obj.Key, ".dump") {
-				backups = append(backups, backupInfo{
-					Key:          *obj.Key,
-					LastModified: *obj.LastModified,
-				})
-			}
+		if !strings.HasPrefix(filepath.Base(*obj.Key), "backup-") || !compression.IsDumpFile(*obj.Key) {
+			continue
 		}
-	}
-
-	// Sort by modification time (newest first)
-	for i := 0; i < len(backups)-1; i++ {
-		for j := i + 1; j < len(backups); j++ {
-			if backups[i].LastModified.Before(backups[j].LastModified) {
-				backups[i], backups[j] = backups[j], backups[i]
-			}
+		backup := BackupObject{
+			Key:          *obj.Key,
+			Database:     BackupDatabase(*obj.Key),
+			LastModified: *obj.LastModified,
 		}
+		if obj.Size != nil {
+			backup.Size = *obj.Size
+		}
+		backups = append(backups, backup)
 	}
 
-	// Convert to string slice
-	result := make([]string, len(backups))
-	for i, backup := range backups {
-		result[i] = backup.Key
-	}
-
-	return result, nil
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[i].LastModified.After(backups[j].LastModified)
+	})
+	return backups, nil
 }
-
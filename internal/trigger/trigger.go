@@ -0,0 +1,245 @@
+package trigger
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hra42/pg_backup/internal/backup"
+	"github.com/hra42/pg_backup/internal/config"
+)
+
+// maxReasonLength bounds the free-text reason stored with a triggered backup
+const maxReasonLength = 256
+
+// ErrBusy is returned by a task that is already running
+var ErrBusy = errors.New("already running")
+
+// Tasks run the restores and cleanups requested through the endpoint. They are provided by
+// the scheduler, so they don't run at the same time as its own runs; a nil task isn't offered.
+type Tasks struct {
+	Restore func(ctx context.Context, backupKey string) error // backupKey "" restores restore.backup_key or the latest backup
+	Cleanup func(ctx context.Context) error
+}
+
+// Response is returned by the trigger endpoints once the triggered run finished
+type Response struct {
+	Task      string            `json:"task,omitempty"` // "backup", "restore" or "cleanup"
+	RunID     string            `json:"run_id,omitempty"`
+	Label     string            `json:"label,omitempty"`
+	BackupKey string            `json:"backup_key,omitempty"` // Requested backup of a restore
+	Success   bool              `json:"success"`
+	Keys      map[string]string `json:"keys,omitempty"` // Uploaded backup key per database
+	Duration  string            `json:"duration,omitempty"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// Server accepts authenticated requests from external systems (e.g. CI deploy pipelines) to
+// run a backup, restore or cleanup and waits for it to finish. Only one triggered backup runs
+// at a time.
+type Server struct {
+	config  *config.Config
+	logger  *slog.Logger
+	server  *http.Server
+	runCtx  context.Context // Cancels running backups on shutdown
+	running sync.Mutex
+	tasks   Tasks
+}
+
+// NewServer returns a server whose runs are canceled, and clean up after themselves, when ctx
+// is canceled
+func NewServer(ctx context.Context, cfg *config.Config, logger *slog.Logger, tasks Tasks) *Server {
+	s := &Server{
+		config: cfg,
+		logger: logger,
+		runCtx: ctx,
+		tasks:  tasks,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/trigger/backup", s.handleBackup)
+	mux.HandleFunc("/backup", s.handleBackup) // Path of earlier versions
+	if tasks.Restore != nil {
+		mux.HandleFunc("/trigger/restore", s.handleRestore)
+	}
+	if tasks.Cleanup != nil {
+		mux.HandleFunc("/trigger/cleanup", s.handleCleanup)
+	}
+	s.server = &http.Server{
+		Addr:              cfg.Trigger.Listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return s
+}
+
+// ListenAndServe serves trigger requests until Shutdown is called
+func (s *Server) ListenAndServe() error {
+	var err error
+	if s.config.Trigger.TLSCert != "" {
+		s.logger.Info("Trigger endpoint listening", slog.String("address", s.config.Trigger.Listen), slog.String("scheme", "https"))
+		err = s.server.ListenAndServeTLS(s.config.Trigger.TLSCert, s.config.Trigger.TLSKey)
+	} else {
+		s.logger.Info("Trigger endpoint listening", slog.String("address", s.config.Trigger.Listen), slog.String("scheme", "http"))
+		err = s.server.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops accepting requests; a backup already running keeps going until ctx expires or
+// the server's context is canceled
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
+
+// accept answers requests that aren't authenticated POST requests and reports whether the
+// request may go on
+func (s *Server) accept(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: "method not allowed"})
+		return false
+	}
+	if !s.authorized(r) {
+		s.logger.Warn("Rejected unauthenticated trigger request", slog.String("remote", r.RemoteAddr))
+		writeJSON(w, http.StatusUnauthorized, Response{Error: "unauthorized"})
+		return false
+	}
+	return true
+}
+
+func (s *Server) handleBackup(w http.ResponseWriter, r *http.Request) {
+	if !s.accept(w, r) {
+		return
+	}
+
+	label := r.URL.Query().Get("label")
+	if label != "" && !config.ValidLabel(label) {
+		writeJSON(w, http.StatusBadRequest, Response{Error: "label must be 1-64 characters of letters, digits, '.', '_' or '-'"})
+		return
+	}
+	reason := r.URL.Query().Get("reason")
+	if len(reason) > maxReasonLength {
+		writeJSON(w, http.StatusBadRequest, Response{Label: label, Error: fmt.Sprintf("reason must not exceed %d characters", maxReasonLength)})
+		return
+	}
+
+	if !s.running.TryLock() {
+		writeJSON(w, http.StatusConflict, Response{Label: label, Error: "a triggered backup is already running"})
+		return
+	}
+	defer s.running.Unlock()
+
+	s.logger.Info("Backup triggered via webhook",
+		slog.String("label", label),
+		slog.String("reason", reason),
+		slog.String("remote", r.RemoteAddr))
+
+	response, status := s.runBackup(label, reason)
+	writeJSON(w, status, response)
+}
+
+func (s *Server) handleRestore(w http.ResponseWriter, r *http.Request) {
+	if !s.accept(w, r) {
+		return
+	}
+
+	backupKey := r.URL.Query().Get("backup_key")
+	s.logger.Info("Restore triggered via webhook",
+		slog.String("backup_key", backupKey),
+		slog.String("remote", r.RemoteAddr))
+
+	response, status := s.runTask("restore", func(ctx context.Context) error {
+		return s.tasks.Restore(ctx, backupKey)
+	})
+	response.BackupKey = backupKey
+	writeJSON(w, status, response)
+}
+
+func (s *Server) handleCleanup(w http.ResponseWriter, r *http.Request) {
+	if !s.accept(w, r) {
+		return
+	}
+
+	s.logger.Info("Cleanup triggered via webhook", slog.String("remote", r.RemoteAddr))
+
+	response, status := s.runTask("cleanup", s.tasks.Cleanup)
+	writeJSON(w, status, response)
+}
+
+// runTask runs a restore or cleanup; like backups, it isn't tied to the request
+func (s *Server) runTask(task string, run func(ctx context.Context) error) (Response, int) {
+	response := Response{Task: task}
+
+	startTime := time.Now()
+	err := run(s.runCtx)
+	response.Duration = time.Since(startTime).Round(time.Second).String()
+	if errors.Is(err, ErrBusy) {
+		response.Error = fmt.Sprintf("a %s is already running", task)
+		return response, http.StatusConflict
+	}
+	if err != nil {
+		response.Error = err.Error()
+		return response, http.StatusInternalServerError
+	}
+
+	response.Success = true
+	return response, http.StatusOK
+}
+
+// runBackup runs one backup with its own manager so the label and results don't leak into
+// scheduled runs. The run is not tied to the request, so a disconnecting client doesn't
+// cancel a half-finished backup; only shutting down does.
+func (s *Server) runBackup(label, reason string) (Response, int) {
+	response := Response{Task: "backup", Label: label}
+
+	backupManager, err := backup.NewBackupManager(s.config, s.logger)
+	if err != nil {
+		response.Error = err.Error()
+		return response, http.StatusInternalServerError
+	}
+	backupManager.SetLabel(label)
+	backupManager.SetReason(reason)
+
+	// The run limits itself with the stage timeouts and timeouts.total
+	startTime := time.Now()
+	err = backupManager.Run(s.runCtx, false)
+	response.RunID = backupManager.RunID()
+	response.Keys = backupManager.Keys()
+	response.Duration = time.Since(startTime).Round(time.Second).String()
+	if err != nil {
+		response.Error = err.Error()
+		// Another backup (e.g. the scheduled one) holds the run lock
+		if strings.Contains(err.Error(), "exit code 7") {
+			return response, http.StatusConflict
+		}
+		return response, http.StatusInternalServerError
+	}
+
+	response.Success = true
+	return response, http.StatusOK
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.config.Trigger.Token)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, status int, response Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
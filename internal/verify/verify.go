@@ -0,0 +1,262 @@
+package verify
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hra42/pg_backup/internal/compression"
+	"github.com/hra42/pg_backup/internal/config"
+	"github.com/hra42/pg_backup/internal/pgoutput"
+	"github.com/hra42/pg_backup/internal/rsync"
+	"github.com/hra42/pg_backup/internal/shell"
+	"github.com/hra42/pg_backup/internal/ssh"
+)
+
+// RowCountQuery returns an exact row count for every user table, one "table|count" line each
+const RowCountQuery = `SELECT format('%I.%I', table_schema, table_name),
+	(xpath('/row/c/text()', query_to_xml(format('SELECT count(*) AS c FROM %I.%I', table_schema, table_name), false, true, '')))[1]::text
+FROM information_schema.tables
+WHERE table_type = 'BASE TABLE' AND table_schema NOT IN ('pg_catalog', 'information_schema')`
+
+// maxIdentifierLength is PostgreSQL's NAMEDATALEN - 1
+const maxIdentifierLength = 63
+
+var unsafeIdentifierChars = regexp.MustCompile(`[^a-z0-9_]`)
+
+// Result describes a successful verification restore
+type Result struct {
+	Database string
+	Tables   int
+	Rows     int64
+	Checks   int // Custom checks that passed
+	Duration time.Duration
+}
+
+// Verifier restores dumps into a disposable database and checks that they contain data. It
+// holds the SSH connection of the dump being verified, so use one Verifier per dump.
+type Verifier struct {
+	config    *config.Config
+	verify    *config.VerifyConfig
+	sshClient *ssh.SSHClient
+	logger    *slog.Logger
+}
+
+func NewVerifier(cfg *config.Config, logger *slog.Logger) *Verifier {
+	return &Verifier{
+		config: cfg,
+		verify: cfg.Backup.Verify,
+		logger: logger,
+	}
+}
+
+// Host returns the host the scratch restore runs on, for metadata and logs
+func (v *Verifier) Host() string {
+	if v.verify.SSH != nil {
+		return v.verify.SSH.Host
+	}
+	return "local"
+}
+
+// Verify restores the dump at localPath into <database>_verify_<ts>, counts the restored rows
+// and drops the scratch database again
+func (v *Verifier) Verify(ctx context.Context, localPath, database string) (*Result, error) {
+	startTime := time.Now()
+	scratch := ScratchName(database, startTime)
+	logger := v.logger.With(slog.String("scratch_database", scratch))
+	logger.Info("Stage 4b: Verifying backup with a scratch restore", slog.String("host", v.Host()))
+
+	dumpPath := localPath
+	if v.verify.SSH != nil {
+		sshClient, err := ssh.NewSSHClient(v.verify.SSH, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create SSH client: %w", err)
+		}
+		if err := sshClient.Connect(v.config.Timeouts.SSHConnection); err != nil {
+			return nil, fmt.Errorf("SSH connection to verification host failed: %w", err)
+		}
+		v.sshClient = sshClient
+		defer func() {
+			sshClient.Close()
+			v.sshClient = nil
+		}()
+
+		dumpPath = filepath.Join(v.verify.TempDir, filepath.Base(localPath))
+		rsyncClient := rsync.NewRsyncClient(v.verify.SSH, logger)
+		if err := rsyncClient.UploadFile(ctx, localPath, dumpPath, v.config.Timeouts.Transfer, nil); err != nil {
+			return nil, fmt.Errorf("failed to copy dump to verification host: %w", err)
+		}
+		defer v.executeCommand(fmt.Sprintf("rm -f %s", dumpPath), 10*time.Second)
+	}
+
+	if algorithm := compression.Detect(dumpPath); algorithm != "" {
+		outPath := compression.TrimExtension(dumpPath)
+		if v.verify.SSH == nil {
+			// Never decompress next to the caller's file
+			outPath = filepath.Join(os.TempDir(), "verify_"+filepath.Base(outPath))
+		}
+		decompressCmd := fmt.Sprintf("%s < %s > %s", compression.DecompressCommand(algorithm), dumpPath, outPath)
+		if output, err := v.executeCommandContext(ctx, decompressCmd, v.config.Timeouts.Transfer); err != nil {
+			v.executeCommand(fmt.Sprintf("rm -f %s", outPath), 10*time.Second)
+			return nil, fmt.Errorf("failed to decompress dump with %s: %w (output: %s)", algorithm, err, output)
+		}
+		defer v.executeCommand(fmt.Sprintf("rm -f %s", outPath), 10*time.Second)
+		dumpPath = outPath
+	}
+
+	createCmd := v.psqlCommand("postgres", "-c "+shell.Quote(fmt.Sprintf("CREATE DATABASE \"%s\"", scratch)))
+	if output, err := v.executeCommand(createCmd, time.Minute); err != nil {
+		return nil, fmt.Errorf("failed to create scratch database %s: %w (output: %s)", scratch, err, output)
+	}
+
+	result, err := v.restoreAndCount(ctx, logger, dumpPath, scratch)
+	if err == nil {
+		result.Checks, err = v.runChecks(logger, database, scratch)
+	}
+	if err != nil && v.verify.KeepOnFailure {
+		logger.Warn("Keeping scratch database for inspection")
+	} else {
+		dropCmd := v.psqlCommand("postgres", "-c "+shell.Quote(fmt.Sprintf("DROP DATABASE IF EXISTS \"%s\"", scratch)))
+		if output, dropErr := v.executeCommand(dropCmd, time.Minute); dropErr != nil {
+			logger.Warn("Failed to drop scratch database",
+				slog.String("error", dropErr.Error()),
+				slog.String("output", output))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result.Database = scratch
+	result.Duration = time.Since(startTime)
+	logger.Info("Backup verified",
+		slog.Int("tables", result.Tables),
+		slog.Int64("rows", result.Rows),
+		slog.Int("checks", result.Checks),
+		slog.Duration("duration", result.Duration))
+	return result, nil
+}
+
+func (v *Verifier) restoreAndCount(ctx context.Context, logger *slog.Logger, dumpPath, scratch string) (*Result, error) {
+	restoreCmd := fmt.Sprintf(
+		"pg_restore -h %s -p %d -U %s -d \"%s\" --no-owner --no-privileges --jobs=%d %s 2>&1",
+		v.verify.Host,
+		v.verify.Port,
+		v.verify.Username,
+		scratch,
+		v.verify.Jobs,
+		dumpPath,
+	)
+	output, err := v.executeCommandContext(ctx, restoreCmd, v.config.Timeouts.Verify)
+	classified := pgoutput.Classify(output)
+	if classified.HasErrors() {
+		return nil, fmt.Errorf("scratch restore reported %d errors: %s", len(classified.Errors), pgoutput.Summary(classified.Errors, 10))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("scratch restore failed: %w (output: %s)", err, output)
+	}
+	if len(classified.Warnings) > 0 {
+		logger.Warn("Scratch restore reported warnings", slog.Int("count", len(classified.Warnings)))
+	}
+
+	countCmd := v.psqlCommand(scratch, "-t -A -c "+shell.Quote(RowCountQuery))
+	output, err = v.executeCommandContext(ctx, countCmd, v.config.Timeouts.Verify)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count restored rows: %w (output: %s)", err, output)
+	}
+
+	result := &Result{}
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		table, count, ok := strings.Cut(line, "|")
+		if !ok {
+			continue
+		}
+		rows, err := strconv.ParseInt(strings.TrimSpace(count), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected row count output: %q", line)
+		}
+		logger.Debug("Restored table", slog.String("table", table), slog.Int64("rows", rows))
+		result.Tables++
+		result.Rows += rows
+	}
+
+	if v.verify.MinTables > 0 && result.Tables < v.verify.MinTables {
+		return nil, fmt.Errorf("scratch restore contains %d tables, expected at least %d", result.Tables, v.verify.MinTables)
+	}
+	if result.Rows < v.verify.MinRows {
+		return nil, fmt.Errorf("scratch restore contains %d rows, expected at least %d", result.Rows, v.verify.MinRows)
+	}
+	return result, nil
+}
+
+// runChecks runs the configured checks of database against the scratch database and returns
+// how many passed. The first failing check fails the verification.
+func (v *Verifier) runChecks(logger *slog.Logger, database, scratch string) (int, error) {
+	passed := 0
+	for _, check := range v.verify.Checks {
+		if check.Database != "" && check.Database != database {
+			continue
+		}
+
+		checkCmd := v.psqlCommand(scratch, "-X -t -A -c "+shell.Quote(check.Query))
+		output, err := v.executeCommand(checkCmd, v.config.Timeouts.Verify)
+		if err != nil {
+			return passed, fmt.Errorf("verify check %s failed to run: %w (output: %s)", check.Name, err, output)
+		}
+		if actual := strings.TrimSpace(output); actual != check.Expect {
+			return passed, fmt.Errorf("verify check %s returned %q, expected %q", check.Name, actual, check.Expect)
+		}
+
+		logger.Debug("Verify check passed", slog.String("check", check.Name))
+		passed++
+	}
+	return passed, nil
+}
+
+func (v *Verifier) psqlCommand(database, args string) string {
+	return fmt.Sprintf(
+		"psql -h %s -p %d -U %s -d \"%s\" -v ON_ERROR_STOP=1 %s",
+		v.verify.Host,
+		v.verify.Port,
+		v.verify.Username,
+		database,
+		args,
+	)
+}
+
+func (v *Verifier) executeCommand(command string, timeout time.Duration) (string, error) {
+	return v.executeCommandContext(context.Background(), command, timeout)
+}
+
+// executeCommandContext runs a command that stops when ctx is canceled. Cleanup uses
+// executeCommand, so it still runs after cancellation.
+func (v *Verifier) executeCommandContext(ctx context.Context, command string, timeout time.Duration) (string, error) {
+	if v.sshClient != nil {
+		return v.sshClient.ExecuteCommandContext(ctx, shell.EnvPrefix(v.config.Backup.Env)+shell.PgPassPrelude+command, shell.PgPassInput(v.verify.Password), timeout)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := shell.Command(ctx, command)
+	cmd.Env = append(os.Environ(), shell.EnvList(v.config.Backup.Env)...)
+	cmd.Env = append(cmd.Env, "PGPASSWORD="+v.verify.Password)
+	output, err := cmd.CombinedOutput()
+	return string(output), err
+}
+
+// ScratchName returns the disposable database name, truncated to fit PostgreSQL's identifier limit
+func ScratchName(database string, t time.Time) string {
+	suffix := "_verify_" + t.UTC().Format("20060102_150405")
+	name := unsafeIdentifierChars.ReplaceAllString(strings.ToLower(database), "_")
+	if len(name)+len(suffix) > maxIdentifierLength {
+		name = name[:maxIdentifierLength-len(suffix)]
+	}
+	return name + suffix
+}
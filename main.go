@@ -10,13 +10,16 @@ import (
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/DeRuina/timberjack"
 	"github.com/hra42/pg_backup/internal/backup"
 	"github.com/hra42/pg_backup/internal/config"
+	"github.com/hra42/pg_backup/internal/notification"
 	"github.com/hra42/pg_backup/internal/restore"
+	"github.com/hra42/pg_backup/internal/retention"
 	"github.com/hra42/pg_backup/internal/scheduler"
 	"github.com/hra42/pg_backup/internal/storage"
 )
@@ -29,16 +32,36 @@ var (
 
 func main() {
 	var (
-		configPath    = flag.String("config", "config.yaml", "Path to configuration file")
-		dryRun        = flag.Bool("dry-run", false, "Test configuration without performing backup")
-		showVersion   = flag.Bool("version", false, "Show version information")
-		logLevel      = flag.String("log-level", "info", "Log level (debug, info, warn, error)")
-		jsonLogs      = flag.Bool("json-logs", false, "Output logs in JSON format")
-		restoreMode   = flag.Bool("restore", false, "Run in restore mode")
-		listBackups   = flag.Bool("list-backups", false, "List available backups")
-		backupKey     = flag.String("backup-key", "", "Specific backup key to restore (optional, uses latest if not specified)")
-		cleanupOnly   = flag.Bool("cleanup", false, "Run cleanup only (remove old backups based on retention policy)")
-		scheduleMode  = flag.Bool("schedule", false, "Run in scheduled mode using gocron")
+		configPath     = flag.String("config", "config.yaml", "Path to configuration file")
+		dryRun         = flag.Bool("dry-run", false, "Test configuration without performing backup")
+		showVersion    = flag.Bool("version", false, "Show version information")
+		logLevel       = flag.String("log-level", "info", "Log level (debug, info, warn, error)")
+		jsonLogs       = flag.Bool("json-logs", false, "Output logs in JSON format")
+		restoreMode    = flag.Bool("restore", false, "Run in restore mode")
+		listBackups    = flag.Bool("list-backups", false, "List available backups")
+		output         = flag.String("output", "text", "Output format of -list-backups, -schedule-status and -schedule -dry-run: text or json")
+		backupKey      = flag.String("backup-key", "", "Backup key to restore, or @N for the N-th newest (asks on a terminal, latest otherwise)")
+		cleanupOnly    = flag.Bool("cleanup", false, "Run cleanup only (remove old backups based on retention policy)")
+		scheduleMode   = flag.Bool("schedule", false, "Run in scheduled mode using gocron")
+		scheduleStatus = flag.Bool("schedule-status", false, "Print the scheduled tasks with their last result and next run, as recorded by the scheduler")
+		snapshot       = flag.String("snapshot", "", "Exported snapshot ID for pg_dump --snapshot (single database backups)")
+		promoteKey     = flag.String("promote", "", "Copy the given backup key to the location set by -to")
+		promoteTo      = flag.String("to", "", "Promotion target as bucket[/prefix], e.g. staging-backups/postgres")
+		pinKey         = flag.String("pin", "", "Protect the given backup key from retention cleanup")
+		unpinKey       = flag.String("unpin", "", "Remove the protection set by -pin from the given backup key")
+		resume         = flag.Bool("resume", false, "Continue an interrupted backup from its last completed stage")
+		label          = flag.String("label", "", "Label stored with the backup, e.g. pre-upgrade (see backup.keep_labels)")
+		reason         = flag.String("reason", "", "Why the backup is taken, stored with the backup")
+		simulatePolicy = flag.String("simulate-retention", "", "Report what the retention policy in the given file would have kept and deleted")
+		simulateMonths = flag.Int("months", 6, "Months of backups covered by -simulate-retention")
+		overrideLimits = flag.Bool("override-limits", false, "Allow this run to exceed the limits in the safety section")
+		asOf           = flag.String("as-of", "", "Restore the newest backup taken before this local time, e.g. \"2024-06-01 12:00\"")
+		drill          = flag.Bool("drill", false, "With -restore, restore into a scratch database, validate it with restore.drill and drop it again")
+		tables         = flag.String("tables", "", "Comma-separated tables to restore, e.g. public.events,audit_log (overrides restore.tables)")
+		jobs           = flag.Int("jobs", 0, "With -restore or -clone, parallel pg_restore jobs (overrides restore.jobs)")
+		clone          = flag.String("clone", "", "Restore the latest backup (or -backup-key, -as-of) into this database, replacing it, then mask and ANALYZE")
+		maskRules      = flag.String("mask", "", "With -clone, masking rules file applied to the clone (overrides restore.masking_rules)")
+		databases      = flag.String("databases", "", "With -restore, comma-separated databases whose newest backups are restored, each into a database of its name")
 	)
 	flag.Parse()
 
@@ -56,7 +79,25 @@ func main() {
 		os.Exit(1)
 	}
 
-	logger := setupLogger(*logLevel, *jsonLogs, cfg)
+	if *output != "text" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "Invalid -output %q, must be text or json\n", *output)
+		os.Exit(1)
+	}
+
+	// Logs move to stderr so the JSON on stdout stays parseable
+	var logOutput io.Writer = os.Stdout
+	if *output == "json" {
+		logOutput = os.Stderr
+	}
+	logger := setupLogger(*logLevel, *jsonLogs, cfg, logOutput)
+	for _, warning := range cfg.Warnings {
+		logger.Warn("Configuration: " + warning)
+	}
+
+	if *overrideLimits {
+		cfg.Safety.Override = true
+		logger.Warn("Safety limits are overridden for this run")
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -64,13 +105,32 @@ func main() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
+	// Check if we should run in scheduled mode
+	hasScheduledTasks := len(cfg.BackupSchedules()) > 0 ||
+		(cfg.Scheduler.Restore != nil && cfg.Scheduler.Restore.Enabled) ||
+		(cfg.Scheduler.Cleanup != nil && cfg.Scheduler.Cleanup.Enabled) ||
+		(cfg.Trigger != nil && cfg.Trigger.Enabled)
+
+	// The scheduler lets running tasks finish within shutdown_grace before stopping them
+	forceExitAfter := time.Minute
+	if *scheduleMode || hasScheduledTasks {
+		forceExitAfter += cfg.Scheduler.ShutdownGrace
+	}
+
+	// Canceling stops pg_dump, rsync and the upload; the run then removes its partial files
+	// and aborts the multipart upload before exiting. A second signal exits right away.
 	go func() {
 		sig := <-sigChan
-		logger.Warn("Received signal, initiating graceful shutdown",
+		logger.Warn("Received signal, stopping and cleaning up (send again to exit immediately)",
 			slog.String("signal", sig.String()))
 		cancel()
-		time.Sleep(5 * time.Second)
-		logger.Error("Forced shutdown after timeout")
+		select {
+		case sig = <-sigChan:
+			logger.Error("Received second signal, exiting without cleanup",
+				slog.String("signal", sig.String()))
+		case <-time.After(forceExitAfter):
+			logger.Error("Forced shutdown after timeout")
+		}
 		os.Exit(130)
 	}()
 
@@ -85,7 +145,9 @@ func main() {
 		}
 		
 		logger.Info("Starting backup cleanup", slog.Int("retention_count", cfg.Backup.RetentionCount))
-		if err := s3Client.CleanupOldBackups(ctx, cfg.Backup.RetentionCount); err != nil {
+		notifier := notification.NewNotificationClient(&cfg.Notification, logger)
+		notifier.SetQueue(notification.NewQueue(cfg, logger))
+		if err := retention.Cleanup(ctx, cfg, s3Client, notifier, logger); err != nil {
 			logger.Error("Cleanup failed", slog.String("error", err.Error()))
 			os.Exit(1)
 		}
@@ -94,12 +156,126 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Handle retention simulation mode
+	if *simulatePolicy != "" {
+		policy, err := retention.LoadPolicy(*simulatePolicy)
+		if err != nil {
+			logger.Error("Invalid retention policy", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+
+		s3Client, err := storage.NewS3Client(&cfg.S3, logger)
+		if err != nil {
+			logger.Error("Failed to initialize S3 client", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+
+		backups, err := s3Client.ListBackupObjects(ctx)
+		if err != nil {
+			logger.Error("Failed to list backups", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+
+		current := retention.Policy{RetentionCount: cfg.Backup.RetentionCount, Databases: cfg.RetentionCounts()}
+		since := time.Now().AddDate(0, -*simulateMonths, 0)
+		if err := retention.Simulate(backups, policy, current, since).Write(os.Stdout); err != nil {
+			logger.Error("Failed to write simulation", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *scheduleStatus {
+		status, err := scheduler.ReadStatus(cfg)
+		if err != nil {
+			logger.Error("Failed to read scheduler state", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+		if err := status.Write(os.Stdout, *output); err != nil {
+			logger.Error("Failed to write scheduler status", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// Handle pin mode
+	if *pinKey != "" || *unpinKey != "" {
+		if *pinKey != "" && *unpinKey != "" {
+			logger.Error("-pin and -unpin cannot be combined")
+			os.Exit(1)
+		}
+		key, pinned := *pinKey, true
+		if *unpinKey != "" {
+			key, pinned = *unpinKey, false
+		}
+
+		s3Client, err := storage.NewS3Client(&cfg.S3, logger)
+		if err != nil {
+			logger.Error("Failed to initialize S3 client", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+
+		if err := s3Client.SetPinned(ctx, key, pinned); err != nil {
+			logger.Error("Failed to update backup", slog.String("key", key), slog.String("error", err.Error()))
+			os.Exit(5)
+		}
+
+		logger.Info("Backup updated", slog.String("key", key), slog.Bool("pinned", pinned))
+		os.Exit(0)
+	}
+
+	// Handle promotion mode
+	if *promoteKey != "" {
+		if *promoteTo == "" {
+			logger.Error("-promote requires -to bucket[/prefix]")
+			os.Exit(1)
+		}
+		destBucket, destPrefix, err := storage.ParseLocation(*promoteTo)
+		if err != nil {
+			logger.Error("Invalid promotion target", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+
+		s3Client, err := storage.NewS3Client(&cfg.S3, logger)
+		if err != nil {
+			logger.Error("Failed to initialize S3 client", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+
+		destKey, err := s3Client.PromoteBackup(ctx, *promoteKey, destBucket, destPrefix)
+		if err != nil {
+			logger.Error("Promotion failed", slog.String("error", err.Error()))
+			os.Exit(5)
+		}
+
+		fmt.Printf("%s/%s\n", destBucket, destKey)
+		os.Exit(0)
+	}
+
 	// Handle restore mode
-	if *restoreMode || *listBackups {
+	if *restoreMode || *listBackups || *clone != "" {
 		if !cfg.Restore.Enabled && !*listBackups {
 			logger.Error("Restore feature is not enabled in configuration")
 			os.Exit(1)
 		}
+		if *clone != "" && (*drill || *databases != "") {
+			logger.Error("-clone cannot be combined with -drill or -databases")
+			os.Exit(1)
+		}
+
+		if *tables != "" {
+			if err := cfg.Restore.SetTables(*tables); err != nil {
+				logger.Error("Invalid -tables", slog.String("error", err.Error()))
+				os.Exit(1)
+			}
+		}
+
+		if *jobs != 0 {
+			if err := cfg.Restore.SetJobs(*jobs); err != nil {
+				logger.Error("Invalid -jobs", slog.String("error", err.Error()))
+				os.Exit(1)
+			}
+		}
 
 		restoreManager, err := restore.NewRestoreManager(cfg, logger)
 		if err != nil {
@@ -108,31 +284,85 @@ func main() {
 		}
 
 		if *listBackups {
-			logger.Info("Listing available backups")
 			backups, err := restoreManager.ListAvailableBackups(ctx)
 			if err != nil {
 				logger.Error("Failed to list backups", slog.String("error", err.Error()))
 				os.Exit(1)
 			}
+			if err := restore.WriteBackupList(os.Stdout, backups, *output); err != nil {
+				logger.Error("Failed to write backup list", slog.String("error", err.Error()))
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
+
+		var asOfTime time.Time
+		if *asOf != "" {
+			if *backupKey != "" {
+				logger.Error("-as-of and -backup-key cannot be combined")
+				os.Exit(1)
+			}
+			asOfTime, err = restore.ParseAsOf(*asOf)
+			if err != nil {
+				logger.Error("Invalid -as-of", slog.String("error", err.Error()))
+				os.Exit(1)
+			}
+			restoreManager.SetAsOf(asOfTime)
+		}
 
-			if len(backups) == 0 {
-				logger.Info("No backups found")
-			} else {
-				logger.Info("Available backups:")
-				for i, backup := range backups {
-					fmt.Printf("%d. %s\n", i+1, backup)
+		if *databases != "" {
+			if *backupKey != "" {
+				logger.Error("-databases and -backup-key cannot be combined")
+				os.Exit(1)
+			}
+			var names []string
+			for _, name := range strings.Split(*databases, ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					names = append(names, name)
 				}
 			}
+
+			startTime := time.Now()
+			if err := restore.RunDatabases(ctx, cfg, logger, names, asOfTime, *drill); err != nil {
+				logger.Error("Restore failed",
+					slog.String("error", err.Error()),
+					slog.Duration("duration", time.Since(startTime)))
+				os.Exit(1)
+			}
+			logger.Info("Restore completed successfully",
+				slog.Int("databases", len(names)),
+				slog.Duration("duration", time.Since(startTime)))
 			os.Exit(0)
 		}
 
+		// On a terminal, ask instead of silently taking the latest backup; a clone always
+		// refreshes from the latest
+		if *backupKey == "" && *asOf == "" && *clone == "" && restore.IsTerminal(os.Stdin) {
+			key, err := restoreManager.PickBackup(ctx, os.Stdin, os.Stdout)
+			if err != nil {
+				logger.Error("No backup selected", slog.String("error", err.Error()))
+				os.Exit(1)
+			}
+			*backupKey = key
+		}
+
 		logger.Info("Starting restore",
 			slog.String("version", version),
 			slog.String("config", *configPath),
 			slog.String("backup_key", *backupKey))
 
+		run := restoreManager.Run
+		switch {
+		case *clone != "":
+			run = func(ctx context.Context, key string) error {
+				return restoreManager.RunClone(ctx, key, *clone, *maskRules)
+			}
+		case *drill:
+			run = restoreManager.RunDrill
+		}
+
 		startTime := time.Now()
-		if err := restoreManager.Run(ctx, *backupKey); err != nil {
+		if err := run(ctx, *backupKey); err != nil {
 			logger.Error("Restore failed",
 				slog.String("error", err.Error()),
 				slog.Duration("duration", time.Since(startTime)))
@@ -144,17 +374,30 @@ func main() {
 		os.Exit(0)
 	}
 
-	// Check if we should run in scheduled mode
-	hasScheduledTasks := (cfg.Backup.Schedule != nil && cfg.Backup.Schedule.Enabled) ||
-		(cfg.Restore.Schedule != nil && cfg.Restore.Schedule.Enabled) ||
-		(cfg.Cleanup != nil && cfg.Cleanup.Schedule != nil && cfg.Cleanup.Schedule.Enabled)
-
 	if *scheduleMode || hasScheduledTasks {
 		if !hasScheduledTasks {
 			logger.Error("Schedule mode requested but no scheduled tasks are configured")
 			os.Exit(1)
 		}
 
+		// Show when each task would run instead of starting the scheduler
+		if *dryRun {
+			previews, err := scheduler.Preview(cfg)
+			if err != nil {
+				logger.Error("Failed to preview schedules", slog.String("error", err.Error()))
+				os.Exit(1)
+			}
+			if err := scheduler.WritePreview(os.Stdout, previews, *output); err != nil {
+				logger.Error("Failed to write schedule preview", slog.String("error", err.Error()))
+				os.Exit(1)
+			}
+			if err := scheduler.PreviewError(previews); err != nil {
+				logger.Error("Invalid schedules", slog.String("error", err.Error()))
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
+
 		logger.Info("Starting pg_backup in scheduled mode",
 			slog.String("version", version),
 			slog.String("config", *configPath))
@@ -187,6 +430,18 @@ func main() {
 	}
 
 	backupManager.SetCancelFunc(cancel)
+	if *snapshot != "" {
+		backupManager.SetSnapshot(*snapshot)
+	}
+	backupManager.SetResume(*resume)
+	if *label != "" {
+		if !config.ValidLabel(*label) {
+			logger.Error("Invalid -label, use 1-64 characters of letters, digits, '.', '_' or '-'", slog.String("label", *label))
+			os.Exit(1)
+		}
+		backupManager.SetLabel(*label)
+	}
+	backupManager.SetReason(*reason)
 
 	startTime := time.Now()
 	if err := backupManager.Run(ctx, *dryRun); err != nil {
@@ -194,6 +449,10 @@ func main() {
 			slog.String("error", err.Error()),
 			slog.Duration("duration", time.Since(startTime)))
 
+		if ctx.Err() != nil {
+			os.Exit(130)
+		}
+
 		switch {
 		case contains(err.Error(), "exit code 2"):
 			os.Exit(2)
@@ -203,6 +462,10 @@ func main() {
 			os.Exit(4)
 		case contains(err.Error(), "exit code 5"):
 			os.Exit(5)
+		case contains(err.Error(), "exit code 7"):
+			os.Exit(7)
+		case contains(err.Error(), "exit code 8"):
+			os.Exit(8)
 		case contains(err.Error(), "cleanup"):
 			os.Exit(6)
 		default:
@@ -215,7 +478,7 @@ func main() {
 	os.Exit(0)
 }
 
-func setupLogger(level string, jsonFormat bool, cfg *config.Config) *slog.Logger {
+func setupLogger(level string, jsonFormat bool, cfg *config.Config, stdout io.Writer) *slog.Logger {
 	var logLevel slog.Level
 	switch level {
 	case "debug":
@@ -235,7 +498,7 @@ func setupLogger(level string, jsonFormat bool, cfg *config.Config) *slog.Logger
 		AddSource: false,
 	}
 
-	var writer io.Writer = os.Stdout
+	writer := stdout
 	
 	// If log file path is configured, set up file logging with rotation
 	if cfg.Log.FilePath != "" {